@@ -34,6 +34,11 @@ func (db *DynamoDBInstance) GetTableName() string {
 }
 
 func CreateDynamoDBInstance() *DynamoDBInstance {
+	return CreateDynamoDBInstanceWithTable(os.Getenv("DYNAMODB_TABLE"))
+}
+
+// CreateDynamoDBInstanceWithTable connects like CreateDynamoDBInstance, to the table named table.
+func CreateDynamoDBInstanceWithTable(table string) *DynamoDBInstance {
 	config := &aws.Config{
 		Region:   aws.String(os.Getenv("REGION")),
 		Endpoint: aws.String(os.Getenv("ENDPOINT")),
@@ -41,7 +46,7 @@ func CreateDynamoDBInstance() *DynamoDBInstance {
 	sess := session.Must(session.NewSession(config))
 
 	dynamoDBClient := dynamodb.New(sess)
-	dbInstance, err := NewDynamoDBInstance(dynamoDBClient, os.Getenv("DYNAMODB_TABLE"))
+	dbInstance, err := NewDynamoDBInstance(dynamoDBClient, table)
 	if err != nil {
 		log.Fatalf("failed to create DynamoDB instance: %v", err)
 	}
@@ -0,0 +1,376 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dynamoPollInterval is how often Reconcile describes a table while it waits for a table or an index to be created.
+var dynamoPollInterval = 5 * time.Second
+
+// DynamoTable declares a DynamoDB table, next to the repositories that read it. The keys of the table and of its
+// indexes are string attributes, and every index projects all the attributes.
+type DynamoTable struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+	// Indexes are the global secondary indexes of the table.
+	Indexes []DynamoIndex
+	// TTLAttribute is the attribute of the expiry time of the items, empty for a table without TTL.
+	TTLAttribute string
+	// StreamViewType is what the stream of the table reports of a changed item, such as NEW_AND_OLD_IMAGES, empty
+	// for a table without stream.
+	StreamViewType string
+}
+
+// DynamoIndex declares a global secondary index of a DynamoTable.
+type DynamoIndex struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+}
+
+// DynamoSchema is the registry of the DynamoDB tables of the application.
+type DynamoSchema []DynamoTable
+
+// DynamoDrift is a difference between a declared table and the table DynamoDB describes.
+type DynamoDrift struct {
+	Table string `json:"table"`
+	// Index names the index that differs, empty when the table does.
+	Index   string `json:"index,omitempty"`
+	Problem string `json:"problem"`
+	fix     dynamoFix
+}
+
+// dynamoFix is how Reconcile fixes a drift.
+type dynamoFix int
+
+const (
+	noFix dynamoFix = iota
+	createTable
+	createIndex
+	payPerRequest
+	enableTTL
+	enableStream
+)
+
+// Fixable tells whether Reconcile can fix the drift without removing anything.
+func (d DynamoDrift) Fixable() bool {
+	return d.fix != noFix
+}
+
+func (d DynamoDrift) String() string {
+	if d.Index != "" {
+		return fmt.Sprintf("table %s, index %s: %s", d.Table, d.Index, d.Problem)
+	}
+	return fmt.Sprintf("table %s: %s", d.Table, d.Problem)
+}
+
+func dynamoKeySchema(hashKey, rangeKey string) []*dynamodb.KeySchemaElement {
+	schema := []*dynamodb.KeySchemaElement{{AttributeName: aws.String(hashKey), KeyType: aws.String(dynamodb.KeyTypeHash)}}
+	if rangeKey != "" {
+		schema = append(schema, &dynamodb.KeySchemaElement{AttributeName: aws.String(rangeKey), KeyType: aws.String(dynamodb.KeyTypeRange)})
+	}
+	return schema
+}
+
+// describeKeySchema writes a key schema like "PK HASH, SK RANGE".
+func describeKeySchema(schema []*dynamodb.KeySchemaElement) string {
+	var parts []string
+	for _, element := range schema {
+		parts = append(parts, aws.StringValue(element.AttributeName)+" "+aws.StringValue(element.KeyType))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (i DynamoIndex) input() *dynamodb.GlobalSecondaryIndex {
+	return &dynamodb.GlobalSecondaryIndex{
+		IndexName:  aws.String(i.Name),
+		KeySchema:  dynamoKeySchema(i.HashKey, i.RangeKey),
+		Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+	}
+}
+
+// attributeDefinitions defines the key attributes of the table and of indexes, once each.
+func (t DynamoTable) attributeDefinitions(indexes []DynamoIndex) []*dynamodb.AttributeDefinition {
+	var names []string
+	add := func(name string) {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	add(t.HashKey)
+	add(t.RangeKey)
+	for _, index := range indexes {
+		add(index.HashKey)
+		add(index.RangeKey)
+	}
+
+	definitions := make([]*dynamodb.AttributeDefinition, 0, len(names))
+	for _, name := range names {
+		definitions = append(definitions, &dynamodb.AttributeDefinition{AttributeName: aws.String(name), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)})
+	}
+	return definitions
+}
+
+// CreateTableInput is the on-demand table t declares. Its TTL is set apart, with UpdateTimeToLive.
+func (t DynamoTable) CreateTableInput() *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName:            aws.String(t.Name),
+		AttributeDefinitions: t.attributeDefinitions(t.Indexes),
+		KeySchema:            dynamoKeySchema(t.HashKey, t.RangeKey),
+		BillingMode:          aws.String(dynamodb.BillingModePayPerRequest),
+		StreamSpecification:  t.streamSpecification(),
+	}
+	for _, index := range t.Indexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, index.input())
+	}
+	return input
+}
+
+// streamSpecification is the stream t declares, nil for none.
+func (t DynamoTable) streamSpecification() *dynamodb.StreamSpecification {
+	if t.StreamViewType == "" {
+		return nil
+	}
+	return &dynamodb.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: aws.String(t.StreamViewType)}
+}
+
+// Drift compares every table of the schema with the one DynamoDB describes. A missing table is a single drift.
+func (s DynamoSchema) Drift(ctx context.Context, client *dynamodb.DynamoDB) ([]DynamoDrift, error) {
+	var drift []DynamoDrift
+	for _, table := range s {
+		tableDrift, err := table.drift(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, tableDrift...)
+	}
+	return drift, nil
+}
+
+// Reconcile creates the missing tables, and adds the missing indexes, TTL and stream to the existing ones. It never removes
+// or rebuilds anything, so it returns the drift it could not fix, such as another key schema.
+func (s DynamoSchema) Reconcile(ctx context.Context, client *dynamodb.DynamoDB) ([]DynamoDrift, error) {
+	var drift []DynamoDrift
+	for _, table := range s {
+		tableDrift, err := table.reconcile(ctx, client)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", table.Name, err)
+		}
+		drift = append(drift, tableDrift...)
+	}
+	return drift, nil
+}
+
+func isResourceNotFound(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException
+}
+
+func (t DynamoTable) drift(ctx context.Context, client *dynamodb.DynamoDB) ([]DynamoDrift, error) {
+	output, err := client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(t.Name)})
+	if isResourceNotFound(err) {
+		return []DynamoDrift{{Table: t.Name, Problem: "missing", fix: createTable}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	description := output.Table
+
+	var drift []DynamoDrift
+	want := describeKeySchema(dynamoKeySchema(t.HashKey, t.RangeKey))
+	if got := describeKeySchema(description.KeySchema); got != want {
+		drift = append(drift, DynamoDrift{Table: t.Name, Problem: fmt.Sprintf("key schema is %s, want %s", got, want)})
+	}
+
+	for _, index := range t.Indexes {
+		i := slices.IndexFunc(description.GlobalSecondaryIndexes, func(actual *dynamodb.GlobalSecondaryIndexDescription) bool {
+			return aws.StringValue(actual.IndexName) == index.Name
+		})
+		if i < 0 {
+			drift = append(drift, DynamoDrift{Table: t.Name, Index: index.Name, Problem: "missing", fix: createIndex})
+			continue
+		}
+		actual := description.GlobalSecondaryIndexes[i]
+		want := describeKeySchema(dynamoKeySchema(index.HashKey, index.RangeKey))
+		if got := describeKeySchema(actual.KeySchema); got != want {
+			drift = append(drift, DynamoDrift{Table: t.Name, Index: index.Name, Problem: fmt.Sprintf("key schema is %s, want %s", got, want)})
+		}
+		if projection := projectionType(actual.Projection); projection != dynamodb.ProjectionTypeAll {
+			drift = append(drift, DynamoDrift{Table: t.Name, Index: index.Name, Problem: fmt.Sprintf("projection is %s, want %s", projection, dynamodb.ProjectionTypeAll)})
+		}
+	}
+	for _, actual := range description.GlobalSecondaryIndexes {
+		name := aws.StringValue(actual.IndexName)
+		if !slices.ContainsFunc(t.Indexes, func(index DynamoIndex) bool { return index.Name == name }) {
+			drift = append(drift, DynamoDrift{Table: t.Name, Index: name, Problem: "not declared"})
+		}
+	}
+	for _, actual := range description.LocalSecondaryIndexes {
+		drift = append(drift, DynamoDrift{Table: t.Name, Index: aws.StringValue(actual.IndexName), Problem: "not declared"})
+	}
+
+	if billing := billingMode(description); billing != dynamodb.BillingModePayPerRequest {
+		drift = append(drift, DynamoDrift{Table: t.Name, Problem: fmt.Sprintf("billing mode is %s, want %s", billing, dynamodb.BillingModePayPerRequest), fix: payPerRequest})
+	}
+
+	if problem, fix := t.streamDrift(description.StreamSpecification); problem != "" {
+		drift = append(drift, DynamoDrift{Table: t.Name, Problem: problem, fix: fix})
+	}
+
+	ttl, err := client.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(t.Name)})
+	if err != nil {
+		return nil, err
+	}
+	if problem, fix := t.ttlDrift(ttl.TimeToLiveDescription); problem != "" {
+		drift = append(drift, DynamoDrift{Table: t.Name, Problem: problem, fix: fix})
+	}
+	return drift, nil
+}
+
+func projectionType(projection *dynamodb.Projection) string {
+	if projection == nil {
+		return ""
+	}
+	return aws.StringValue(projection.ProjectionType)
+}
+
+// billingMode is the billing mode of a table, which DynamoDB leaves out of the tables created with provisioned
+// capacity.
+func billingMode(description *dynamodb.TableDescription) string {
+	if description.BillingModeSummary == nil || description.BillingModeSummary.BillingMode == nil {
+		return dynamodb.BillingModeProvisioned
+	}
+	return aws.StringValue(description.BillingModeSummary.BillingMode)
+}
+
+// ttlDrift describes how the TTL of a table differs from TTLAttribute. Only a disabled TTL can be enabled right away.
+func (t DynamoTable) ttlDrift(description *dynamodb.TimeToLiveDescription) (string, dynamoFix) {
+	status := dynamodb.TimeToLiveStatusDisabled
+	attribute := ""
+	if description != nil {
+		status = aws.StringValue(description.TimeToLiveStatus)
+		attribute = aws.StringValue(description.AttributeName)
+	}
+	enabled := status == dynamodb.TimeToLiveStatusEnabled || status == dynamodb.TimeToLiveStatusEnabling
+
+	switch {
+	case t.TTLAttribute == "" && enabled:
+		return fmt.Sprintf("TTL is enabled on %s, want none", attribute), noFix
+	case t.TTLAttribute == "":
+		return "", noFix
+	case !enabled && status != dynamodb.TimeToLiveStatusDisabled:
+		return fmt.Sprintf("TTL is %s, want enabled on %s", strings.ToLower(status), t.TTLAttribute), noFix
+	case !enabled:
+		return fmt.Sprintf("TTL is disabled, want enabled on %s", t.TTLAttribute), enableTTL
+	case attribute != t.TTLAttribute:
+		return fmt.Sprintf("TTL is enabled on %s, want %s", attribute, t.TTLAttribute), noFix
+	}
+	return "", noFix
+}
+
+// streamDrift describes how the stream of a table differs from StreamViewType. Only a missing stream can be enabled
+// right away, another view type needs the stream to be disabled first, which its consumers would notice.
+func (t DynamoTable) streamDrift(specification *dynamodb.StreamSpecification) (string, dynamoFix) {
+	viewType := ""
+	if specification != nil && aws.BoolValue(specification.StreamEnabled) {
+		viewType = aws.StringValue(specification.StreamViewType)
+	}
+
+	switch {
+	case viewType == t.StreamViewType:
+		return "", noFix
+	case t.StreamViewType == "":
+		return fmt.Sprintf("stream is enabled with %s, want none", viewType), noFix
+	case viewType == "":
+		return fmt.Sprintf("stream is disabled, want %s", t.StreamViewType), enableStream
+	}
+	return fmt.Sprintf("stream is %s, want %s", viewType, t.StreamViewType), noFix
+}
+
+func (t DynamoTable) reconcile(ctx context.Context, client *dynamodb.DynamoDB) ([]DynamoDrift, error) {
+	drift, err := t.drift(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []DynamoDrift
+	for _, d := range drift {
+		switch d.fix {
+		case noFix:
+			remaining = append(remaining, d)
+			continue
+		case createTable:
+			_, err = client.CreateTableWithContext(ctx, t.CreateTableInput())
+		case createIndex:
+			// DynamoDB builds one new index of a table at a time, so every index waits for the previous one.
+			i := slices.IndexFunc(t.Indexes, func(index DynamoIndex) bool { return index.Name == d.Index })
+			index := t.Indexes[i].input()
+			_, err = client.UpdateTableWithContext(ctx, &dynamodb.UpdateTableInput{
+				TableName:            aws.String(t.Name),
+				AttributeDefinitions: t.attributeDefinitions(t.Indexes[i : i+1]),
+				GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{{
+					Create: &dynamodb.CreateGlobalSecondaryIndexAction{IndexName: index.IndexName, KeySchema: index.KeySchema, Projection: index.Projection},
+				}},
+			})
+		case payPerRequest:
+			_, err = client.UpdateTableWithContext(ctx, &dynamodb.UpdateTableInput{TableName: aws.String(t.Name), BillingMode: aws.String(dynamodb.BillingModePayPerRequest)})
+		case enableTTL:
+			err = t.enableTTL(ctx, client)
+		case enableStream:
+			_, err = client.UpdateTableWithContext(ctx, &dynamodb.UpdateTableInput{TableName: aws.String(t.Name), StreamSpecification: t.streamSpecification()})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := waitForDynamoTable(ctx, client, t.Name); err != nil {
+			return nil, err
+		}
+		// A new table gets its TTL once it is active.
+		if d.fix == createTable && t.TTLAttribute != "" {
+			if err := t.enableTTL(ctx, client); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return remaining, nil
+}
+
+func (t DynamoTable) enableTTL(ctx context.Context, client *dynamodb.DynamoDB) error {
+	_, err := client.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName:               aws.String(t.Name),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{AttributeName: aws.String(t.TTLAttribute), Enabled: aws.Bool(true)},
+	})
+	return err
+}
+
+// waitForDynamoTable returns once the table and all its indexes are active.
+func waitForDynamoTable(ctx context.Context, client *dynamodb.DynamoDB, name string) error {
+	for {
+		output, err := client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+		if err != nil {
+			return err
+		}
+		active := aws.StringValue(output.Table.TableStatus) == dynamodb.TableStatusActive
+		for _, index := range output.Table.GlobalSecondaryIndexes {
+			active = active && aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive
+		}
+		if active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dynamoPollInterval):
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"simple-api-go/db/dynamotest"
+	"slices"
+	"testing"
+)
+
+var testSchema = DynamoSchema{{
+	Name:     "iotwatcher",
+	HashKey:  "PK",
+	RangeKey: "SK",
+	Indexes: []DynamoIndex{
+		{Name: "GSI1", HashKey: "GSI1PK", RangeKey: "GSI1SK"},
+		{Name: "GSI2", HashKey: "GSI2PK", RangeKey: "GSI2SK"},
+	},
+	TTLAttribute:   "purgeAt",
+	StreamViewType: dynamodb.StreamViewTypeNewAndOldImages,
+}}
+
+// driftStrings lists the drift as it is reported.
+func driftStrings(drift []DynamoDrift) []string {
+	list := []string{}
+	for _, d := range drift {
+		list = append(list, d.String())
+	}
+	return list
+}
+
+func TestDynamoSchema_Reconcile(t *testing.T) {
+	server := dynamotest.NewServer()
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	drift, err := testSchema.Drift(ctx, client)
+	if want := []string{"table iotwatcher: missing"}; err != nil || !slices.Equal(driftStrings(drift), want) {
+		t.Fatalf("Drift() got = %v, %v, want %v", driftStrings(drift), err, want)
+	}
+	if !drift[0].Fixable() {
+		t.Errorf("Fixable() got = false, want a missing table to be fixable")
+	}
+
+	if drift, err := testSchema.Reconcile(ctx, client); err != nil || len(drift) != 0 {
+		t.Fatalf("Reconcile() got = %v, %v, want the table created", driftStrings(drift), err)
+	}
+	if drift, err := testSchema.Drift(ctx, client); err != nil || len(drift) != 0 {
+		t.Errorf("Drift() got = %v, %v, want no drift after Reconcile", driftStrings(drift), err)
+	}
+	ttl, err := client.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String("iotwatcher")})
+	if err != nil || aws.StringValue(ttl.TimeToLiveDescription.AttributeName) != "purgeAt" {
+		t.Errorf("DescribeTimeToLive() got = %v, %v, want TTL on purgeAt", ttl, err)
+	}
+	table, err := client.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String("iotwatcher")})
+	if err != nil || aws.StringValue(table.Table.StreamSpecification.StreamViewType) != dynamodb.StreamViewTypeNewAndOldImages {
+		t.Errorf("DescribeTable() got = %v, %v, want a stream of new and old images", table, err)
+	}
+
+	// Reconciling an up-to-date table changes nothing.
+	if drift, err := testSchema.Reconcile(ctx, client); err != nil || len(drift) != 0 {
+		t.Errorf("Reconcile() got = %v, %v, want nothing to do", driftStrings(drift), err)
+	}
+}
+
+func TestDynamoSchema_Drift(t *testing.T) {
+	server := dynamotest.NewServer()
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	// A table set up by hand: another key, GSI1 with other keys and projection, GSI2 missing, an index that is
+	// not declared, provisioned capacity, no stream and no TTL.
+	_, err := client.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String("iotwatcher"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("GSI1PK"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("deviceModel"), AttributeType: aws.String("S")},
+		},
+		KeySchema: dynamoKeySchema("id", ""),
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{IndexName: aws.String("GSI1"), KeySchema: dynamoKeySchema("GSI1PK", ""), Projection: &dynamodb.Projection{ProjectionType: aws.String("KEYS_ONLY")}, ProvisionedThroughput: &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(5)}},
+			{IndexName: aws.String("deviceModel-index"), KeySchema: dynamoKeySchema("deviceModel", "id"), Projection: &dynamodb.Projection{ProjectionType: aws.String("ALL")}, ProvisionedThroughput: &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(5)}},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(5)},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+
+	unfixable := []string{
+		"table iotwatcher: key schema is id HASH, want PK HASH, SK RANGE",
+		"table iotwatcher, index GSI1: key schema is GSI1PK HASH, want GSI1PK HASH, GSI1SK RANGE",
+		"table iotwatcher, index GSI1: projection is KEYS_ONLY, want ALL",
+		"table iotwatcher, index deviceModel-index: not declared",
+	}
+	want := append(slices.Clone(unfixable[:3]),
+		"table iotwatcher, index GSI2: missing",
+		unfixable[3],
+		"table iotwatcher: billing mode is PROVISIONED, want PAY_PER_REQUEST",
+		"table iotwatcher: stream is disabled, want NEW_AND_OLD_IMAGES",
+		"table iotwatcher: TTL is disabled, want enabled on purgeAt",
+	)
+	drift, err := testSchema.Drift(ctx, client)
+	if err != nil || !slices.Equal(driftStrings(drift), want) {
+		t.Fatalf("Drift() got = %q, %v, want %q", driftStrings(drift), err, want)
+	}
+
+	drift, err = testSchema.Reconcile(ctx, client)
+	if err != nil || !slices.Equal(driftStrings(drift), unfixable) {
+		t.Fatalf("Reconcile() got = %q, %v, want %q left", driftStrings(drift), err, unfixable)
+	}
+	if drift, err = testSchema.Drift(ctx, client); err != nil || !slices.Equal(driftStrings(drift), unfixable) {
+		t.Errorf("Drift() got = %q, %v, want only %q", driftStrings(drift), err, unfixable)
+	}
+}
+
+func TestDynamoSchema_TTLDrift(t *testing.T) {
+	status := func(status, attribute string) *dynamodb.TimeToLiveDescription {
+		return &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(status), AttributeName: aws.String(attribute)}
+	}
+	tests := []struct {
+		name        string
+		table       DynamoTable
+		description *dynamodb.TimeToLiveDescription
+		problem     string
+		fix         dynamoFix
+	}{
+		{"Enabled", testSchema[0], status(dynamodb.TimeToLiveStatusEnabled, "purgeAt"), "", noFix},
+		{"Enabling", testSchema[0], status(dynamodb.TimeToLiveStatusEnabling, "purgeAt"), "", noFix},
+		{"Disabled", testSchema[0], nil, "TTL is disabled, want enabled on purgeAt", enableTTL},
+		{"Disabling", testSchema[0], status(dynamodb.TimeToLiveStatusDisabling, "purgeAt"), "TTL is disabling, want enabled on purgeAt", noFix},
+		{"OtherAttribute", testSchema[0], status(dynamodb.TimeToLiveStatusEnabled, "expiresAt"), "TTL is enabled on expiresAt, want purgeAt", noFix},
+		{"NotDeclared", DynamoTable{Name: "logs"}, status(dynamodb.TimeToLiveStatusEnabled, "expiresAt"), "TTL is enabled on expiresAt, want none", noFix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problem, fix := tt.table.ttlDrift(tt.description); problem != tt.problem || fix != tt.fix {
+				t.Errorf("ttlDrift() got = %q, %v, want %q, %v", problem, fix, tt.problem, tt.fix)
+			}
+		})
+	}
+}
+
+func TestDynamoSchema_StreamDrift(t *testing.T) {
+	stream := func(enabled bool, viewType string) *dynamodb.StreamSpecification {
+		return &dynamodb.StreamSpecification{StreamEnabled: aws.Bool(enabled), StreamViewType: aws.String(viewType)}
+	}
+	tests := []struct {
+		name          string
+		table         DynamoTable
+		specification *dynamodb.StreamSpecification
+		problem       string
+		fix           dynamoFix
+	}{
+		{"Enabled", testSchema[0], stream(true, dynamodb.StreamViewTypeNewAndOldImages), "", noFix},
+		{"Missing", testSchema[0], nil, "stream is disabled, want NEW_AND_OLD_IMAGES", enableStream},
+		{"Disabled", testSchema[0], stream(false, dynamodb.StreamViewTypeNewAndOldImages), "stream is disabled, want NEW_AND_OLD_IMAGES", enableStream},
+		{"OtherViewType", testSchema[0], stream(true, dynamodb.StreamViewTypeKeysOnly), "stream is KEYS_ONLY, want NEW_AND_OLD_IMAGES", noFix},
+		{"NotDeclared", DynamoTable{Name: "logs"}, stream(true, dynamodb.StreamViewTypeNewImage), "stream is enabled with NEW_IMAGE, want none", noFix},
+		{"NoneDeclared", DynamoTable{Name: "logs"}, nil, "", noFix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problem, fix := tt.table.streamDrift(tt.specification); problem != tt.problem || fix != tt.fix {
+				t.Errorf("streamDrift() got = %q, %v, want %q, %v", problem, fix, tt.problem, tt.fix)
+			}
+		})
+	}
+}
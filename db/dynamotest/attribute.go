@@ -0,0 +1,229 @@
+package dynamotest
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+type item = map[string]*dynamodb.AttributeValue
+
+// typeOf returns the DynamoDB type descriptor of a value, e.g. "S" or "M".
+func typeOf(v *dynamodb.AttributeValue) string {
+	switch {
+	case v == nil:
+		return ""
+	case v.S != nil:
+		return "S"
+	case v.N != nil:
+		return "N"
+	case v.B != nil:
+		return "B"
+	case v.BOOL != nil:
+		return "BOOL"
+	case v.NULL != nil:
+		return "NULL"
+	case v.M != nil:
+		return "M"
+	case v.L != nil:
+		return "L"
+	case v.SS != nil:
+		return "SS"
+	case v.NS != nil:
+		return "NS"
+	case v.BS != nil:
+		return "BS"
+	}
+	return ""
+}
+
+func copyValue(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+	c := &dynamodb.AttributeValue{}
+	switch typeOf(v) {
+	case "S":
+		c.S = aws.String(*v.S)
+	case "N":
+		c.N = aws.String(*v.N)
+	case "B":
+		c.B = slices.Clone(v.B)
+	case "BOOL":
+		c.BOOL = aws.Bool(*v.BOOL)
+	case "NULL":
+		c.NULL = aws.Bool(*v.NULL)
+	case "M":
+		c.M = copyItem(v.M)
+	case "L":
+		c.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			c.L[i] = copyValue(e)
+		}
+	case "SS":
+		c.SS = aws.StringSlice(aws.StringValueSlice(v.SS))
+	case "NS":
+		c.NS = aws.StringSlice(aws.StringValueSlice(v.NS))
+	case "BS":
+		c.BS = make([][]byte, len(v.BS))
+		for i, b := range v.BS {
+			c.BS[i] = slices.Clone(b)
+		}
+	}
+	return c
+}
+
+func copyItem(in item) item {
+	if in == nil {
+		return nil
+	}
+	out := make(item, len(in))
+	for k, v := range in {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+func parseNumber(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(strings.TrimSpace(s))
+}
+
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	return strings.TrimRight(strings.TrimRight(r.FloatString(38), "0"), ".")
+}
+
+// compareValues orders two scalar values of the same type. ok is false when they are not comparable.
+func compareValues(a, b *dynamodb.AttributeValue) (result int, ok bool) {
+	if typeOf(a) != typeOf(b) {
+		return 0, false
+	}
+	switch typeOf(a) {
+	case "S":
+		return strings.Compare(*a.S, *b.S), true
+	case "N":
+		x, okX := parseNumber(*a.N)
+		y, okY := parseNumber(*b.N)
+		if !okX || !okY {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case "B":
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+func equalValues(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if typeOf(a) != typeOf(b) {
+		return false
+	}
+	switch typeOf(a) {
+	case "S", "N", "B":
+		c, ok := compareValues(a, b)
+		return ok && c == 0
+	case "BOOL":
+		return *a.BOOL == *b.BOOL
+	case "NULL":
+		return true
+	case "M":
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, v := range a.M {
+			if !equalValues(v, b.M[k]) {
+				return false
+			}
+		}
+		return true
+	case "L":
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !equalValues(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case "SS":
+		return sameSet(aws.StringValueSlice(a.SS), aws.StringValueSlice(b.SS))
+	case "NS":
+		return sameSet(normalizeNumbers(aws.StringValueSlice(a.NS)), normalizeNumbers(aws.StringValueSlice(b.NS)))
+	case "BS":
+		x := make([]string, len(a.BS))
+		for i, v := range a.BS {
+			x[i] = string(v)
+		}
+		y := make([]string, len(b.BS))
+		for i, v := range b.BS {
+			y[i] = string(v)
+		}
+		return sameSet(x, y)
+	}
+	return false
+}
+
+func normalizeNumbers(in []string) []string {
+	out := make([]string, len(in))
+	for i, n := range in {
+		if r, ok := parseNumber(n); ok {
+			out[i] = formatNumber(r)
+		} else {
+			out[i] = n
+		}
+	}
+	return out
+}
+
+func sameSet(a, b []string) bool {
+	x, y := slices.Clone(a), slices.Clone(b)
+	slices.Sort(x)
+	slices.Sort(y)
+	return slices.Equal(slices.Compact(x), slices.Compact(y))
+}
+
+// sizeOf implements the size() function of the expression language.
+func sizeOf(v *dynamodb.AttributeValue) (int, bool) {
+	switch typeOf(v) {
+	case "S":
+		return len(*v.S), true
+	case "B":
+		return len(v.B), true
+	case "M":
+		return len(v.M), true
+	case "L":
+		return len(v.L), true
+	case "SS":
+		return len(v.SS), true
+	case "NS":
+		return len(v.NS), true
+	case "BS":
+		return len(v.BS), true
+	}
+	return 0, false
+}
+
+// keyString serializes a scalar key value so it can be used as a map key.
+func keyString(v *dynamodb.AttributeValue) string {
+	switch typeOf(v) {
+	case "S":
+		return "S:" + *v.S
+	case "N":
+		if r, ok := parseNumber(*v.N); ok {
+			return "N:" + formatNumber(r)
+		}
+		return "N:" + *v.N
+	case "B":
+		return "B:" + string(v.B)
+	}
+	return ""
+}
@@ -0,0 +1,883 @@
+package dynamotest
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenName
+	tokenValue
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#' || r == ':':
+			j := i + 1
+			for j < len(runes) && isIdentRune(runes[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("invalid token at position %d", i)
+			}
+			kind := tokenName
+			if r == ':' {
+				kind = tokenValue
+			}
+			tokens = append(tokens, token{kind: kind, text: string(runes[i:j])})
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[i:j])})
+			i = j
+		case isIdentRune(r):
+			j := i
+			for j < len(runes) && isIdentRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[i:j])})
+			i = j
+		case r == '<' || r == '>':
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '<' && runes[i+1] == '>')) {
+				tokens = append(tokens, token{kind: tokenSymbol, text: string(runes[i : i+2])})
+				i += 2
+			} else {
+				tokens = append(tokens, token{kind: tokenSymbol, text: string(r)})
+				i++
+			}
+		case strings.ContainsRune("()[],.=+-", r):
+			tokens = append(tokens, token{kind: tokenSymbol, text: string(r)})
+			i++
+		default:
+			return nil, fmt.Errorf("invalid character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+type pathElement struct {
+	name  string
+	index int
+	list  bool
+}
+
+type path []pathElement
+
+func (p path) top() string {
+	return p[0].name
+}
+
+func (p path) resolve(it item) *dynamodb.AttributeValue {
+	current := &dynamodb.AttributeValue{M: it}
+	for _, e := range p {
+		switch {
+		case e.list && current.L != nil:
+			if e.index >= len(current.L) {
+				return nil
+			}
+			current = current.L[e.index]
+		case !e.list && current.M != nil:
+			next, ok := current.M[e.name]
+			if !ok {
+				return nil
+			}
+			current = next
+		default:
+			return nil
+		}
+	}
+	return current
+}
+
+func (p path) set(it item, v *dynamodb.AttributeValue) error {
+	parent := &dynamodb.AttributeValue{M: it}
+	if len(p) > 1 {
+		parent = p[:len(p)-1].resolve(it)
+	}
+	last := p[len(p)-1]
+	switch {
+	case last.list && parent != nil && parent.L != nil:
+		if last.index >= len(parent.L) {
+			parent.L = append(parent.L, v)
+		} else {
+			parent.L[last.index] = v
+		}
+	case !last.list && parent != nil && parent.M != nil:
+		parent.M[last.name] = v
+	default:
+		return fmt.Errorf("the document path provided in the update expression is invalid for update")
+	}
+	return nil
+}
+
+func (p path) remove(it item) {
+	parent := &dynamodb.AttributeValue{M: it}
+	if len(p) > 1 {
+		parent = p[:len(p)-1].resolve(it)
+	}
+	last := p[len(p)-1]
+	switch {
+	case last.list && parent != nil && parent.L != nil && last.index < len(parent.L):
+		parent.L = slices.Delete(parent.L, last.index, last.index+1)
+	case !last.list && parent != nil && parent.M != nil:
+		delete(parent.M, last.name)
+	}
+}
+
+type operand interface {
+	evaluate(it item) (*dynamodb.AttributeValue, error)
+}
+
+type pathOperand struct{ path path }
+
+func (o pathOperand) evaluate(it item) (*dynamodb.AttributeValue, error) {
+	return o.path.resolve(it), nil
+}
+
+type valueOperand struct{ value *dynamodb.AttributeValue }
+
+func (o valueOperand) evaluate(item) (*dynamodb.AttributeValue, error) {
+	return o.value, nil
+}
+
+type sizeOperand struct{ path path }
+
+func (o sizeOperand) evaluate(it item) (*dynamodb.AttributeValue, error) {
+	size, ok := sizeOf(o.path.resolve(it))
+	if !ok {
+		return nil, nil
+	}
+	return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(size))}, nil
+}
+
+type ifNotExistsOperand struct {
+	path     path
+	fallback operand
+}
+
+func (o ifNotExistsOperand) evaluate(it item) (*dynamodb.AttributeValue, error) {
+	if v := o.path.resolve(it); v != nil {
+		return v, nil
+	}
+	return o.fallback.evaluate(it)
+}
+
+type listAppendOperand struct{ left, right operand }
+
+func (o listAppendOperand) evaluate(it item) (*dynamodb.AttributeValue, error) {
+	left, err := o.left.evaluate(it)
+	if err != nil {
+		return nil, err
+	}
+	right, err := o.right.evaluate(it)
+	if err != nil {
+		return nil, err
+	}
+	if typeOf(left) != "L" || typeOf(right) != "L" {
+		return nil, fmt.Errorf("incorrect operand type for operator or function; operator or function: list_append")
+	}
+	return &dynamodb.AttributeValue{L: append(slices.Clone(left.L), right.L...)}, nil
+}
+
+type arithmeticOperand struct {
+	left, right operand
+	minus       bool
+}
+
+func (o arithmeticOperand) evaluate(it item) (*dynamodb.AttributeValue, error) {
+	left, err := o.left.evaluate(it)
+	if err != nil {
+		return nil, err
+	}
+	right, err := o.right.evaluate(it)
+	if err != nil {
+		return nil, err
+	}
+	if typeOf(left) != "N" || typeOf(right) != "N" {
+		return nil, fmt.Errorf("an operand in the update expression has an incorrect data type")
+	}
+	x, _ := parseNumber(*left.N)
+	y, _ := parseNumber(*right.N)
+	if o.minus {
+		y.Neg(y)
+	}
+	return &dynamodb.AttributeValue{N: aws.String(formatNumber(new(big.Rat).Add(x, y)))}, nil
+}
+
+type condition interface {
+	matches(it item) (bool, error)
+}
+
+type andCondition struct{ left, right condition }
+
+func (c andCondition) matches(it item) (bool, error) {
+	ok, err := c.left.matches(it)
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.right.matches(it)
+}
+
+type orCondition struct{ left, right condition }
+
+func (c orCondition) matches(it item) (bool, error) {
+	ok, err := c.left.matches(it)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.right.matches(it)
+}
+
+type notCondition struct{ inner condition }
+
+func (c notCondition) matches(it item) (bool, error) {
+	ok, err := c.inner.matches(it)
+	return !ok, err
+}
+
+type compareCondition struct {
+	op          string
+	left, right operand
+}
+
+func (c compareCondition) matches(it item) (bool, error) {
+	left, err := c.left.evaluate(it)
+	if err != nil {
+		return false, err
+	}
+	right, err := c.right.evaluate(it)
+	if err != nil {
+		return false, err
+	}
+	switch c.op {
+	case "=":
+		return left != nil && right != nil && equalValues(left, right), nil
+	case "<>":
+		return left == nil || right == nil || !equalValues(left, right), nil
+	}
+	result, ok := compareValues(left, right)
+	if left == nil || right == nil || !ok {
+		return false, nil
+	}
+	switch c.op {
+	case "<":
+		return result < 0, nil
+	case "<=":
+		return result <= 0, nil
+	case ">":
+		return result > 0, nil
+	default:
+		return result >= 0, nil
+	}
+}
+
+type betweenCondition struct{ value, low, high operand }
+
+func (c betweenCondition) matches(it item) (bool, error) {
+	lower, err := compareCondition{op: ">=", left: c.value, right: c.low}.matches(it)
+	if err != nil || !lower {
+		return false, err
+	}
+	return compareCondition{op: "<=", left: c.value, right: c.high}.matches(it)
+}
+
+type inCondition struct {
+	value   operand
+	choices []operand
+}
+
+func (c inCondition) matches(it item) (bool, error) {
+	for _, choice := range c.choices {
+		ok, err := compareCondition{op: "=", left: c.value, right: choice}.matches(it)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+type functionCondition struct {
+	name string
+	path path
+	arg  operand
+}
+
+func (c functionCondition) matches(it item) (bool, error) {
+	value := c.path.resolve(it)
+	var arg *dynamodb.AttributeValue
+	if c.arg != nil {
+		var err error
+		if arg, err = c.arg.evaluate(it); err != nil {
+			return false, err
+		}
+	}
+	switch c.name {
+	case "attribute_exists":
+		return value != nil, nil
+	case "attribute_not_exists":
+		return value == nil, nil
+	case "attribute_type":
+		return arg != nil && arg.S != nil && typeOf(value) == *arg.S, nil
+	case "begins_with":
+		switch {
+		case typeOf(value) == "S" && typeOf(arg) == "S":
+			return strings.HasPrefix(*value.S, *arg.S), nil
+		case typeOf(value) == "B" && typeOf(arg) == "B":
+			return strings.HasPrefix(string(value.B), string(arg.B)), nil
+		}
+		return false, nil
+	case "contains":
+		switch typeOf(value) {
+		case "S":
+			return typeOf(arg) == "S" && strings.Contains(*value.S, *arg.S), nil
+		case "SS":
+			return typeOf(arg) == "S" && slices.Contains(aws.StringValueSlice(value.SS), *arg.S), nil
+		case "NS":
+			return typeOf(arg) == "N" && slices.Contains(normalizeNumbers(aws.StringValueSlice(value.NS)), normalizeNumbers([]string{*arg.N})[0]), nil
+		case "L":
+			return slices.ContainsFunc(value.L, func(e *dynamodb.AttributeValue) bool { return equalValues(e, arg) }), nil
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid function name; function: %s", c.name)
+}
+
+type updateAction struct {
+	action string
+	path   path
+	value  operand
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func newParser(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*parser, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens, names: names, values: values}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) symbol(s string) bool {
+	if t := p.peek(); t.kind == tokenSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) keyword(k string) bool {
+	if t := p.peek(); t.kind == tokenIdent && strings.EqualFold(t.text, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.symbol(s) {
+		return fmt.Errorf("syntax error; token: %q, near: %q", p.peek().text, s)
+	}
+	return nil
+}
+
+func (p *parser) function(name string) bool {
+	t := p.peek()
+	if t.kind == tokenIdent && strings.EqualFold(t.text, name) && p.tokens[p.pos+1].kind == tokenSymbol && p.tokens[p.pos+1].text == "(" {
+		p.pos += 2
+		return true
+	}
+	return false
+}
+
+func (p *parser) pathName(t token) (string, error) {
+	switch t.kind {
+	case tokenIdent:
+		return t.text, nil
+	case tokenName:
+		name, ok := p.names[t.text]
+		if !ok || name == nil {
+			return "", fmt.Errorf("an expression attribute name used in the document path is not defined; attribute name: %s", t.text)
+		}
+		return *name, nil
+	}
+	return "", fmt.Errorf("syntax error; token: %q", t.text)
+}
+
+func (p *parser) parsePath() (path, error) {
+	name, err := p.pathName(p.next())
+	if err != nil {
+		return nil, err
+	}
+	result := path{{name: name}}
+	for {
+		switch {
+		case p.symbol("."):
+			name, err := p.pathName(p.next())
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, pathElement{name: name})
+		case p.symbol("["):
+			t := p.next()
+			if t.kind != tokenNumber {
+				return nil, fmt.Errorf("syntax error; token: %q", t.text)
+			}
+			index, _ := strconv.Atoi(t.text)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			result = append(result, pathElement{index: index, list: true})
+		default:
+			return result, nil
+		}
+	}
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	if p.function("size") {
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return sizeOperand{path: target}, p.expect(")")
+	}
+	if t := p.peek(); t.kind == tokenValue {
+		p.pos++
+		value, ok := p.values[t.text]
+		if !ok || value == nil {
+			return nil, fmt.Errorf("an expression attribute value used in expression is not defined; attribute value: %s", t.text)
+		}
+		return valueOperand{value: value}, nil
+	}
+	target, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{path: target}, nil
+}
+
+func (p *parser) parseCondition() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.keyword("NOT") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{inner: inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.symbol("(") {
+		inner, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+
+	for _, name := range []string{"attribute_exists", "attribute_not_exists", "attribute_type", "begins_with", "contains"} {
+		if !p.function(name) {
+			continue
+		}
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		c := functionCondition{name: name, path: target}
+		if name != "attribute_exists" && name != "attribute_not_exists" {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if c.arg, err = p.parseOperand(); err != nil {
+				return nil, err
+			}
+		}
+		return c, p.expect(")")
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.keyword("BETWEEN"):
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, fmt.Errorf("syntax error; BETWEEN requires AND")
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenCondition{value: left, low: low, high: high}, nil
+	case p.keyword("IN"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		c := inCondition{value: left}
+		for {
+			choice, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			c.choices = append(c.choices, choice)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		return c, p.expect(")")
+	}
+
+	t := p.next()
+	if t.kind != tokenSymbol || !slices.Contains([]string{"=", "<>", "<", "<=", ">", ">="}, t.text) {
+		return nil, fmt.Errorf("syntax error; token: %q", t.text)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareCondition{op: t.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseSetOperand() (operand, error) {
+	if p.function("if_not_exists") {
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		fallback, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return ifNotExistsOperand{path: target, fallback: fallback}, p.expect(")")
+	}
+	if p.function("list_append") {
+		left, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return listAppendOperand{left: left, right: right}, p.expect(")")
+	}
+	return p.parseOperand()
+}
+
+func (p *parser) parseUpdate() ([]updateAction, error) {
+	var actions []updateAction
+	for p.peek().kind != tokenEOF {
+		clause := strings.ToUpper(p.next().text)
+		if !slices.Contains([]string{"SET", "REMOVE", "ADD", "DELETE"}, clause) {
+			return nil, fmt.Errorf("syntax error; token: %q", clause)
+		}
+		for {
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			action := updateAction{action: clause, path: target}
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				if action.value, err = p.parseSetOperand(); err != nil {
+					return nil, err
+				}
+				if p.symbol("+") || p.symbol("-") {
+					minus := p.tokens[p.pos-1].text == "-"
+					right, err := p.parseSetOperand()
+					if err != nil {
+						return nil, err
+					}
+					action.value = arithmeticOperand{left: action.value, right: right, minus: minus}
+				}
+			case "ADD", "DELETE":
+				if action.value, err = p.parseOperand(); err != nil {
+					return nil, err
+				}
+			}
+			actions = append(actions, action)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	return actions, nil
+}
+
+func (p *parser) parseProjection() ([]path, error) {
+	var paths []path
+	for {
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, target)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("syntax error; token: %q", p.peek().text)
+	}
+	return paths, nil
+}
+
+// compileCondition parses a condition, filter or key condition expression. An empty expression always matches.
+func compileCondition(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (condition, error) {
+	if expr == nil || strings.TrimSpace(*expr) == "" {
+		return nil, nil
+	}
+	p, err := newParser(*expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("syntax error; token: %q", p.peek().text)
+	}
+	return c, nil
+}
+
+func matches(c condition, it item) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	return c.matches(it)
+}
+
+// applyUpdate evaluates every action against the original item, as DynamoDB does, and returns the updated copy
+// together with the top level attributes that changed.
+func applyUpdate(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue, original item) (item, []string, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	actions, err := p.parseUpdate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	evaluated := make([]*dynamodb.AttributeValue, len(actions))
+	for i, action := range actions {
+		if action.value == nil {
+			continue
+		}
+		if evaluated[i], err = action.value.evaluate(original); err != nil {
+			return nil, nil, err
+		}
+		if evaluated[i] == nil {
+			return nil, nil, fmt.Errorf("the provided expression refers to an attribute that does not exist in the item")
+		}
+	}
+
+	updated := copyItem(original)
+	var changed []string
+	for i, action := range actions {
+		changed = append(changed, action.path.top())
+		value := copyValue(evaluated[i])
+		switch action.action {
+		case "SET":
+			if err := action.path.set(updated, value); err != nil {
+				return nil, nil, err
+			}
+		case "REMOVE":
+			action.path.remove(updated)
+		case "ADD":
+			current := action.path.resolve(updated)
+			next, err := addValues(current, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := action.path.set(updated, next); err != nil {
+				return nil, nil, err
+			}
+		case "DELETE":
+			current := action.path.resolve(updated)
+			if current == nil {
+				continue
+			}
+			next, err := deleteValues(current, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if next == nil {
+				action.path.remove(updated)
+			} else if err := action.path.set(updated, next); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	slices.Sort(changed)
+	return updated, slices.Compact(changed), nil
+}
+
+func addValues(current, value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	if current == nil {
+		return value, nil
+	}
+	switch {
+	case typeOf(current) == "N" && typeOf(value) == "N":
+		return arithmeticOperand{left: valueOperand{current}, right: valueOperand{value}}.evaluate(nil)
+	case typeOf(current) == "SS" && typeOf(value) == "SS":
+		return &dynamodb.AttributeValue{SS: aws.StringSlice(union(aws.StringValueSlice(current.SS), aws.StringValueSlice(value.SS)))}, nil
+	case typeOf(current) == "NS" && typeOf(value) == "NS":
+		return &dynamodb.AttributeValue{NS: aws.StringSlice(union(normalizeNumbers(aws.StringValueSlice(current.NS)), normalizeNumbers(aws.StringValueSlice(value.NS))))}, nil
+	}
+	return nil, fmt.Errorf("an operand in the update expression has an incorrect data type")
+}
+
+func deleteValues(current, value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	var remaining []string
+	switch {
+	case typeOf(current) == "SS" && typeOf(value) == "SS":
+		remaining = difference(aws.StringValueSlice(current.SS), aws.StringValueSlice(value.SS))
+		if len(remaining) > 0 {
+			return &dynamodb.AttributeValue{SS: aws.StringSlice(remaining)}, nil
+		}
+	case typeOf(current) == "NS" && typeOf(value) == "NS":
+		remaining = difference(normalizeNumbers(aws.StringValueSlice(current.NS)), normalizeNumbers(aws.StringValueSlice(value.NS)))
+		if len(remaining) > 0 {
+			return &dynamodb.AttributeValue{NS: aws.StringSlice(remaining)}, nil
+		}
+	default:
+		return nil, fmt.Errorf("an operand in the update expression has an incorrect data type")
+	}
+	return nil, nil
+}
+
+func union(a, b []string) []string {
+	out := slices.Clone(a)
+	for _, v := range b {
+		if !slices.Contains(out, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func difference(a, b []string) []string {
+	var out []string
+	for _, v := range a {
+		if !slices.Contains(b, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func project(expr *string, names map[string]*string, it item) (item, error) {
+	if expr == nil || strings.TrimSpace(*expr) == "" || it == nil {
+		return it, nil
+	}
+	p, err := newParser(*expr, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := p.parseProjection()
+	if err != nil {
+		return nil, err
+	}
+	out := item{}
+	for _, target := range paths {
+		if v, ok := it[target.top()]; ok {
+			out[target.top()] = v
+		}
+	}
+	return out, nil
+}
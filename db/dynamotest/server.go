@@ -0,0 +1,1088 @@
+// Package dynamotest provides an in-process DynamoDB fake for tests. It speaks the DynamoDB JSON protocol over an
+// httptest server, so the real aws-sdk-go client and the repositories run unchanged against it.
+package dynamotest
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const targetPrefix = "DynamoDB_20120810."
+
+// Server is a DynamoDB compatible endpoint backed by memory. It implements the table, item, batch and
+// transaction operations the repositories use, including condition, update, key condition and filter expressions.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	tables map[string]*table
+	// unprocessed is the number of write requests BatchWriteItem hands back before it starts accepting them.
+	unprocessed int
+	// staleReads makes the eventually consistent GetItem calls miss the last write of an item.
+	staleReads bool
+}
+
+type table struct {
+	description *dynamodb.TableDescription
+	ttl         *dynamodb.TimeToLiveDescription
+	items       map[string]item
+	// previous holds every written item as it was before its last write, nil when it did not exist.
+	previous map[string]item
+}
+
+type keySchema struct {
+	hash, rangeKey string
+}
+
+// NewServer starts a fake DynamoDB endpoint. Close it when the test is done.
+func NewServer() *Server {
+	s := &Server{tables: map[string]*table{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns a DynamoDB client that talks to the fake with static credentials.
+func (s *Server) Client() *dynamodb.DynamoDB {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("local"),
+		Endpoint:    aws.String(s.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return dynamodb.New(sess)
+}
+
+// SetUnprocessedWrites makes the next BatchWriteItem calls return up to n write requests as UnprocessedItems,
+// like a throttled table does.
+func (s *Server) SetUnprocessedWrites(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unprocessed = n
+}
+
+// SetStaleReads makes the GetItem calls without ConsistentRead answer with the item as it was before its last write,
+// like a replica that has not caught up yet.
+func (s *Server) SetStaleReads(stale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.staleReads = stale
+}
+
+// ExpireItems runs the TTL sweeper: it deletes every item whose TTL attribute is before now and returns how many
+// items were removed.
+func (s *Server) ExpireItems(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, t := range s.tables {
+		if t.ttl == nil || aws.StringValue(t.ttl.TimeToLiveStatus) != dynamodb.TimeToLiveStatusEnabled {
+			continue
+		}
+		attribute := aws.StringValue(t.ttl.AttributeName)
+		for key, it := range t.items {
+			v := it[attribute]
+			if typeOf(v) != "N" {
+				continue
+			}
+			if expires, err := strconv.ParseFloat(*v.N, 64); err == nil && int64(expires) < now.Unix() {
+				delete(t.items, key)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+type apiError struct {
+	_                   struct{}                       `type:"structure"`
+	Type                string                         `locationName:"__type" type:"string"`
+	Message             *string                        `locationName:"message" type:"string"`
+	CancellationReasons []*dynamodb.CancellationReason `type:"list"`
+}
+
+func (e *apiError) Error() string {
+	return e.Type + ": " + aws.StringValue(e.Message)
+}
+
+func newError(code, format string, args ...any) *apiError {
+	return &apiError{Type: "com.amazonaws.dynamodb.v20120810#" + code, Message: aws.String(fmt.Sprintf(format, args...))}
+}
+
+func validationError(format string, args ...any) *apiError {
+	return newError("ValidationException", format, args...)
+}
+
+func conditionFailed() *apiError {
+	return newError("ConditionalCheckFailedException", "The conditional request failed")
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), targetPrefix)
+	handlers := map[string]func(*http.Request) (any, error){
+		"CreateTable":        s.createTable,
+		"DescribeTable":      s.describeTable,
+		"DeleteTable":        s.deleteTable,
+		"ListTables":         s.listTables,
+		"UpdateTable":        s.updateTable,
+		"UpdateTimeToLive":   s.updateTimeToLive,
+		"DescribeTimeToLive": s.describeTimeToLive,
+		"PutItem":            s.putItem,
+		"GetItem":            s.getItem,
+		"UpdateItem":         s.updateItem,
+		"DeleteItem":         s.deleteItem,
+		"Query":              s.query,
+		"Scan":               s.scan,
+		"BatchWriteItem":     s.batchWriteItem,
+		"BatchGetItem":       s.batchGetItem,
+		"TransactWriteItems": s.transactWriteItems,
+		"TransactGetItems":   s.transactGetItems,
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	handler, ok := handlers[operation]
+	if !ok {
+		writeError(w, newError("UnknownOperationException", "unsupported operation %q", operation))
+		return
+	}
+
+	s.mu.Lock()
+	output, err := handler(r)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	body, err := jsonutil.BuildJSON(output)
+	if err != nil {
+		writeError(w, newError("InternalServerError", "%v", err))
+		return
+	}
+	_, _ = w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = validationError("%v", err)
+	}
+	body, _ := jsonutil.BuildJSON(e)
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(body)
+}
+
+func decode(r *http.Request, input any) error {
+	if err := jsonutil.UnmarshalJSON(input, r.Body); err != nil {
+		return validationError("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) table(name *string) (*table, error) {
+	t, ok := s.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, newError("ResourceNotFoundException", "Requested resource not found: Table: %s not found", aws.StringValue(name))
+	}
+	return t, nil
+}
+
+func schemaOf(elements []*dynamodb.KeySchemaElement) keySchema {
+	var schema keySchema
+	for _, e := range elements {
+		if aws.StringValue(e.KeyType) == dynamodb.KeyTypeHash {
+			schema.hash = aws.StringValue(e.AttributeName)
+		} else {
+			schema.rangeKey = aws.StringValue(e.AttributeName)
+		}
+	}
+	return schema
+}
+
+func (t *table) schema() keySchema {
+	return schemaOf(t.description.KeySchema)
+}
+
+// indexSchema returns the key schema of a secondary index, or of the table when name is empty.
+func (t *table) indexSchema(name *string) (keySchema, error) {
+	if aws.StringValue(name) == "" {
+		return t.schema(), nil
+	}
+	for _, index := range t.description.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == *name {
+			return schemaOf(index.KeySchema), nil
+		}
+	}
+	for _, index := range t.description.LocalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == *name {
+			return schemaOf(index.KeySchema), nil
+		}
+	}
+	return keySchema{}, validationError("The table does not have the specified index: %s", *name)
+}
+
+func (t *table) attributeType(name string) string {
+	for _, definition := range t.description.AttributeDefinitions {
+		if aws.StringValue(definition.AttributeName) == name {
+			return aws.StringValue(definition.AttributeType)
+		}
+	}
+	return ""
+}
+
+// primaryKey validates that key holds exactly the table key attributes and returns its storage key.
+func (t *table) primaryKey(key item, exact bool) (string, error) {
+	schema := t.schema()
+	names := []string{schema.hash}
+	if schema.rangeKey != "" {
+		names = append(names, schema.rangeKey)
+	}
+	if exact && len(key) != len(names) {
+		return "", validationError("The provided key element does not match the schema")
+	}
+
+	var parts []string
+	for _, name := range names {
+		v, ok := key[name]
+		if !ok || typeOf(v) != t.attributeType(name) {
+			return "", validationError("One or more parameter values were invalid: Missing the key %s in the item", name)
+		}
+		if keyString(v) == "S:" || keyString(v) == "B:" {
+			return "", validationError("One or more parameter values are not valid. The AttributeValue for a key attribute cannot contain an empty string value. Key: %s", name)
+		}
+		parts = append(parts, keyString(v))
+	}
+	return strings.Join(parts, "\x00"), nil
+}
+
+// checkIndexKeys rejects items whose secondary index key attributes have another type than their definition.
+// Items without the attributes are allowed and left out of the index.
+func (t *table) checkIndexKeys(it item) error {
+	var schemas []keySchema
+	for _, index := range t.description.GlobalSecondaryIndexes {
+		schemas = append(schemas, schemaOf(index.KeySchema))
+	}
+	for _, index := range t.description.LocalSecondaryIndexes {
+		schemas = append(schemas, schemaOf(index.KeySchema))
+	}
+	for _, schema := range schemas {
+		for _, name := range []string{schema.hash, schema.rangeKey} {
+			v, ok := it[name]
+			if name == "" || !ok {
+				continue
+			}
+			if typeOf(v) != t.attributeType(name) || keyString(v) == "S:" || keyString(v) == "B:" {
+				return validationError("One or more parameter values were invalid: Type mismatch for Index Key %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *table) keyOf(it item) item {
+	schema := t.schema()
+	key := item{schema.hash: copyValue(it[schema.hash])}
+	if schema.rangeKey != "" {
+		key[schema.rangeKey] = copyValue(it[schema.rangeKey])
+	}
+	return key
+}
+
+func (s *Server) createTable(r *http.Request) (any, error) {
+	var input dynamodb.CreateTableInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.TableName)
+	if name == "" || len(input.KeySchema) == 0 {
+		return nil, validationError("TableName and KeySchema are required")
+	}
+	if _, exists := s.tables[name]; exists {
+		return nil, newError("ResourceInUseException", "Table already exists: %s", name)
+	}
+
+	description := &dynamodb.TableDescription{
+		TableName:            aws.String(name),
+		TableArn:             aws.String("arn:aws:dynamodb:local:000000000000:table/" + name),
+		TableStatus:          aws.String(dynamodb.TableStatusActive),
+		CreationDateTime:     aws.Time(time.Now()),
+		KeySchema:            input.KeySchema,
+		AttributeDefinitions: input.AttributeDefinitions,
+	}
+	billing := aws.StringValue(input.BillingMode)
+	if billing == "" {
+		billing = dynamodb.BillingModeProvisioned
+	}
+	description.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(billing)}
+	description.ProvisionedThroughput = throughputDescription(input.ProvisionedThroughput)
+	setStream(description, input.StreamSpecification)
+	for _, index := range input.GlobalSecondaryIndexes {
+		description.GlobalSecondaryIndexes = append(description.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:             index.IndexName,
+			IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+			KeySchema:             index.KeySchema,
+			Projection:            index.Projection,
+			ProvisionedThroughput: throughputDescription(index.ProvisionedThroughput),
+		})
+	}
+	for _, index := range input.LocalSecondaryIndexes {
+		description.LocalSecondaryIndexes = append(description.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndexDescription{
+			IndexName:  index.IndexName,
+			KeySchema:  index.KeySchema,
+			Projection: index.Projection,
+		})
+	}
+
+	t := &table{description: description, items: map[string]item{}, previous: map[string]item{}}
+	for _, e := range input.KeySchema {
+		if t.attributeType(aws.StringValue(e.AttributeName)) == "" {
+			return nil, validationError("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions")
+		}
+	}
+	s.tables[name] = t
+	return &dynamodb.CreateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// setStream enables or disables the stream of a table as specification says. The fake records no stream, it only
+// describes it.
+func setStream(description *dynamodb.TableDescription, specification *dynamodb.StreamSpecification) {
+	if specification == nil {
+		return
+	}
+	if !aws.BoolValue(specification.StreamEnabled) {
+		description.StreamSpecification = nil
+		return
+	}
+	label := time.Now().UTC().Format("2006-01-02T15:04:05.000")
+	description.StreamSpecification = specification
+	description.LatestStreamLabel = aws.String(label)
+	description.LatestStreamArn = aws.String(aws.StringValue(description.TableArn) + "/stream/" + label)
+}
+
+func throughputDescription(throughput *dynamodb.ProvisionedThroughput) *dynamodb.ProvisionedThroughputDescription {
+	description := &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(0), WriteCapacityUnits: aws.Int64(0)}
+	if throughput != nil {
+		description.ReadCapacityUnits = throughput.ReadCapacityUnits
+		description.WriteCapacityUnits = throughput.WriteCapacityUnits
+	}
+	return description
+}
+
+func (t *table) describe() *dynamodb.TableDescription {
+	description := *t.description
+	description.ItemCount = aws.Int64(int64(len(t.items)))
+	return &description
+}
+
+func (s *Server) describeTable(r *http.Request) (any, error) {
+	var input dynamodb.DescribeTableInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: t.describe()}, nil
+}
+
+func (s *Server) deleteTable(r *http.Request) (any, error) {
+	var input dynamodb.DeleteTableInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.tables, aws.StringValue(input.TableName))
+	return &dynamodb.DeleteTableOutput{TableDescription: t.describe()}, nil
+}
+
+func (s *Server) listTables(r *http.Request) (any, error) {
+	var input dynamodb.ListTablesInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	names := make([]*string, 0, len(s.tables))
+	for name := range s.tables {
+		names = append(names, aws.String(name))
+	}
+	slices.SortFunc(names, func(a, b *string) int { return strings.Compare(*a, *b) })
+	return &dynamodb.ListTablesOutput{TableNames: names}, nil
+}
+
+func (s *Server) updateTable(r *http.Request) (any, error) {
+	var input dynamodb.UpdateTableInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, definition := range input.AttributeDefinitions {
+		if t.attributeType(aws.StringValue(definition.AttributeName)) == "" {
+			t.description.AttributeDefinitions = append(t.description.AttributeDefinitions, definition)
+		}
+	}
+	if input.BillingMode != nil {
+		t.description.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: input.BillingMode}
+	}
+	if input.ProvisionedThroughput != nil {
+		t.description.ProvisionedThroughput = throughputDescription(input.ProvisionedThroughput)
+	}
+	setStream(t.description, input.StreamSpecification)
+	for _, update := range input.GlobalSecondaryIndexUpdates {
+		switch {
+		case update.Create != nil:
+			if _, err := t.indexSchema(update.Create.IndexName); err == nil {
+				return nil, validationError("Attempting to create an index which already exists")
+			}
+			t.description.GlobalSecondaryIndexes = append(t.description.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+				IndexName:             update.Create.IndexName,
+				IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+				KeySchema:             update.Create.KeySchema,
+				Projection:            update.Create.Projection,
+				ProvisionedThroughput: throughputDescription(update.Create.ProvisionedThroughput),
+			})
+		case update.Delete != nil:
+			t.description.GlobalSecondaryIndexes = slices.DeleteFunc(t.description.GlobalSecondaryIndexes, func(index *dynamodb.GlobalSecondaryIndexDescription) bool {
+				return aws.StringValue(index.IndexName) == aws.StringValue(update.Delete.IndexName)
+			})
+		case update.Update != nil:
+			for _, index := range t.description.GlobalSecondaryIndexes {
+				if aws.StringValue(index.IndexName) == aws.StringValue(update.Update.IndexName) {
+					index.ProvisionedThroughput = throughputDescription(update.Update.ProvisionedThroughput)
+				}
+			}
+		}
+	}
+	return &dynamodb.UpdateTableOutput{TableDescription: t.describe()}, nil
+}
+
+func (s *Server) updateTimeToLive(r *http.Request) (any, error) {
+	var input dynamodb.UpdateTimeToLiveInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.TimeToLiveSpecification == nil {
+		return nil, validationError("TimeToLiveSpecification is required")
+	}
+	status := dynamodb.TimeToLiveStatusDisabled
+	if aws.BoolValue(input.TimeToLiveSpecification.Enabled) {
+		status = dynamodb.TimeToLiveStatusEnabled
+	}
+	t.ttl = &dynamodb.TimeToLiveDescription{
+		AttributeName:    input.TimeToLiveSpecification.AttributeName,
+		TimeToLiveStatus: aws.String(status),
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: input.TimeToLiveSpecification}, nil
+}
+
+func (s *Server) describeTimeToLive(r *http.Request) (any, error) {
+	var input dynamodb.DescribeTimeToLiveInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	description := t.ttl
+	if description == nil {
+		description = &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled)}
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: description}, nil
+}
+
+// write is a single validated mutation. Batches and transactions check every write before applying any.
+type write struct {
+	table  *table
+	key    string
+	result item
+}
+
+func (w write) apply() {
+	w.table.previous[w.key] = w.table.items[w.key]
+	if w.result == nil {
+		delete(w.table.items, w.key)
+	} else {
+		w.table.items[w.key] = w.result
+	}
+}
+
+func (s *Server) preparePut(tableName *string, newItem item, conditionExpression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (write, item, error) {
+	t, err := s.table(tableName)
+	if err != nil {
+		return write{}, nil, err
+	}
+	key, err := t.primaryKey(newItem, false)
+	if err != nil {
+		return write{}, nil, err
+	}
+	if err := t.checkIndexKeys(newItem); err != nil {
+		return write{}, nil, err
+	}
+	old := t.items[key]
+	if err := checkCondition(conditionExpression, names, values, old); err != nil {
+		return write{}, nil, err
+	}
+	return write{table: t, key: key, result: copyItem(newItem)}, old, nil
+}
+
+func (s *Server) prepareDelete(tableName *string, keyItem item, conditionExpression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (write, item, error) {
+	t, err := s.table(tableName)
+	if err != nil {
+		return write{}, nil, err
+	}
+	key, err := t.primaryKey(keyItem, true)
+	if err != nil {
+		return write{}, nil, err
+	}
+	old := t.items[key]
+	if err := checkCondition(conditionExpression, names, values, old); err != nil {
+		return write{}, nil, err
+	}
+	return write{table: t, key: key}, old, nil
+}
+
+func (s *Server) prepareUpdate(tableName *string, keyItem item, updateExpression, conditionExpression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (write, item, []string, error) {
+	t, err := s.table(tableName)
+	if err != nil {
+		return write{}, nil, nil, err
+	}
+	key, err := t.primaryKey(keyItem, true)
+	if err != nil {
+		return write{}, nil, nil, err
+	}
+	old := t.items[key]
+	if err := checkCondition(conditionExpression, names, values, old); err != nil {
+		return write{}, nil, nil, err
+	}
+
+	base := old
+	if base == nil {
+		base = copyItem(keyItem)
+	}
+	updated, changed := base, []string(nil)
+	if aws.StringValue(updateExpression) != "" {
+		if updated, changed, err = applyUpdate(*updateExpression, names, values, base); err != nil {
+			return write{}, nil, nil, validationError("Invalid UpdateExpression: %v", err)
+		}
+	}
+	for name := range t.keyOf(keyItem) {
+		if !equalValues(updated[name], keyItem[name]) {
+			return write{}, nil, nil, validationError("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name)
+		}
+	}
+	if err := t.checkIndexKeys(updated); err != nil {
+		return write{}, nil, nil, err
+	}
+	return write{table: t, key: key, result: updated}, old, changed, nil
+}
+
+func checkCondition(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, it item) error {
+	c, err := compileCondition(expr, names, values)
+	if err != nil {
+		return validationError("Invalid ConditionExpression: %v", err)
+	}
+	target := it
+	if target == nil {
+		target = item{}
+	}
+	ok, err := matches(c, target)
+	if err != nil {
+		return validationError("Invalid ConditionExpression: %v", err)
+	}
+	if !ok {
+		return conditionFailed()
+	}
+	return nil
+}
+
+func returnValues(mode *string, old, updated item, changed []string) item {
+	pick := func(it item) item {
+		out := item{}
+		for _, name := range changed {
+			if v, ok := it[name]; ok {
+				out[name] = v
+			}
+		}
+		return out
+	}
+	switch aws.StringValue(mode) {
+	case dynamodb.ReturnValueAllOld:
+		return copyItem(old)
+	case dynamodb.ReturnValueAllNew:
+		return copyItem(updated)
+	case dynamodb.ReturnValueUpdatedOld:
+		return pick(copyItem(old))
+	case dynamodb.ReturnValueUpdatedNew:
+		return pick(copyItem(updated))
+	}
+	return nil
+}
+
+func (s *Server) putItem(r *http.Request) (any, error) {
+	var input dynamodb.PutItemInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	w, old, err := s.preparePut(input.TableName, input.Item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	w.apply()
+	return &dynamodb.PutItemOutput{Attributes: returnValues(input.ReturnValues, old, nil, nil)}, nil
+}
+
+func (s *Server) getItem(r *http.Request) (any, error) {
+	var input dynamodb.GetItemInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.primaryKey(input.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	current := t.items[key]
+	if previous, ok := t.previous[key]; ok && s.staleReads && !aws.BoolValue(input.ConsistentRead) {
+		current = previous
+	}
+	it, err := project(input.ProjectionExpression, input.ExpressionAttributeNames, copyItem(current))
+	if err != nil {
+		return nil, validationError("Invalid ProjectionExpression: %v", err)
+	}
+	return &dynamodb.GetItemOutput{Item: it}, nil
+}
+
+func (s *Server) updateItem(r *http.Request) (any, error) {
+	var input dynamodb.UpdateItemInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	w, old, changed, err := s.prepareUpdate(input.TableName, input.Key, input.UpdateExpression, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	w.apply()
+	return &dynamodb.UpdateItemOutput{Attributes: returnValues(input.ReturnValues, old, w.result, changed)}, nil
+}
+
+func (s *Server) deleteItem(r *http.Request) (any, error) {
+	var input dynamodb.DeleteItemInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	w, old, err := s.prepareDelete(input.TableName, input.Key, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	w.apply()
+	return &dynamodb.DeleteItemOutput{Attributes: returnValues(input.ReturnValues, old, nil, nil)}, nil
+}
+
+type readRequest struct {
+	table             *table
+	indexName         *string
+	keyCondition      condition
+	filter            condition
+	limit             int64
+	exclusiveStartKey item
+	forward           bool
+	projection        *string
+	names             map[string]*string
+	countOnly         bool
+}
+
+type readResult struct {
+	items            []item
+	scanned          int64
+	lastEvaluatedKey item
+}
+
+// read runs a Query or Scan. Items are ordered by the index key and then by the table key, which keeps
+// ExclusiveStartKey positions stable while items are added or removed.
+func (s *Server) read(req readRequest) (*readResult, error) {
+	indexSchema, err := req.table.indexSchema(req.indexName)
+	if err != nil {
+		return nil, err
+	}
+	tableSchema := req.table.schema()
+	order := []string{indexSchema.hash, indexSchema.rangeKey, tableSchema.hash, tableSchema.rangeKey}
+	order = slices.DeleteFunc(order, func(name string) bool { return name == "" })
+	order = slices.Compact(order)
+
+	var candidates []item
+	for _, it := range req.table.items {
+		if it[indexSchema.hash] == nil || (indexSchema.rangeKey != "" && it[indexSchema.rangeKey] == nil) {
+			continue
+		}
+		ok, err := matches(req.keyCondition, it)
+		if err != nil {
+			return nil, validationError("Invalid KeyConditionExpression: %v", err)
+		}
+		if ok {
+			candidates = append(candidates, it)
+		}
+	}
+
+	compare := func(a, b item) int {
+		for _, name := range order {
+			if c, _ := compareValues(a[name], b[name]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if req.forward {
+			return compare(candidates[i], candidates[j]) < 0
+		}
+		return compare(candidates[i], candidates[j]) > 0
+	})
+
+	if req.exclusiveStartKey != nil {
+		candidates = slices.DeleteFunc(candidates, func(it item) bool {
+			c := compare(it, req.exclusiveStartKey)
+			return (req.forward && c <= 0) || (!req.forward && c >= 0)
+		})
+	}
+
+	result := &readResult{}
+	for i, it := range candidates {
+		if req.limit > 0 && int64(i) == req.limit {
+			break
+		}
+		result.scanned++
+		if req.limit > 0 && result.scanned == req.limit {
+			last := item{}
+			for _, name := range order {
+				last[name] = copyValue(it[name])
+			}
+			result.lastEvaluatedKey = last
+		}
+		ok, err := matches(req.filter, it)
+		if err != nil {
+			return nil, validationError("Invalid FilterExpression: %v", err)
+		}
+		if !ok {
+			continue
+		}
+		projected, err := project(req.projection, req.names, copyItem(it))
+		if err != nil {
+			return nil, validationError("Invalid ProjectionExpression: %v", err)
+		}
+		result.items = append(result.items, projected)
+	}
+	if req.countOnly {
+		count := len(result.items)
+		result.items = make([]item, count)
+	}
+	return result, nil
+}
+
+func (s *Server) query(r *http.Request) (any, error) {
+	var input dynamodb.QueryInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(input.KeyConditionExpression) == "" {
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request.")
+	}
+	keyCondition, err := compileCondition(input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationError("Invalid KeyConditionExpression: %v", err)
+	}
+	filter, err := compileCondition(input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationError("Invalid FilterExpression: %v", err)
+	}
+
+	result, err := s.read(readRequest{
+		table:             t,
+		indexName:         input.IndexName,
+		keyCondition:      keyCondition,
+		filter:            filter,
+		limit:             aws.Int64Value(input.Limit),
+		exclusiveStartKey: input.ExclusiveStartKey,
+		forward:           input.ScanIndexForward == nil || *input.ScanIndexForward,
+		projection:        input.ProjectionExpression,
+		names:             input.ExpressionAttributeNames,
+		countOnly:         aws.StringValue(input.Select) == dynamodb.SelectCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &dynamodb.QueryOutput{
+		Count:            aws.Int64(int64(len(result.items))),
+		ScannedCount:     aws.Int64(result.scanned),
+		LastEvaluatedKey: result.lastEvaluatedKey,
+	}
+	if aws.StringValue(input.Select) != dynamodb.SelectCount {
+		output.Items = result.items
+	}
+	return output, nil
+}
+
+func (s *Server) scan(r *http.Request) (any, error) {
+	var input dynamodb.ScanInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := compileCondition(input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationError("Invalid FilterExpression: %v", err)
+	}
+
+	result, err := s.read(readRequest{
+		table:             t,
+		indexName:         input.IndexName,
+		filter:            filter,
+		limit:             aws.Int64Value(input.Limit),
+		exclusiveStartKey: input.ExclusiveStartKey,
+		forward:           true,
+		projection:        input.ProjectionExpression,
+		names:             input.ExpressionAttributeNames,
+		countOnly:         aws.StringValue(input.Select) == dynamodb.SelectCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &dynamodb.ScanOutput{
+		Count:            aws.Int64(int64(len(result.items))),
+		ScannedCount:     aws.Int64(result.scanned),
+		LastEvaluatedKey: result.lastEvaluatedKey,
+	}
+	if aws.StringValue(input.Select) != dynamodb.SelectCount {
+		output.Items = result.items
+	}
+	return output, nil
+}
+
+func (s *Server) batchWriteItem(r *http.Request) (any, error) {
+	var input dynamodb.BatchWriteItemInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, requests := range input.RequestItems {
+		total += len(requests)
+	}
+	if total == 0 || total > 25 {
+		return nil, validationError("Too many items requested for the BatchWriteItem call")
+	}
+
+	var writes []write
+	seen := map[string]bool{}
+	unprocessed := map[string][]*dynamodb.WriteRequest{}
+	tableNames := make([]string, 0, len(input.RequestItems))
+	for name := range input.RequestItems {
+		tableNames = append(tableNames, name)
+	}
+	slices.Sort(tableNames)
+
+	for _, name := range tableNames {
+		for _, request := range input.RequestItems[name] {
+			var w write
+			var err error
+			switch {
+			case request.PutRequest != nil:
+				w, _, err = s.preparePut(aws.String(name), request.PutRequest.Item, nil, nil, nil)
+			case request.DeleteRequest != nil:
+				w, _, err = s.prepareDelete(aws.String(name), request.DeleteRequest.Key, nil, nil, nil)
+			default:
+				err = validationError("WriteRequest must contain a PutRequest or a DeleteRequest")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if seen[name+"\x01"+w.key] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			seen[name+"\x01"+w.key] = true
+
+			if s.unprocessed > 0 {
+				s.unprocessed--
+				unprocessed[name] = append(unprocessed[name], request)
+				continue
+			}
+			writes = append(writes, w)
+		}
+	}
+
+	for _, w := range writes {
+		w.apply()
+	}
+	return &dynamodb.BatchWriteItemOutput{UnprocessedItems: unprocessed}, nil
+}
+
+func (s *Server) batchGetItem(r *http.Request) (any, error) {
+	var input dynamodb.BatchGetItemInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+
+	total := 0
+	responses := map[string][]map[string]*dynamodb.AttributeValue{}
+	for name, request := range input.RequestItems {
+		t, err := s.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		total += len(request.Keys)
+		for _, keyItem := range request.Keys {
+			key, err := t.primaryKey(keyItem, true)
+			if err != nil {
+				return nil, err
+			}
+			if it, ok := t.items[key]; ok {
+				projected, err := project(request.ProjectionExpression, request.ExpressionAttributeNames, copyItem(it))
+				if err != nil {
+					return nil, validationError("Invalid ProjectionExpression: %v", err)
+				}
+				responses[name] = append(responses[name], projected)
+			}
+		}
+	}
+	if total == 0 || total > 100 {
+		return nil, validationError("Too many items requested for the BatchGetItem call")
+	}
+	return &dynamodb.BatchGetItemOutput{Responses: responses, UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{}}, nil
+}
+
+func (s *Server) transactWriteItems(r *http.Request) (any, error) {
+	var input dynamodb.TransactWriteItemsInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > 100 {
+		return nil, validationError("Member must have length less than or equal to 100")
+	}
+
+	var writes []write
+	seen := map[string]bool{}
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	failed := false
+	for i, transactItem := range input.TransactItems {
+		var w write
+		var err error
+		var tableName *string
+		switch {
+		case transactItem.Put != nil:
+			p := transactItem.Put
+			tableName = p.TableName
+			w, _, err = s.preparePut(p.TableName, p.Item, p.ConditionExpression, p.ExpressionAttributeNames, p.ExpressionAttributeValues)
+		case transactItem.Delete != nil:
+			d := transactItem.Delete
+			tableName = d.TableName
+			w, _, err = s.prepareDelete(d.TableName, d.Key, d.ConditionExpression, d.ExpressionAttributeNames, d.ExpressionAttributeValues)
+		case transactItem.Update != nil:
+			u := transactItem.Update
+			tableName = u.TableName
+			w, _, _, err = s.prepareUpdate(u.TableName, u.Key, u.UpdateExpression, u.ConditionExpression, u.ExpressionAttributeNames, u.ExpressionAttributeValues)
+		case transactItem.ConditionCheck != nil:
+			c := transactItem.ConditionCheck
+			tableName = c.TableName
+			w, _, err = s.prepareDelete(c.TableName, c.Key, c.ConditionExpression, c.ExpressionAttributeNames, c.ExpressionAttributeValues)
+			w.table = nil
+		default:
+			err = validationError("TransactItem must contain one operation")
+		}
+
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+		if err != nil {
+			e, ok := err.(*apiError)
+			if !ok || !strings.HasSuffix(e.Type, "#ConditionalCheckFailedException") {
+				return nil, err
+			}
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String("ConditionalCheckFailed"), Message: e.Message}
+			failed = true
+			continue
+		}
+
+		id := aws.StringValue(tableName) + "\x01" + w.key
+		if seen[id] {
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[id] = true
+		if w.table != nil {
+			writes = append(writes, w)
+		}
+	}
+
+	if failed {
+		codes := make([]string, len(reasons))
+		for i, reason := range reasons {
+			codes[i] = aws.StringValue(reason.Code)
+		}
+		e := newError("TransactionCanceledException", "Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))
+		e.CancellationReasons = reasons
+		return nil, e
+	}
+
+	for _, w := range writes {
+		w.apply()
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (s *Server) transactGetItems(r *http.Request) (any, error) {
+	var input dynamodb.TransactGetItemsInput
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	output := &dynamodb.TransactGetItemsOutput{}
+	for _, transactItem := range input.TransactItems {
+		if transactItem.Get == nil {
+			return nil, validationError("TransactGetItem must contain a Get")
+		}
+		t, err := s.table(transactItem.Get.TableName)
+		if err != nil {
+			return nil, err
+		}
+		key, err := t.primaryKey(transactItem.Get.Key, true)
+		if err != nil {
+			return nil, err
+		}
+		it, err := project(transactItem.Get.ProjectionExpression, transactItem.Get.ExpressionAttributeNames, copyItem(t.items[key]))
+		if err != nil {
+			return nil, validationError("Invalid ProjectionExpression: %v", err)
+		}
+		output.Responses = append(output.Responses, &dynamodb.ItemResponse{Item: it})
+	}
+	return output, nil
+}
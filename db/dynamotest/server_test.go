@@ -0,0 +1,151 @@
+package dynamotest
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"testing"
+)
+
+// newTestClient starts a server with a table hashed on id.
+func newTestClient(t *testing.T) *dynamodb.DynamoDB {
+	server := NewServer()
+	t.Cleanup(server.Close)
+	client := server.Client()
+	_, err := client.CreateTable(&dynamodb.CreateTableInput{
+		TableName:            aws.String("items"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{AttributeName: aws.String("id"), AttributeType: aws.String("S")}},
+		KeySchema:            []*dynamodb.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: aws.String("HASH")}},
+		BillingMode:          aws.String("PAY_PER_REQUEST"),
+	})
+	if err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+	return client
+}
+
+func errorCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestServer_ConditionalPut(t *testing.T) {
+	client := newTestClient(t)
+	put := &dynamodb.PutItemInput{
+		TableName:                aws.String("items"),
+		Item:                     map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}, "n": {N: aws.String("1")}},
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("id")},
+	}
+	if _, err := client.PutItem(put); err != nil {
+		t.Fatalf("PutItem() error = %v", err)
+	}
+	if _, err := client.PutItem(put); errorCode(err) != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Errorf("PutItem() error = %v, want %s", err, dynamodb.ErrCodeConditionalCheckFailedException)
+	}
+}
+
+func TestServer_UpdateItem(t *testing.T) {
+	client := newTestClient(t)
+	key := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}}
+	update := func(expr string, values map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+		out, err := client.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String("items"),
+			Key:                       key,
+			UpdateExpression:          aws.String(expr),
+			ExpressionAttributeValues: values,
+			ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		})
+		if err != nil {
+			t.Fatalf("UpdateItem(%q) error = %v", expr, err)
+		}
+		return out.Attributes
+	}
+
+	update("SET n = if_not_exists(n, :zero) + :one, tag = :tag", map[string]*dynamodb.AttributeValue{
+		":zero": {N: aws.String("0")}, ":one": {N: aws.String("1")}, ":tag": {S: aws.String("a")},
+	})
+	got := update("ADD n :two REMOVE tag", map[string]*dynamodb.AttributeValue{":two": {N: aws.String("2")}})
+	if aws.StringValue(got["n"].N) != "3" || got["tag"] != nil {
+		t.Errorf("UpdateItem() got = %v, want n = 3 and no tag", got)
+	}
+}
+
+func TestServer_TransactWriteItemsCanceled(t *testing.T) {
+	client := newTestClient(t)
+	if _, err := client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("items"),
+		Item:      map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}},
+	}); err != nil {
+		t.Fatalf("PutItem() error = %v", err)
+	}
+
+	_, err := client.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{
+		{Put: &dynamodb.Put{TableName: aws.String("items"), Item: map[string]*dynamodb.AttributeValue{"id": {S: aws.String("2")}}}},
+		{Put: &dynamodb.Put{
+			TableName:           aws.String("items"),
+			Item:                map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}},
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		}},
+	}})
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		t.Fatalf("TransactWriteItems() error = %v, want a %s", err, dynamodb.ErrCodeTransactionCanceledException)
+	}
+	reasons := []string{}
+	for _, reason := range canceled.CancellationReasons {
+		reasons = append(reasons, aws.StringValue(reason.Code))
+	}
+	if len(reasons) != 2 || reasons[0] != "None" || reasons[1] != "ConditionalCheckFailed" {
+		t.Errorf("CancellationReasons got = %v, want [None ConditionalCheckFailed]", reasons)
+	}
+
+	// Nothing of the canceled transaction was written.
+	out, err := client.GetItem(&dynamodb.GetItemInput{TableName: aws.String("items"), Key: map[string]*dynamodb.AttributeValue{"id": {S: aws.String("2")}}})
+	if err != nil || out.Item != nil {
+		t.Errorf("GetItem() got = %v, %v, want no item", out.Item, err)
+	}
+}
+
+func TestServer_StaleReads(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Close)
+	client := server.Client()
+	_, err := client.CreateTable(&dynamodb.CreateTableInput{
+		TableName:            aws.String("items"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{AttributeName: aws.String("id"), AttributeType: aws.String("S")}},
+		KeySchema:            []*dynamodb.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: aws.String("HASH")}},
+		BillingMode:          aws.String("PAY_PER_REQUEST"),
+	})
+	if err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+	server.SetStaleReads(true)
+
+	key := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}}
+	get := func(consistent bool) map[string]*dynamodb.AttributeValue {
+		out, err := client.GetItem(&dynamodb.GetItemInput{TableName: aws.String("items"), Key: key, ConsistentRead: aws.Bool(consistent)})
+		if err != nil {
+			t.Fatalf("GetItem() error = %v", err)
+		}
+		return out.Item
+	}
+	for _, n := range []string{"1", "2"} {
+		item := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}, "n": {N: aws.String(n)}}
+		if _, err := client.PutItem(&dynamodb.PutItemInput{TableName: aws.String("items"), Item: item}); err != nil {
+			t.Fatalf("PutItem() error = %v", err)
+		}
+	}
+
+	// An eventually consistent read misses the last write, a strongly consistent one sees it.
+	if got := get(false); aws.StringValue(got["n"].N) != "1" {
+		t.Errorf("GetItem() got = %v, want the item before the last write", got)
+	}
+	if got := get(true); aws.StringValue(got["n"].N) != "2" {
+		t.Errorf("GetItem(ConsistentRead) got = %v, want the last write", got)
+	}
+}
@@ -0,0 +1,278 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultDataDir is where the file stores live when DATA_DIR is not set, relative to the working directory.
+const DefaultDataDir = "data"
+
+// DefaultSnapshotEvery is how many records the write-ahead log takes before it is compacted into a snapshot.
+const DefaultSnapshotEvery = 1000
+
+// maxRecordSize bounds the length of a record, a larger one can only be read from a torn header.
+const maxRecordSize = 64 << 20
+
+// frameHeaderSize is the length and the CRC-32C checksum of the payload, in front of every record of the log.
+const frameHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileStore keeps the state of a repository in a data directory: <name>.snapshot holds the state as of the last
+// compaction, and <name>.wal the records appended since, each one synced to disk before Append returns.
+//
+// A record must hold the result of a mutation rather than the mutation itself, so that replaying it on top of a
+// snapshot that already has it changes nothing. Then a crash between writing a snapshot and truncating the log
+// is harmless.
+type FileStore struct {
+	mu            sync.Mutex
+	dir           string
+	name          string
+	wal           walFile
+	records       int
+	snapshotEvery int
+	// torn is set when a failed append could not remove its frame, which would hide the records after it.
+	torn error
+}
+
+// walFile is the file of the log, an *os.File but in the tests that fail its writes.
+type walFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OpenFileStore opens the log of name in dir, creating both when they do not exist. Load must run before Append.
+func OpenFileStore(dir, name string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("data directory is required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, name+".wal"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		dir:           dir,
+		name:          name,
+		wal:           wal,
+		snapshotEvery: DefaultSnapshotEvery,
+	}, nil
+}
+
+// CreateFileStore opens the store of name in DATA_DIR, or in DefaultDataDir when it is not set.
+func CreateFileStore(name string) (*FileStore, error) {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		dir = DefaultDataDir
+	}
+	return OpenFileStore(dir, name)
+}
+
+// SetSnapshotEvery changes how many records the log takes before NeedsSnapshot, DefaultSnapshotEvery by default.
+func (s *FileStore) SetSnapshotEvery(records int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshotEvery = records
+}
+
+func (s *FileStore) snapshotPath() string {
+	return filepath.Join(s.dir, s.name+".snapshot")
+}
+
+// Load hands the snapshot, if there is one, to restore and then every record of the log to replay, in order. A
+// record cut short or failing its checksum can only be the tail of a write interrupted by a crash, which was never
+// acknowledged: the log is truncated right before it.
+func (s *FileStore) Load(restore func(snapshot []byte) error, replay func(record []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot, err := os.ReadFile(s.snapshotPath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := restore(snapshot); err != nil {
+			return fmt.Errorf("%s snapshot: %w", s.name, err)
+		}
+	}
+
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.wal)
+	var offset int64
+	s.records = 0
+	for {
+		payload, err := readFrame(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("%s.wal: %v at offset %d, dropping the tail of the log", s.name, err, offset)
+			return s.wal.Truncate(offset)
+		}
+		if err := replay(payload); err != nil {
+			return fmt.Errorf("%s.wal record at offset %d: %w", s.name, offset, err)
+		}
+		offset += frameHeaderSize + int64(len(payload))
+		s.records++
+	}
+}
+
+// readFrame reads one record. It returns io.EOF at the end of the log, and another error for a torn record.
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	n, err := io.ReadFull(reader, header[:])
+	if n == 0 && errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errors.New("truncated record header")
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, errors.New("record length out of range")
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errors.New("truncated record")
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// Append writes record as JSON at the end of the log and syncs it to disk. When it fails, the log is cut back to
+// where it was, since Load stops at a torn frame and would drop the records appended after it; when even that
+// fails, the log takes no more records.
+func (s *FileStore) Append(record any) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	frame = append(frame, payload...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.torn != nil {
+		return s.torn
+	}
+	info, err := s.wal.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(frame); err != nil {
+		return s.cutBack(info.Size(), err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return s.cutBack(info.Size(), err)
+	}
+	s.records++
+	return nil
+}
+
+// cutBack truncates the log to size after an append failed with err.
+func (s *FileStore) cutBack(size int64, err error) error {
+	truncateErr := s.wal.Truncate(size)
+	if truncateErr == nil {
+		truncateErr = s.wal.Sync()
+	}
+	if truncateErr != nil {
+		s.torn = fmt.Errorf("%s.wal: failed to remove a torn record: %w", s.name, truncateErr)
+		return errors.Join(err, s.torn)
+	}
+	return err
+}
+
+// NeedsSnapshot tells whether the log has grown enough to be compacted.
+func (s *FileStore) NeedsSnapshot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotEvery > 0 && s.records >= s.snapshotEvery
+}
+
+// Snapshot replaces the snapshot with state as JSON and empties the log. The snapshot is written to a temporary
+// file and renamed, so a crash leaves either the old one or the new one.
+func (s *FileStore) Snapshot(state any) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.snapshotPath() + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.snapshotPath()); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.records = 0
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	return s.wal.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
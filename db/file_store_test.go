@@ -0,0 +1,181 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testRecord struct {
+	N int `json:"n"`
+}
+
+// loadTestStore opens the store of dir and returns the snapshot and the records it holds.
+func loadTestStore(t *testing.T, dir string) (*FileStore, []int, []int) {
+	t.Helper()
+	store, err := OpenFileStore(dir, "test")
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	var snapshot, records []int
+	err = store.Load(
+		func(data []byte) error { return json.Unmarshal(data, &snapshot) },
+		func(data []byte) error {
+			var record testRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record.N)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	return store, snapshot, records
+}
+
+func appendTestRecords(t *testing.T, store *FileStore, numbers ...int) {
+	t.Helper()
+	for _, n := range numbers {
+		if err := store.Append(testRecord{N: n}); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+}
+
+func TestFileStore_Replay(t *testing.T) {
+	dir := t.TempDir()
+	store, _, _ := loadTestStore(t, dir)
+	appendTestRecords(t, store, 1, 2, 3)
+	store.Close()
+
+	_, snapshot, records := loadTestStore(t, dir)
+	if snapshot != nil || !reflect.DeepEqual(records, []int{1, 2, 3}) {
+		t.Errorf("Load() got snapshot = %v, records = %v, want records [1 2 3]", snapshot, records)
+	}
+}
+
+func TestFileStore_TruncatedTail(t *testing.T) {
+	testsList := []struct {
+		name   string
+		damage func(data []byte) []byte
+	}{
+		{name: "TornRecord", damage: func(data []byte) []byte { return data[:len(data)-3] }},
+		{name: "TornHeader", damage: func(data []byte) []byte { return append(data, 0, 0, 0) }},
+		{name: "ChecksumMismatch", damage: func(data []byte) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, _, _ := loadTestStore(t, dir)
+			appendTestRecords(t, store, 1, 2, 3)
+			store.Close()
+
+			path := filepath.Join(dir, "test.wal")
+			data, _ := os.ReadFile(path)
+			if err := os.WriteFile(path, tt.damage(data), 0o644); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+
+			store, _, records := loadTestStore(t, dir)
+			want := []int{1, 2, 3}
+			if tt.name != "TornHeader" {
+				want = []int{1, 2}
+			}
+			if !reflect.DeepEqual(records, want) {
+				t.Errorf("Load() got = %v, want %v", records, want)
+			}
+
+			// The damaged tail is gone, so the records appended after the recovery replay too.
+			appendTestRecords(t, store, 4)
+			store.Close()
+			_, _, records = loadTestStore(t, dir)
+			if want = append(want, 4); !reflect.DeepEqual(records, want) {
+				t.Errorf("Load() got = %v, want %v", records, want)
+			}
+		})
+	}
+}
+
+// tornFile writes half of a frame and fails, as a full disk does, or fails the first sync after the write.
+type tornFile struct {
+	*os.File
+	failSync bool
+	synced   bool
+}
+
+func (f *tornFile) Write(data []byte) (int, error) {
+	if f.failSync {
+		return f.File.Write(data)
+	}
+	n, _ := f.File.Write(data[:len(data)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *tornFile) Sync() error {
+	if f.failSync && !f.synced {
+		f.synced = true
+		return errors.New("input/output error")
+	}
+	return f.File.Sync()
+}
+
+func TestFileStore_AppendFailure(t *testing.T) {
+	for _, failSync := range []bool{false, true} {
+		dir := t.TempDir()
+		store, _, _ := loadTestStore(t, dir)
+		appendTestRecords(t, store, 1)
+
+		file := store.wal.(*os.File)
+		store.wal = &tornFile{File: file, failSync: failSync}
+		if err := store.Append(testRecord{N: 2}); err == nil {
+			t.Fatalf("Append() expected an error")
+		}
+		// The records acknowledged after the failed one replay too.
+		store.wal = file
+		appendTestRecords(t, store, 3)
+		store.Close()
+
+		if _, _, records := loadTestStore(t, dir); !reflect.DeepEqual(records, []int{1, 3}) {
+			t.Errorf("Load() after a failed %s got = %v, want [1 3]", map[bool]string{false: "write", true: "sync"}[failSync], records)
+		}
+	}
+}
+
+func TestFileStore_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, _, _ := loadTestStore(t, dir)
+	store.SetSnapshotEvery(2)
+
+	appendTestRecords(t, store, 1)
+	if store.NeedsSnapshot() {
+		t.Errorf("NeedsSnapshot() got = true after one record, want false")
+	}
+	appendTestRecords(t, store, 2)
+	if !store.NeedsSnapshot() {
+		t.Errorf("NeedsSnapshot() got = false after two records, want true")
+	}
+	if err := store.Snapshot([]int{1, 2}); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if store.NeedsSnapshot() {
+		t.Errorf("NeedsSnapshot() got = true after a snapshot, want false")
+	}
+	appendTestRecords(t, store, 3)
+	store.Close()
+
+	_, snapshot, records := loadTestStore(t, dir)
+	if !reflect.DeepEqual(snapshot, []int{1, 2}) || !reflect.DeepEqual(records, []int{3}) {
+		t.Errorf("Load() got snapshot = %v, records = %v, want [1 2] and [3]", snapshot, records)
+	}
+}
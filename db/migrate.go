@@ -0,0 +1,112 @@
+package db
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations holds the schema changes as NNNN_description.sql files. A released migration must never change, a
+// schema change goes into a new file with the next version.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []migration
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s does not start with a version number", file)
+		}
+		data, err := migrations.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration{version: version, name: name, sql: string(data)})
+	}
+
+	slices.SortFunc(list, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(list); i++ {
+		if list[i].version == list[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", list[i-1].name, list[i].name)
+		}
+	}
+	return list, nil
+}
+
+// Migrate applies the migrations newer than the version recorded in schema_migrations, each one in its own
+// transaction together with its record.
+func (db *SQLInstance) Migrate() error {
+	list, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    INTEGER PRIMARY KEY,
+    name       TEXT NOT NULL,
+    applied_at TEXT NOT NULL
+)`)
+	if err != nil {
+		return err
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+		if err := db.apply(m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (db *SQLInstance) apply(m migration) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		return err
+	}
+	_, err = tx.Exec(db.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+		m.version, m.name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion is the version of the last applied migration, zero on an empty database.
+func (db *SQLInstance) SchemaVersion() (int, error) {
+	var version int
+	err := db.DB.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
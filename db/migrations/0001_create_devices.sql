@@ -0,0 +1,13 @@
+CREATE TABLE devices (
+    id           TEXT PRIMARY KEY,
+    device_model TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    note         TEXT NOT NULL DEFAULT '',
+    serial       TEXT NOT NULL,
+    version      BIGINT NOT NULL,
+    deleted_at   TEXT NOT NULL DEFAULT '',
+    deleted_by   TEXT NOT NULL DEFAULT '',
+    purge_at     BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX devices_device_model ON devices (device_model, id);
@@ -0,0 +1,7 @@
+CREATE TABLE device_models (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    manufacturer TEXT NOT NULL,
+    category     TEXT NOT NULL,
+    specs        TEXT NOT NULL DEFAULT '{}'
+);
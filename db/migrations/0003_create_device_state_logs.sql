@@ -0,0 +1,12 @@
+CREATE TABLE device_state_logs (
+    device_id    TEXT NOT NULL,
+    state_date   TEXT NOT NULL,
+    operator     TEXT NOT NULL,
+    date         TEXT NOT NULL,
+    state        TEXT NOT NULL,
+    escalated_to TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (device_id, state_date)
+);
+
+CREATE INDEX device_state_logs_date ON device_state_logs (device_id, date, state_date);
+CREATE INDEX device_state_logs_escalated_to ON device_state_logs (escalated_to, date, device_id, state_date);
@@ -0,0 +1,51 @@
+-- Every table gets a tenant in front of its key. The rows stored before there were tenants belong to 'default'.
+-- SQLite can not change a primary key in place, so each table is copied into a new one.
+CREATE TABLE devices_by_tenant (
+    tenant       TEXT NOT NULL,
+    id           TEXT NOT NULL,
+    device_model TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    note         TEXT NOT NULL DEFAULT '',
+    serial       TEXT NOT NULL,
+    version      BIGINT NOT NULL,
+    deleted_at   TEXT NOT NULL DEFAULT '',
+    deleted_by   TEXT NOT NULL DEFAULT '',
+    purge_at     BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant, id)
+);
+INSERT INTO devices_by_tenant (tenant, id, device_model, name, note, serial, version, deleted_at, deleted_by, purge_at)
+SELECT 'default', id, device_model, name, note, serial, version, deleted_at, deleted_by, purge_at FROM devices;
+DROP TABLE devices;
+ALTER TABLE devices_by_tenant RENAME TO devices;
+CREATE INDEX devices_device_model ON devices (tenant, device_model, id);
+
+CREATE TABLE device_models_by_tenant (
+    tenant       TEXT NOT NULL,
+    id           TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    manufacturer TEXT NOT NULL,
+    category     TEXT NOT NULL,
+    specs        TEXT NOT NULL DEFAULT '{}',
+    PRIMARY KEY (tenant, id)
+);
+INSERT INTO device_models_by_tenant (tenant, id, name, manufacturer, category, specs)
+SELECT 'default', id, name, manufacturer, category, specs FROM device_models;
+DROP TABLE device_models;
+ALTER TABLE device_models_by_tenant RENAME TO device_models;
+
+CREATE TABLE device_state_logs_by_tenant (
+    tenant       TEXT NOT NULL,
+    device_id    TEXT NOT NULL,
+    state_date   TEXT NOT NULL,
+    operator     TEXT NOT NULL,
+    date         TEXT NOT NULL,
+    state        TEXT NOT NULL,
+    escalated_to TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant, device_id, state_date)
+);
+INSERT INTO device_state_logs_by_tenant (tenant, device_id, state_date, operator, date, state, escalated_to)
+SELECT 'default', device_id, state_date, operator, date, state, escalated_to FROM device_state_logs;
+DROP TABLE device_state_logs;
+ALTER TABLE device_state_logs_by_tenant RENAME TO device_state_logs;
+CREATE INDEX device_state_logs_date ON device_state_logs (tenant, device_id, date, state_date);
+CREATE INDEX device_state_logs_escalated_to ON device_state_logs (tenant, escalated_to, date, device_id, state_date);
@@ -0,0 +1,12 @@
+-- The events of the writes wait here until they are delivered. A write inserts its events in the transaction of its
+-- rows, and source tells apart the repositories that share the table. The IDs sort in the order of the events.
+CREATE TABLE event_outbox (
+    id          TEXT PRIMARY KEY,
+    source      TEXT NOT NULL,
+    tenant      TEXT NOT NULL,
+    type        TEXT NOT NULL,
+    occurred_at TEXT NOT NULL,
+    data        TEXT NOT NULL
+);
+
+CREATE INDEX event_outbox_source ON event_outbox (source, id);
@@ -0,0 +1,26 @@
+-- The webhooks of the tenants, and the deliveries of the events to them. events is a JSON array of event types,
+-- empty for all of them. A delivery is keyed by the ID of its event, and keeps the event and its attempts as JSON.
+CREATE TABLE webhooks (
+    tenant     TEXT NOT NULL,
+    id         TEXT NOT NULL,
+    url        TEXT NOT NULL,
+    events     TEXT NOT NULL DEFAULT '[]',
+    secret     TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (tenant, id)
+);
+
+CREATE TABLE webhook_deliveries (
+    tenant          TEXT NOT NULL,
+    webhook_id      TEXT NOT NULL,
+    id              TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    next_attempt_at TEXT NOT NULL DEFAULT '',
+    event           TEXT NOT NULL,
+    attempts        TEXT NOT NULL DEFAULT '[]',
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant, webhook_id, id)
+);
+
+CREATE INDEX webhook_deliveries_status ON webhook_deliveries (tenant, webhook_id, status, id);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at, id);
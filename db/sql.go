@@ -0,0 +1,112 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	SQLiteDriver   = "sqlite"
+	PostgresDriver = "postgres"
+
+	// DefaultSQLDSN is an SQLite file next to the binary, which needs no server.
+	DefaultSQLDSN = "file:simple-api.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+)
+
+type SQLInstance struct {
+	DB     *sql.DB
+	driver string
+}
+
+func NewSQLInstance(db *sql.DB, driver string) (*SQLInstance, error) {
+	if db == nil {
+		return nil, errors.New("SQL database is required")
+	}
+
+	if driver != SQLiteDriver && driver != PostgresDriver {
+		return nil, errors.New("SQL driver must be sqlite or postgres")
+	}
+
+	return &SQLInstance{
+		DB:     db,
+		driver: driver,
+	}, nil
+}
+
+func (db *SQLInstance) GetDriver() string {
+	return db.driver
+}
+
+// OpenSQLInstance connects to dsn and migrates its schema to the latest version. A postgres:// or postgresql://
+// URL connects to PostgreSQL, anything else is an SQLite file.
+func OpenSQLInstance(dsn string) (*SQLInstance, error) {
+	if dsn == "" {
+		dsn = DefaultSQLDSN
+	}
+	driver := SQLiteDriver
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		driver = PostgresDriver
+	}
+
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == SQLiteDriver {
+		// SQLite takes one writer at a time, one connection keeps writers from failing with SQLITE_BUSY.
+		conn.SetMaxOpenConns(1)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	instance, err := NewSQLInstance(conn, driver)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := instance.Migrate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return instance, nil
+}
+
+// CreateSQLInstance connects to SQL_DSN, or to DefaultSQLDSN when it is not set.
+func CreateSQLInstance() (*SQLInstance, error) {
+	return OpenSQLInstance(os.Getenv("SQL_DSN"))
+}
+
+// Rebind turns the ? placeholders of query into the $1, $2... placeholders of PostgreSQL. Queries must not have a
+// literal question mark.
+func (db *SQLInstance) Rebind(query string) string {
+	if db.driver != PostgresDriver {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// Contains is the condition that column contains the text of the next placeholder.
+func (db *SQLInstance) Contains(column string) string {
+	if db.driver == PostgresDriver {
+		return "strpos(" + column + ", ?) > 0"
+	}
+	return "instr(" + column + ", ?) > 0"
+}
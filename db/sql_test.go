@@ -0,0 +1,58 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLInstance_Rebind(t *testing.T) {
+	query := "UPDATE devices SET name = ? WHERE id = ? AND version = ?"
+
+	sqlite := &SQLInstance{driver: SQLiteDriver}
+	if got := sqlite.Rebind(query); got != query {
+		t.Errorf("Rebind() got = %v, want %v", got, query)
+	}
+
+	postgres := &SQLInstance{driver: PostgresDriver}
+	want := "UPDATE devices SET name = $1 WHERE id = $2 AND version = $3"
+	if got := postgres.Rebind(query); got != want {
+		t.Errorf("Rebind() got = %v, want %v", got, want)
+	}
+}
+
+func TestSQLInstance_Migrate(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "test.db")
+	instance, err := OpenSQLInstance(dsn)
+	if err != nil {
+		t.Fatalf("OpenSQLInstance() error = %v", err)
+	}
+	instance.DB.Close()
+
+	list, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+
+	// Opening the database again finds every migration applied and applies none twice.
+	instance, err = OpenSQLInstance(dsn)
+	if err != nil {
+		t.Fatalf("OpenSQLInstance() error = %v", err)
+	}
+	defer instance.DB.Close()
+
+	version, err := instance.SchemaVersion()
+	if err != nil {
+		t.Fatalf("SchemaVersion() error = %v", err)
+	}
+	if want := list[len(list)-1].version; version != want {
+		t.Errorf("SchemaVersion() got = %v, want %v", version, want)
+	}
+
+	var applied int
+	if err := instance.DB.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("QueryRow() error = %v", err)
+	}
+	if applied != len(list) {
+		t.Errorf("Migrate() applied = %v migrations, want %v", applied, len(list))
+	}
+}
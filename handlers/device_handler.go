@@ -3,14 +3,23 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"regexp"
 	"simple-api-go/models"
+	"simple-api-go/repositories"
 	"simple-api-go/services"
 	"simple-api-go/utils"
+	"slices"
+	"strconv"
 	"strings"
 )
 
+// operatorHeader names who deletes a device, it is kept as deletedBy while the device is in the trash.
+const operatorHeader = "X-Operator"
+
 type DeviceHandler struct {
 	service services.DeviceService
 }
@@ -21,8 +30,7 @@ func NewDeviceHandler(service services.DeviceService) *DeviceHandler {
 
 func (h *DeviceHandler) CreateDevice(w http.ResponseWriter, r *http.Request) {
 	var device models.Device
-	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
-		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+	if !decodeBody(w, r, &device) {
 		return
 	}
 
@@ -30,39 +38,66 @@ func (h *DeviceHandler) CreateDevice(w http.ResponseWriter, r *http.Request) {
 		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	//Check if the device ID already exists
-	existingDevice, err := h.service.GetDevice(device.ID)
-	if err == nil && existingDevice != nil {
-		utils.ErrorJSONFormat(w, utils.ErrDeviceDuplicate.Error(), http.StatusConflict)
-		return
-	}
-
-	createdDevice, err := h.service.CreateDevice(&device)
+	// The repository refuses an existing ID in the same step as the write, so two concurrent creates can not both
+	// succeed.
+	createdDevice, err := h.service.CreateDevice(r.Context(), &device)
 	if err != nil {
-		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+		writeDeviceError(w, err)
 		return
 	}
 
+	setETag(w, createdDevice.Version)
 	h.ReturnHttpResponse(w, createdDevice, http.StatusCreated)
 }
 
 func (h *DeviceHandler) GetDevice(w http.ResponseWriter, r *http.Request) {
 	id := "/devices/" + getDeviceIDFromRequest(r)
-	device, err := h.service.GetDevice(id)
+	device, err := h.service.GetDevice(r.Context(), id)
 	if err != nil {
 		//utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
 		utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	setETag(w, device.Version)
 	h.ReturnHttpResponse(w, device, http.StatusOK)
 }
 
+func (h *DeviceHandler) ListDevices(w http.ResponseWriter, r *http.Request) {
+	h.listDevices(w, r, false)
+}
+
+// ListDeletedDevices lists the trash, with the same query parameters as ListDevices.
+func (h *DeviceHandler) ListDeletedDevices(w http.ResponseWriter, r *http.Request) {
+	h.listDevices(w, r, true)
+}
+
+// listDevices serves a page of the live devices, or of the trash when deleted is set.
+func (h *DeviceHandler) listDevices(w http.ResponseWriter, r *http.Request, deleted bool) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Deleted = deleted
+
+	page, err := h.service.ListDevices(r.Context(), opts)
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidCursor) || errors.Is(err, utils.ErrInvalidFilter) || errors.Is(err, utils.ErrInvalidSort) {
+			utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.ReturnHttpResponse(w, page, http.StatusOK)
+}
+
 func (h *DeviceHandler) UpdateDevice(w http.ResponseWriter, r *http.Request) {
 	id := "/devices/" + getDeviceIDFromRequest(r)
 	var updatedDevice models.Device
-	if err := json.NewDecoder(r.Body).Decode(&updatedDevice); err != nil {
-		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+	if !decodeBody(w, r, &updatedDevice) {
 		return
 	}
 
@@ -72,32 +107,321 @@ func (h *DeviceHandler) UpdateDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := h.service.UpdateDevice(id, &updatedDevice)
+	version, ok := parseIfMatch(r)
+	if !ok {
+		utils.ErrorJSONFormat(w, utils.ErrVersionMismatch.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	updatedDevice.Version = version
+
+	device, err := h.service.UpdateDevice(r.Context(), id, &updatedDevice)
 	if err != nil {
-		if errors.Is(err, utils.ErrDeviceNotFound) {
-			utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
-			return
+		writeDeviceError(w, err)
+		return
+	}
+	setETag(w, device.Version)
+	h.ReturnHttpResponse(w, device, http.StatusOK)
+}
+
+// PatchDevice applies an RFC 7396 merge patch to the stored device: fields of the patch replace the stored ones and
+// a null clears a field. The merged device goes through the same validation as a PUT, and is written on condition
+// that the device did not change since it was read, so a concurrent update is never overwritten silently.
+func (h *DeviceHandler) PatchDevice(w http.ResponseWriter, r *http.Request) {
+	id := "/devices/" + getDeviceIDFromRequest(r)
+	if !isMergePatch(r) {
+		utils.ErrorJSONFormat(w, "unsupported content type, It must be application/merge-patch+json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	version, ok := parseIfMatch(r)
+	if !ok {
+		utils.ErrorJSONFormat(w, utils.ErrVersionMismatch.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	// The patch is applied to the device as stored, again if a concurrent write changed it in between.
+	var invalid error
+	device, err := h.service.PatchDevice(r.Context(), id, version, func(device *models.Device) error {
+		patchedDevice, err := applyDevicePatch(device, patch)
+		switch {
+		case err != nil:
+			invalid = err
+		case patchedDevice.ID != id:
+			invalid = errors.New("device id can not be changed")
+		default:
+			invalid = validateDevice(*patchedDevice)
 		}
-		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+		if invalid != nil {
+			return invalid
+		}
+		*device = *patchedDevice
+		return nil
+	})
+	if invalid != nil {
+		utils.ErrorJSONFormat(w, invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeDeviceError(w, err)
 		return
 	}
+	setETag(w, device.Version)
 	h.ReturnHttpResponse(w, device, http.StatusOK)
 }
 
+// isMergePatch accepts application/merge-patch+json, and plain application/json for clients that can not set it.
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/merge-patch+json" || mediaType == "application/json")
+}
+
+// applyDevicePatch merges patch into a copy of device. The version is not part of the patch, it comes from If-Match.
+func applyDevicePatch(device *models.Device, patch []byte) (*models.Device, error) {
+	current, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := utils.MergePatch(current, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	patchedDevice := &models.Device{}
+	if err := json.Unmarshal(merged, patchedDevice); err != nil {
+		return nil, fmt.Errorf("%w: %v", utils.ErrInvalidPatch, err)
+	}
+	return patchedDevice, nil
+}
+
 func (h *DeviceHandler) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 	id := "/devices/" + getDeviceIDFromRequest(r)
-	if err := h.service.DeleteDevice(id); err != nil {
-		if errors.Is(err, utils.ErrDeviceNotFound) {
-			utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+	version, ok := parseIfMatch(r)
+	if !ok {
+		utils.ErrorJSONFormat(w, utils.ErrVersionMismatch.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	if err := h.service.DeleteDevice(r.Context(), id, version, r.Header.Get(operatorHeader)); err != nil {
+		writeDeviceError(w, err)
 		return
 	}
 
 	h.ReturnHttpResponse(w, nil, http.StatusNoContent)
 }
 
+// DeviceAction serves the custom methods of a device, POST /api/devices/{id}:action. A wildcard has to be a whole
+// path segment, so the action is split off the ID here.
+func (h *DeviceHandler) DeviceAction(w http.ResponseWriter, r *http.Request) {
+	deviceID, action, _ := strings.Cut(getDeviceIDFromRequest(r), ":")
+	switch action {
+	case "restore":
+		h.RestoreDevice(w, r, "/devices/"+deviceID)
+	default:
+		utils.ErrorJSONFormat(w, "unknown device action '"+action+"', It must be one of restore", http.StatusNotFound)
+	}
+}
+
+// RestoreDevice takes a device out of the trash. If-Match is checked against the version of the deleted device.
+func (h *DeviceHandler) RestoreDevice(w http.ResponseWriter, r *http.Request, id string) {
+	version, ok := parseIfMatch(r)
+	if !ok {
+		utils.ErrorJSONFormat(w, utils.ErrVersionMismatch.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	device, err := h.service.RestoreDevice(r.Context(), id, version)
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+	setETag(w, device.Version)
+	h.ReturnHttpResponse(w, device, http.StatusOK)
+}
+
+// BatchDevices applies a list of create, update and delete operations, see models.DeviceBatchRequest. Every
+// device is validated like on its own endpoint and an invalid one rejects the whole request; otherwise the
+// response reports the status of each operation in the order of the request.
+func (h *DeviceHandler) BatchDevices(w http.ResponseWriter, r *http.Request) {
+	var request models.DeviceBatchRequest
+	if !decodeBody(w, r, &request) {
+		return
+	}
+
+	var errorMessages []string
+	for i, op := range request.Operations {
+		var err error
+		if op.Op == models.BatchDelete {
+			request.Operations[i].Device.DeletedBy = r.Header.Get(operatorHeader)
+			if !deviceIDRegex.MatchString(op.Device.ID) {
+				err = errors.New("invalid ID format, It must be in the format '/devices/alphanumeric'")
+			}
+		} else {
+			err = validateDevice(op.Device)
+		}
+		if err != nil {
+			errorMessages = append(errorMessages, "operation "+strconv.Itoa(i)+": "+err.Error())
+		}
+	}
+	if len(errorMessages) > 0 {
+		utils.ErrorJSONFormat(w, strings.Join(errorMessages, "; "), http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.service.WriteDevices(r.Context(), request.Operations, request.Atomic)
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+
+	response := models.DeviceBatchResponse{Results: make([]models.DeviceBatchResult, len(results))}
+	for i, result := range results {
+		op := request.Operations[i]
+		response.Results[i] = models.DeviceBatchResult{Op: op.Op, ID: op.Device.ID, Device: result.Device}
+		if result.Err != nil {
+			response.Results[i].Status = deviceErrorStatus(result.Err)
+			response.Results[i].Error = result.Err.Error()
+			response.Failed++
+			continue
+		}
+		switch op.Op {
+		case models.BatchCreate:
+			response.Results[i].Status = http.StatusCreated
+		case models.BatchUpdate:
+			response.Results[i].Status = http.StatusOK
+		case models.BatchDelete:
+			response.Results[i].Status = http.StatusNoContent
+		}
+	}
+	h.ReturnHttpResponse(w, response, http.StatusOK)
+}
+
+// writeDeviceError writes err with the status code of deviceErrorStatus.
+func writeDeviceError(w http.ResponseWriter, err error) {
+	utils.ErrorJSONFormat(w, err.Error(), deviceErrorStatus(err))
+}
+
+// deviceErrorStatus maps the errors of a device write to their status codes.
+func deviceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, utils.ErrUnknownDeviceModel), errors.Is(err, utils.ErrInvalidBatch):
+		return http.StatusBadRequest
+	case errors.Is(err, utils.ErrDeviceDuplicate), errors.Is(err, utils.ErrDeviceNotDeleted):
+		return http.StatusConflict
+	case errors.Is(err, utils.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, utils.ErrBatchAborted):
+		return http.StatusFailedDependency
+	case errors.Is(err, utils.ErrBatchUnprocessed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// setETag serves the version of a device as a strong entity tag, e.g. "3".
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// parseIfMatch returns the version a request expects from the If-Match header, or zero when the header is missing
+// or '*'. ok is false for an entity tag that is not a device version, which can never match.
+func parseIfMatch(r *http.Request) (version int64, ok bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, true
+	}
+
+	tag, err := strconv.Unquote(ifMatch)
+	if err != nil {
+		return 0, false
+	}
+	version, err = strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// decodeBody decodes the JSON body of r into v. When it can not, it answers the request and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// writeBodyError answers a body that could not be read: 413 Request Entity Too Large when it is over the limit of
+// the routes, whether or not the openapi validator already checked it, 400 Bad Request otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		utils.ErrorJSONFormat(w, "body is too large, It must be at most "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+}
+
+// parseLimit reads the page size of a listing; zero when it is not given, leaving the default to the repository.
+func parseLimit(limit string) (int, error) {
+	if limit == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(limit)
+	if err != nil || value < 1 || value > repositories.MaxListLimit {
+		return 0, errors.New("invalid limit, It must be a number between 1 and " + strconv.Itoa(repositories.MaxListLimit))
+	}
+	return value, nil
+}
+
+// parseListOptions reads the listing query string. Every device field can be filtered as
+// field=value (exact), field=value* (prefix) or field~=value (contains), and sort takes a
+// comma separated list of fields, each optionally prefixed with '-' for descending order.
+// Example: /api/devices?deviceModel=/devicemodels/id1&name~=cam&sort=-serial&limit=20
+func parseListOptions(r *http.Request) (repositories.ListOptions, error) {
+	query := r.URL.Query()
+	opts := repositories.ListOptions{Cursor: query.Get("cursor")}
+
+	var err error
+	if opts.Limit, err = parseLimit(query.Get("limit")); err != nil {
+		return opts, err
+	}
+
+	for _, field := range repositories.DeviceFields {
+		for _, value := range query[field] {
+			condition := repositories.FilterCondition{Field: field, Operator: repositories.FilterEquals, Value: value}
+			if prefix, ok := strings.CutSuffix(value, "*"); ok {
+				condition.Operator = repositories.FilterPrefix
+				condition.Value = prefix
+			}
+			opts.Filter = append(opts.Filter, condition)
+		}
+		for _, value := range query[field+"~"] {
+			opts.Filter = append(opts.Filter, repositories.FilterCondition{Field: field, Operator: repositories.FilterContains, Value: value})
+		}
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		for _, field := range strings.Split(sort, ",") {
+			name, descending := strings.CutPrefix(strings.TrimSpace(field), "-")
+			if !slices.Contains(repositories.DeviceFields, name) {
+				return opts, errors.New("invalid sort field '" + name + "', It must be one of " + strings.Join(repositories.DeviceFields, ", "))
+			}
+			opts.Sort = append(opts.Sort, repositories.SortField{Field: name, Descending: descending})
+		}
+	}
+
+	return opts, nil
+}
+
 func getDeviceIDFromRequest(r *http.Request) string {
 	// Example: /devices/{id}
 	if len(r.PathValue("id")) > 1 {
@@ -112,21 +436,15 @@ func getDeviceIDFromRequest(r *http.Request) string {
 	return ""
 }
 
-func (h *DeviceHandler) ReturnHttpResponse(w http.ResponseWriter, createdDevice *models.Device, httpCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(httpCode)
-
-	err := json.NewEncoder(w).Encode(createdDevice)
-	if err != nil {
-		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+func (h *DeviceHandler) ReturnHttpResponse(w http.ResponseWriter, body any, httpCode int) {
+	utils.JSONFormat(w, body, httpCode)
 }
 
+var deviceIDRegex = regexp.MustCompile(`^/devices/[A-Za-z0-9]+$`)
+
 func validateDevice(device models.Device) error {
 	var errorMessages []string
 
-	deviceIDRegex := regexp.MustCompile(`^/devices/[A-Za-z0-9]+$`)
 	if !deviceIDRegex.MatchString(device.ID) {
 		errorMessages = append(errorMessages, "invalid ID format, It must be in the format '/devices/alphanumeric'")
 	}
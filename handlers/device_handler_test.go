@@ -2,35 +2,58 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"simple-api-go/models"
+	"simple-api-go/repositories"
 	"simple-api-go/utils"
 	"testing"
 )
 
 type MockDeviceService struct {
-	GetDeviceFunc    func(id string) (*models.Device, error)
-	CreateDeviceFunc func(device *models.Device) (*models.Device, error)
-	UpdateDeviceFunc func(id string, device *models.Device) (*models.Device, error)
-	DeleteDeviceFunc func(id string) error
+	GetDeviceFunc     func(ctx context.Context, id string) (*models.Device, error)
+	ListDevicesFunc   func(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error)
+	CreateDeviceFunc  func(ctx context.Context, device *models.Device) (*models.Device, error)
+	UpdateDeviceFunc  func(ctx context.Context, id string, device *models.Device) (*models.Device, error)
+	PatchDeviceFunc   func(ctx context.Context, id string, version int64, patch func(device *models.Device) error) (*models.Device, error)
+	DeleteDeviceFunc  func(ctx context.Context, id string, version int64, deletedBy string) error
+	RestoreDeviceFunc func(ctx context.Context, id string, version int64) (*models.Device, error)
+	WriteDevicesFunc  func(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error)
 }
 
-func (m *MockDeviceService) GetDevice(id string) (*models.Device, error) {
-	return m.GetDeviceFunc(id)
+func (m *MockDeviceService) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	return m.GetDeviceFunc(ctx, id)
 }
 
-func (m *MockDeviceService) CreateDevice(device *models.Device) (*models.Device, error) {
-	return m.CreateDeviceFunc(device)
+func (m *MockDeviceService) ListDevices(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+	return m.ListDevicesFunc(ctx, opts)
 }
 
-func (m *MockDeviceService) UpdateDevice(id string, device *models.Device) (*models.Device, error) {
-	return m.UpdateDeviceFunc(id, device)
+func (m *MockDeviceService) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	return m.CreateDeviceFunc(ctx, device)
 }
 
-func (m *MockDeviceService) DeleteDevice(id string) error {
-	return m.DeleteDeviceFunc(id)
+func (m *MockDeviceService) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+	return m.UpdateDeviceFunc(ctx, id, device)
+}
+
+func (m *MockDeviceService) PatchDevice(ctx context.Context, id string, version int64, patch func(device *models.Device) error) (*models.Device, error) {
+	return m.PatchDeviceFunc(ctx, id, version, patch)
+}
+
+func (m *MockDeviceService) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	return m.DeleteDeviceFunc(ctx, id, version, deletedBy)
+}
+
+func (m *MockDeviceService) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	return m.RestoreDeviceFunc(ctx, id, version)
+}
+
+func (m *MockDeviceService) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error) {
+	return m.WriteDevicesFunc(ctx, ops, atomic)
 }
 
 func TestDeviceHandler_CreateDevice(t *testing.T) {
@@ -46,10 +69,10 @@ func TestDeviceHandler_CreateDevice(t *testing.T) {
 			Serial:      "ABC123",
 		}
 
-		mockService.CreateDeviceFunc = func(device *models.Device) (*models.Device, error) {
+		mockService.CreateDeviceFunc = func(ctx context.Context, device *models.Device) (*models.Device, error) {
 			return device, nil
 		}
-		mockService.GetDeviceFunc = func(id string) (*models.Device, error) {
+		mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
 			return nil, nil
 		}
 
@@ -89,11 +112,12 @@ func TestDeviceHandler_CreateDevice(t *testing.T) {
 			Serial:      "DEF456",
 		}
 
-		mockService.CreateDeviceFunc = func(device *models.Device) (*models.Device, error) {
-			return existingDevice, nil
+		mockService.CreateDeviceFunc = func(ctx context.Context, device *models.Device) (*models.Device, error) {
+			return nil, utils.ErrDeviceDuplicate
 		}
 
-		mockService.GetDeviceFunc = func(id string) (*models.Device, error) {
+		mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
+			t.Errorf("CreateDevice() should leave the duplicate check to the repository")
 			return existingDevice, nil
 		}
 
@@ -115,6 +139,32 @@ func TestDeviceHandler_CreateDevice(t *testing.T) {
 		}
 	})
 
+	t.Run("UnknownDeviceModel", func(t *testing.T) {
+		mockService.CreateDeviceFunc = func(ctx context.Context, device *models.Device) (*models.Device, error) {
+			return nil, utils.ErrUnknownDeviceModel
+		}
+		mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
+			return nil, utils.ErrDeviceNotFound
+		}
+
+		reqBody, err := json.Marshal(models.Device{ID: "/devices/idTest2", Name: "Device 2", DeviceModel: "/devicemodels/Unknown", Serial: "DEF456"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateDevice(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
 	t.Run("ValidateDevice", func(t *testing.T) {
 		existingDevice := &models.Device{
 			ID:          "Bad idTest1",
@@ -123,11 +173,11 @@ func TestDeviceHandler_CreateDevice(t *testing.T) {
 			Serial:      "__ Bad DEF456",
 		}
 
-		mockService.CreateDeviceFunc = func(device *models.Device) (*models.Device, error) {
+		mockService.CreateDeviceFunc = func(ctx context.Context, device *models.Device) (*models.Device, error) {
 			return existingDevice, nil
 		}
 
-		mockService.GetDeviceFunc = func(id string) (*models.Device, error) {
+		mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
 			return existingDevice, nil
 		}
 
@@ -161,9 +211,10 @@ func TestDeviceHandler_GetDevice(t *testing.T) {
 			DeviceModel: "/devicemodels/Model2",
 			Note:        "This is a test device",
 			Serial:      "ABC123",
+			Version:     3,
 		}
 
-		mockService.GetDeviceFunc = func(id string) (*models.Device, error) {
+		mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
 			return expectedDevice, nil
 		}
 		_ = getDeviceIDFromRequest
@@ -182,6 +233,9 @@ func TestDeviceHandler_GetDevice(t *testing.T) {
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
 		}
+		if etag := rr.Header().Get("ETag"); etag != `"3"` {
+			t.Errorf("unexpected ETag: got %v, want %v", etag, `"3"`)
+		}
 
 		var responseDevice models.Device
 		err = json.NewDecoder(rr.Body).Decode(&responseDevice)
@@ -195,7 +249,7 @@ func TestDeviceHandler_GetDevice(t *testing.T) {
 	})
 
 	t.Run("NonExistingDevice", func(t *testing.T) {
-		mockService.GetDeviceFunc = func(id string) (*models.Device, error) {
+		mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
 			return nil, utils.ErrDeviceNotFound
 		}
 
@@ -213,6 +267,136 @@ func TestDeviceHandler_GetDevice(t *testing.T) {
 	})
 }
 
+func TestDeviceHandler_ListDevices(t *testing.T) {
+	mockService := &MockDeviceService{}
+	handler := NewDeviceHandler(mockService)
+
+	t.Run("ListWithCursor", func(t *testing.T) {
+		expectedPage := &models.DevicePage{
+			Items: []*models.Device{
+				{
+					ID:          "/devices/idTest1",
+					Name:        "Device 1",
+					DeviceModel: "/devicemodels/Model2",
+					Note:        "This is a test device",
+					Serial:      "ABC123",
+				},
+			},
+			NextCursor: "next",
+		}
+
+		var gotOpts repositories.ListOptions
+		mockService.ListDevicesFunc = func(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+			gotOpts = opts
+			return expectedPage, nil
+		}
+
+		req, err := http.NewRequest("GET", "/api/devices?limit=1&cursor=abc", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListDevices(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+		if gotOpts.Limit != 1 || gotOpts.Cursor != "abc" {
+			t.Errorf("unexpected list options: got %+v", gotOpts)
+		}
+
+		var responsePage models.DevicePage
+		err = json.NewDecoder(rr.Body).Decode(&responsePage)
+		if err != nil {
+			t.Errorf("failed to decode response: %v", err)
+		}
+		if len(responsePage.Items) != 1 || responsePage.NextCursor != "next" {
+			t.Errorf("unexpected response page: got %+v, want %+v", responsePage, *expectedPage)
+		}
+	})
+
+	t.Run("FilterAndSort", func(t *testing.T) {
+		var gotOpts repositories.ListOptions
+		mockService.ListDevicesFunc = func(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+			gotOpts = opts
+			return &models.DevicePage{Items: []*models.Device{}}, nil
+		}
+
+		req, err := http.NewRequest("GET", "/api/devices?deviceModel=/devicemodels/X&serial=A02*&name~=cam&sort=name,-serial", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListDevices(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+
+		wantFilter := repositories.DeviceFilter{
+			{Field: "deviceModel", Operator: repositories.FilterEquals, Value: "/devicemodels/X"},
+			{Field: "name", Operator: repositories.FilterContains, Value: "cam"},
+			{Field: "serial", Operator: repositories.FilterPrefix, Value: "A02"},
+		}
+		if !reflect.DeepEqual(gotOpts.Filter, wantFilter) {
+			t.Errorf("unexpected filter: got %+v, want %+v", gotOpts.Filter, wantFilter)
+		}
+
+		wantSort := []repositories.SortField{{Field: "name"}, {Field: "serial", Descending: true}}
+		if !reflect.DeepEqual(gotOpts.Sort, wantSort) {
+			t.Errorf("unexpected sort: got %+v, want %+v", gotOpts.Sort, wantSort)
+		}
+	})
+
+	t.Run("InvalidSort", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/api/devices?sort=-createdAt", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListDevices(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("InvalidLimit", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/api/devices?limit=0", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListDevices(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("InvalidCursor", func(t *testing.T) {
+		mockService.ListDevicesFunc = func(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+			return nil, utils.ErrInvalidCursor
+		}
+
+		req, err := http.NewRequest("GET", "/api/devices?cursor=bad", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListDevices(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
 func TestDeviceHandler_UpdateDevice(t *testing.T) {
 	mockService := &MockDeviceService{}
 	handler := NewDeviceHandler(mockService)
@@ -233,7 +417,7 @@ func TestDeviceHandler_UpdateDevice(t *testing.T) {
 			Serial:      "XYZ789",
 		}
 
-		mockService.UpdateDeviceFunc = func(id string, device *models.Device) (*models.Device, error) {
+		mockService.UpdateDeviceFunc = func(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
 			return expectedDevice, nil
 		}
 
@@ -266,7 +450,7 @@ func TestDeviceHandler_UpdateDevice(t *testing.T) {
 	})
 
 	t.Run("NonExistingDevice", func(t *testing.T) {
-		mockService.UpdateDeviceFunc = func(id string, device *models.Device) (*models.Device, error) {
+		mockService.UpdateDeviceFunc = func(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
 			return nil, utils.ErrDeviceNotFound
 		}
 
@@ -296,12 +480,275 @@ func TestDeviceHandler_UpdateDevice(t *testing.T) {
 	})
 }
 
+func TestDeviceHandler_UpdateDeviceIfMatch(t *testing.T) {
+	mockService := &MockDeviceService{}
+	handler := NewDeviceHandler(mockService)
+
+	testsList := []struct {
+		name        string
+		ifMatch     string
+		err         error
+		wantVersion int64
+		wantCode    int
+		wantETag    string
+	}{
+		{name: "MatchingVersion", ifMatch: `"2"`, wantVersion: 2, wantCode: http.StatusOK, wantETag: `"3"`},
+		{name: "AnyVersion", ifMatch: "*", wantVersion: 0, wantCode: http.StatusOK, wantETag: `"3"`},
+		{name: "StaleVersion", ifMatch: `"1"`, err: utils.ErrVersionMismatch, wantVersion: 1, wantCode: http.StatusPreconditionFailed},
+		{name: "InvalidETag", ifMatch: `"abc"`, wantCode: http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService.UpdateDeviceFunc = func(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+				if device.Version != tt.wantVersion {
+					t.Errorf("unexpected expected version: got %v, want %v", device.Version, tt.wantVersion)
+				}
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				device.Version = 3
+				return device, nil
+			}
+
+			reqBody, err := json.Marshal(models.Device{Name: "Updated Device", DeviceModel: "/devicemodels/Model2", Serial: "XYZ789"})
+			if err != nil {
+				t.Fatalf("failed to marshal request body: %v", err)
+			}
+
+			req, err := http.NewRequest("PUT", "/api/devices/idTest1", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("If-Match", tt.ifMatch)
+
+			rr := httptest.NewRecorder()
+			handler.UpdateDevice(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+			if etag := rr.Header().Get("ETag"); etag != tt.wantETag {
+				t.Errorf("unexpected ETag: got %v, want %v", etag, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestDeviceHandler_PatchDevice(t *testing.T) {
+	mockService := &MockDeviceService{}
+	handler := NewDeviceHandler(mockService)
+
+	mockService.GetDeviceFunc = func(ctx context.Context, id string) (*models.Device, error) {
+		if id != "/devices/idTest1" {
+			return nil, utils.ErrDeviceNotFound
+		}
+		return &models.Device{
+			ID:          "/devices/idTest1",
+			Name:        "Device 1",
+			DeviceModel: "/devicemodels/Model2",
+			Note:        "This is a test device",
+			Serial:      "ABC123",
+			Version:     2,
+		}, nil
+	}
+
+	testsList := []struct {
+		name        string
+		path        string
+		contentType string
+		ifMatch     string
+		body        string
+		updateErr   error
+		wantCode    int
+		wantDevice  *models.Device
+	}{
+		{
+			name:        "PatchNote",
+			path:        "/api/devices/idTest1",
+			contentType: "application/merge-patch+json",
+			body:        `{"note":"Moved to the second floor"}`,
+			wantCode:    http.StatusOK,
+			wantDevice: &models.Device{
+				ID: "/devices/idTest1", Name: "Device 1", DeviceModel: "/devicemodels/Model2",
+				Note: "Moved to the second floor", Serial: "ABC123", Version: 3,
+			},
+		},
+		{
+			name:        "NullClearsField",
+			path:        "/api/devices/idTest1",
+			contentType: "application/json",
+			ifMatch:     `"2"`,
+			body:        `{"note":null,"serial":"XYZ789"}`,
+			wantCode:    http.StatusOK,
+			wantDevice: &models.Device{
+				ID: "/devices/idTest1", Name: "Device 1", DeviceModel: "/devicemodels/Model2",
+				Serial: "XYZ789", Version: 3,
+			},
+		},
+		{name: "InvalidMergedDevice", path: "/api/devices/idTest1", contentType: "application/merge-patch+json", body: `{"name":null}`, wantCode: http.StatusBadRequest},
+		{name: "ChangedID", path: "/api/devices/idTest1", contentType: "application/merge-patch+json", body: `{"id":"/devices/other"}`, wantCode: http.StatusBadRequest},
+		{name: "NotAnObject", path: "/api/devices/idTest1", contentType: "application/merge-patch+json", body: `["note"]`, wantCode: http.StatusBadRequest},
+		{name: "UnsupportedContentType", path: "/api/devices/idTest1", contentType: "text/plain", body: `{"note":"x"}`, wantCode: http.StatusUnsupportedMediaType},
+		{name: "StaleIfMatch", path: "/api/devices/idTest1", contentType: "application/merge-patch+json", ifMatch: `"1"`, body: `{"note":"x"}`, wantCode: http.StatusPreconditionFailed},
+		{name: "ConcurrentUpdate", path: "/api/devices/idTest1", contentType: "application/merge-patch+json", body: `{"note":"x"}`, updateErr: utils.ErrVersionMismatch, wantCode: http.StatusPreconditionFailed},
+		{name: "NonExistingDevice", path: "/api/devices/idTest2XYZ", contentType: "application/merge-patch+json", body: `{"note":"x"}`, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService.PatchDeviceFunc = func(ctx context.Context, id string, version int64, patch func(device *models.Device) error) (*models.Device, error) {
+				device, err := mockService.GetDevice(ctx, id)
+				if err != nil {
+					return nil, err
+				}
+				if version != 0 && version != device.Version {
+					return nil, utils.ErrVersionMismatch
+				}
+				if err := patch(device); err != nil {
+					return nil, err
+				}
+				if tt.updateErr != nil {
+					return nil, tt.updateErr
+				}
+				device.Version = 3
+				return device, nil
+			}
+
+			req, err := http.NewRequest("PATCH", tt.path, bytes.NewBufferString(tt.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.PatchDevice(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("unexpected status code: got %v, want %v: %s", rr.Code, tt.wantCode, rr.Body.String())
+			}
+			if tt.wantDevice == nil {
+				return
+			}
+
+			var responseDevice models.Device
+			if err := json.NewDecoder(rr.Body).Decode(&responseDevice); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if responseDevice != *tt.wantDevice {
+				t.Errorf("unexpected response device: got %v, want %v", responseDevice, *tt.wantDevice)
+			}
+			if etag := rr.Header().Get("ETag"); etag != `"3"` {
+				t.Errorf("unexpected ETag: got %v, want %v", etag, `"3"`)
+			}
+		})
+	}
+}
+
+func TestDeviceHandler_BatchDevices(t *testing.T) {
+	mockService := &MockDeviceService{}
+	handler := NewDeviceHandler(mockService)
+
+	t.Run("PerItemResults", func(t *testing.T) {
+		mockService.WriteDevicesFunc = func(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error) {
+			if len(ops) != 3 || atomic {
+				t.Errorf("unexpected batch: got %v operations, atomic %v", len(ops), atomic)
+			}
+			created := ops[0].Device
+			created.Version = 1
+			return []repositories.BatchResult{
+				{Device: &created},
+				{Err: utils.ErrVersionMismatch},
+				{},
+			}, nil
+		}
+
+		reqBody := `{"operations":[
+			{"op":"create","device":{"id":"/devices/id1","name":"Device 1","deviceModel":"/devicemodels/Model2","serial":"ABC123"}},
+			{"op":"update","device":{"id":"/devices/id2","name":"Device 2","deviceModel":"/devicemodels/Model2","serial":"DEF456","version":4}},
+			{"op":"delete","device":{"id":"/devices/id3"}}
+		]}`
+		req, err := http.NewRequest("POST", "/api/devices:batch", bytes.NewBufferString(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.BatchDevices(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		var response models.DeviceBatchResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		wantStatus := []int{http.StatusCreated, http.StatusPreconditionFailed, http.StatusNoContent}
+		for i, result := range response.Results {
+			if result.Status != wantStatus[i] {
+				t.Errorf("unexpected status of operation %d: got %v, want %v", i, result.Status, wantStatus[i])
+			}
+		}
+		if response.Failed != 1 {
+			t.Errorf("unexpected failed count: got %v, want %v", response.Failed, 1)
+		}
+		if response.Results[0].Device == nil || response.Results[0].Device.Version != 1 {
+			t.Errorf("unexpected created device: got %v", response.Results[0].Device)
+		}
+	})
+
+	t.Run("InvalidDevice", func(t *testing.T) {
+		mockService.WriteDevicesFunc = func(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error) {
+			t.Errorf("an invalid batch should not be written")
+			return nil, nil
+		}
+
+		reqBody := `{"atomic":true,"operations":[{"op":"delete","device":{"id":"devices-id3"}}]}`
+		req, err := http.NewRequest("POST", "/api/devices:batch", bytes.NewBufferString(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.BatchDevices(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("InvalidBatch", func(t *testing.T) {
+		mockService.WriteDevicesFunc = func(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error) {
+			return nil, utils.ErrInvalidBatch
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices:batch", bytes.NewBufferString(`{"operations":[]}`))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.BatchDevices(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
 func TestDeviceHandler_DeleteDevice(t *testing.T) {
 	mockService := &MockDeviceService{}
 	handler := NewDeviceHandler(mockService)
 
 	t.Run("DeleteExistingDevice", func(t *testing.T) {
-		mockService.DeleteDeviceFunc = func(id string) error {
+		mockService.DeleteDeviceFunc = func(ctx context.Context, id string, version int64, deletedBy string) error {
+			if deletedBy != "alice" {
+				t.Errorf("unexpected deletedBy: got %v, want %v", deletedBy, "alice")
+			}
 			return nil
 		}
 
@@ -309,6 +756,7 @@ func TestDeviceHandler_DeleteDevice(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to create request: %v", err)
 		}
+		req.Header.Set("X-Operator", "alice")
 
 		rr := httptest.NewRecorder()
 		handler.DeleteDevice(rr, req)
@@ -319,7 +767,7 @@ func TestDeviceHandler_DeleteDevice(t *testing.T) {
 	})
 
 	t.Run("NonExistingDevice", func(t *testing.T) {
-		mockService.DeleteDeviceFunc = func(id string) error {
+		mockService.DeleteDeviceFunc = func(ctx context.Context, id string, version int64, deletedBy string) error {
 			return utils.ErrDeviceNotFound
 		}
 
@@ -335,4 +783,125 @@ func TestDeviceHandler_DeleteDevice(t *testing.T) {
 			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusNotFound)
 		}
 	})
+
+	t.Run("StaleVersion", func(t *testing.T) {
+		mockService.DeleteDeviceFunc = func(ctx context.Context, id string, version int64, deletedBy string) error {
+			if version != 1 {
+				t.Errorf("unexpected expected version: got %v, want %v", version, 1)
+			}
+			return utils.ErrVersionMismatch
+		}
+
+		req, err := http.NewRequest("DELETE", "/api/devices/idTest1", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("If-Match", `"1"`)
+
+		rr := httptest.NewRecorder()
+		handler.DeleteDevice(rr, req)
+
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusPreconditionFailed)
+		}
+	})
+}
+
+func TestDeviceHandler_ListDeletedDevices(t *testing.T) {
+	mockService := &MockDeviceService{}
+	handler := NewDeviceHandler(mockService)
+
+	mockService.ListDevicesFunc = func(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+		if !opts.Deleted || opts.Limit != 10 {
+			t.Errorf("unexpected options: got %+v, want the trash with limit 10", opts)
+		}
+		return &models.DevicePage{Items: []*models.Device{{ID: "/devices/idTest1", DeletedAt: "2024-05-01T12:00:00Z", DeletedBy: "alice"}}}, nil
+	}
+
+	req, err := http.NewRequest("GET", "/api/devices/trash?limit=10", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ListDeletedDevices(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	var page models.DevicePage
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].DeletedBy != "alice" {
+		t.Errorf("unexpected page: got %v", page.Items)
+	}
+
+	// The trash answers the errors of a listing like ListDevices does.
+	mockService.ListDevicesFunc = func(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+		return nil, utils.ErrInvalidCursor
+	}
+	for _, target := range []string{"/api/devices/trash?cursor=bogus", "/api/devices/trash?limit=0"} {
+		req = httptest.NewRequest("GET", target, nil)
+		rr = httptest.NewRecorder()
+		handler.ListDeletedDevices(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status code: got %v, want %v", target, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDeviceHandler_DeviceAction(t *testing.T) {
+	mockService := &MockDeviceService{}
+	handler := NewDeviceHandler(mockService)
+
+	mockService.RestoreDeviceFunc = func(ctx context.Context, id string, version int64) (*models.Device, error) {
+		switch {
+		case id == "/devices/idTest2":
+			return nil, utils.ErrDeviceNotDeleted
+		case id != "/devices/idTest1":
+			return nil, utils.ErrDeviceNotFound
+		case version != 0 && version != 4:
+			return nil, utils.ErrVersionMismatch
+		}
+		return &models.Device{ID: id, Name: "Device 1", Version: 5}, nil
+	}
+
+	testsList := []struct {
+		name     string
+		id       string
+		ifMatch  string
+		wantCode int
+		wantETag string
+	}{
+		{name: "Restore", id: "idTest1:restore", ifMatch: `"4"`, wantCode: http.StatusOK, wantETag: `"5"`},
+		{name: "RestoreStaleVersion", id: "idTest1:restore", ifMatch: `"3"`, wantCode: http.StatusPreconditionFailed},
+		{name: "RestoreLiveDevice", id: "idTest2:restore", wantCode: http.StatusConflict},
+		{name: "RestoreNonExistingDevice", id: "idTest3:restore", wantCode: http.StatusNotFound},
+		{name: "UnknownAction", id: "idTest1:archive", wantCode: http.StatusNotFound},
+		{name: "NoAction", id: "idTest1", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/devices/"+tt.id, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.SetPathValue("id", tt.id)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.DeviceAction(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+			if etag := rr.Header().Get("ETag"); etag != tt.wantETag {
+				t.Errorf("unexpected ETag: got %v, want %v", etag, tt.wantETag)
+			}
+		})
+	}
 }
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"strconv"
+	"strings"
+)
+
+type DeviceModelHandler struct {
+	service services.DeviceModelService
+}
+
+func NewDeviceModelHandler(service services.DeviceModelService) *DeviceModelHandler {
+	return &DeviceModelHandler{service: service}
+}
+
+func (h *DeviceModelHandler) CreateDeviceModel(w http.ResponseWriter, r *http.Request) {
+	var model models.DeviceModel
+	if !decodeBody(w, r, &model) {
+		return
+	}
+
+	if err := validateDeviceModel(model); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The repository refuses an existing ID in the same step as the write, so two concurrent creates can not both
+	// succeed.
+	createdModel, err := h.service.CreateDeviceModel(r.Context(), &model)
+	if err != nil {
+		writeDeviceModelError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, createdModel, http.StatusCreated)
+}
+
+func (h *DeviceModelHandler) GetDeviceModel(w http.ResponseWriter, r *http.Request) {
+	id := "/devicemodels/" + getDeviceIDFromRequest(r)
+	model, err := h.service.GetDeviceModel(r.Context(), id)
+	if err != nil {
+		writeDeviceModelError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, model, http.StatusOK)
+}
+
+func (h *DeviceModelHandler) ListDeviceModels(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	modelQuery := repositories.DeviceModelQuery{Cursor: query.Get("cursor")}
+
+	var err error
+	if modelQuery.Limit, err = parseLimit(query.Get("limit")); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.service.ListDeviceModels(r.Context(), modelQuery)
+	if err != nil {
+		writeDeviceModelError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, page, http.StatusOK)
+}
+
+func (h *DeviceModelHandler) UpdateDeviceModel(w http.ResponseWriter, r *http.Request) {
+	id := "/devicemodels/" + getDeviceIDFromRequest(r)
+	var updatedModel models.DeviceModel
+	if !decodeBody(w, r, &updatedModel) {
+		return
+	}
+
+	updatedModel.ID = id
+	if err := validateDeviceModel(updatedModel); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err := h.service.UpdateDeviceModel(r.Context(), id, &updatedModel)
+	if err != nil {
+		writeDeviceModelError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, model, http.StatusOK)
+}
+
+// DeleteDeviceModel refuses to delete a model that is still in use, unless ?cascade=true deletes its devices too.
+func (h *DeviceModelHandler) DeleteDeviceModel(w http.ResponseWriter, r *http.Request) {
+	id := "/devicemodels/" + getDeviceIDFromRequest(r)
+
+	cascade := false
+	if value := r.URL.Query().Get("cascade"); value != "" {
+		var err error
+		if cascade, err = strconv.ParseBool(value); err != nil {
+			utils.ErrorJSONFormat(w, "invalid cascade, It must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.service.DeleteDeviceModel(r.Context(), id, cascade); err != nil {
+		writeDeviceModelError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, nil, http.StatusNoContent)
+}
+
+func writeDeviceModelError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, utils.ErrDeviceModelNotFound):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, utils.ErrDeviceModelDuplicate):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, utils.ErrDeviceModelInUse):
+		utils.ErrorJSONFormat(w, err.Error()+", delete them first or use ?cascade=true", http.StatusConflict)
+	case errors.Is(err, utils.ErrInvalidCursor):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+	default:
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func validateDeviceModel(model models.DeviceModel) error {
+	var errorMessages []string
+
+	deviceModelRegex := regexp.MustCompile(`^/devicemodels/[A-Za-z0-9]+$`)
+	if !deviceModelRegex.MatchString(model.ID) {
+		errorMessages = append(errorMessages, "invalid ID format, It must be in the format '/devicemodels/alphanumeric'")
+	}
+
+	if model.Name == "" {
+		errorMessages = append(errorMessages, "device model name is required")
+	}
+
+	if model.Manufacturer == "" {
+		errorMessages = append(errorMessages, "manufacturer is required")
+	}
+
+	for name := range model.Specs {
+		if strings.TrimSpace(name) == "" {
+			errorMessages = append(errorMessages, "spec names must not be empty")
+			break
+		}
+	}
+
+	if len(errorMessages) > 0 {
+		return errors.New(strings.Join(errorMessages, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"testing"
+)
+
+type MockDeviceModelService struct {
+	GetDeviceModelFunc    func(ctx context.Context, id string) (*models.DeviceModel, error)
+	ListDeviceModelsFunc  func(ctx context.Context, query repositories.DeviceModelQuery) (*models.DeviceModelPage, error)
+	CreateDeviceModelFunc func(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error)
+	UpdateDeviceModelFunc func(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error)
+	DeleteDeviceModelFunc func(ctx context.Context, id string, cascade bool) error
+}
+
+func (m *MockDeviceModelService) GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error) {
+	return m.GetDeviceModelFunc(ctx, id)
+}
+
+func (m *MockDeviceModelService) ListDeviceModels(ctx context.Context, query repositories.DeviceModelQuery) (*models.DeviceModelPage, error) {
+	return m.ListDeviceModelsFunc(ctx, query)
+}
+
+func (m *MockDeviceModelService) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	return m.CreateDeviceModelFunc(ctx, model)
+}
+
+func (m *MockDeviceModelService) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	return m.UpdateDeviceModelFunc(ctx, id, model)
+}
+
+func (m *MockDeviceModelService) DeleteDeviceModel(ctx context.Context, id string, cascade bool) error {
+	return m.DeleteDeviceModelFunc(ctx, id, cascade)
+}
+
+func TestDeviceModelHandler_CreateDeviceModel(t *testing.T) {
+	mockService := &MockDeviceModelService{}
+	handler := NewDeviceModelHandler(mockService)
+
+	t.Run("CreateDeviceModel", func(t *testing.T) {
+		newModel := &models.DeviceModel{
+			ID:           "/devicemodels/id1",
+			Name:         "Thermal camera",
+			Manufacturer: "Acme",
+			Category:     "Camera",
+			Specs:        map[string]string{"resolution": "640x480"},
+		}
+
+		mockService.CreateDeviceModelFunc = func(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+			return model, nil
+		}
+
+		reqBody, err := json.Marshal(newModel)
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devicemodels", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateDeviceModel(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusCreated)
+		}
+
+		var responseModel models.DeviceModel
+		if err := json.NewDecoder(rr.Body).Decode(&responseModel); err != nil {
+			t.Errorf("failed to decode response: %v", err)
+		}
+		if !reflect.DeepEqual(responseModel, *newModel) {
+			t.Errorf("unexpected response model: got %v, want %v", responseModel, *newModel)
+		}
+	})
+
+	t.Run("DuplicateDeviceModel", func(t *testing.T) {
+		existingModel := &models.DeviceModel{ID: "/devicemodels/id1", Name: "Thermal camera", Manufacturer: "Acme"}
+		mockService.CreateDeviceModelFunc = func(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+			return nil, utils.ErrDeviceModelDuplicate
+		}
+
+		reqBody, err := json.Marshal(existingModel)
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devicemodels", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateDeviceModel(rr, req)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("ValidateDeviceModel", func(t *testing.T) {
+		reqBody, err := json.Marshal(models.DeviceModel{ID: "Bad id1", Name: "Thermal camera"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devicemodels", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateDeviceModel(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestDeviceModelHandler_GetDeviceModel(t *testing.T) {
+	mockService := &MockDeviceModelService{}
+	handler := NewDeviceModelHandler(mockService)
+
+	t.Run("NonExistingDeviceModel", func(t *testing.T) {
+		mockService.GetDeviceModelFunc = func(ctx context.Context, id string) (*models.DeviceModel, error) {
+			if id != "/devicemodels/id9" {
+				t.Errorf("unexpected device model ID: got %v, want %v", id, "/devicemodels/id9")
+			}
+			return nil, utils.ErrDeviceModelNotFound
+		}
+
+		req, err := http.NewRequest("GET", "/api/devicemodels/id9", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.GetDeviceModel(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestDeviceModelHandler_UpdateDeviceModel(t *testing.T) {
+	mockService := &MockDeviceModelService{}
+	handler := NewDeviceModelHandler(mockService)
+
+	t.Run("NonExistingDeviceModel", func(t *testing.T) {
+		mockService.UpdateDeviceModelFunc = func(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+			return nil, utils.ErrDeviceModelNotFound
+		}
+
+		reqBody, err := json.Marshal(models.DeviceModel{Name: "Thermal camera", Manufacturer: "Acme"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("PUT", "/api/devicemodels/id9", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.UpdateDeviceModel(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestDeviceModelHandler_DeleteDeviceModel(t *testing.T) {
+	mockService := &MockDeviceModelService{}
+	handler := NewDeviceModelHandler(mockService)
+
+	testsList := []struct {
+		name        string
+		url         string
+		err         error
+		wantCascade bool
+		wantCode    int
+	}{
+		{name: "DeleteUnusedDeviceModel", url: "/api/devicemodels/id1", wantCode: http.StatusNoContent},
+		{name: "DeviceModelInUse", url: "/api/devicemodels/id1", err: utils.ErrDeviceModelInUse, wantCode: http.StatusConflict},
+		{name: "Cascade", url: "/api/devicemodels/id1?cascade=true", wantCascade: true, wantCode: http.StatusNoContent},
+		{name: "InvalidCascade", url: "/api/devicemodels/id1?cascade=maybe", wantCode: http.StatusBadRequest},
+		{name: "NonExistingDeviceModel", url: "/api/devicemodels/id9", err: utils.ErrDeviceModelNotFound, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService.DeleteDeviceModelFunc = func(ctx context.Context, id string, cascade bool) error {
+				if cascade != tt.wantCascade {
+					t.Errorf("unexpected cascade: got %v, want %v", cascade, tt.wantCascade)
+				}
+				return tt.err
+			}
+
+			req, err := http.NewRequest("DELETE", tt.url, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.DeleteDeviceModel(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"strings"
+)
+
+type DeviceStateLogHandler struct {
+	service services.DeviceStateLogService
+}
+
+func NewDeviceStateLogHandler(service services.DeviceStateLogService) *DeviceStateLogHandler {
+	return &DeviceStateLogHandler{service: service}
+}
+
+func (h *DeviceStateLogHandler) CreateLog(w http.ResponseWriter, r *http.Request) {
+	var log models.DeviceStateLog
+	if !decodeBody(w, r, &log) {
+		return
+	}
+
+	log.DeviceID = "/devices/" + getDeviceIDFromRequest(r)
+	if err := validateDeviceStateLog(log); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	createdLog, err := h.service.CreateLog(r.Context(), &log)
+	if err != nil {
+		writeLogError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, createdLog, http.StatusCreated)
+}
+
+func (h *DeviceStateLogHandler) ListLogs(w http.ResponseWriter, r *http.Request) {
+	deviceID := "/devices/" + getDeviceIDFromRequest(r)
+	query := r.URL.Query()
+	logQuery := repositories.LogQuery{
+		State:  query.Get("state"),
+		From:   query.Get("from"),
+		To:     query.Get("to"),
+		Cursor: query.Get("cursor"),
+	}
+
+	var err error
+	if logQuery.Limit, err = parseLimit(query.Get("limit")); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.service.ListLogs(r.Context(), deviceID, logQuery)
+	if err != nil {
+		writeLogError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, page, http.StatusOK)
+}
+
+// ListEscalations serves the inbox of a supervisor: the logs escalated to the assignee, newest first.
+// Example: /api/escalations?assignee=supervisor1&state=Critical&since=2024-03-24T00:00:00Z
+func (h *DeviceStateLogHandler) ListEscalations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	escalationQuery := repositories.EscalationQuery{
+		Assignee: query.Get("assignee"),
+		State:    query.Get("state"),
+		Since:    query.Get("since"),
+		Cursor:   query.Get("cursor"),
+	}
+	if escalationQuery.Assignee == "" {
+		utils.ErrorJSONFormat(w, "assignee is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if escalationQuery.Limit, err = parseLimit(query.Get("limit")); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.service.ListEscalations(r.Context(), escalationQuery)
+	if err != nil {
+		writeLogError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, page, http.StatusOK)
+}
+
+func writeLogError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, utils.ErrDeviceNotFound):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, utils.ErrInvalidDate), errors.Is(err, utils.ErrInvalidCursor),
+		errors.Is(err, utils.ErrUnknownState), errors.Is(err, utils.ErrTransitionRequires),
+		errors.Is(err, utils.ErrLogBeforeLatest):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, utils.ErrIllegalTransition), errors.Is(err, utils.ErrStateChanged):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusConflict)
+	default:
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func validateDeviceStateLog(log models.DeviceStateLog) error {
+	var errorMessages []string
+
+	deviceIDRegex := regexp.MustCompile(`^/devices/[A-Za-z0-9]+$`)
+	if !deviceIDRegex.MatchString(log.DeviceID) {
+		errorMessages = append(errorMessages, "invalid ID format, It must be in the format '/devices/alphanumeric'")
+	}
+
+	// The state is part of the State#Date sort key, so it must not contain the separator.
+	stateRegex := regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	if !stateRegex.MatchString(log.State) {
+		errorMessages = append(errorMessages, "invalid state format, It's must be alphameric format")
+	}
+
+	if log.Operator == "" {
+		errorMessages = append(errorMessages, "operator is required")
+	}
+
+	if len(errorMessages) > 0 {
+		return errors.New(strings.Join(errorMessages, "; "))
+	}
+
+	return nil
+}
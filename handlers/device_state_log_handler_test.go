@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"testing"
+)
+
+type MockDeviceStateLogService struct {
+	CreateLogFunc func(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error)
+	ListLogsFunc  func(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error)
+
+	ListEscalationsFunc func(ctx context.Context, query repositories.EscalationQuery) (*models.EscalationPage, error)
+}
+
+func (m *MockDeviceStateLogService) CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	return m.CreateLogFunc(ctx, log)
+}
+
+func (m *MockDeviceStateLogService) ListLogs(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error) {
+	return m.ListLogsFunc(ctx, deviceID, query)
+}
+
+func (m *MockDeviceStateLogService) ListEscalations(ctx context.Context, query repositories.EscalationQuery) (*models.EscalationPage, error) {
+	return m.ListEscalationsFunc(ctx, query)
+}
+
+func TestDeviceStateLogHandler_CreateLog(t *testing.T) {
+	mockService := &MockDeviceStateLogService{}
+	handler := NewDeviceStateLogHandler(mockService)
+
+	t.Run("CreateLog", func(t *testing.T) {
+		mockService.CreateLogFunc = func(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+			if log.DeviceID != "/devices/id1" {
+				t.Errorf("unexpected device ID: got %v, want %v", log.DeviceID, "/devices/id1")
+			}
+			return log, nil
+		}
+
+		reqBody, err := json.Marshal(models.DeviceStateLog{State: "Critical", Operator: "operator1", EscalatedTo: "supervisor1"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices/id1/logs", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateLog(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusCreated)
+		}
+	})
+
+	t.Run("InvalidState", func(t *testing.T) {
+		reqBody, err := json.Marshal(models.DeviceStateLog{State: "Bad#State", Operator: "operator1"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices/id1/logs", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateLog(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("IllegalTransition", func(t *testing.T) {
+		mockService.CreateLogFunc = func(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+			return nil, fmt.Errorf("%w from Normal to Critical", utils.ErrIllegalTransition)
+		}
+
+		reqBody, err := json.Marshal(models.DeviceStateLog{State: "Critical", Operator: "operator1"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices/id1/logs", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateLog(rr, req)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("StateChanged", func(t *testing.T) {
+		mockService.CreateLogFunc = func(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+			return nil, utils.ErrStateChanged
+		}
+
+		reqBody, err := json.Marshal(models.DeviceStateLog{State: "Warning", Operator: "operator1"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices/id1/logs", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateLog(rr, req)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("NonExistingDevice", func(t *testing.T) {
+		mockService.CreateLogFunc = func(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+			return nil, utils.ErrDeviceNotFound
+		}
+
+		reqBody, err := json.Marshal(models.DeviceStateLog{State: "Normal", Operator: "operator1"})
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/devices/id2/logs", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.CreateLog(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestDeviceStateLogHandler_ListLogs(t *testing.T) {
+	mockService := &MockDeviceStateLogService{}
+	handler := NewDeviceStateLogHandler(mockService)
+
+	t.Run("ListLogs", func(t *testing.T) {
+		var gotQuery repositories.LogQuery
+		mockService.ListLogsFunc = func(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error) {
+			gotQuery = query
+			return &models.DeviceStateLogPage{Items: []*models.DeviceStateLog{{DeviceID: deviceID, State: "Critical"}}}, nil
+		}
+
+		req, err := http.NewRequest("GET", "/api/devices/id1/logs?state=Critical&from=2024-03-24T00:00:00Z&to=2024-03-25T00:00:00Z&limit=10", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListLogs(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+		want := repositories.LogQuery{State: "Critical", From: "2024-03-24T00:00:00Z", To: "2024-03-25T00:00:00Z", Limit: 10}
+		if gotQuery != want {
+			t.Errorf("unexpected query: got %+v, want %+v", gotQuery, want)
+		}
+
+		var responsePage models.DeviceStateLogPage
+		if err := json.NewDecoder(rr.Body).Decode(&responsePage); err != nil {
+			t.Errorf("failed to decode response: %v", err)
+		}
+		if len(responsePage.Items) != 1 {
+			t.Errorf("unexpected response page: got %+v", responsePage)
+		}
+	})
+
+	t.Run("InvalidDate", func(t *testing.T) {
+		mockService.ListLogsFunc = func(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error) {
+			return nil, utils.ErrInvalidDate
+		}
+
+		req, err := http.NewRequest("GET", "/api/devices/id1/logs?from=yesterday", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListLogs(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestDeviceStateLogHandler_ListEscalations(t *testing.T) {
+	mockService := &MockDeviceStateLogService{}
+	handler := NewDeviceStateLogHandler(mockService)
+
+	t.Run("ListEscalations", func(t *testing.T) {
+		var gotQuery repositories.EscalationQuery
+		mockService.ListEscalationsFunc = func(ctx context.Context, query repositories.EscalationQuery) (*models.EscalationPage, error) {
+			gotQuery = query
+			return &models.EscalationPage{Items: []*models.Escalation{{
+				DeviceStateLog: models.DeviceStateLog{DeviceID: "/devices/id1", State: "Critical", EscalatedTo: query.Assignee},
+				DeviceName:     "Camera",
+				DeviceSerial:   "A020000103",
+			}}}, nil
+		}
+
+		req, err := http.NewRequest("GET", "/api/escalations?assignee=supervisor1&state=Critical&since=2024-03-24T00:00:00Z", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListEscalations(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+		want := repositories.EscalationQuery{Assignee: "supervisor1", State: "Critical", Since: "2024-03-24T00:00:00Z"}
+		if gotQuery != want {
+			t.Errorf("unexpected query: got %+v, want %+v", gotQuery, want)
+		}
+
+		var responsePage models.EscalationPage
+		if err := json.NewDecoder(rr.Body).Decode(&responsePage); err != nil {
+			t.Errorf("failed to decode response: %v", err)
+		}
+		if len(responsePage.Items) != 1 || responsePage.Items[0].DeviceName != "Camera" || responsePage.Items[0].State != "Critical" {
+			t.Errorf("unexpected response page: got %+v", responsePage)
+		}
+	})
+
+	t.Run("MissingAssignee", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/api/escalations?state=Critical", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ListEscalations(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"strings"
+)
+
+// TenantHeader names the tenant of a request when tenants are not bound to tokens.
+const TenantHeader = "X-Tenant-ID"
+
+// TenantConfig tells how a request finds its tenant.
+type TenantConfig struct {
+	// Tokens maps the bearer tokens to the tenant they act for. When there are any, every request needs one, and
+	// X-Tenant-ID can only repeat the tenant of the token.
+	Tokens map[string]string
+	// Default is the tenant of the requests that name none, when there are no tokens. Empty to require one.
+	Default string
+	// TrustHeader takes the tenant from X-Tenant-ID when there are no tokens. Any client can set the header, so
+	// it keeps the tenants apart by convention only. Otherwise X-Tenant-ID can only name Default.
+	TrustHeader bool
+	// AdminToken is the bearer token of the admin endpoints. Empty to disable them.
+	AdminToken string
+}
+
+type TenantHandler struct {
+	service services.TenantService
+	config  TenantConfig
+	// tokens maps the SHA-256 of the tokens of config to their tenant. A token is looked up by its hash, so the time
+	// a lookup takes tells nothing about how much of a token a guess got right.
+	tokens map[[sha256.Size]byte]string
+}
+
+func NewTenantHandler(service services.TenantService, config TenantConfig) *TenantHandler {
+	tokens := make(map[[sha256.Size]byte]string, len(config.Tokens))
+	for token, tenant := range config.Tokens {
+		tokens[sha256.Sum256([]byte(token))] = tenant
+	}
+	config.Tokens = nil
+	return &TenantHandler{service: service, config: config, tokens: tokens}
+}
+
+// Resolve runs next with the tenant of the request in its context, see utils.WithTenant. Every repository reads
+// the tenant from there, so a request can only reach the records of its own tenant.
+func (h *TenantHandler) Resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := h.tenantOf(r)
+		if err != nil {
+			writeTenantError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(utils.WithTenant(r.Context(), tenant)))
+	})
+}
+
+func (h *TenantHandler) tenantOf(r *http.Request) (string, error) {
+	header := r.Header.Get(TenantHeader)
+	if len(h.tokens) > 0 {
+		token, ok := bearerToken(r)
+		if !ok {
+			return "", utils.ErrTenantRequired
+		}
+		tenant, ok := h.tokens[sha256.Sum256([]byte(token))]
+		if !ok {
+			return "", utils.ErrInvalidToken
+		}
+		if header != "" && header != tenant {
+			return "", utils.ErrTenantMismatch
+		}
+		return tenant, nil
+	}
+
+	if header == "" {
+		if h.config.Default == "" {
+			return "", utils.ErrTenantRequired
+		}
+		return h.config.Default, nil
+	}
+	if err := utils.ValidateTenant(header); err != nil {
+		return "", err
+	}
+	if !h.config.TrustHeader && header != h.config.Default {
+		return "", utils.ErrTenantHeader
+	}
+	return header, nil
+}
+
+// bearerToken returns the token of the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+// RequireAdmin runs next only for the requests that carry the admin token.
+func (h *TenantHandler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if h.config.AdminToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.config.AdminToken)) != 1 {
+			writeTenantError(w, utils.ErrAdminRequired)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *TenantHandler) ListTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := h.service.ListTenants(r.Context())
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, tenants, http.StatusOK)
+}
+
+func (h *TenantHandler) GetTenant(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	if err := utils.ValidateTenant(tenant); err != nil {
+		writeTenantError(w, err)
+		return
+	}
+
+	usage, err := h.service.GetTenant(r.Context(), tenant)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, usage, http.StatusOK)
+}
+
+func writeTenantError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, utils.ErrTenantRequired), errors.Is(err, utils.ErrInvalidToken), errors.Is(err, utils.ErrAdminRequired):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, utils.ErrTenantMismatch), errors.Is(err, utils.ErrTenantHeader):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, utils.ErrInvalidTenant):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, utils.ErrTenantNotFound):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, repositories.ErrTenantUsageUnsupported):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusNotImplemented)
+	default:
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"testing"
+)
+
+type MockTenantService struct {
+	ListTenantsFunc func(ctx context.Context) ([]models.TenantUsage, error)
+	GetTenantFunc   func(ctx context.Context, tenant string) (*models.TenantUsage, error)
+}
+
+func (m *MockTenantService) ListTenants(ctx context.Context) ([]models.TenantUsage, error) {
+	return m.ListTenantsFunc(ctx)
+}
+
+func (m *MockTenantService) GetTenant(ctx context.Context, tenant string) (*models.TenantUsage, error) {
+	return m.GetTenantFunc(ctx, tenant)
+}
+
+func TestTenantHandler_Resolve(t *testing.T) {
+	tokens := map[string]string{"token-a": "tenant-a", "token-b": "tenant-b"}
+	tests := []struct {
+		name          string
+		config        TenantConfig
+		authorization string
+		header        string
+		wantCode      int
+		wantTenant    string
+	}{
+		{"Header", TenantConfig{TrustHeader: true}, "", "tenant-a", http.StatusOK, "tenant-a"},
+		{"DefaultTenant", TenantConfig{Default: "default"}, "", "", http.StatusOK, "default"},
+		{"MissingTenant", TenantConfig{TrustHeader: true}, "", "", http.StatusUnauthorized, ""},
+		{"UntrustedHeader", TenantConfig{Default: "default"}, "", "tenant-a", http.StatusForbidden, ""},
+		{"UntrustedHeaderOfDefaultTenant", TenantConfig{Default: "default"}, "", "default", http.StatusOK, "default"},
+		{"InvalidHeader", TenantConfig{Default: "default"}, "", "tenant#a", http.StatusBadRequest, ""},
+		{"Token", TenantConfig{Tokens: tokens}, "Bearer token-b", "", http.StatusOK, "tenant-b"},
+		{"TokenAndHeader", TenantConfig{Tokens: tokens}, "Bearer token-b", "tenant-b", http.StatusOK, "tenant-b"},
+		{"TokenOfAnotherTenant", TenantConfig{Tokens: tokens}, "Bearer token-b", "tenant-a", http.StatusForbidden, ""},
+		{"UnknownToken", TenantConfig{Tokens: tokens}, "Bearer token-c", "", http.StatusUnauthorized, ""},
+		{"PrefixOfToken", TenantConfig{Tokens: tokens}, "Bearer token-", "", http.StatusUnauthorized, ""},
+		{"HeaderWithoutToken", TenantConfig{Tokens: tokens, Default: "default"}, "", "tenant-a", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tenant string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tenant = utils.TenantFromContext(r.Context())
+			})
+			handler := NewTenantHandler(&MockTenantService{}, tt.config)
+
+			req := httptest.NewRequest("GET", "/api/devices", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.header != "" {
+				req.Header.Set(TenantHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.Resolve(next).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+			if tenant != tt.wantTenant {
+				t.Errorf("unexpected tenant: got %q, want %q", tenant, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func TestNewTenantHandler_HashesTokens(t *testing.T) {
+	handler := NewTenantHandler(&MockTenantService{}, TenantConfig{Tokens: map[string]string{"token-a": "tenant-a"}})
+
+	if handler.config.Tokens != nil {
+		t.Errorf("NewTenantHandler() kept the tokens: %v", handler.config.Tokens)
+	}
+	if tenant := handler.tokens[sha256.Sum256([]byte("token-a"))]; len(handler.tokens) != 1 || tenant != "tenant-a" {
+		t.Errorf("NewTenantHandler() got tokens %v, want the hash of token-a", handler.tokens)
+	}
+}
+
+func TestTenantHandler_Admin(t *testing.T) {
+	usage := []models.TenantUsage{{Tenant: "tenant-a", Devices: 2}, {Tenant: "tenant-b", StateLogs: 1}}
+	mockService := &MockTenantService{
+		ListTenantsFunc: func(ctx context.Context) ([]models.TenantUsage, error) {
+			return usage, nil
+		},
+		GetTenantFunc: func(ctx context.Context, tenant string) (*models.TenantUsage, error) {
+			if tenant != "tenant-a" {
+				return nil, utils.ErrTenantNotFound
+			}
+			return &usage[0], nil
+		},
+	}
+	handler := NewTenantHandler(mockService, TenantConfig{AdminToken: "admin-token"})
+	router := http.NewServeMux()
+	router.HandleFunc("GET /api/admin/tenants", handler.RequireAdmin(handler.ListTenants))
+	router.HandleFunc("GET /api/admin/tenants/{tenant}", handler.RequireAdmin(handler.GetTenant))
+
+	t.Run("ListTenants", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/admin/tenants", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+		var got []models.TenantUsage
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if !reflect.DeepEqual(got, usage) {
+			t.Errorf("unexpected tenants: got %v, want %v", got, usage)
+		}
+	})
+
+	t.Run("GetTenant", func(t *testing.T) {
+		tests := []struct {
+			path     string
+			wantCode int
+		}{
+			{"/api/admin/tenants/tenant-a", http.StatusOK},
+			{"/api/admin/tenants/tenant-z", http.StatusNotFound},
+			{"/api/admin/tenants/Tenant_A", http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Authorization", "Bearer admin-token")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("GET %s: unexpected status code: got %v, want %v", tt.path, rr.Code, tt.wantCode)
+			}
+		}
+	})
+
+	t.Run("RequireAdmin", func(t *testing.T) {
+		for _, authorization := range []string{"", "Bearer token-a", "admin-token"} {
+			req := httptest.NewRequest("GET", "/api/admin/tenants", nil)
+			req.Header.Set("Authorization", authorization)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("Authorization %q: unexpected status code: got %v, want %v", authorization, rr.Code, http.StatusUnauthorized)
+			}
+		}
+
+		disabled := NewTenantHandler(mockService, TenantConfig{})
+		req := httptest.NewRequest("GET", "/api/admin/tenants", nil)
+		req.Header.Set("Authorization", "Bearer ")
+		rr := httptest.NewRecorder()
+		disabled.RequireAdmin(disabled.ListTenants)(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("unexpected status code without an admin token: got %v, want %v", rr.Code, http.StatusUnauthorized)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+)
+
+type WebhookHandler struct {
+	service services.WebhookService
+}
+
+func NewWebhookHandler(service services.WebhookService) *WebhookHandler {
+	return &WebhookHandler{service: service}
+}
+
+// CreateWebhook answers with the secret of the webhook, the only response that shows it.
+func (h *WebhookHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook models.Webhook
+	if !decodeBody(w, r, &webhook) {
+		return
+	}
+
+	if err := validateWebhook(webhook); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := h.service.CreateWebhook(r.Context(), &webhook)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, created, http.StatusCreated)
+}
+
+func (h *WebhookHandler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := h.service.GetWebhook(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, webhook, http.StatusOK)
+}
+
+func (h *WebhookHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	webhookQuery := repositories.WebhookQuery{Cursor: query.Get("cursor")}
+
+	var err error
+	if webhookQuery.Limit, err = parseLimit(query.Get("limit")); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.service.ListWebhooks(r.Context(), webhookQuery)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, page, http.StatusOK)
+}
+
+// DeleteWebhook deletes the webhook with its deliveries.
+func (h *WebhookHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeleteWebhook(r.Context(), r.PathValue("id")); err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, nil, http.StatusNoContent)
+}
+
+// WebhookAction runs the custom method of a webhook, as in POST /api/webhooks/{id}:replay.
+func (h *WebhookHandler) WebhookAction(w http.ResponseWriter, r *http.Request) {
+	webhookID, action, _ := strings.Cut(r.PathValue("id"), ":")
+	switch action {
+	case "replay":
+		h.ReplayDeadDeliveries(w, r, webhookID)
+	default:
+		utils.ErrorJSONFormat(w, "unknown webhook action '"+action+"', It must be one of replay", http.StatusNotFound)
+	}
+}
+
+// ReplayDeadDeliveries sends the dead deliveries of a webhook again, and answers with how many it replayed.
+func (h *WebhookHandler) ReplayDeadDeliveries(w http.ResponseWriter, r *http.Request, webhookID string) {
+	replayed, err := h.service.ReplayDeadDeliveries(r.Context(), webhookID)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, models.WebhookReplay{Replayed: replayed}, http.StatusOK)
+}
+
+// ListDeliveries is the delivery log of a webhook, oldest event first. ?status=dead lists its dead letters.
+func (h *WebhookHandler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deliveryQuery := repositories.WebhookDeliveryQuery{Status: query.Get("status"), Cursor: query.Get("cursor")}
+
+	var err error
+	if deliveryQuery.Limit, err = parseLimit(query.Get("limit")); err != nil {
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if deliveryQuery.Status != "" && !slices.Contains(deliveryStatuses, deliveryQuery.Status) {
+		utils.ErrorJSONFormat(w, "invalid status, It must be one of "+strings.Join(deliveryStatuses, ", "), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.service.ListDeliveries(r.Context(), r.PathValue("id"), deliveryQuery)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	utils.JSONFormat(w, page, http.StatusOK)
+}
+
+// DeliveryAction runs the custom method of a delivery, as in POST /api/webhooks/{id}/deliveries/{delivery}:replay.
+func (h *WebhookHandler) DeliveryAction(w http.ResponseWriter, r *http.Request) {
+	deliveryID, action, _ := strings.Cut(r.PathValue("delivery"), ":")
+	switch action {
+	case "replay":
+		delivery, err := h.service.ReplayDelivery(r.Context(), r.PathValue("id"), deliveryID)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+		utils.JSONFormat(w, delivery, http.StatusOK)
+	default:
+		utils.ErrorJSONFormat(w, "unknown delivery action '"+action+"', It must be one of replay", http.StatusNotFound)
+	}
+}
+
+func writeWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, utils.ErrWebhookNotFound), errors.Is(err, utils.ErrDeliveryNotFound):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, utils.ErrDeliveryNotDead):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, utils.ErrInvalidCursor):
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusBadRequest)
+	default:
+		utils.ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var deliveryStatuses = []string{models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead}
+
+// publicHost tells whether host may receive webhooks. The deliverer checks every address it connects to, names
+// included; this only refuses early the URLs that can never be delivered.
+func publicHost(host string) bool {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return services.PublicAddress(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host != "localhost" && !strings.HasSuffix(host, ".localhost")
+}
+
+func validateWebhook(webhook models.Webhook) error {
+	var errorMessages []string
+
+	if target, err := url.Parse(webhook.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		errorMessages = append(errorMessages, "invalid url, It must be an absolute http or https URL")
+	} else if !publicHost(target.Hostname()) {
+		errorMessages = append(errorMessages, "invalid url, It must not name a loopback, private or other special-purpose address")
+	}
+
+	for _, eventType := range webhook.Events {
+		if !slices.Contains(models.EventTypes, eventType) {
+			errorMessages = append(errorMessages, "unknown event '"+eventType+"', It must be one of "+strings.Join(models.EventTypes, ", "))
+			break
+		}
+	}
+
+	if len(errorMessages) > 0 {
+		return errors.New(strings.Join(errorMessages, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"testing"
+)
+
+type MockWebhookService struct {
+	CreateWebhookFunc        func(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error)
+	GetWebhookFunc           func(ctx context.Context, id string) (*models.Webhook, error)
+	ListWebhooksFunc         func(ctx context.Context, query repositories.WebhookQuery) (*models.WebhookPage, error)
+	DeleteWebhookFunc        func(ctx context.Context, id string) error
+	ListDeliveriesFunc       func(ctx context.Context, webhookID string, query repositories.WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error)
+	ReplayDeliveryFunc       func(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error)
+	ReplayDeadDeliveriesFunc func(ctx context.Context, webhookID string) (int, error)
+}
+
+func (m *MockWebhookService) CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+	return m.CreateWebhookFunc(ctx, webhook)
+}
+
+func (m *MockWebhookService) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	return m.GetWebhookFunc(ctx, id)
+}
+
+func (m *MockWebhookService) ListWebhooks(ctx context.Context, query repositories.WebhookQuery) (*models.WebhookPage, error) {
+	return m.ListWebhooksFunc(ctx, query)
+}
+
+func (m *MockWebhookService) DeleteWebhook(ctx context.Context, id string) error {
+	return m.DeleteWebhookFunc(ctx, id)
+}
+
+func (m *MockWebhookService) ListDeliveries(ctx context.Context, webhookID string, query repositories.WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error) {
+	return m.ListDeliveriesFunc(ctx, webhookID, query)
+}
+
+func (m *MockWebhookService) ReplayDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+	return m.ReplayDeliveryFunc(ctx, webhookID, id)
+}
+
+func (m *MockWebhookService) ReplayDeadDeliveries(ctx context.Context, webhookID string) (int, error) {
+	return m.ReplayDeadDeliveriesFunc(ctx, webhookID)
+}
+
+func TestWebhookHandler_CreateWebhook(t *testing.T) {
+	mockService := &MockWebhookService{
+		CreateWebhookFunc: func(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+			webhook.ID, webhook.Secret = "abc123", "secret"
+			return webhook, nil
+		},
+	}
+	handler := NewWebhookHandler(mockService)
+
+	testsList := []struct {
+		name     string
+		webhook  models.Webhook
+		wantCode int
+	}{
+		{name: "CreateWebhook", webhook: models.Webhook{URL: "https://example.com/hook", Events: []string{models.EventStateChanged}}, wantCode: http.StatusCreated},
+		{name: "AllEvents", webhook: models.Webhook{URL: "http://hooks.example.com:8081/hook"}, wantCode: http.StatusCreated},
+		{name: "LoopbackURL", webhook: models.Webhook{URL: "http://127.0.0.1:8081/hook"}, wantCode: http.StatusBadRequest},
+		{name: "LocalhostURL", webhook: models.Webhook{URL: "http://localhost:8081/hook"}, wantCode: http.StatusBadRequest},
+		{name: "MetadataURL", webhook: models.Webhook{URL: "http://169.254.169.254/latest/meta-data"}, wantCode: http.StatusBadRequest},
+		{name: "PrivateIPv6URL", webhook: models.Webhook{URL: "http://[fd00::1]/hook"}, wantCode: http.StatusBadRequest},
+		{name: "CarrierGradeNATURL", webhook: models.Webhook{URL: "http://100.64.0.1/hook"}, wantCode: http.StatusBadRequest},
+		{name: "NAT64URL", webhook: models.Webhook{URL: "http://[64:ff9b::a9fe:a9fe]/hook"}, wantCode: http.StatusBadRequest},
+		{name: "RelativeURL", webhook: models.Webhook{URL: "/hook"}, wantCode: http.StatusBadRequest},
+		{name: "UnsupportedScheme", webhook: models.Webhook{URL: "ftp://example.com/hook"}, wantCode: http.StatusBadRequest},
+		{name: "UnknownEvent", webhook: models.Webhook{URL: "https://example.com/hook", Events: []string{"DeviceRenamed"}}, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			reqBody, err := json.Marshal(tt.webhook)
+			if err != nil {
+				t.Fatalf("failed to marshal request body: %v", err)
+			}
+
+			req, err := http.NewRequest("POST", "/api/webhooks", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.CreateWebhook(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+			if rr.Code == http.StatusCreated {
+				var created models.Webhook
+				if err := json.NewDecoder(rr.Body).Decode(&created); err != nil || created.Secret != "secret" {
+					t.Errorf("unexpected response: got %+v, %v, want the webhook with its secret", created, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookHandler_ListDeliveries(t *testing.T) {
+	mockService := &MockWebhookService{}
+	handler := NewWebhookHandler(mockService)
+
+	testsList := []struct {
+		name       string
+		url        string
+		err        error
+		wantStatus string
+		wantCode   int
+	}{
+		{name: "ListDeliveries", url: "/api/webhooks/abc123/deliveries", wantCode: http.StatusOK},
+		{name: "DeadLetters", url: "/api/webhooks/abc123/deliveries?status=dead", wantStatus: models.DeliveryDead, wantCode: http.StatusOK},
+		{name: "InvalidStatus", url: "/api/webhooks/abc123/deliveries?status=lost", wantCode: http.StatusBadRequest},
+		{name: "InvalidLimit", url: "/api/webhooks/abc123/deliveries?limit=0", wantCode: http.StatusBadRequest},
+		{name: "InvalidCursor", url: "/api/webhooks/abc123/deliveries?cursor=bad", err: utils.ErrInvalidCursor, wantCode: http.StatusBadRequest},
+		{name: "NonExistingWebhook", url: "/api/webhooks/abc123/deliveries", err: utils.ErrWebhookNotFound, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService.ListDeliveriesFunc = func(ctx context.Context, webhookID string, query repositories.WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error) {
+				if webhookID != "abc123" || query.Status != tt.wantStatus {
+					t.Errorf("unexpected query: got %v, %+v", webhookID, query)
+				}
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return &models.WebhookDeliveryPage{Items: []*models.WebhookDelivery{}}, nil
+			}
+
+			req, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.SetPathValue("id", "abc123")
+
+			rr := httptest.NewRecorder()
+			handler.ListDeliveries(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWebhookHandler_Replay(t *testing.T) {
+	mockService := &MockWebhookService{
+		ReplayDeliveryFunc: func(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+			switch id {
+			case "event1":
+				return &models.WebhookDelivery{ID: id, WebhookID: webhookID, Status: models.DeliveryPending}, nil
+			case "event2":
+				return nil, utils.ErrDeliveryNotDead
+			}
+			return nil, utils.ErrDeliveryNotFound
+		},
+		ReplayDeadDeliveriesFunc: func(ctx context.Context, webhookID string) (int, error) {
+			return 2, nil
+		},
+	}
+	handler := NewWebhookHandler(mockService)
+
+	testsList := []struct {
+		name     string
+		delivery string
+		wantCode int
+	}{
+		{name: "ReplayWebhook", wantCode: http.StatusOK},
+		{name: "ReplayDelivery", delivery: "event1:replay", wantCode: http.StatusOK},
+		{name: "DeliveryNotDead", delivery: "event2:replay", wantCode: http.StatusConflict},
+		{name: "NonExistingDelivery", delivery: "event9:replay", wantCode: http.StatusNotFound},
+		{name: "UnknownAction", delivery: "event1:cancel", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/webhooks/abc123", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			if tt.delivery == "" {
+				req.SetPathValue("id", "abc123:replay")
+				handler.WebhookAction(rr, req)
+			} else {
+				req.SetPathValue("id", "abc123")
+				req.SetPathValue("delivery", tt.delivery)
+				handler.DeliveryAction(rr, req)
+			}
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
 	_ "github.com/joho/godotenv/autoload"
@@ -11,18 +14,49 @@ import (
 	"os"
 	"simple-api-go/db"
 	"simple-api-go/handlers"
+	"simple-api-go/models"
 	"simple-api-go/repositories"
 	"simple-api-go/routes"
 	"simple-api-go/services"
+	"simple-api-go/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrInvalidDatabaseType = errors.New("invalid database type")
+	ErrInvalidPurgeAfter   = errors.New("invalid DEVICE_PURGE_AFTER, It must be a positive duration such as 720h")
+	ErrInvalidCacheSize    = errors.New("invalid DEVICE_CACHE_SIZE, It must be a number of devices such as 1000")
+	ErrInvalidCacheTTL     = errors.New("invalid DEVICE_CACHE_TTL or DEVICE_CACHE_NEGATIVE_TTL, It must be a duration such as 30s")
+	ErrInvalidTenantTokens = errors.New("invalid TENANT_TOKENS, It must be token=tenant pairs separated by commas")
+	ErrInvalidTenant       = errors.New("invalid DEFAULT_TENANT, It must be lowercase alphanumeric with dashes")
+	ErrInvalidTrustHeader  = errors.New("invalid TRUST_TENANT_HEADER, It must be true or false")
+	ErrUntrustedHeader     = errors.New("without TENANT_TOKENS and DEFAULT_TENANT the tenants come from X-Tenant-ID, which any client can set: set TRUST_TENANT_HEADER=true to accept that")
+	ErrInvalidDynamoSchema = errors.New("invalid DYNAMODB_SCHEMA, It must be check or reconcile")
+	ErrInvalidDispatch     = errors.New("invalid EVENT_DISPATCH_INTERVAL, It must be a duration such as 1s, or 0 to disable it")
+	ErrInvalidWebhook      = errors.New("invalid WEBHOOK_MAX_ATTEMPTS, WEBHOOK_BACKOFF or WEBHOOK_MAX_BACKOFF, It must be a positive number or duration")
+	ErrInvalidValidation   = errors.New("invalid OPENAPI_VALIDATION, It must be true or false")
 )
 
+// sqlInstance connects once to the database shared by the repositories when DATABASE_TYPE is sql.
+var sqlInstance = sync.OnceValues(db.CreateSQLInstance)
+
 func main() {
 	fmt.Println("Simple API!")
 
+	if os.Getenv("DATABASE_TYPE") == "dynamodb" && os.Getenv("RUNNING_MODE") != "schema" {
+		drift, err := CheckDynamoSchema(context.Background())
+		if err != nil {
+			log.Fatalf("failed to check the DynamoDB tables: %v", err)
+			return
+		}
+		for _, d := range drift {
+			log.Printf("DynamoDB schema drift: %s", d)
+		}
+	}
+
 	//deviceRepo := repositories.NewDeviceMemoryRepository()
 	deviceRepo, err := NewDeviceRepository()
 	if err != nil {
@@ -30,32 +64,520 @@ func main() {
 		return
 	}
 
-	deviceSvc := services.NewDeviceService(deviceRepo)
+	logRepo, err := NewDeviceStateLogRepository()
+	if err != nil {
+		log.Fatalf("failed to connect to the database instance: %v", err)
+		return
+	}
+
+	modelRepo, err := NewDeviceModelRepository()
+	if err != nil {
+		log.Fatalf("failed to connect to the database instance: %v", err)
+		return
+	}
+
+	deviceSvc := services.NewDeviceService(deviceRepo, modelRepo)
 	deviceHandler := handlers.NewDeviceHandler(deviceSvc)
 
-	router := routes.SetupRoutes(deviceHandler)
+	modelSvc := services.NewDeviceModelService(modelRepo, deviceRepo)
+	modelHandler := handlers.NewDeviceModelHandler(modelSvc)
+
+	stateMachine, err := NewStateMachine()
+	if err != nil {
+		log.Fatalf("failed to load the state machine: %v", err)
+		return
+	}
+
+	logSvc := services.NewDeviceStateLogService(logRepo, deviceRepo, stateMachine)
+	logHandler := handlers.NewDeviceStateLogHandler(logSvc)
+
+	tenantConfig, err := NewTenantConfig()
+	if err != nil {
+		log.Fatalf("failed to load the tenants: %v", err)
+		return
+	}
+
+	tenantSvc := services.NewTenantService(deviceRepo, modelRepo, logRepo)
+	tenantHandler := handlers.NewTenantHandler(tenantSvc, tenantConfig)
+
+	webhookRepo, err := NewWebhookRepository()
+	if err != nil {
+		log.Fatalf("failed to connect to the database instance: %v", err)
+		return
+	}
+
+	webhookSvc := services.NewWebhookService(webhookRepo)
+	webhookHandler := handlers.NewWebhookHandler(webhookSvc)
+
+	validate, err := openAPIValidation()
+	if err != nil {
+		log.Fatalf("failed to load the request validation: %v", err)
+		return
+	}
+
+	router := routes.SetupRoutes(deviceHandler, logHandler, modelHandler, tenantHandler, webhookHandler, validate)
+
+	webhookConfig, err := webhookDeliveryConfig()
+	if err != nil {
+		log.Fatalf("failed to load the webhooks: %v", err)
+		return
+	}
+	deliverer := services.NewWebhookDeliverer(webhookRepo, webhookConfig)
+
+	dispatcher := NewEventDispatcher(deviceRepo, logRepo)
+	dispatcher.Subscribe(deliverer)
+	dispatchInterval, err := eventDispatchInterval()
+	if err != nil {
+		log.Fatalf("failed to load the event dispatcher: %v", err)
+		return
+	}
 
 	switch os.Getenv("RUNNING_MODE") {
 	case "local":
+		if dispatchInterval > 0 {
+			go RunEventDispatcher(context.Background(), dispatcher, deliverer, dispatchInterval)
+		}
 		serverInstance := os.Getenv("SERVER_HOST") + ":" + os.Getenv("SERVER_PORT")
 		log.Println("Starting server on " + serverInstance)
 		log.Fatal(http.ListenAndServe(serverInstance, router))
 	case "aws":
 		lambda.Start(httpadapter.New(router).ProxyWithContext)
+	case "dispatch":
+		lambda.Start(func(ctx context.Context) error {
+			delivered, err := dispatcher.Dispatch(ctx)
+			log.Printf("Dispatched %d events", delivered)
+			sent, deliverErr := deliverer.DeliverDue(ctx)
+			log.Printf("Delivered %d webhooks", sent)
+			return errors.Join(err, deliverErr)
+		})
+	case "stream":
+		consumer := services.NewStreamConsumer(dispatcher)
+		// The failed record goes back to the stream as a batch item failure, an error would retry the whole batch.
+		lambda.Start(func(ctx context.Context, batch events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+			response, err := consumer.HandleStream(ctx, batch)
+			if err != nil {
+				log.Printf("failed to handle the stream: %v", err)
+			}
+			return response, nil
+		})
+	case "replay":
+		records, err := ReplayStreamFiles(context.Background(), services.NewStreamConsumer(dispatcher), os.Args[1:])
+		if err != nil {
+			log.Fatalf("failed to replay the stream: %v", err)
+		}
+		log.Printf("Replayed %d stream records", records)
+	case "schema":
+		drift, err := dynamoSchema().Reconcile(context.Background(), db.CreateDynamoDBInstance().Client)
+		if err != nil {
+			log.Fatalf("failed to reconcile the DynamoDB tables: %v", err)
+		}
+		for _, d := range drift {
+			log.Printf("DynamoDB schema drift: %s", d)
+		}
+		if len(drift) > 0 {
+			log.Fatalf("The DynamoDB tables differ from their declaration in ways that need a new table.")
+		}
+		log.Println("The DynamoDB tables match their declaration.")
+	case "migrate":
+		migration, err := MigrateDynamoDB(context.Background())
+		if err != nil {
+			log.Fatalf("failed to migrate the legacy tables: %v", err)
+		}
+		log.Printf("Migrated the legacy tables: %d items copied, %d already in the table, %d devices backfilled", migration.Copied, migration.Skipped, migration.Backfilled)
 	default:
 		log.Fatalf("Could not runnig application.")
 	}
 }
 
+// NewDeviceRepository opens the device repository of DATABASE_TYPE, behind a cache when DEVICE_CACHE_SIZE is set.
 func NewDeviceRepository() (repositories.DeviceRepository, error) {
+	cacheConfig, err := deviceCacheConfig()
+	if err != nil {
+		return nil, err
+	}
+	repo, err := newDeviceBackend()
+	if err != nil {
+		return nil, err
+	}
+	if cacheConfig.Size == 0 {
+		return repo, nil
+	}
+	return repositories.NewDeviceCacheRepository(repo, cacheConfig), nil
+}
+
+func newDeviceBackend() (repositories.DeviceRepository, error) {
+	dbType := os.Getenv("DATABASE_TYPE")
+	switch dbType {
+	case "memory":
+		purgeAfter, err := devicePurgeAfter()
+		if err != nil {
+			return nil, err
+		}
+		repo := repositories.NewDeviceMemoryRepository()
+		repo.SetPurgeAfter(purgeAfter)
+		return repo, nil
+	case "dynamodb":
+		purgeAfter, err := devicePurgeAfter()
+		if err != nil {
+			return nil, err
+		}
+		dbInstance := db.CreateDynamoDBInstance()
+		repo := repositories.NewDynamoDeviceService(dbInstance)
+		repo.SetPurgeAfter(purgeAfter)
+		return repo, nil
+	case "sql":
+		purgeAfter, err := devicePurgeAfter()
+		if err != nil {
+			return nil, err
+		}
+		dbInstance, err := sqlInstance()
+		if err != nil {
+			return nil, err
+		}
+		repo := repositories.NewSQLDeviceRepository(dbInstance)
+		repo.SetPurgeAfter(purgeAfter)
+		return repo, nil
+	case "file":
+		purgeAfter, err := devicePurgeAfter()
+		if err != nil {
+			return nil, err
+		}
+		store, err := db.CreateFileStore("devices")
+		if err != nil {
+			return nil, err
+		}
+		repo, err := repositories.NewDeviceFileRepository(store)
+		if err != nil {
+			return nil, err
+		}
+		repo.SetPurgeAfter(purgeAfter)
+		return repo, nil
+	default:
+		return nil, ErrInvalidDatabaseType
+	}
+}
+
+// devicePurgeAfter reads how long deleted devices stay in the trash from DEVICE_PURGE_AFTER, e.g. 720h.
+func devicePurgeAfter() (time.Duration, error) {
+	value := os.Getenv("DEVICE_PURGE_AFTER")
+	if value == "" {
+		return repositories.DefaultPurgeAfter, nil
+	}
+	purgeAfter, err := time.ParseDuration(value)
+	if err != nil || purgeAfter <= 0 {
+		return 0, ErrInvalidPurgeAfter
+	}
+	return purgeAfter, nil
+}
+
+// deviceCacheConfig reads the size of the device cache from DEVICE_CACHE_SIZE, 0 or unset to go without, and how
+// long entries live from DEVICE_CACHE_TTL and DEVICE_CACHE_NEGATIVE_TTL.
+func deviceCacheConfig() (repositories.DeviceCacheConfig, error) {
+	config := repositories.DeviceCacheConfig{
+		TTL:         repositories.DefaultDeviceCacheTTL,
+		NegativeTTL: repositories.DefaultDeviceCacheNegativeTTL,
+	}
+
+	if value := os.Getenv("DEVICE_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return config, ErrInvalidCacheSize
+		}
+		config.Size = size
+	}
+	if value := os.Getenv("DEVICE_CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return config, ErrInvalidCacheTTL
+		}
+		config.TTL = ttl
+	}
+	if value := os.Getenv("DEVICE_CACHE_NEGATIVE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return config, ErrInvalidCacheTTL
+		}
+		config.NegativeTTL = ttl
+	}
+	return config, nil
+}
+
+func NewDeviceStateLogRepository() (repositories.DeviceStateLogRepository, error) {
+	dbType := os.Getenv("DATABASE_TYPE")
+	switch dbType {
+	case "memory":
+		return repositories.NewDeviceStateLogMemoryRepository(), nil
+	case "dynamodb":
+		dbInstance := db.CreateDynamoDBInstance()
+		return repositories.NewDynamoDeviceStateLogRepository(dbInstance), nil
+	case "sql":
+		dbInstance, err := sqlInstance()
+		if err != nil {
+			return nil, err
+		}
+		return repositories.NewSQLDeviceStateLogRepository(dbInstance), nil
+	case "file":
+		store, err := db.CreateFileStore("device_state_logs")
+		if err != nil {
+			return nil, err
+		}
+		return repositories.NewDeviceStateLogFileRepository(store)
+	default:
+		return nil, ErrInvalidDatabaseType
+	}
+}
+
+func NewDeviceModelRepository() (repositories.DeviceModelRepository, error) {
+	dbType := os.Getenv("DATABASE_TYPE")
+	switch dbType {
+	case "memory":
+		return repositories.NewDeviceModelMemoryRepository(), nil
+	case "dynamodb":
+		dbInstance := db.CreateDynamoDBInstance()
+		return repositories.NewDynamoDeviceModelRepository(dbInstance), nil
+	case "sql":
+		dbInstance, err := sqlInstance()
+		if err != nil {
+			return nil, err
+		}
+		return repositories.NewSQLDeviceModelRepository(dbInstance), nil
+	case "file":
+		store, err := db.CreateFileStore("device_models")
+		if err != nil {
+			return nil, err
+		}
+		return repositories.NewDeviceModelFileRepository(store)
+	default:
+		return nil, ErrInvalidDatabaseType
+	}
+}
+
+func NewWebhookRepository() (repositories.WebhookRepository, error) {
 	dbType := os.Getenv("DATABASE_TYPE")
 	switch dbType {
 	case "memory":
-		return repositories.NewDeviceMemoryRepository(), nil
+		return repositories.NewWebhookMemoryRepository(), nil
 	case "dynamodb":
 		dbInstance := db.CreateDynamoDBInstance()
-		return repositories.NewDynamoDeviceService(dbInstance), nil
+		return repositories.NewDynamoWebhookRepository(dbInstance), nil
+	case "sql":
+		dbInstance, err := sqlInstance()
+		if err != nil {
+			return nil, err
+		}
+		return repositories.NewSQLWebhookRepository(dbInstance), nil
+	case "file":
+		store, err := db.CreateFileStore("webhooks")
+		if err != nil {
+			return nil, err
+		}
+		return repositories.NewWebhookFileRepository(store)
 	default:
 		return nil, ErrInvalidDatabaseType
 	}
 }
+
+// webhookDeliveryConfig reads how many failed attempts make a webhook delivery dead from WEBHOOK_MAX_ATTEMPTS, and
+// the delays between them from WEBHOOK_BACKOFF and WEBHOOK_MAX_BACKOFF.
+func webhookDeliveryConfig() (services.WebhookDeliveryConfig, error) {
+	config := services.WebhookDeliveryConfig{
+		MaxAttempts: services.DefaultWebhookMaxAttempts,
+		Backoff:     services.DefaultWebhookBackoff,
+		MaxBackoff:  services.DefaultWebhookMaxBackoff,
+		Timeout:     services.DefaultWebhookTimeout,
+	}
+
+	if value := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return config, ErrInvalidWebhook
+		}
+		config.MaxAttempts = attempts
+	}
+	if value := os.Getenv("WEBHOOK_BACKOFF"); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff <= 0 {
+			return config, ErrInvalidWebhook
+		}
+		config.Backoff = backoff
+	}
+	if value := os.Getenv("WEBHOOK_MAX_BACKOFF"); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff <= 0 {
+			return config, ErrInvalidWebhook
+		}
+		config.MaxBackoff = backoff
+	}
+	return config, nil
+}
+
+// NewEventDispatcher delivers the events of the outboxes of the repositories that have one to the audit log, and
+// to the repositories that subscribe to them, such as the device cache.
+func NewEventDispatcher(repos ...any) *services.EventDispatcher {
+	var outboxes []repositories.EventOutbox
+	for _, repo := range repos {
+		if outbox, ok := repo.(repositories.EventOutbox); ok {
+			outboxes = append(outboxes, outbox)
+		}
+	}
+	dispatcher := services.NewEventDispatcher(outboxes...)
+	dispatcher.Subscribe(services.SubscriberFunc(func(ctx context.Context, event models.Event) error {
+		log.Printf("Event %s %s of tenant %s", event.ID, event.Type, event.Tenant)
+		return nil
+	}))
+	for _, repo := range repos {
+		if subscriber, ok := repo.(services.Subscriber); ok {
+			dispatcher.Subscribe(subscriber)
+		}
+	}
+	return dispatcher
+}
+
+// ReplayStreamFiles feeds the stream batches recorded in the files of paths through consumer, in order, and returns
+// how many records it handled. Each file holds an events.DynamoDBEvent, the JSON the stream Lambda receives.
+func ReplayStreamFiles(ctx context.Context, consumer *services.StreamConsumer, paths []string) (int, error) {
+	records := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return records, err
+		}
+		var batch events.DynamoDBEvent
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return records, fmt.Errorf("%s: %w", path, err)
+		}
+		if _, err := consumer.HandleStream(ctx, batch); err != nil {
+			return records, fmt.Errorf("%s: %w", path, err)
+		}
+		records += len(batch.Records)
+	}
+	return records, nil
+}
+
+// eventDispatchInterval reads how often the local server dispatches the events from EVENT_DISPATCH_INTERVAL, 1s
+// when unset and never when 0.
+func eventDispatchInterval() (time.Duration, error) {
+	value := os.Getenv("EVENT_DISPATCH_INTERVAL")
+	if value == "" {
+		return time.Second, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, ErrInvalidDispatch
+	}
+	return interval, nil
+}
+
+// RunEventDispatcher dispatches the events and sends the webhook deliveries that are due every interval until ctx
+// is done. An event that fails stays in its outbox for the next round.
+func RunEventDispatcher(ctx context.Context, dispatcher *services.EventDispatcher, deliverer *services.WebhookDeliverer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := dispatcher.Dispatch(ctx); err != nil {
+				log.Printf("failed to dispatch the events: %v", err)
+			}
+			if _, err := deliverer.DeliverDue(ctx); err != nil {
+				log.Printf("failed to deliver the webhooks: %v", err)
+			}
+		}
+	}
+}
+
+// openAPIValidation reads from OPENAPI_VALIDATION whether the requests of the device endpoints are checked against
+// the OpenAPI document before they reach the handlers, false when unset.
+func openAPIValidation() (bool, error) {
+	value := os.Getenv("OPENAPI_VALIDATION")
+	if value == "" {
+		return false, nil
+	}
+	validate, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, ErrInvalidValidation
+	}
+	return validate, nil
+}
+
+// dynamoSchema declares the tables of the DynamoDB repositories, named by DYNAMODB_TABLE.
+func dynamoSchema() db.DynamoSchema {
+	return repositories.DynamoSchema(os.Getenv("DYNAMODB_TABLE"))
+}
+
+// CheckDynamoSchema reads from DYNAMODB_SCHEMA what to do with the DynamoDB tables at startup: check compares them
+// with their declaration, reconcile also creates what they lack, and empty does nothing. It returns the drift left.
+func CheckDynamoSchema(ctx context.Context) ([]db.DynamoDrift, error) {
+	switch os.Getenv("DYNAMODB_SCHEMA") {
+	case "":
+		return nil, nil
+	case "check":
+		return dynamoSchema().Drift(ctx, db.CreateDynamoDBInstance().Client)
+	case "reconcile":
+		return dynamoSchema().Reconcile(ctx, db.CreateDynamoDBInstance().Client)
+	default:
+		return nil, ErrInvalidDynamoSchema
+	}
+}
+
+// MigrateDynamoDB copies the tables the DynamoDB repositories had before the single table, named by
+// LEGACY_DYNAMODB_TABLE, LEGACY_DEVICE_MODEL_TABLE and LEGACY_DEVICE_STATE_LOG_TABLE, into DYNAMODB_TABLE, and adds
+// the index keys its devices miss. Without legacy tables it only does the latter.
+func MigrateDynamoDB(ctx context.Context) (repositories.DynamoMigration, error) {
+	legacy := repositories.LegacyDynamoTables{
+		Devices:         os.Getenv("LEGACY_DYNAMODB_TABLE"),
+		DeviceModels:    os.Getenv("LEGACY_DEVICE_MODEL_TABLE"),
+		DeviceStateLogs: os.Getenv("LEGACY_DEVICE_STATE_LOG_TABLE"),
+	}
+	return repositories.MigrateDynamoTables(ctx, db.CreateDynamoDBInstance(), legacy)
+}
+
+// NewStateMachine loads the transition table from STATE_MACHINE_FILE, or falls back to the default one.
+func NewStateMachine() (*services.StateMachine, error) {
+	path := os.Getenv("STATE_MACHINE_FILE")
+	if path == "" {
+		return services.NewStateMachine(services.DefaultStateMachineConfig)
+	}
+	return services.LoadStateMachine(path)
+}
+
+// NewTenantConfig reads the tokens of the tenants from TENANT_TOKENS, e.g. "token1=tenant-a,token2=tenant-b", the
+// tenant of the requests that name none from DEFAULT_TENANT, utils.DefaultTenant when unset and none when empty,
+// whether X-Tenant-ID is trusted without tokens from TRUST_TENANT_HEADER, and the token of the admin endpoints from
+// ADMIN_TOKEN. It fails when the tenants could only come from an untrusted header.
+func NewTenantConfig() (handlers.TenantConfig, error) {
+	config := handlers.TenantConfig{
+		Default:    utils.DefaultTenant,
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+	}
+
+	if value, ok := os.LookupEnv("DEFAULT_TENANT"); ok {
+		if value != "" && utils.ValidateTenant(value) != nil {
+			return config, ErrInvalidTenant
+		}
+		config.Default = value
+	}
+	if value := os.Getenv("TENANT_TOKENS"); value != "" {
+		config.Tokens = map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			token, tenant, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || token == "" || utils.ValidateTenant(tenant) != nil {
+				return config, ErrInvalidTenantTokens
+			}
+			config.Tokens[token] = tenant
+		}
+	}
+	if value := os.Getenv("TRUST_TENANT_HEADER"); value != "" {
+		trust, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, ErrInvalidTrustHeader
+		}
+		config.TrustHeader = trust
+	}
+	if len(config.Tokens) == 0 && config.Default == "" && !config.TrustHeader {
+		return config, ErrUntrustedHeader
+	}
+	return config, nil
+}
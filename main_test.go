@@ -1,10 +1,17 @@
 package main_test
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
 	main "simple-api-go"
 	"simple-api-go/db"
+	"simple-api-go/db/dynamotest"
+	"simple-api-go/models"
 	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"slices"
 	. "testing"
 )
 
@@ -36,9 +43,101 @@ func TestNewDeviceRepository(t *T) {
 			expectedError: nil,
 			setupEnvVars: func() {
 				_ = os.Setenv("DATABASE_TYPE", "dynamodb")
+				_ = os.Setenv("DYNAMODB_TABLE", "devices")
+				_ = os.Setenv("REGION", "local")
 			},
 			teardownEnvVar: func() {
 				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("DYNAMODB_TABLE")
+				_ = os.Unsetenv("REGION")
+			},
+		},
+		{
+			name:          "SQLRepository",
+			databaseType:  "sql",
+			expected:      &repositories.DeviceSQLRepository{},
+			expectedError: nil,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "sql")
+				_ = os.Setenv("SQL_DSN", filepath.Join(t.TempDir(), "simple-api-test.db"))
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("SQL_DSN")
+			},
+		},
+		{
+			name:          "FileRepository",
+			databaseType:  "file",
+			expected:      &repositories.DeviceFileRepository{},
+			expectedError: nil,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "file")
+				_ = os.Setenv("DATA_DIR", t.TempDir())
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("DATA_DIR")
+			},
+		},
+		{
+			name:          "InvalidPurgeAfter",
+			databaseType:  "memory",
+			expected:      nil,
+			expectedError: main.ErrInvalidPurgeAfter,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "memory")
+				_ = os.Setenv("DEVICE_PURGE_AFTER", "30 days")
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("DEVICE_PURGE_AFTER")
+			},
+		},
+		{
+			name:          "CacheRepository",
+			databaseType:  "memory",
+			expected:      &repositories.DeviceCacheRepository{},
+			expectedError: nil,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "memory")
+				_ = os.Setenv("DEVICE_CACHE_SIZE", "100")
+				_ = os.Setenv("DEVICE_CACHE_TTL", "10s")
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("DEVICE_CACHE_SIZE")
+				_ = os.Unsetenv("DEVICE_CACHE_TTL")
+			},
+		},
+		{
+			name:          "InvalidCacheSize",
+			databaseType:  "memory",
+			expected:      nil,
+			expectedError: main.ErrInvalidCacheSize,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "memory")
+				_ = os.Setenv("DEVICE_CACHE_SIZE", "-1")
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("DEVICE_CACHE_SIZE")
+			},
+		},
+		{
+			name:          "InvalidCacheTTL",
+			databaseType:  "memory",
+			expected:      nil,
+			expectedError: main.ErrInvalidCacheTTL,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "memory")
+				_ = os.Setenv("DEVICE_CACHE_SIZE", "100")
+				_ = os.Setenv("DEVICE_CACHE_TTL", "soon")
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+				_ = os.Unsetenv("DEVICE_CACHE_SIZE")
+				_ = os.Unsetenv("DEVICE_CACHE_TTL")
 			},
 		},
 		{
@@ -74,3 +173,245 @@ func TestNewDeviceRepository(t *T) {
 		})
 	}
 }
+
+func TestNewDeviceStateLogRepository(t *T) {
+	testCases := []struct {
+		name           string
+		expectedError  error
+		setupEnvVars   func()
+		teardownEnvVar func()
+	}{
+		{
+			name:          "MemoryRepository",
+			expectedError: nil,
+			setupEnvVars: func() {
+				_ = os.Setenv("DATABASE_TYPE", "memory")
+			},
+			teardownEnvVar: func() {
+				_ = os.Unsetenv("DATABASE_TYPE")
+			},
+		},
+		{
+			name:           "InvalidDatabaseType",
+			expectedError:  main.ErrInvalidDatabaseType,
+			setupEnvVars:   func() {},
+			teardownEnvVar: func() {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *T) {
+			tc.setupEnvVars()
+			defer tc.teardownEnvVar()
+
+			repo, err := main.NewDeviceStateLogRepository()
+			if err != tc.expectedError {
+				t.Errorf("NewDeviceStateLogRepository() expected error: %v, got: %v", tc.expectedError, err)
+			}
+			if err == nil && repo == nil {
+				t.Errorf("NewDeviceStateLogRepository() expected repository, got nil")
+			}
+		})
+	}
+}
+
+func TestNewStateMachine(t *T) {
+	t.Run("DefaultStateMachine", func(t *T) {
+		_ = os.Unsetenv("STATE_MACHINE_FILE")
+
+		machine, err := main.NewStateMachine()
+		if err != nil || machine == nil {
+			t.Errorf("NewStateMachine() expected the default state machine, got: %v, %v", machine, err)
+		}
+	})
+
+	t.Run("ConfigurationFile", func(t *T) {
+		_ = os.Setenv("STATE_MACHINE_FILE", "resource/state-machine.json")
+		defer os.Unsetenv("STATE_MACHINE_FILE")
+
+		if _, err := main.NewStateMachine(); err != nil {
+			t.Errorf("NewStateMachine() error: %v", err)
+		}
+	})
+
+	t.Run("MissingFile", func(t *T) {
+		_ = os.Setenv("STATE_MACHINE_FILE", "resource/missing.json")
+		defer os.Unsetenv("STATE_MACHINE_FILE")
+
+		if _, err := main.NewStateMachine(); err == nil {
+			t.Errorf("NewStateMachine() expected an error for a missing file")
+		}
+	})
+}
+
+func TestNewDeviceModelRepository(t *T) {
+	t.Run("MemoryRepository", func(t *T) {
+		_ = os.Setenv("DATABASE_TYPE", "memory")
+		defer os.Unsetenv("DATABASE_TYPE")
+
+		repo, err := main.NewDeviceModelRepository()
+		if err != nil || repo == nil {
+			t.Errorf("NewDeviceModelRepository() expected repository, got: %v, %v", repo, err)
+		}
+	})
+
+	t.Run("InvalidDatabaseType", func(t *T) {
+		if _, err := main.NewDeviceModelRepository(); err != main.ErrInvalidDatabaseType {
+			t.Errorf("NewDeviceModelRepository() expected error: %v, got: %v", main.ErrInvalidDatabaseType, err)
+		}
+	})
+}
+
+func TestCheckDynamoSchema(t *T) {
+	t.Run("Disabled", func(t *T) {
+		if drift, err := main.CheckDynamoSchema(context.Background()); drift != nil || err != nil {
+			t.Errorf("CheckDynamoSchema() expected nothing to do, got: %v, %v", drift, err)
+		}
+	})
+
+	t.Run("InvalidMode", func(t *T) {
+		_ = os.Setenv("DYNAMODB_SCHEMA", "create")
+		defer os.Unsetenv("DYNAMODB_SCHEMA")
+
+		if _, err := main.CheckDynamoSchema(context.Background()); !errors.Is(err, main.ErrInvalidDynamoSchema) {
+			t.Errorf("CheckDynamoSchema() expected error: %v, got: %v", main.ErrInvalidDynamoSchema, err)
+		}
+	})
+
+	t.Run("Reconcile", func(t *T) {
+		server := dynamotest.NewServer()
+		defer server.Close()
+		t.Setenv("ENDPOINT", server.URL)
+		t.Setenv("REGION", "local")
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+		t.Setenv("DYNAMODB_TABLE", "iotwatcher")
+
+		t.Setenv("DYNAMODB_SCHEMA", "check")
+		if drift, err := main.CheckDynamoSchema(context.Background()); err != nil || len(drift) != 1 {
+			t.Errorf("CheckDynamoSchema() expected the missing table, got: %v, %v", drift, err)
+		}
+		t.Setenv("DYNAMODB_SCHEMA", "reconcile")
+		if drift, err := main.CheckDynamoSchema(context.Background()); err != nil || len(drift) != 0 {
+			t.Errorf("CheckDynamoSchema() expected the table created, got: %v, %v", drift, err)
+		}
+		t.Setenv("DYNAMODB_SCHEMA", "check")
+		if drift, err := main.CheckDynamoSchema(context.Background()); err != nil || len(drift) != 0 {
+			t.Errorf("CheckDynamoSchema() expected no drift, got: %v, %v", drift, err)
+		}
+	})
+}
+
+func TestMigrateDynamoDB(t *T) {
+	// Without legacy tables only the devices of the single table are backfilled.
+	t.Run("NoLegacyTables", func(t *T) {
+		server := dynamotest.NewServer()
+		defer server.Close()
+		t.Setenv("ENDPOINT", server.URL)
+		t.Setenv("REGION", "local")
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+		t.Setenv("DYNAMODB_TABLE", "iotwatcher")
+		t.Setenv("DYNAMODB_SCHEMA", "reconcile")
+		if _, err := main.CheckDynamoSchema(context.Background()); err != nil {
+			t.Fatalf("CheckDynamoSchema() error = %v", err)
+		}
+
+		if migration, err := main.MigrateDynamoDB(context.Background()); err != nil || migration != (repositories.DynamoMigration{}) {
+			t.Errorf("MigrateDynamoDB() expected nothing to migrate, got: %+v, %v", migration, err)
+		}
+	})
+}
+
+func TestNewTenantConfig(t *T) {
+	t.Run("Default", func(t *T) {
+		config, err := main.NewTenantConfig()
+		if err != nil || config.Default != "default" || config.Tokens != nil || config.TrustHeader {
+			t.Errorf("NewTenantConfig() expected the default tenant, got: %v, %v", config, err)
+		}
+	})
+
+	t.Run("Tokens", func(t *T) {
+		_ = os.Setenv("TENANT_TOKENS", "token1=tenant-a, token2=tenant-b")
+		_ = os.Setenv("DEFAULT_TENANT", "")
+		_ = os.Setenv("ADMIN_TOKEN", "admin")
+		defer os.Unsetenv("TENANT_TOKENS")
+		defer os.Unsetenv("DEFAULT_TENANT")
+		defer os.Unsetenv("ADMIN_TOKEN")
+
+		config, err := main.NewTenantConfig()
+		if err != nil {
+			t.Fatalf("NewTenantConfig() error: %v", err)
+		}
+		if config.Tokens["token1"] != "tenant-a" || config.Tokens["token2"] != "tenant-b" || config.Default != "" || config.AdminToken != "admin" {
+			t.Errorf("NewTenantConfig() got: %v", config)
+		}
+	})
+
+	t.Run("UntrustedHeader", func(t *T) {
+		_ = os.Setenv("DEFAULT_TENANT", "")
+		defer os.Unsetenv("DEFAULT_TENANT")
+
+		if _, err := main.NewTenantConfig(); !errors.Is(err, main.ErrUntrustedHeader) {
+			t.Errorf("NewTenantConfig() expected error: %v, got: %v", main.ErrUntrustedHeader, err)
+		}
+
+		_ = os.Setenv("TRUST_TENANT_HEADER", "true")
+		defer os.Unsetenv("TRUST_TENANT_HEADER")
+		config, err := main.NewTenantConfig()
+		if err != nil || !config.TrustHeader || config.Default != "" {
+			t.Errorf("NewTenantConfig() expected the tenants of the header, got: %v, %v", config, err)
+		}
+	})
+
+	t.Run("InvalidTrustHeader", func(t *T) {
+		_ = os.Setenv("TRUST_TENANT_HEADER", "yes please")
+		defer os.Unsetenv("TRUST_TENANT_HEADER")
+
+		if _, err := main.NewTenantConfig(); !errors.Is(err, main.ErrInvalidTrustHeader) {
+			t.Errorf("NewTenantConfig() expected error: %v, got: %v", main.ErrInvalidTrustHeader, err)
+		}
+	})
+
+	t.Run("InvalidTokens", func(t *T) {
+		_ = os.Setenv("TENANT_TOKENS", "token1=tenant#a")
+		defer os.Unsetenv("TENANT_TOKENS")
+
+		if _, err := main.NewTenantConfig(); !errors.Is(err, main.ErrInvalidTenantTokens) {
+			t.Errorf("NewTenantConfig() expected error: %v, got: %v", main.ErrInvalidTenantTokens, err)
+		}
+	})
+
+	t.Run("InvalidDefaultTenant", func(t *T) {
+		_ = os.Setenv("DEFAULT_TENANT", "Default")
+		defer os.Unsetenv("DEFAULT_TENANT")
+
+		if _, err := main.NewTenantConfig(); !errors.Is(err, main.ErrInvalidTenant) {
+			t.Errorf("NewTenantConfig() expected error: %v, got: %v", main.ErrInvalidTenant, err)
+		}
+	})
+}
+
+func TestReplayStreamFiles(t *T) {
+	dispatcher := services.NewEventDispatcher()
+	var received []string
+	dispatcher.Subscribe(services.SubscriberFunc(func(ctx context.Context, event models.Event) error {
+		received = append(received, event.Type+" "+event.Tenant)
+		return nil
+	}))
+	consumer := services.NewStreamConsumer(dispatcher)
+
+	records, err := main.ReplayStreamFiles(context.Background(), consumer, []string{"resource/stream/sample.json"})
+	if err != nil || records != 7 {
+		t.Fatalf("ReplayStreamFiles() got = %v, %v, want the 7 records of the sample", records, err)
+	}
+	// The sample also has a write of the API, its outbox item and the TTL removing a deleted device.
+	want := []string{"DeviceCreated acme", "DeviceUpdated acme", "StateChanged acme", "DeviceDeleted globex"}
+	if !slices.Equal(received, want) {
+		t.Errorf("ReplayStreamFiles() delivered %v, want %v", received, want)
+	}
+
+	if _, err := main.ReplayStreamFiles(context.Background(), consumer, []string{"resource/stream/missing.json"}); err == nil {
+		t.Errorf("ReplayStreamFiles() expected an error for a missing file")
+	}
+}
@@ -1,9 +1,22 @@
 package models
 
 type Device struct {
-	ID          string `json:"id"`
-	DeviceModel string `json:"deviceModel"`
+	ID          string `json:"id" openapi:"pattern=^/devices/[A-Za-z0-9]+$"`
+	DeviceModel string `json:"deviceModel" openapi:"pattern=^/devicemodels/[A-Za-z0-9]+$"`
 	Name        string `json:"name"`
 	Note        string `json:"note"`
-	Serial      string `json:"serial"`
+	Serial      string `json:"serial" openapi:"pattern=^[A-Za-z0-9]+$"`
+	// Version counts the writes of the device, starting at 1. It is served as the ETag of the device.
+	Version int64 `json:"version" openapi:"minimum=0"`
+	// DeletedAt (RFC3339) and DeletedBy are set while the device is in the trash.
+	DeletedAt string `json:"deletedAt,omitempty" openapi:"readOnly,format=date-time"`
+	DeletedBy string `json:"deletedBy,omitempty" openapi:"readOnly"`
+	// PurgeAt is when a deleted device is removed for good, in Unix seconds as the DynamoDB TTL expects it.
+	PurgeAt int64 `json:"-" dynamodbav:"purgeAt,omitempty"`
+}
+
+// DevicePage is one page of a device listing. NextCursor is empty on the last page.
+type DevicePage struct {
+	Items      []*Device `json:"items"`
+	NextCursor string    `json:"nextCursor,omitempty"`
 }
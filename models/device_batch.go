@@ -0,0 +1,36 @@
+package models
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// DeviceBatchRequest lists the operations of POST /api/devices:batch. With Atomic either every operation is applied
+// or none is.
+type DeviceBatchRequest struct {
+	Atomic     bool                   `json:"atomic"`
+	Operations []DeviceBatchOperation `json:"operations" openapi:"required"`
+}
+
+// DeviceBatchOperation creates, updates or deletes Device. An update and a delete expect Device.Version, zero skips
+// the check; a delete only reads Device.ID and Device.Version.
+type DeviceBatchOperation struct {
+	Op     string `json:"op" openapi:"required,enum=create|update|delete"`
+	Device Device `json:"device" openapi:"required"`
+}
+
+// DeviceBatchResult reports one operation, in the order of the request. Status is the HTTP status the operation
+// would have on its own endpoint.
+type DeviceBatchResult struct {
+	Op     string  `json:"op"`
+	ID     string  `json:"id"`
+	Status int     `json:"status"`
+	Error  string  `json:"error,omitempty"`
+	Device *Device `json:"device,omitempty"`
+}
+
+type DeviceBatchResponse struct {
+	Results []DeviceBatchResult `json:"results"`
+	Failed  int                 `json:"failed"`
+}
@@ -0,0 +1,16 @@
+package models
+
+// DeviceModel is a catalogue entry that devices refer to with Device.DeviceModel.
+type DeviceModel struct {
+	ID           string            `json:"id" openapi:"pattern=^/devicemodels/[A-Za-z0-9]+$"`
+	Name         string            `json:"name" openapi:"required"`
+	Manufacturer string            `json:"manufacturer" openapi:"required"`
+	Category     string            `json:"category"`
+	Specs        map[string]string `json:"specs,omitempty"`
+}
+
+// DeviceModelPage is one page of a device model listing. NextCursor is empty on the last page.
+type DeviceModelPage struct {
+	Items      []*DeviceModel `json:"items"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
@@ -1,10 +1,43 @@
 package models
 
+import "time"
+
+// LogDateFormat keeps a fixed width so dates, and the State#Date sort key built from them, order lexicographically.
+const LogDateFormat = "2006-01-02T15:04:05.000Z"
+
 type DeviceStateLog struct {
-	DeviceID    string `json:"DeviceID"`
-	StateDate   string `json:"State#Date"`
-	Operator    string `json:"Operator"`
-	Date        string `json:"Date"`
-	State       string `json:"State"`
-	EscalatedTo string `json:"EscalatedTo"`
+	DeviceID  string `json:"DeviceID" openapi:"readOnly"`
+	StateDate string `json:"State#Date" openapi:"readOnly"`
+	Operator  string `json:"Operator" openapi:"required"`
+	Date      string `json:"Date" openapi:"format=date-time"`
+	State     string `json:"State" openapi:"required,pattern=^[A-Za-z0-9]+$"`
+	// EscalatedTo keys a sparse index, so it is left out of the stored item when empty.
+	EscalatedTo string `json:"EscalatedTo" dynamodbav:"EscalatedTo,omitempty"`
+}
+
+// DeviceStateLogPage is one page of a log query. NextCursor is empty on the last page.
+type DeviceStateLogPage struct {
+	Items      []*DeviceStateLog `json:"items"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+// Escalation is an escalated log together with the current name and serial of its device.
+type Escalation struct {
+	DeviceStateLog
+	DeviceName   string `json:"DeviceName"`
+	DeviceSerial string `json:"DeviceSerial"`
+}
+
+// EscalationPage is one page of an escalation inbox. NextCursor is empty on the last page.
+type EscalationPage struct {
+	Items      []*Escalation `json:"items"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+func FormatLogDate(t time.Time) string {
+	return t.UTC().Format(LogDateFormat)
+}
+
+func StateDateKey(state, date string) string {
+	return state + "#" + date
 }
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"simple-api-go/utils"
+	"sync/atomic"
+	"time"
+)
+
+// EventTimeFormat keeps a fixed width so the times of the events order lexicographically.
+const EventTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// The types of the domain events.
+const (
+	EventDeviceCreated = "DeviceCreated"
+	EventDeviceUpdated = "DeviceUpdated"
+	EventDeviceDeleted = "DeviceDeleted"
+	EventStateChanged  = "StateChanged"
+)
+
+// EventTypes lists the types of the domain events.
+var EventTypes = []string{EventDeviceCreated, EventDeviceUpdated, EventDeviceDeleted, EventStateChanged}
+
+// EventData is the payload of a domain event.
+type EventData interface {
+	EventType() string
+}
+
+// DeviceCreated reports a device created at version 1, over the tombstone of a deleted device if there was one.
+type DeviceCreated struct {
+	Device Device `json:"device"`
+}
+
+// DeviceUpdated reports a device as an update, a patch or a restore from the trash stored it.
+type DeviceUpdated struct {
+	Device Device `json:"device"`
+}
+
+// DeviceDeleted reports a device moved to the trash, with its tombstone.
+type DeviceDeleted struct {
+	Device Device `json:"device"`
+}
+
+// StateChanged reports a device moved to the state of Log. From is the state of the log before it, empty for the
+// first log of the device.
+type StateChanged struct {
+	Log  DeviceStateLog `json:"log"`
+	From string         `json:"from,omitempty"`
+}
+
+func (DeviceCreated) EventType() string { return EventDeviceCreated }
+func (DeviceUpdated) EventType() string { return EventDeviceUpdated }
+func (DeviceDeleted) EventType() string { return EventDeviceDeleted }
+func (StateChanged) EventType() string  { return EventStateChanged }
+
+// Event is a domain event as the outboxes store it and the subscribers receive it. Its ID is unique, and the IDs
+// made by one process sort in the order their events occurred.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type" openapi:"enum=DeviceCreated|DeviceUpdated|DeviceDeleted|StateChanged"`
+	Tenant     string          `json:"tenant"`
+	OccurredAt string          `json:"occurredAt" openapi:"format=date-time"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// eventSequence orders the IDs of the events made in the same nanosecond.
+var eventSequence atomic.Uint32
+
+// NewEvent wraps data in an event of tenant that occurred at now.
+func NewEvent(tenant string, data EventData, now time.Time) (Event, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:         fmt.Sprintf("%016x%08x%s", now.UnixNano(), eventSequence.Add(1), hex.EncodeToString(random)),
+		Type:       data.EventType(),
+		Tenant:     tenant,
+		OccurredAt: now.UTC().Format(EventTimeFormat),
+		Data:       payload,
+	}, nil
+}
+
+// Decode returns the payload of the event, one of the types above, or utils.ErrUnknownEventType.
+func (e Event) Decode() (EventData, error) {
+	var data EventData
+	switch e.Type {
+	case EventDeviceCreated:
+		data = &DeviceCreated{}
+	case EventDeviceUpdated:
+		data = &DeviceUpdated{}
+	case EventDeviceDeleted:
+		data = &DeviceDeleted{}
+	case EventStateChanged:
+		data = &StateChanged{}
+	default:
+		return nil, fmt.Errorf("%w '%s'", utils.ErrUnknownEventType, e.Type)
+	}
+	if err := json.Unmarshal(e.Data, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,9 @@
+package models
+
+// TenantUsage counts what a tenant stores. Devices includes the devices in the trash.
+type TenantUsage struct {
+	Tenant       string `json:"tenant"`
+	Devices      int    `json:"devices"`
+	DeviceModels int    `json:"deviceModels"`
+	StateLogs    int    `json:"stateLogs"`
+}
@@ -0,0 +1,64 @@
+package models
+
+import "slices"
+
+// Webhook subscribes a URL to the domain events of its tenant. Events lists the event types it receives, all of
+// them when it is empty. Secret signs the deliveries; it is only shown in the response that creates the webhook.
+type Webhook struct {
+	ID        string   `json:"id" openapi:"readOnly"`
+	URL       string   `json:"url" openapi:"required,format=uri"`
+	Events    []string `json:"events,omitempty" openapi:"enum=DeviceCreated|DeviceUpdated|DeviceDeleted|StateChanged"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"createdAt" openapi:"readOnly,format=date-time"`
+}
+
+// Matches tells whether the webhook receives the events of eventType.
+func (w *Webhook) Matches(eventType string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, eventType)
+}
+
+// WebhookPage is one page of a webhook listing. NextCursor is empty on the last page.
+type WebhookPage struct {
+	Items      []*Webhook `json:"items"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// The statuses of a webhook delivery. A pending delivery waits for its next attempt, and a dead one gave up after
+// too many failures, until it is replayed.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDelivery is the delivery of one event to one webhook, with the log of its attempts. Its ID is the ID of
+// the event, so an event delivered twice to the subscribers makes one delivery per webhook. FailedAttempts counts
+// the failures since the delivery was made or last replayed.
+type WebhookDelivery struct {
+	ID             string           `json:"id"`
+	WebhookID      string           `json:"webhookId"`
+	Event          Event            `json:"event"`
+	Status         string           `json:"status" openapi:"enum=pending|delivered|dead"`
+	Attempts       []WebhookAttempt `json:"attempts"`
+	FailedAttempts int              `json:"failedAttempts"`
+	NextAttemptAt  string           `json:"nextAttemptAt,omitempty"`
+}
+
+// WebhookReplay reports how many dead deliveries of a webhook were replayed.
+type WebhookReplay struct {
+	Replayed int `json:"replayed"`
+}
+
+// WebhookAttempt is one request of a delivery. StatusCode is the status of the response, none when the request
+// failed before it, and Error tells why the attempt failed.
+type WebhookAttempt struct {
+	At         string `json:"at"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// WebhookDeliveryPage is one page of the deliveries of a webhook. NextCursor is empty on the last page.
+type WebhookDeliveryPage struct {
+	Items      []*WebhookDelivery `json:"items"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
@@ -0,0 +1,242 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"simple-api-go/utils"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Endpoint describes a route of the API to Build.
+type Endpoint struct {
+	// Pattern is the http.ServeMux pattern of the route, e.g. "GET /api/devices/{id}".
+	Pattern     string
+	OperationID string
+	Summary     string
+	Description string
+	Tag         string
+	// Params are the query and header parameters. Build adds the path parameters of the pattern, unless Params
+	// describes them.
+	Params []*Parameter
+	// Body is a value of the type of the request body, nil for none. BodyTypes are its media types,
+	// application/json when empty.
+	Body      any
+	BodyTypes []string
+	// Responses maps the success statuses to a value of the type of their body, nil for no content. Errors are the
+	// error statuses, which answer with a utils.ErrorJSON.
+	Responses map[int]any
+	Errors    []int
+	// Security overrides the security of the document.
+	Security []SecurityRequirement
+}
+
+// pathParam matches the wildcards of a http.ServeMux pattern.
+var pathParam = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// Build makes the document of endpoints. The schemas of the bodies come from their Go types, see schemaBuilder.
+func Build(info Info, endpoints []Endpoint) *Document {
+	doc := &Document{
+		OpenAPI:    Version,
+		Info:       info,
+		Paths:      map[string]PathItem{},
+		Components: Components{Schemas: map[string]*Schema{}},
+	}
+	schemas := &schemaBuilder{components: doc.Components.Schemas}
+	errorSchema := schemas.of(reflect.TypeOf(utils.ErrorJSON{}))
+
+	for _, endpoint := range endpoints {
+		method, path, _ := strings.Cut(endpoint.Pattern, " ")
+		operation := &Operation{
+			OperationID: endpoint.OperationID,
+			Summary:     endpoint.Summary,
+			Description: endpoint.Description,
+			Responses:   map[string]*Response{},
+			Security:    endpoint.Security,
+		}
+		if endpoint.Tag != "" {
+			operation.Tags = []string{endpoint.Tag}
+		}
+
+		for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+			if !slices.ContainsFunc(endpoint.Params, func(p *Parameter) bool { return p.In == InPath && p.Name == match[1] }) {
+				operation.Parameters = append(operation.Parameters, &Parameter{Name: match[1], In: InPath, Required: true, Schema: &Schema{Type: "string"}})
+			}
+		}
+		for _, param := range endpoint.Params {
+			compilePatterns(param.Schema)
+			operation.Parameters = append(operation.Parameters, param)
+		}
+
+		if endpoint.Body != nil {
+			bodySchema := schemas.of(reflect.TypeOf(endpoint.Body))
+			operation.RequestBody = &RequestBody{Required: true, Content: map[string]*MediaType{}}
+			mediaTypes := endpoint.BodyTypes
+			if len(mediaTypes) == 0 {
+				mediaTypes = []string{"application/json"}
+			}
+			for _, mediaType := range mediaTypes {
+				operation.RequestBody.Content[mediaType] = &MediaType{Schema: bodySchema}
+			}
+		}
+
+		for status, body := range endpoint.Responses {
+			response := &Response{Description: http.StatusText(status)}
+			if body != nil {
+				response.Content = map[string]*MediaType{"application/json": {Schema: schemas.of(reflect.TypeOf(body))}}
+			}
+			operation.Responses[strconv.Itoa(status)] = response
+		}
+		for _, status := range endpoint.Errors {
+			operation.Responses[strconv.Itoa(status)] = &Response{
+				Description: http.StatusText(status),
+				Content:     map[string]*MediaType{"application/json": {Schema: errorSchema}},
+			}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(method)] = operation
+	}
+	return doc
+}
+
+// schemaBuilder makes the schemas of Go types, with the schemas of the structs they refer to in components, by the
+// name of their type. The properties of a struct are its JSON fields, refined by the openapi tag of the field, a
+// comma separated list of:
+//
+//	required        the field must be present
+//	readOnly        the field is only in responses
+//	format=<format> e.g. date-time or uri
+//	enum=<a>|<b>    the values of the field, or of the elements of a slice
+//	minimum=<n>     the bounds of an integer
+//	maximum=<n>
+//	pattern=<re>    the regular expression of a string, always last so that it may hold commas
+type schemaBuilder struct {
+	components map[string]*Schema
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func (b *schemaBuilder) of(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == rawMessageType || t.Kind() == reflect.Interface:
+		return &Schema{}
+	case t.Kind() == reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			// The entry is there before the properties, so a struct that refers to itself ends.
+			b.components[t.Name()] = &Schema{}
+			*b.components[t.Name()] = *b.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return &Schema{Type: "array", Items: b.of(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.of(t.Elem())}
+	case t.Kind() == reflect.String:
+		return &Schema{Type: "string"}
+	case t.Kind() == reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &Schema{Type: "number"}
+	default:
+		return &Schema{}
+	}
+}
+
+// object is the schema of the JSON fields of struct t, the fields of its embedded structs included.
+func (b *schemaBuilder) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	b.addFields(schema, t)
+	return schema
+}
+
+func (b *schemaBuilder) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		// As in encoding/json, the fields of an embedded struct are promoted, even when its type is unexported.
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(schema, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := b.of(field.Type)
+		if refine(property, field.Tag.Get("openapi")) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	}
+}
+
+// refine applies the openapi tag of a field to its schema, and returns whether the field is required. The
+// schema of a struct is a reference, which the tag can not change.
+func refine(schema *Schema, tag string) (required bool) {
+	target := schema
+	if schema.Items != nil {
+		target = schema.Items
+	}
+	for tag != "" {
+		var item string
+		if strings.HasPrefix(tag, "pattern=") {
+			item, tag = tag, ""
+		} else {
+			item, tag, _ = strings.Cut(tag, ",")
+		}
+
+		key, value, _ := strings.Cut(item, "=")
+		switch key {
+		case "required":
+			required = true
+		case "readOnly":
+			schema.ReadOnly = true
+		case "format":
+			target.Format = value
+		case "enum":
+			target.Enum = strings.Split(value, "|")
+		case "minimum", "maximum":
+			bound, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				panic("openapi: invalid " + key + " '" + value + "'")
+			}
+			if key == "minimum" {
+				target.Minimum = &bound
+			} else {
+				target.Maximum = &bound
+			}
+		case "pattern":
+			target.Pattern = value
+			target.pattern = regexp.MustCompile(value)
+		}
+	}
+	return required
+}
+
+// compilePatterns compiles the pattern of a schema made by hand, such as the schema of a parameter.
+func compilePatterns(schema *Schema) {
+	if schema != nil && schema.Pattern != "" && schema.pattern == nil {
+		schema.pattern = regexp.MustCompile(schema.Pattern)
+	}
+}
@@ -0,0 +1,170 @@
+package openapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"simple-api-go/utils"
+	"strings"
+	"testing"
+)
+
+type testPart struct {
+	Name string `json:"name" openapi:"required"`
+}
+
+type testBase struct {
+	ID string `json:"id" openapi:"readOnly"`
+}
+
+type testThing struct {
+	testBase
+	Kind    string            `json:"kind" openapi:"required,enum=a|b"`
+	Code    string            `json:"code,omitempty" openapi:"pattern=^[a-z]{1,3}$"`
+	Count   int               `json:"count" openapi:"minimum=1,maximum=10"`
+	Tags    []string          `json:"tags" openapi:"enum=x|y"`
+	Parts   []*testPart       `json:"parts"`
+	Labels  map[string]string `json:"labels"`
+	Data    json.RawMessage   `json:"data"`
+	Enabled bool              `json:"enabled"`
+	Hidden  string            `json:"-"`
+}
+
+var testEndpoints = []Endpoint{
+	{
+		Pattern: "PUT /things/{id}", OperationID: "updateThing",
+		Params: []*Parameter{
+			{Name: "limit", In: InQuery, Schema: &Schema{Type: "integer", Minimum: new(int64), Maximum: bound(5)}},
+			{Name: "X-Owner", In: InHeader, Required: true, Schema: &Schema{Type: "string", Pattern: "^[a-z]+$"}},
+		},
+		Body:      testThing{},
+		Responses: map[int]any{http.StatusOK: testThing{}},
+		Errors:    []int{http.StatusBadRequest},
+	},
+	{Pattern: "DELETE /things/{id}", Responses: map[int]any{http.StatusNoContent: nil}},
+}
+
+func bound(value int64) *int64 {
+	return &value
+}
+
+func TestBuild(t *testing.T) {
+	doc := Build(Info{Title: "Things", Version: "1"}, testEndpoints)
+
+	if doc.OpenAPI != Version || len(doc.Paths) != 1 || len(doc.Paths["/things/{id}"]) != 2 {
+		t.Fatalf("Build() got paths %v, want put and delete of /things/{id}", doc.Paths)
+	}
+	update := doc.Paths["/things/{id}"]["put"]
+	if param := update.Parameters[0]; param.Name != "id" || param.In != InPath || !param.Required {
+		t.Errorf("first parameter = %+v, want the path parameter of the pattern", param)
+	}
+	if got := update.RequestBody.Content["application/json"].Schema.Ref; got != "#/components/schemas/testThing" {
+		t.Errorf("request body schema = %q, want a reference to testThing", got)
+	}
+	if got := update.Responses["400"].Content["application/json"].Schema.Ref; got != "#/components/schemas/ErrorJSON" {
+		t.Errorf("error schema = %q, want a reference to ErrorJSON", got)
+	}
+	if response := doc.Paths["/things/{id}"]["delete"].Responses["204"]; response == nil || response.Content != nil {
+		t.Errorf("delete response = %+v, want no content", response)
+	}
+
+	thing := doc.Components.Schemas["testThing"]
+	properties := make([]string, 0, len(thing.Properties))
+	for name := range thing.Properties {
+		properties = append(properties, name)
+	}
+	if len(properties) != 9 || thing.Properties["Hidden"] != nil || !thing.Properties["id"].ReadOnly {
+		t.Errorf("testThing properties = %v, want the JSON fields with the embedded id", properties)
+	}
+	if !reflect.DeepEqual(thing.Required, []string{"kind"}) {
+		t.Errorf("testThing required = %v, want [kind]", thing.Required)
+	}
+	if got := thing.Properties["tags"]; got.Type != "array" || !reflect.DeepEqual(got.Items.Enum, []string{"x", "y"}) {
+		t.Errorf("tags = %+v, want an array of x or y", got)
+	}
+	if got := thing.Properties["parts"].Items.Ref; got != "#/components/schemas/testPart" {
+		t.Errorf("parts items = %q, want a reference to testPart", got)
+	}
+	if got := thing.Properties["labels"]; got.Type != "object" || got.AdditionalProperties.Type != "string" {
+		t.Errorf("labels = %+v, want an object of strings", got)
+	}
+	if got := thing.Properties["data"]; got.Type != "" {
+		t.Errorf("data = %+v, want any value", got)
+	}
+
+	// The document is plain JSON, with $ref for the references.
+	data, err := json.Marshal(doc)
+	if err != nil || !strings.Contains(string(data), `"$ref":"#/components/schemas/testPart"`) {
+		t.Errorf("json.Marshal() got = %s, %v", data, err)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	doc := Build(Info{Title: "Things", Version: "1"}, testEndpoints)
+	validator := NewValidator(doc)
+
+	var received string
+	router := http.NewServeMux()
+	router.Handle("PUT /things/{id}", validator.Validate("PUT /things/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	testsList := []struct {
+		name        string
+		url         string
+		contentType string
+		owner       string
+		body        string
+		wantCode    int
+		wantMessage string
+	}{
+		{name: "Valid", url: "/things/1", owner: "bob", body: `{"kind":"a","code":"ab","count":3,"tags":["x"],"parts":[{"name":"p"}],"labels":{"k":"v"},"data":[1]}`, wantCode: http.StatusNoContent},
+		{name: "MissingHeader", url: "/things/1", body: `{"kind":"a"}`, wantCode: http.StatusBadRequest, wantMessage: "header parameter X-Owner is required"},
+		{name: "InvalidQuery", url: "/things/1?limit=9", owner: "bob", body: `{"kind":"a"}`, wantCode: http.StatusBadRequest, wantMessage: "query parameter limit must be between 0 and 5"},
+		{name: "NotAnInteger", url: "/things/1?limit=two", owner: "bob", body: `{"kind":"a"}`, wantCode: http.StatusBadRequest, wantMessage: "query parameter limit must be an integer"},
+		{name: "MissingRequired", url: "/things/1", owner: "bob", body: `{"code":"ab"}`, wantCode: http.StatusBadRequest, wantMessage: "body.kind is required"},
+		{name: "Enum", url: "/things/1", owner: "bob", body: `{"kind":"c","tags":["x","z"]}`, wantCode: http.StatusBadRequest, wantMessage: "body.kind must be one of a, b; body.tags[1] must be one of x, y"},
+		{name: "Pattern", url: "/things/1", owner: "bob", body: `{"kind":"a","code":"ABCD"}`, wantCode: http.StatusBadRequest, wantMessage: "body.code must match ^[a-z]{1,3}$"},
+		{name: "Types", url: "/things/1", owner: "bob", body: `{"kind":"a","count":1.5,"enabled":"yes","parts":[{}],"labels":{"k":1}}`, wantCode: http.StatusBadRequest, wantMessage: "body.count must be an integer; body.enabled must be true or false; body.labels.k must be a string; body.parts[0].name is required"},
+		{name: "Bounds", url: "/things/1", owner: "bob", body: `{"kind":"a","count":11}`, wantCode: http.StatusBadRequest, wantMessage: "body.count must be between 1 and 10"},
+		{name: "InvalidJSON", url: "/things/1", owner: "bob", body: `{"kind":`, wantCode: http.StatusBadRequest, wantMessage: "invalid JSON body: unexpected EOF"},
+		{name: "NoBody", url: "/things/1", owner: "bob", wantCode: http.StatusBadRequest, wantMessage: "body is required"},
+		{name: "TooLarge", url: "/things/1", owner: "bob", body: `{"kind":"a","code":"` + strings.Repeat("a", utils.MaxBodySize) + `"}`, wantCode: http.StatusRequestEntityTooLarge, wantMessage: "body is too large, It must be at most 1048576 bytes"},
+		{name: "UnsupportedMediaType", url: "/things/1", owner: "bob", contentType: "text/plain", body: `{"kind":"a"}`, wantCode: http.StatusUnsupportedMediaType, wantMessage: "unsupported content type, It must be application/json"},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			req := httptest.NewRequest("PUT", tt.url, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json; charset=utf-8")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.owner != "" {
+				req.Header.Set("X-Owner", tt.owner)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("unexpected status code: got %v, want %v (%s)", rr.Code, tt.wantCode, rr.Body)
+			}
+			if tt.wantMessage != "" {
+				var response struct{ Message string }
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.Message != tt.wantMessage {
+					t.Errorf("unexpected message: got %q, %v, want %q", response.Message, err, tt.wantMessage)
+				}
+			}
+			// The handler reads the body the validator read.
+			if tt.wantCode == http.StatusNoContent && received != tt.body {
+				t.Errorf("handler received %q, want %q", received, tt.body)
+			}
+		})
+	}
+}
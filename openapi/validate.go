@@ -0,0 +1,260 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"simple-api-go/utils"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Validator checks the requests of the operations of a document against their parameters and request body.
+type Validator struct {
+	doc *Document
+}
+
+func NewValidator(doc *Document) *Validator {
+	return &Validator{doc: doc}
+}
+
+// Validate runs next for the requests that are valid for the operation of pattern, the http.ServeMux pattern next is
+// served at. It answers the others with 400 Bad Request, listing every problem it found, 413 Request Entity Too
+// Large for a body over utils.MaxBodySize, or 415 Unsupported Media Type for a body of a media type the operation
+// does not take. A pattern the document does not describe is not checked.
+func (v *Validator) Validate(pattern string, next http.Handler) http.Handler {
+	method, path, _ := strings.Cut(pattern, " ")
+	operation := v.doc.Paths[path][strings.ToLower(method)]
+	if operation == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problems := v.checkParameters(operation, r)
+		if operation.RequestBody != nil {
+			bodyProblems, status := v.checkBody(operation.RequestBody, w, r)
+			if status != 0 {
+				utils.ErrorJSONFormat(w, strings.Join(bodyProblems, "; "), status)
+				return
+			}
+			problems = append(problems, bodyProblems...)
+		}
+		if len(problems) > 0 {
+			utils.ErrorJSONFormat(w, strings.Join(problems, "; "), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (v *Validator) checkParameters(operation *Operation, r *http.Request) []string {
+	var problems []string
+	for _, param := range operation.Parameters {
+		var values []string
+		switch param.In {
+		case InPath:
+			if value := r.PathValue(param.Name); value != "" {
+				values = []string{value}
+			}
+		case InQuery:
+			values = r.URL.Query()[param.Name]
+		case InHeader:
+			values = r.Header.Values(param.Name)
+		}
+
+		where := param.In + " parameter " + param.Name
+		if len(values) == 0 {
+			if param.Required {
+				problems = append(problems, where+" is required")
+			}
+			continue
+		}
+		for _, value := range values {
+			problems = append(problems, v.checkString(param.Schema, value, where)...)
+		}
+	}
+	return problems
+}
+
+// checkString checks a parameter, whose value comes as a string whatever its type.
+func (v *Validator) checkString(schema *Schema, value, where string) []string {
+	schema = v.resolve(schema)
+	switch schema.Type {
+	case "integer":
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return []string{where + " must be an integer"}
+		}
+		return checkBounds(schema, number, where)
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return []string{where + " must be true or false"}
+		}
+		return nil
+	default:
+		return checkText(schema, value, where)
+	}
+}
+
+// checkBody reads the JSON body of r, up to utils.MaxBodySize, checks it against the schema of its media type, and
+// puts it back for the handler. It returns the problems of the body, and the status that answers them at once when
+// the body is too large or the operation does not take its media type.
+func (v *Validator) checkBody(requestBody *RequestBody, w http.ResponseWriter, r *http.Request) ([]string, int) {
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			mediaType = contentType
+		}
+	}
+	content, ok := requestBody.Content[mediaType]
+	if !ok {
+		mediaTypes := make([]string, 0, len(requestBody.Content))
+		for name := range requestBody.Content {
+			mediaTypes = append(mediaTypes, name)
+		}
+		slices.Sort(mediaTypes)
+		return []string{"unsupported content type, It must be " + strings.Join(mediaTypes, " or ")}, http.StatusUnsupportedMediaType
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, utils.MaxBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return []string{"body is too large, It must be at most " + strconv.FormatInt(tooLarge.Limit, 10) + " bytes"}, http.StatusRequestEntityTooLarge
+	}
+	if err != nil {
+		return []string{err.Error()}, 0
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		if requestBody.Required {
+			return []string{"body is required"}, 0
+		}
+		return nil, 0
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var body any
+	if err := decoder.Decode(&body); err != nil {
+		return []string{"invalid JSON body: " + err.Error()}, 0
+	}
+	return v.checkValue(content.Schema, body, "body"), 0
+}
+
+// checkValue checks a decoded JSON value against schema. where names the value in the problems, e.g.
+// body.operations[0].op.
+func (v *Validator) checkValue(schema *Schema, value any, where string) []string {
+	schema = v.resolve(schema)
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return []string{where + " must be an object"}
+		}
+		var problems []string
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				problems = append(problems, where+"."+name+" is required")
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				problems = append(problems, v.checkValue(property, object[name], where+"."+name)...)
+			} else if schema.AdditionalProperties != nil {
+				problems = append(problems, v.checkValue(schema.AdditionalProperties, object[name], where+"."+name)...)
+			}
+		}
+		return problems
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return []string{where + " must be an array"}
+		}
+		var problems []string
+		for i, item := range array {
+			problems = append(problems, v.checkValue(schema.Items, item, where+"["+strconv.Itoa(i)+"]")...)
+		}
+		return problems
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return []string{where + " must be a string"}
+		}
+		return checkText(schema, text, where)
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return []string{where + " must be an integer"}
+		}
+		integer, err := number.Int64()
+		if err != nil {
+			return []string{where + " must be an integer"}
+		}
+		return checkBounds(schema, integer, where)
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return []string{where + " must be a number"}
+		}
+		return nil
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{where + " must be true or false"}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// resolve follows the reference of schema to the components of the document.
+func (v *Validator) resolve(schema *Schema) *Schema {
+	if schema == nil {
+		return &Schema{}
+	}
+	if name, ok := strings.CutPrefix(schema.Ref, "#/components/schemas/"); ok {
+		if resolved, ok := v.doc.Components.Schemas[name]; ok {
+			return resolved
+		}
+	}
+	return schema
+}
+
+func checkText(schema *Schema, value, where string) []string {
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, value) {
+		return []string{where + " must be one of " + strings.Join(schema.Enum, ", ")}
+	}
+	if schema.Pattern != "" {
+		pattern := schema.pattern
+		if pattern == nil {
+			pattern = regexp.MustCompile(schema.Pattern)
+		}
+		if !pattern.MatchString(value) {
+			return []string{where + " must match " + schema.Pattern}
+		}
+	}
+	return nil
+}
+
+func checkBounds(schema *Schema, value int64, where string) []string {
+	if (schema.Minimum == nil || value >= *schema.Minimum) && (schema.Maximum == nil || value <= *schema.Maximum) {
+		return nil
+	}
+	switch {
+	case schema.Minimum != nil && schema.Maximum != nil:
+		return []string{where + " must be between " + strconv.FormatInt(*schema.Minimum, 10) + " and " + strconv.FormatInt(*schema.Maximum, 10)}
+	case schema.Minimum != nil:
+		return []string{where + " must be at least " + strconv.FormatInt(*schema.Minimum, 10)}
+	default:
+		return []string{where + " must be at most " + strconv.FormatInt(*schema.Maximum, 10)}
+	}
+}
@@ -0,0 +1,27 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"simple-api-go/utils"
+)
+
+// encodeCursor turns a backend specific position into an opaque token for clients.
+func encodeCursor(position any) (string, error) {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, position any) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return utils.ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, position); err != nil {
+		return utils.ErrInvalidCursor
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package repositories
+
+import (
+	"fmt"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+)
+
+const (
+	// MaxBatchOperations bounds a batch; an atomic batch is bounded by the 100 items of a DynamoDB transaction. A
+	// backend may take fewer, see DeviceDynamoRepository.WriteDevices.
+	MaxBatchOperations       = 500
+	MaxAtomicBatchOperations = 100
+)
+
+// BatchResult is the outcome of one operation of a batch: the device as stored after a create or an update, or
+// the error the operation failed with.
+type BatchResult struct {
+	Device *models.Device
+	Err    error
+}
+
+// ValidateBatch checks the shape of a batch, failing with utils.ErrInvalidBatch. A device can appear only once, so
+// the operations of a batch never depend on each other's order.
+func ValidateBatch(ops []models.DeviceBatchOperation, atomic bool) error {
+	limit := MaxBatchOperations
+	if atomic {
+		limit = MaxAtomicBatchOperations
+	}
+	if len(ops) == 0 || len(ops) > limit {
+		return fmt.Errorf("%w, It must have between 1 and %d operations", utils.ErrInvalidBatch, limit)
+	}
+
+	seen := make(map[string]bool, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case models.BatchCreate, models.BatchUpdate, models.BatchDelete:
+		default:
+			return fmt.Errorf("%w: operation %d has unknown op '%s'", utils.ErrInvalidBatch, i, op.Op)
+		}
+		if seen[op.Device.ID] {
+			return fmt.Errorf("%w: device '%s' appears more than once", utils.ErrInvalidBatch, op.Device.ID)
+		}
+		seen[op.Device.ID] = true
+	}
+	return nil
+}
+
+// abortBatch fails the operations of an atomic batch that would have succeeded on their own.
+func abortBatch(results []BatchResult) {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = BatchResult{Err: utils.ErrBatchAborted}
+		}
+	}
+}
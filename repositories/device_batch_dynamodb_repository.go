@@ -0,0 +1,304 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"math/rand/v2"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"time"
+)
+
+const (
+	batchGetSize       = 100
+	batchWriteSize     = 25
+	batchRetryAttempts = 5
+
+	// MaxDynamoAtomicEventOperations bounds an atomic batch that stores events: its transaction writes an outbox
+	// item along with every device, and takes 100 items at most.
+	MaxDynamoAtomicEventOperations = 50
+)
+
+// batchRetryDelay is the first backoff before reading the unprocessed keys of a BatchGetItem again, doubled on every
+// attempt.
+var batchRetryDelay = 50 * time.Millisecond
+
+// WriteDevices runs an atomic batch as one TransactWriteItems request, which takes MaxDynamoAtomicEventOperations
+// at most when it stores events. Otherwise the batch is written batchWriteSize operations per transaction, see
+// writeDevices: BatchWriteItem can not check conditions, so a create would overwrite a device created after it
+// looked, and an update would not check the version.
+func (d *DeviceDynamoRepository) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]BatchResult, error) {
+	if err := ValidateBatch(ops, atomic); err != nil {
+		return nil, err
+	}
+	switch {
+	case atomic && hasDeviceEvents(ctx):
+		if len(ops) > MaxDynamoAtomicEventOperations {
+			return nil, fmt.Errorf("%w, It must have between 1 and %d operations on DynamoDB", utils.ErrInvalidBatch, MaxDynamoAtomicEventOperations)
+		}
+		return d.transactDevicesWithEvents(ctx, ops)
+	case atomic:
+		return d.transactDevices(ctx, ops)
+	}
+
+	return d.writeDevices(ctx, ops)
+}
+
+// writeDevices applies the operations of a batch that is not atomic, batchWriteSize of them per transaction, with
+// the events of the writes when ctx stores them. The operations that fail report why, and the ones their failure
+// aborted are sent again in a transaction without them, so a chunk takes one more request per failed operation.
+func (d *DeviceDynamoRepository) writeDevices(ctx context.Context, ops []models.DeviceBatchOperation) ([]BatchResult, error) {
+	transact := d.transactDevices
+	if hasDeviceEvents(ctx) {
+		transact = d.transactDevicesWithEvents
+	}
+
+	results := make([]BatchResult, len(ops))
+	for start := 0; start < len(ops); start += batchWriteSize {
+		pending := make([]int, 0, batchWriteSize)
+		for i := start; i < min(start+batchWriteSize, len(ops)); i++ {
+			pending = append(pending, i)
+		}
+		for len(pending) > 0 {
+			chunk := make([]models.DeviceBatchOperation, len(pending))
+			for j, i := range pending {
+				chunk[j] = ops[i]
+			}
+			chunkResults, err := transact(ctx, chunk)
+			if err != nil {
+				return nil, err
+			}
+
+			var aborted []int
+			for j, i := range pending {
+				results[i] = chunkResults[j]
+				if errors.Is(chunkResults[j].Err, utils.ErrBatchAborted) {
+					aborted = append(aborted, i)
+				}
+			}
+			// A transaction cancelled without a failed operation is not sent again.
+			if len(aborted) == len(pending) {
+				break
+			}
+			pending = aborted
+		}
+	}
+	return results, nil
+}
+
+// getDevices reads the devices of ids that exist, 100 per BatchGetItem request.
+func (d *DeviceDynamoRepository) getDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	tenant := utils.TenantFromContext(ctx)
+	table := d.db.GetTableName()
+	devices := make(map[string]*models.Device, len(ids))
+	for start := 0; start < len(ids); start += batchGetSize {
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, batchGetSize)
+		for _, id := range ids[start:min(start+batchGetSize, len(ids))] {
+			keys = append(keys, deviceKey(tenant, id))
+		}
+
+		request := map[string]*dynamodb.KeysAndAttributes{table: {Keys: keys, ConsistentRead: aws.Bool(true)}}
+		for attempt := 0; len(request) > 0; attempt++ {
+			if attempt == batchRetryAttempts {
+				return nil, utils.ErrBatchUnprocessed
+			}
+			if attempt > 0 {
+				if err := backoff(ctx, attempt-1); err != nil {
+					return nil, err
+				}
+			}
+
+			result, err := d.db.Client.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return nil, contextError(ctx, err)
+			}
+			batch, err := unmarshalDevices(result.Responses[table])
+			if err != nil {
+				return nil, err
+			}
+			for _, device := range batch {
+				devices[device.ID] = device
+			}
+			request = result.UnprocessedKeys
+		}
+	}
+	return devices, nil
+}
+
+// transactDevices applies every operation or none. When the transaction is cancelled, the operations whose
+// condition failed report why, and the others report that they were aborted.
+func (d *DeviceDynamoRepository) transactDevices(ctx context.Context, ops []models.DeviceBatchOperation) ([]BatchResult, error) {
+	tenant := utils.TenantFromContext(ctx)
+	now := d.now()
+	items := make([]*dynamodb.TransactWriteItem, len(ops))
+	for i, op := range ops {
+		device := op.Device
+		var err error
+		items[i] = &dynamodb.TransactWriteItem{}
+		switch op.Op {
+		case models.BatchCreate:
+			device = liveDevice(device)
+			device.Version = 1
+			items[i].Put, err = d.devicePut(tenant, &device)
+		case models.BatchUpdate:
+			items[i].Update, err = d.deviceUpdate(tenant, device.ID, &device)
+		case models.BatchDelete:
+			items[i].Update = d.deviceDelete(tenant, device.ID, device.Version, device.DeletedBy, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := d.db.Client.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var cancelled *dynamodb.TransactionCanceledException
+		if !errors.As(err, &cancelled) || len(cancelled.CancellationReasons) != len(ops) {
+			return nil, contextError(ctx, err)
+		}
+		return d.cancelledResults(ctx, ops, cancelled.CancellationReasons), nil
+	}
+
+	results := make([]BatchResult, len(ops))
+
+	// A transaction returns no items, so the updated devices are read back for their new version.
+	var updated []string
+	for i, op := range ops {
+		switch op.Op {
+		case models.BatchCreate:
+			device := liveDevice(op.Device)
+			device.Version = 1
+			results[i].Device = &device
+		case models.BatchUpdate:
+			updated = append(updated, op.Device.ID)
+		}
+	}
+	devices, err := d.getDevices(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if op.Op == models.BatchUpdate {
+			results[i].Device = devices[op.Device.ID]
+		}
+	}
+	return results, nil
+}
+
+// transactDevicesWithEvents is transactDevices with the events of the batch in the same transaction. It reads the
+// devices first, for the events and for the version that every update and delete checks, and fails the batch
+// right away when an operation can not succeed. When another write gets in between, it starts over.
+func (d *DeviceDynamoRepository) transactDevicesWithEvents(ctx context.Context, ops []models.DeviceBatchOperation) ([]BatchResult, error) {
+	tenant := utils.TenantFromContext(ctx)
+	ids := make([]string, len(ops))
+	for i, op := range ops {
+		ids[i] = op.Device.ID
+	}
+
+	for attempt := 1; ; attempt++ {
+		existing, err := d.getDevices(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		now := d.now()
+		results := make([]BatchResult, len(ops))
+		items := make([]*dynamodb.TransactWriteItem, len(ops))
+		stored := make([]*models.Device, len(ops))
+		failed := false
+		for i, op := range ops {
+			device := op.Device
+			current, ok := existing[device.ID]
+			live := ok && current.DeletedAt == ""
+			items[i] = &dynamodb.TransactWriteItem{}
+			switch {
+			case op.Op == models.BatchCreate && live:
+				results[i].Err = utils.ErrDeviceDuplicate
+			case op.Op == models.BatchCreate:
+				device = liveDevice(device)
+				device.Version = 1
+				stored[i] = &device
+				items[i].Put, err = d.devicePut(tenant, &device)
+			case !live:
+				results[i].Err = utils.ErrDeviceNotFound
+			case device.Version != 0 && device.Version != current.Version:
+				results[i].Err = utils.ErrVersionMismatch
+			case op.Op == models.BatchUpdate:
+				device.Version = current.Version
+				items[i].Update, err = d.deviceUpdate(tenant, device.ID, &device)
+				updated := liveDevice(device)
+				updated.Version = current.Version + 1
+				stored[i] = &updated
+			case op.Op == models.BatchDelete:
+				items[i].Update = d.deviceDelete(tenant, device.ID, current.Version, device.DeletedBy, now)
+				stored[i] = d.tombstone(current, device.DeletedBy, now)
+			}
+			if err != nil {
+				return nil, err
+			}
+			failed = failed || results[i].Err != nil
+		}
+		if failed {
+			abortBatch(results)
+			return results, nil
+		}
+
+		err = d.transactWithEvents(ctx, items, stored)
+		if err == nil {
+			for i, op := range ops {
+				if op.Op != models.BatchDelete {
+					results[i].Device = stored[i]
+				}
+			}
+			return results, nil
+		}
+
+		var cancelled *dynamodb.TransactionCanceledException
+		if !errors.As(err, &cancelled) || len(cancelled.CancellationReasons) < len(ops) {
+			return nil, err
+		}
+		reasons := cancelled.CancellationReasons[:len(ops)]
+		if attempt < updateAttempts && slices.ContainsFunc(reasons, func(reason *dynamodb.CancellationReason) bool {
+			return aws.StringValue(reason.Code) == "ConditionalCheckFailed"
+		}) {
+			continue
+		}
+		return d.cancelledResults(ctx, ops, reasons), nil
+	}
+}
+
+// cancelledResults reports the operations of a cancelled transaction: the ones that were cancelled tell why, and
+// the others that they were aborted.
+func (d *DeviceDynamoRepository) cancelledResults(ctx context.Context, ops []models.DeviceBatchOperation, reasons []*dynamodb.CancellationReason) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	for i, reason := range reasons {
+		switch code := aws.StringValue(reason.Code); {
+		case code == "None":
+		case code == "ConditionalCheckFailed" && ops[i].Op == models.BatchCreate:
+			results[i].Err = utils.ErrDeviceDuplicate
+		case code == "ConditionalCheckFailed":
+			results[i].Err = d.conditionError(ctx, ops[i].Device.ID)
+		default:
+			results[i].Err = fmt.Errorf("%s: %s", code, aws.StringValue(reason.Message))
+		}
+	}
+	abortBatch(results)
+	return results
+}
+
+// backoff sleeps before the retry that follows attempt, with full jitter. It wakes up early with the error of ctx
+// when ctx ends.
+func backoff(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(rand.N(batchRetryDelay << attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,290 @@
+package repositories
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDeviceCacheTTL         = 30 * time.Second
+	DefaultDeviceCacheNegativeTTL = 5 * time.Second
+)
+
+// DeviceCacheConfig sizes the cache of a DeviceCacheRepository.
+type DeviceCacheConfig struct {
+	// Size bounds the number of cached devices, the least recently used one is evicted first.
+	Size int
+	// TTL is how long a device read from the backend is served from the cache.
+	TTL time.Duration
+	// NegativeTTL is how long a device that was not found is remembered as missing, 0 disables it.
+	NegativeTTL time.Duration
+}
+
+// CacheStats counts how the reads of a DeviceCacheRepository were served since it was created.
+type CacheStats struct {
+	Hits         uint64 `json:"hits"`
+	NegativeHits uint64 `json:"negativeHits"`
+	Misses       uint64 `json:"misses"`
+	Evictions    uint64 `json:"evictions"`
+	Size         int    `json:"size"`
+}
+
+type deviceCacheEntry struct {
+	key     string         // the id of the device, scoped to its tenant by tenantKey
+	device  *models.Device // nil when the device was not found
+	expires time.Time
+}
+
+// DeviceCacheRepository is a read-through cache of GetDevice in front of another DeviceRepository. Every write goes
+// to the backend and then drops the devices it touched from the cache, so the next read fetches what was stored.
+// Listings are not cached. Entries are keyed by the tenant of the request as well as the id, so a tenant never
+// reads a device cached for another.
+//
+// A write never fills the cache with the record it returns: two concurrent writes may return out of order, and the
+// older record would then stay cached. For the same reason, a read only fills the cache when no write finished
+// while it was waiting for the backend.
+type DeviceCacheRepository struct {
+	next   DeviceRepository
+	config DeviceCacheConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	// generation counts the invalidations, so that a read can tell whether one happened while it was in flight.
+	generation uint64
+	stats      CacheStats
+}
+
+func NewDeviceCacheRepository(next DeviceRepository, config DeviceCacheConfig) *DeviceCacheRepository {
+	return &DeviceCacheRepository{
+		next:    next,
+		config:  config,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Stats returns the hit and miss counts, and the number of devices cached now.
+func (r *DeviceCacheRepository) Stats() CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Size = r.lru.Len()
+	return stats
+}
+
+func (r *DeviceCacheRepository) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	key := tenantKey(utils.TenantFromContext(ctx), id)
+	r.mu.Lock()
+	if device, ok := r.lookup(key); ok {
+		r.mu.Unlock()
+		if device == nil {
+			return nil, utils.ErrDeviceNotFound
+		}
+		return device, nil
+	}
+	r.stats.Misses++
+	generation := r.generation
+	r.mu.Unlock()
+
+	device, err := r.next.GetDevice(ctx, id)
+	switch {
+	case err == nil:
+		r.fill(key, copyDevice(device), r.config.TTL, generation)
+	case errors.Is(err, utils.ErrDeviceNotFound) && r.config.NegativeTTL > 0:
+		r.fill(key, nil, r.config.NegativeTTL, generation)
+	}
+	return device, err
+}
+
+// GetDevices serves the devices it has cached, and reads the others from the backend in one call, which fills the
+// cache with them like GetDevice does.
+func (r *DeviceCacheRepository) GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	tenant := utils.TenantFromContext(ctx)
+	devices := make(map[string]*models.Device, len(ids))
+	var missed []string
+	r.mu.Lock()
+	for _, id := range ids {
+		if _, ok := devices[id]; ok || slices.Contains(missed, id) {
+			continue
+		}
+		device, ok := r.lookup(tenantKey(tenant, id))
+		switch {
+		case !ok:
+			r.stats.Misses++
+			missed = append(missed, id)
+		case device != nil:
+			devices[id] = device
+		}
+	}
+	generation := r.generation
+	r.mu.Unlock()
+	if len(missed) == 0 {
+		return devices, nil
+	}
+
+	read, err := r.next.GetDevices(ctx, missed)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range missed {
+		device, ok := read[id]
+		switch {
+		case ok:
+			devices[id] = device
+			r.fill(tenantKey(tenant, id), copyDevice(device), r.config.TTL, generation)
+		case r.config.NegativeTTL > 0:
+			r.fill(tenantKey(tenant, id), nil, r.config.NegativeTTL, generation)
+		}
+	}
+	return devices, nil
+}
+
+// lookup serves key from the cache: a copy of the device, or nil when it is cached as missing. ok is false when it
+// has to be read from the backend. The caller holds the lock.
+func (r *DeviceCacheRepository) lookup(key string) (*models.Device, bool) {
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*deviceCacheEntry)
+	if !r.now().Before(entry.expires) {
+		r.remove(element)
+		return nil, false
+	}
+
+	r.lru.MoveToFront(element)
+	if entry.device == nil {
+		r.stats.NegativeHits++
+		return nil, true
+	}
+	r.stats.Hits++
+	return copyDevice(entry.device), true
+}
+
+// fill caches what a read started at generation got from the backend, unless a write finished in the meantime.
+func (r *DeviceCacheRepository) fill(key string, device *models.Device, ttl time.Duration, generation uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.generation != generation {
+		return
+	}
+
+	entry := &deviceCacheEntry{key: key, device: device, expires: r.now().Add(ttl)}
+	if element, ok := r.entries[key]; ok {
+		element.Value = entry
+		r.lru.MoveToFront(element)
+		return
+	}
+	r.entries[key] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.config.Size {
+		r.remove(r.lru.Back())
+		r.stats.Evictions++
+	}
+}
+
+func (r *DeviceCacheRepository) remove(element *list.Element) {
+	r.lru.Remove(element)
+	delete(r.entries, element.Value.(*deviceCacheEntry).key)
+}
+
+// invalidate drops ids of the tenant of ctx once a write to them is over, whether it succeeded or not.
+func (r *DeviceCacheRepository) invalidate(ctx context.Context, ids ...string) {
+	tenant := utils.TenantFromContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation++
+	for _, id := range ids {
+		if element, ok := r.entries[tenantKey(tenant, id)]; ok {
+			r.remove(element)
+		}
+	}
+}
+
+// HandleEvent drops the device of a device event from the cache, for the changes made by another process or
+// outside the API, which the cache would otherwise serve stale until its TTL. It makes the cache a subscriber of
+// the domain events, see services.Subscriber.
+func (r *DeviceCacheRepository) HandleEvent(ctx context.Context, event models.Event) error {
+	data, err := event.Decode()
+	if errors.Is(err, utils.ErrUnknownEventType) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch data := data.(type) {
+	case *models.DeviceCreated:
+		r.invalidate(ctx, data.Device.ID)
+	case *models.DeviceUpdated:
+		r.invalidate(ctx, data.Device.ID)
+	case *models.DeviceDeleted:
+		r.invalidate(ctx, data.Device.ID)
+	}
+	return nil
+}
+
+// GetDeletedDevice reads the trash of the backend, the cache only holds live devices.
+func (r *DeviceCacheRepository) GetDeletedDevice(ctx context.Context, id string) (*models.Device, error) {
+	return r.next.GetDeletedDevice(ctx, id)
+}
+
+func (r *DeviceCacheRepository) ListDevices(ctx context.Context, opts ListOptions) (*models.DevicePage, error) {
+	return r.next.ListDevices(ctx, opts)
+}
+
+func (r *DeviceCacheRepository) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	defer r.invalidate(ctx, device.ID)
+	return r.next.CreateDevice(ctx, device)
+}
+
+func (r *DeviceCacheRepository) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+	defer r.invalidate(ctx, id)
+	return r.next.UpdateDevice(ctx, id, device)
+}
+
+// UpdateDeviceFunc reads the device from the backend rather than from the cache, a cached device may be stale.
+func (r *DeviceCacheRepository) UpdateDeviceFunc(ctx context.Context, id string, update func(device *models.Device) error) (*models.Device, error) {
+	defer r.invalidate(ctx, id)
+	return UpdateDeviceFunc(ctx, r.next, id, update)
+}
+
+func (r *DeviceCacheRepository) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	defer r.invalidate(ctx, id)
+	return r.next.DeleteDevice(ctx, id, version, deletedBy)
+}
+
+func (r *DeviceCacheRepository) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	defer r.invalidate(ctx, id)
+	return r.next.RestoreDevice(ctx, id, version)
+}
+
+func (r *DeviceCacheRepository) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]BatchResult, error) {
+	ids := make([]string, len(ops))
+	for i, op := range ops {
+		ids[i] = op.Device.ID
+	}
+	defer r.invalidate(ctx, ids...)
+	return r.next.WriteDevices(ctx, ops, atomic)
+}
+
+// CountByTenant counts the devices of the backend, the cache holds none of its own.
+func (r *DeviceCacheRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	return CountByTenant(ctx, r.next)
+}
+
+// PendingEvents reads the outbox of the backend, the cache holds no events of its own.
+func (r *DeviceCacheRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	return pendingEvents(ctx, r.next, limit)
+}
+
+func (r *DeviceCacheRepository) AckEvents(ctx context.Context, ids []string) error {
+	return ackEvents(ctx, r.next, ids)
+}
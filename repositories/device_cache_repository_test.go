@@ -0,0 +1,227 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"testing"
+	"time"
+)
+
+func newTestCacheRepository(size int) (*DeviceCacheRepository, *DeviceMemoryRepository, *time.Time) {
+	backend := NewDeviceMemoryRepository()
+	r := NewDeviceCacheRepository(backend, DeviceCacheConfig{Size: size, TTL: time.Minute, NegativeTTL: 10 * time.Second})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	return r, backend, &now
+}
+
+func TestDeviceCacheRepository_GetDevice(t *testing.T) {
+	r, backend, now := newTestCacheRepository(10)
+	backend.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"})
+
+	for i := 0; i < 3; i++ {
+		if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.Name != "Device 1" {
+			t.Fatalf("GetDevice() got = %v, %v, want Device 1", device, err)
+		}
+	}
+	if stats := r.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Errorf("Stats() got = %+v, want 2 hits and 1 miss", stats)
+	}
+
+	// A write that goes around the cache is only seen once the entry expires.
+	backend.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Renamed"})
+	if device, _ := r.GetDevice(context.Background(), "1"); device.Name != "Device 1" {
+		t.Errorf("GetDevice() got = %v, want the cached device", device.Name)
+	}
+	*now = now.Add(time.Minute)
+	if device, _ := r.GetDevice(context.Background(), "1"); device.Name != "Renamed" {
+		t.Errorf("GetDevice() got = %v, want the device read again after the TTL", device.Name)
+	}
+
+	// The cached device is a copy.
+	device, _ := r.GetDevice(context.Background(), "1")
+	device.Name = "Changed by the caller"
+	if device, _ := r.GetDevice(context.Background(), "1"); device.Name != "Renamed" {
+		t.Errorf("GetDevice() got = %v, the cache should not share its devices", device.Name)
+	}
+}
+
+func TestDeviceCacheRepository_GetDevices(t *testing.T) {
+	r, backend, _ := newTestCacheRepository(10)
+	backend.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"})
+	backend.CreateDevice(context.Background(), &models.Device{ID: "2", Name: "Device 2"})
+	if _, err := r.GetDevice(context.Background(), "1"); err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+
+	// The cached device is served, the others are read and cached, found or not.
+	for i := 0; i < 2; i++ {
+		devices, err := r.GetDevices(context.Background(), []string{"1", "2", "3", "2"})
+		if err != nil || len(devices) != 2 || devices["1"].Name != "Device 1" || devices["2"].Name != "Device 2" {
+			t.Fatalf("GetDevices() got = %v, %v, want devices 1 and 2", devices, err)
+		}
+	}
+	if stats := r.Stats(); stats.Hits != 3 || stats.NegativeHits != 1 || stats.Misses != 3 || stats.Size != 3 {
+		t.Errorf("Stats() got = %+v, want 3 hits, 1 negative hit and 3 misses", stats)
+	}
+}
+
+// TestDeviceCacheRepository_DynamoDB checks that the cache never fills from a replica of DynamoDB that missed the
+// last write: the write invalidates the entry, and the read after it must see the write.
+func TestDeviceCacheRepository_DynamoDB(t *testing.T) {
+	server, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	server.SetStaleReads(true)
+	r := NewDeviceCacheRepository(NewDynamoDeviceService(instance), DeviceCacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+
+	if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.Name != "Device 1" {
+		t.Fatalf("GetDevice() got = %v, %v, want Device 1", device, err)
+	}
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Renamed"}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.Name != "Renamed" || device.Version != 2 {
+			t.Errorf("GetDevice() got = %v, %v, want Renamed at version 2", device, err)
+		}
+	}
+}
+
+func TestDeviceCacheRepository_NegativeCache(t *testing.T) {
+	r, backend, now := newTestCacheRepository(10)
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.GetDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+			t.Fatalf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+		}
+	}
+	if stats := r.Stats(); stats.NegativeHits != 1 || stats.Misses != 1 {
+		t.Errorf("Stats() got = %+v, want 1 negative hit and 1 miss", stats)
+	}
+
+	// A device created around the cache shows up once the negative TTL is over, one created through it at once.
+	backend.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"})
+	*now = now.Add(10 * time.Second)
+	if _, err := r.GetDevice(context.Background(), "1"); err != nil {
+		t.Errorf("GetDevice() error = %v after the negative TTL", err)
+	}
+	r.GetDevice(context.Background(), "2")
+	r.CreateDevice(context.Background(), &models.Device{ID: "2", Name: "Device 2"})
+	if _, err := r.GetDevice(context.Background(), "2"); err != nil {
+		t.Errorf("GetDevice() error = %v, CreateDevice() should drop the negative entry", err)
+	}
+}
+
+func TestDeviceCacheRepository_Invalidation(t *testing.T) {
+	r, _, _ := newTestCacheRepository(10)
+	r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"})
+	r.CreateDevice(context.Background(), &models.Device{ID: "2", Name: "Device 2"})
+	r.GetDevice(context.Background(), "1")
+	r.GetDevice(context.Background(), "2")
+
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Renamed"}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if device, _ := r.GetDevice(context.Background(), "1"); device.Name != "Renamed" || device.Version != 2 {
+		t.Errorf("GetDevice() got = %v, want the updated device", *device)
+	}
+
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Stale", Version: 1}); !errors.Is(err, utils.ErrVersionMismatch) {
+		t.Fatalf("UpdateDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+	}
+	updated, err := UpdateDeviceFunc(context.Background(), r, "1", func(device *models.Device) error {
+		device.Note = "Noted"
+		return nil
+	})
+	if err != nil || updated.Version != 3 {
+		t.Fatalf("UpdateDeviceFunc() got = %v, %v, want version 3", updated, err)
+	}
+	if device, _ := r.GetDevice(context.Background(), "1"); device.Note != "Noted" {
+		t.Errorf("GetDevice() got = %v, want the device of UpdateDeviceFunc", *device)
+	}
+
+	if err := r.DeleteDevice(context.Background(), "1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if _, err := r.GetDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v after DeleteDevice()", err, utils.ErrDeviceNotFound)
+	}
+	if _, err := r.RestoreDevice(context.Background(), "1", 0); err != nil {
+		t.Fatalf("RestoreDevice() error = %v", err)
+	}
+	if _, err := r.GetDevice(context.Background(), "1"); err != nil {
+		t.Errorf("GetDevice() error = %v after RestoreDevice()", err)
+	}
+
+	ops := []models.DeviceBatchOperation{{Op: models.BatchDelete, Device: models.Device{ID: "2"}}}
+	if _, err := r.WriteDevices(context.Background(), ops, false); err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	if _, err := r.GetDevice(context.Background(), "2"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v after WriteDevices()", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func TestDeviceCacheRepository_Eviction(t *testing.T) {
+	r, backend, _ := newTestCacheRepository(2)
+	for _, id := range []string{"1", "2", "3"} {
+		backend.CreateDevice(context.Background(), &models.Device{ID: id})
+	}
+
+	r.GetDevice(context.Background(), "1")
+	r.GetDevice(context.Background(), "2")
+	r.GetDevice(context.Background(), "1") // 2 is now the least recently used
+	r.GetDevice(context.Background(), "3")
+	if stats := r.Stats(); stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("Stats() got = %+v, want 1 eviction and 2 devices", stats)
+	}
+
+	misses := r.Stats().Misses
+	r.GetDevice(context.Background(), "1")
+	r.GetDevice(context.Background(), "3")
+	if got := r.Stats().Misses; got != misses {
+		t.Errorf("GetDevice() got %v misses for the cached devices", got-misses)
+	}
+	r.GetDevice(context.Background(), "2")
+	if got := r.Stats().Misses; got != misses+1 {
+		t.Errorf("GetDevice() the evicted device should be a miss")
+	}
+}
+
+// TestDeviceCacheRepository_Concurrent is meant for go test -race, see testConcurrentDevices.
+func TestDeviceCacheRepository_Concurrent(t *testing.T) {
+	testConcurrentDevices(t, NewDeviceCacheRepository(NewDeviceMemoryRepository(), DeviceCacheConfig{Size: 2, TTL: time.Minute}))
+}
+
+func TestDeviceCacheRepository_HandleEvent(t *testing.T) {
+	r, backend, _ := newTestCacheRepository(10)
+	tenantB := utils.WithTenant(context.Background(), "tenant-b")
+	for _, ctx := range []context.Context{context.Background(), tenantB} {
+		backend.CreateDevice(ctx, &models.Device{ID: "1", Name: "Device 1"})
+		r.GetDevice(ctx, "1")
+	}
+
+	// A write made elsewhere reaches the cache as an event of its tenant.
+	backend.UpdateDevice(tenantB, "1", &models.Device{ID: "1", Name: "Renamed"})
+	event, err := models.NewEvent("tenant-b", models.DeviceUpdated{Device: models.Device{ID: "1", Name: "Renamed", Version: 2}}, time.Now())
+	if err != nil {
+		t.Fatalf("NewEvent() error = %v", err)
+	}
+	if err := r.HandleEvent(tenantB, event); err != nil {
+		t.Fatalf("HandleEvent() error = %v", err)
+	}
+	if device, _ := r.GetDevice(tenantB, "1"); device.Name != "Renamed" {
+		t.Errorf("GetDevice() got = %v, want the device read again after its event", device.Name)
+	}
+	if stats := r.Stats(); stats.Size != 2 || stats.Misses != 3 {
+		t.Errorf("Stats() got = %+v, want only the device of tenant-b read again", stats)
+	}
+
+	if err := r.HandleEvent(context.Background(), models.Event{Type: "DeviceRenamed"}); err != nil {
+		t.Errorf("HandleEvent() error = %v, want the unknown events ignored", err)
+	}
+}
@@ -1,134 +1,727 @@
 package repositories
 
 import (
-	"cmp"
-	"errors"
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"maps"
 	"simple-api-go/db"
 	"simple-api-go/models"
 	"simple-api-go/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// DeviceDynamoRepository stores the devices in the single table of dynamodb_table.go, keyed by their tenant and
+// their ID, so that a call only ever reaches the items of the tenant of its context. The listings query a partition
+// of the tenant too: the GSI1 partition of a model for a deviceModel equality filter, and the GSI2 partition of the
+// devices of the tenant otherwise.
+//
+// A write that stores events puts them into the outbox partition in the same transaction as the device. The events
+// carry the device as stored, which an update of DynamoDB only returns once it is applied: so those writes read the
+// device first, check in the transaction that its version is still the one read, and start over when another write
+// got in between.
 type DeviceDynamoRepository struct {
-	db *db.DynamoDBInstance
+	db         *db.DynamoDBInstance
+	outbox     dynamoEventOutbox
+	purgeAfter time.Duration
+	now        func() time.Time
 }
 
 func NewDynamoDeviceService(db *db.DynamoDBInstance) *DeviceDynamoRepository {
 	return &DeviceDynamoRepository{
-		db: db,
+		db:         db,
+		outbox:     dynamoEventOutbox{db: db, source: deviceEventSource},
+		purgeAfter: DefaultPurgeAfter,
+		now:        time.Now,
 	}
 }
 
-func (d *DeviceDynamoRepository) CreateDevice(device *models.Device) (*models.Device, error) {
-	av, err := dynamodbattribute.MarshalMap(device)
+// SetPurgeAfter changes how long deleted devices stay in the trash, DefaultPurgeAfter by default. The table removes
+// them with a TTL on purgeAt.
+func (d *DeviceDynamoRepository) SetPurgeAfter(purgeAfter time.Duration) {
+	d.purgeAfter = purgeAfter
+}
+
+// marshalDevice is the item of a device of tenant.
+func marshalDevice(tenant string, device *models.Device) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(device)
 	if err != nil {
 		return nil, err
 	}
+	setItemKeys(item, deviceItem, tenant, map[string]string{
+		pkAttribute:     tenantKey(tenant, devicePrefix+device.ID),
+		skAttribute:     deviceSortKey,
+		gsi1PKAttribute: modelDevicesKey(tenant, device.DeviceModel),
+		gsi1SKAttribute: devicePrefix + device.ID,
+		gsi2PKAttribute: tenantDevicesKey(tenant),
+		gsi2SKAttribute: devicePrefix + device.ID,
+	})
+	return item, nil
+}
+
+// unmarshalDevices reads the devices of items.
+func unmarshalDevices(items []map[string]*dynamodb.AttributeValue) ([]*models.Device, error) {
+	devices := []*models.Device{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func unmarshalDevice(item map[string]*dynamodb.AttributeValue) (*models.Device, error) {
+	device := &models.Device{}
+	if err := dynamodbattribute.UnmarshalMap(item, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (d *DeviceDynamoRepository) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	*device = liveDevice(*device)
+	device.Version = 1
+	put, err := d.devicePut(utils.TenantFromContext(ctx), device)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasDeviceEvents(ctx) {
+		err := d.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{{Put: put}}, []*models.Device{device})
+		if cancelledOnCondition(err, 0) {
+			return nil, utils.ErrDeviceDuplicate
+		}
+		if err != nil {
+			return nil, err
+		}
+		return device, nil
+	}
 
 	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(d.db.GetTableName()),
+		Item:                     put.Item,
+		TableName:                put.TableName,
+		ConditionExpression:      put.ConditionExpression,
+		ExpressionAttributeNames: put.ExpressionAttributeNames,
 	}
 
-	_, err = d.db.Client.PutItem(input)
+	_, err = d.db.Client.PutItemWithContext(ctx, input)
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, utils.ErrDeviceDuplicate
+		}
+		return nil, contextError(ctx, err)
+	}
+
+	return device, nil
+}
+
+// devicePut is the conditional put behind CreateDevice, shared with transactions. It replaces a deleted device.
+func (d *DeviceDynamoRepository) devicePut(tenant string, device *models.Device) (*dynamodb.Put, error) {
+	item, err := marshalDevice(tenant, device)
 	if err != nil {
 		return nil, err
 	}
+	return &dynamodb.Put{
+		Item:                     item,
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_not_exists(#PK) OR attribute_exists(#DA)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute), "#DA": aws.String("deletedAt")},
+	}, nil
+}
+
+// transactWithEvents writes items in one transaction with the events of stored, the devices as items store them.
+func (d *DeviceDynamoRepository) transactWithEvents(ctx context.Context, items []*dynamodb.TransactWriteItem, stored []*models.Device) error {
+	events := make([][]models.Event, len(stored))
+	for i, device := range stored {
+		var err error
+		if events[i], err = deviceEvents(ctx, device); err != nil {
+			return err
+		}
+	}
+	return d.outbox.transact(ctx, items, events)
+}
 
+func (d *DeviceDynamoRepository) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	device, err := d.getItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if device.DeletedAt != "" {
+		return nil, utils.ErrDeviceNotFound
+	}
 	return device, nil
 }
 
-func (d *DeviceDynamoRepository) GetDevice(id string) (*models.Device, error) {
-	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": id})
+// GetDevices reads the devices with BatchGetItem, batchGetSize per request. The request takes a key only once.
+func (d *DeviceDynamoRepository) GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	unique := slices.Clone(ids)
+	slices.Sort(unique)
+	devices, err := d.getDevices(ctx, slices.Compact(unique))
 	if err != nil {
 		return nil, err
 	}
+	maps.DeleteFunc(devices, func(_ string, device *models.Device) bool {
+		return device.DeletedAt != ""
+	})
+	return devices, nil
+}
+
+func (d *DeviceDynamoRepository) GetDeletedDevice(ctx context.Context, id string) (*models.Device, error) {
+	device, err := d.getItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return deletedDevice(device, d.now())
+}
 
+// getItem reads a device whether it is deleted or not. The read is strongly consistent: the device cache keeps what
+// it reads, and the version that the compare-and-set writes expect must not be behind the last write.
+func (d *DeviceDynamoRepository) getItem(ctx context.Context, id string) (*models.Device, error) {
 	input := &dynamodb.GetItemInput{
-		Key:       key,
-		TableName: aws.String(d.db.GetTableName()),
+		Key:            deviceKey(utils.TenantFromContext(ctx), id),
+		TableName:      aws.String(d.db.GetTableName()),
+		ConsistentRead: aws.Bool(true),
 	}
 
-	result, err := d.db.Client.GetItem(input)
+	result, err := d.db.Client.GetItemWithContext(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 
 	if result.Item == nil {
 		return nil, utils.ErrDeviceNotFound
 	}
 
-	device := &models.Device{}
-	err = dynamodbattribute.UnmarshalMap(result.Item, device)
-	if err != nil {
+	return unmarshalDevice(result.Item)
+}
+
+// ListDevices pages through the devices matching opts.Filter. An equality filter on deviceModel is answered by a
+// Query on the GSI1 partition of the model, anything else by a Query on the GSI2 partition of the devices of the
+// tenant, so a listing never reads the items of other tenants or types. The cursor wraps the key to resume from.
+// Sorting needs the complete result set, so sorted listings read every matching device and page in memory.
+func (d *DeviceDynamoRepository) ListDevices(ctx context.Context, opts ListOptions) (*models.DevicePage, error) {
+	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
+	tenant := utils.TenantFromContext(ctx)
 
-	return device, nil
+	if len(opts.Sort) > 0 {
+		var devices []*models.Device
+		var startKey map[string]*dynamodb.AttributeValue
+		for {
+			batch, lastKey, err := d.readDevices(ctx, opts, startKey, 0)
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, batch...)
+			if lastKey == nil {
+				return pageDevices(devices, opts)
+			}
+			startKey = lastKey
+		}
+	}
+
+	var startKey map[string]*dynamodb.AttributeValue
+	if opts.Cursor != "" {
+		var err error
+		if startKey, err = decodeDynamoCursor(opts.Cursor, deviceListIndex(opts.Filter)); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := normalizeLimit(opts.Limit)
+	page := &models.DevicePage{Items: []*models.Device{}}
+	for {
+		// A Limit counts the items read before the filter is applied, so keep reading until the page is full.
+		batch, lastKey, err := d.readDevices(ctx, opts, startKey, limit)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, batch...)
+
+		if len(page.Items) > limit {
+			page.Items = page.Items[:limit]
+			lastKey = listKey(tenant, opts.Filter, page.Items[limit-1])
+		}
+		if lastKey == nil {
+			return page, nil
+		}
+		if len(page.Items) == limit {
+			page.NextCursor, err = encodeDynamoCursor(lastKey)
+			if err != nil {
+				return nil, err
+			}
+			return page, nil
+		}
+		startKey = lastKey
+	}
 }
 
-func (d *DeviceDynamoRepository) UpdateDevice(id string, updatedDevice *models.Device) (*models.Device, error) {
-	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": id})
+// readDevices runs a single Query request and returns the matching devices and the LastEvaluatedKey.
+func (d *DeviceDynamoRepository) readDevices(ctx context.Context, opts ListOptions, startKey map[string]*dynamodb.AttributeValue, limit int) ([]*models.Device, map[string]*dynamodb.AttributeValue, error) {
+	filterExpression, names, values := buildFilterExpression(opts.Filter)
+	if filterExpression != "" {
+		filterExpression += " AND "
+	}
+	filterExpression += d.trashCondition(opts.Deleted, names, values)
+	tenant := utils.TenantFromContext(ctx)
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(d.db.GetTableName()),
+		FilterExpression:          aws.String(filterExpression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ExclusiveStartKey:         startKey,
+	}
+	input.IndexName = aws.String(deviceListIndex(opts.Filter))
+	if deviceModel, ok := opts.Filter.equality("deviceModel"); ok {
+		names["#GPK"] = aws.String(gsi1PKAttribute)
+		values[":partition"] = stringValue(modelDevicesKey(tenant, deviceModel))
+	} else {
+		names["#GPK"] = aws.String(gsi2PKAttribute)
+		values[":partition"] = stringValue(tenantDevicesKey(tenant))
+	}
+	input.KeyConditionExpression = aws.String("#GPK = :partition")
+	if limit > 0 {
+		input.Limit = aws.Int64(int64(limit))
+	}
+
+	result, err := d.db.Client.QueryWithContext(ctx, input)
+	if err != nil {
+		return nil, nil, contextError(ctx, err)
+	}
+	items, lastKey := result.Items, result.LastEvaluatedKey
+
+	devices, err := unmarshalDevices(items)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(lastKey) == 0 {
+		lastKey = nil
+	}
+	return devices, lastKey, nil
+}
+
+// trashCondition keeps either the live devices, or the deleted ones that are still in their purge period: the TTL
+// can take a while to remove an expired item.
+func (d *DeviceDynamoRepository) trashCondition(deleted bool, names map[string]*string, values map[string]*dynamodb.AttributeValue) string {
+	names["#DA"] = aws.String("deletedAt")
+	if !deleted {
+		return "attribute_not_exists(#DA)"
+	}
+	names["#P"] = aws.String(purgeAttribute)
+	values[":now"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(d.now().Unix(), 10))}
+	return "attribute_exists(#DA) AND #P > :now"
+}
+
+// buildFilterExpression translates a DeviceFilter into a FilterExpression with its attribute names and values.
+func buildFilterExpression(filter DeviceFilter) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	var conditions []string
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+
+	for i, c := range filter {
+		name := "#F" + strconv.Itoa(i)
+		value := ":f" + strconv.Itoa(i)
+		names[name] = aws.String(c.Field)
+		values[value] = &dynamodb.AttributeValue{S: aws.String(c.Value)}
+
+		switch c.Operator {
+		case FilterEquals:
+			conditions = append(conditions, name+" = "+value)
+		case FilterPrefix:
+			conditions = append(conditions, "begins_with("+name+", "+value+")")
+		case FilterContains:
+			conditions = append(conditions, "contains("+name+", "+value+")")
+		}
+	}
+	return strings.Join(conditions, " AND "), names, values
+}
+
+// listKey is the ExclusiveStartKey that resumes a listing right after device of tenant.
+// deviceListIndex is the index a listing with filter queries: GSI1 for the devices of a model, GSI2 otherwise.
+func deviceListIndex(filter DeviceFilter) string {
+	if _, ok := filter.equality("deviceModel"); ok {
+		return gsi1Index
+	}
+	return gsi2Index
+}
+
+func listKey(tenant string, filter DeviceFilter, device *models.Device) map[string]*dynamodb.AttributeValue {
+	key := deviceKey(tenant, device.ID)
+	if _, ok := filter.equality("deviceModel"); ok {
+		key[gsi1PKAttribute] = stringValue(modelDevicesKey(tenant, device.DeviceModel))
+		key[gsi1SKAttribute] = stringValue(devicePrefix + device.ID)
+	} else {
+		key[gsi2PKAttribute] = stringValue(tenantDevicesKey(tenant))
+		key[gsi2SKAttribute] = stringValue(devicePrefix + device.ID)
+	}
+	return key
+}
+
+// UpdateDevice replaces every field of the device and increments the version in the same request. The expected
+// version is checked with a ConditionExpression so that two concurrent updates can not both succeed, and the item
+// is read back with ALL_NEW so the caller gets the record as stored.
+func (d *DeviceDynamoRepository) UpdateDevice(ctx context.Context, id string, updatedDevice *models.Device) (*models.Device, error) {
+	if hasDeviceEvents(ctx) {
+		return d.updateWithEvents(ctx, id, updatedDevice)
+	}
+
+	tenant := utils.TenantFromContext(ctx)
+	update, err := d.deviceUpdate(tenant, id, updatedDevice)
 	if err != nil {
 		return nil, err
 	}
 
-	existingDevice, err := d.GetDevice(id)
+	input := &dynamodb.UpdateItemInput{
+		Key:                       update.Key,
+		TableName:                 update.TableName,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+		ReturnValues:              aws.String("ALL_NEW"),
+	}
+
+	result, err := d.db.Client.UpdateItemWithContext(ctx, input)
 	if err != nil {
-		return nil, errors.New("device not found")
+		if isConditionFailed(err) {
+			return nil, d.conditionError(ctx, id)
+		}
+		return nil, contextError(ctx, err)
 	}
 
+	return unmarshalDevice(result.Attributes)
+}
+
+// updateWithEvents is UpdateDevice in a transaction with its events. An update that does not check the version
+// checks the one it read.
+func (d *DeviceDynamoRepository) updateWithEvents(ctx context.Context, id string, updatedDevice *models.Device) (*models.Device, error) {
+	tenant := utils.TenantFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		expected := *updatedDevice
+		if expected.Version == 0 {
+			current, err := d.GetDevice(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			expected.Version = current.Version
+		}
+		update, err := d.deviceUpdate(tenant, id, &expected)
+		if err != nil {
+			return nil, err
+		}
+		stored := liveDevice(expected)
+		stored.ID = id
+		stored.Version = expected.Version + 1
+
+		err = d.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{{Update: update}}, []*models.Device{&stored})
+		switch {
+		case cancelledOnCondition(err, 0) && updatedDevice.Version == 0 && attempt < updateAttempts:
+			continue
+		case cancelledOnCondition(err, 0):
+			return nil, d.conditionError(ctx, id)
+		case err != nil:
+			return nil, err
+		}
+		return &stored, nil
+	}
+}
+
+// deviceUpdate is the conditional update behind UpdateDevice, shared with transactions. It moves the device to the
+// GSI1 partition of its new model.
+func (d *DeviceDynamoRepository) deviceUpdate(tenant, id string, updatedDevice *models.Device) (*dynamodb.Update, error) {
 	expressionAttributeNames := map[string]*string{
-		"#N":  aws.String("name"),
-		"#DM": aws.String("deviceModel"),
-		"#NT": aws.String("note"),
-		"#S":  aws.String("serial"),
+		"#PK":   aws.String(pkAttribute),
+		"#G1PK": aws.String(gsi1PKAttribute),
+		"#DA":   aws.String("deletedAt"),
+		"#N":    aws.String("name"),
+		"#DM":   aws.String("deviceModel"),
+		"#NT":   aws.String("note"),
+		"#S":    aws.String("serial"),
+		"#V":    aws.String("version"),
 	}
 
 	expressionAttributeValues := map[string]*dynamodb.AttributeValue{
-		":name":        &dynamodb.AttributeValue{S: aws.String(cmp.Or(updatedDevice.Name, existingDevice.Name))},
-		":deviceModel": &dynamodb.AttributeValue{S: aws.String(updatedDevice.DeviceModel)},
-		":note":        &dynamodb.AttributeValue{S: aws.String(updatedDevice.Note)},
-		":serial":      &dynamodb.AttributeValue{S: aws.String(updatedDevice.Serial)},
+		":name":        {S: aws.String(updatedDevice.Name)},
+		":deviceModel": {S: aws.String(updatedDevice.DeviceModel)},
+		":note":        {S: aws.String(updatedDevice.Note)},
+		":serial":      {S: aws.String(updatedDevice.Serial)},
+		":model":       stringValue(modelDevicesKey(tenant, updatedDevice.DeviceModel)),
+		":zero":        {N: aws.String("0")},
+		":one":         {N: aws.String("1")},
 	}
 
-	input := &dynamodb.UpdateItemInput{
-		Key:                       key,
+	conditionExpression := "attribute_exists(#PK) AND attribute_not_exists(#DA)"
+	if updatedDevice.Version != 0 {
+		conditionExpression += " AND #V = :version"
+		expressionAttributeValues[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(updatedDevice.Version, 10))}
+	}
+
+	return &dynamodb.Update{
+		Key:                       deviceKey(tenant, id),
 		TableName:                 aws.String(d.db.GetTableName()),
 		ExpressionAttributeNames:  expressionAttributeNames,
 		ExpressionAttributeValues: expressionAttributeValues,
-		UpdateExpression:          aws.String("SET #N = :name, #DM = :deviceModel, #NT = :note, #S = :serial"),
-		ReturnValues:              aws.String("UPDATED_NEW"),
+		UpdateExpression:          aws.String("SET #N = :name, #DM = :deviceModel, #G1PK = :model, #NT = :note, #S = :serial, #V = if_not_exists(#V, :zero) + :one"),
+		ConditionExpression:       aws.String(conditionExpression),
+	}, nil
+}
+
+// DeleteDevice turns the device into a tombstone, which keeps every field and gets a purgeAt for the TTL.
+func (d *DeviceDynamoRepository) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	if hasDeviceEvents(ctx) {
+		return d.deleteWithEvents(ctx, id, version, deletedBy)
 	}
 
-	_, err = d.db.Client.UpdateItem(input)
+	update := d.deviceDelete(utils.TenantFromContext(ctx), id, version, deletedBy, d.now())
+
+	input := &dynamodb.UpdateItemInput{
+		Key:                       update.Key,
+		TableName:                 update.TableName,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+	}
+
+	_, err := d.db.Client.UpdateItemWithContext(ctx, input)
 	if err != nil {
-		return nil, err
+		if isConditionFailed(err) {
+			return d.conditionError(ctx, id)
+		}
+		return contextError(ctx, err)
 	}
 
-	return updatedDevice, nil
+	return nil
 }
 
-func (d *DeviceDynamoRepository) DeleteDevice(id string) error {
-	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": id})
-	if err != nil {
+// deleteWithEvents is DeleteDevice in a transaction with its events, which carry the tombstone of the device it
+// read.
+func (d *DeviceDynamoRepository) deleteWithEvents(ctx context.Context, id string, version int64, deletedBy string) error {
+	tenant := utils.TenantFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		current, err := d.GetDevice(ctx, id)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != current.Version {
+			return utils.ErrVersionMismatch
+		}
+		now := d.now()
+		update := d.deviceDelete(tenant, id, current.Version, deletedBy, now)
+
+		err = d.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{{Update: update}}, []*models.Device{d.tombstone(current, deletedBy, now)})
+		switch {
+		case cancelledOnCondition(err, 0) && version == 0 && attempt < updateAttempts:
+			continue
+		case cancelledOnCondition(err, 0):
+			return d.conditionError(ctx, id)
+		}
 		return err
 	}
+}
 
-	input := &dynamodb.DeleteItemInput{
-		Key:       key,
+// tombstone is device as deviceDelete leaves it at now.
+func (d *DeviceDynamoRepository) tombstone(device *models.Device, deletedBy string, now time.Time) *models.Device {
+	tombstone := *device
+	tombstone.DeletedAt = now.UTC().Format(time.RFC3339)
+	tombstone.DeletedBy = deletedBy
+	tombstone.PurgeAt = now.Add(d.purgeAfter).Unix()
+	tombstone.Version = device.Version + 1
+	return &tombstone
+}
+
+// deviceDelete is the conditional update behind DeleteDevice at now, shared with transactions.
+func (d *DeviceDynamoRepository) deviceDelete(tenant, id string, version int64, deletedBy string, now time.Time) *dynamodb.Update {
+	update := &dynamodb.Update{
+		Key:       deviceKey(tenant, id),
 		TableName: aws.String(d.db.GetTableName()),
+		ExpressionAttributeNames: map[string]*string{
+			"#PK": aws.String(pkAttribute),
+			"#DA": aws.String("deletedAt"),
+			"#DB": aws.String("deletedBy"),
+			"#P":  aws.String(purgeAttribute),
+			"#V":  aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":deletedAt": {S: aws.String(now.UTC().Format(time.RFC3339))},
+			":deletedBy": {S: aws.String(deletedBy)},
+			":purgeAt":   {N: aws.String(strconv.FormatInt(now.Add(d.purgeAfter).Unix(), 10))},
+			":zero":      {N: aws.String("0")},
+			":one":       {N: aws.String("1")},
+		},
+		UpdateExpression:    aws.String("SET #DA = :deletedAt, #DB = :deletedBy, #P = :purgeAt, #V = if_not_exists(#V, :zero) + :one"),
+		ConditionExpression: aws.String("attribute_exists(#PK) AND attribute_not_exists(#DA)"),
+	}
+	if version != 0 {
+		update.ConditionExpression = aws.String("attribute_exists(#PK) AND attribute_not_exists(#DA) AND #V = :version")
+		update.ExpressionAttributeValues[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))}
+	}
+	return update
+}
+
+// RestoreDevice takes the device out of the trash, as long as its purge period is not over.
+func (d *DeviceDynamoRepository) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	if hasDeviceEvents(ctx) {
+		return d.restoreWithEvents(ctx, id, version)
 	}
 
-	_, err = d.db.Client.DeleteItem(input)
+	update := d.deviceRestore(utils.TenantFromContext(ctx), id, version, d.now())
+	input := &dynamodb.UpdateItemInput{
+		Key:                       update.Key,
+		TableName:                 update.TableName,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+		ReturnValues:              aws.String("ALL_NEW"),
+	}
+
+	result, err := d.db.Client.UpdateItemWithContext(ctx, input)
 	if err != nil {
-		if err.Error() == "item not found" {
-			return utils.ErrDeviceNotFound
+		if isConditionFailed(err) {
+			return nil, d.restoreError(ctx, id)
 		}
+		return nil, contextError(ctx, err)
+	}
+
+	return unmarshalDevice(result.Attributes)
+}
+
+// restoreWithEvents is RestoreDevice in a transaction with its events, which carry the device it read out of the
+// trash.
+func (d *DeviceDynamoRepository) restoreWithEvents(ctx context.Context, id string, version int64) (*models.Device, error) {
+	tenant := utils.TenantFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		now := d.now()
+		current, err := d.getItem(ctx, id)
+		switch {
+		case err != nil:
+			return nil, err
+		case current.DeletedAt == "":
+			return nil, utils.ErrDeviceNotDeleted
+		case current.PurgeAt <= now.Unix():
+			return nil, utils.ErrDeviceNotFound
+		case version != 0 && version != current.Version:
+			return nil, utils.ErrVersionMismatch
+		}
+		restored := liveDevice(*current)
+		restored.Version = current.Version + 1
+		update := d.deviceRestore(tenant, id, current.Version, now)
+
+		err = d.transactWithEvents(ctx, []*dynamodb.TransactWriteItem{{Update: update}}, []*models.Device{&restored})
+		switch {
+		case cancelledOnCondition(err, 0) && version == 0 && attempt < updateAttempts:
+			continue
+		case cancelledOnCondition(err, 0):
+			return nil, d.restoreError(ctx, id)
+		case err != nil:
+			return nil, err
+		}
+		return &restored, nil
+	}
+}
+
+// deviceRestore is the conditional update behind RestoreDevice at now.
+func (d *DeviceDynamoRepository) deviceRestore(tenant, id string, version int64, now time.Time) *dynamodb.Update {
+	expressionAttributeValues := map[string]*dynamodb.AttributeValue{
+		":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		":one": {N: aws.String("1")},
+	}
+	conditionExpression := "attribute_exists(#DA) AND #P > :now"
+	if version != 0 {
+		conditionExpression += " AND #V = :version"
+		expressionAttributeValues[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))}
+	}
+
+	return &dynamodb.Update{
+		Key:       deviceKey(tenant, id),
+		TableName: aws.String(d.db.GetTableName()),
+		ExpressionAttributeNames: map[string]*string{
+			"#DA": aws.String("deletedAt"),
+			"#DB": aws.String("deletedBy"),
+			"#P":  aws.String(purgeAttribute),
+			"#V":  aws.String("version"),
+		},
+		ExpressionAttributeValues: expressionAttributeValues,
+		UpdateExpression:          aws.String("REMOVE #DA, #DB, #P SET #V = #V + :one"),
+		ConditionExpression:       aws.String(conditionExpression),
+	}
+}
+
+// restoreError tells why a device could not be restored.
+func (d *DeviceDynamoRepository) restoreError(ctx context.Context, id string) error {
+	device, err := d.getItem(ctx, id)
+	switch {
+	case err != nil:
 		return err
+	case device.DeletedAt == "":
+		return utils.ErrDeviceNotDeleted
+	case device.PurgeAt <= d.now().Unix():
+		return utils.ErrDeviceNotFound
+	default:
+		return utils.ErrVersionMismatch
 	}
+}
 
-	return nil
+// conditionError tells apart the two reasons a conditional write on a device fails: the device is gone, or
+// another request changed its version.
+func (d *DeviceDynamoRepository) conditionError(ctx context.Context, id string) error {
+	if _, err := d.GetDevice(ctx, id); err != nil {
+		return err
+	}
+	return utils.ErrVersionMismatch
+}
+
+// The table keys are all strings, so a LastEvaluatedKey fits in a plain string map.
+func encodeDynamoCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	position := map[string]string{}
+	if err := dynamodbattribute.UnmarshalMap(key, &position); err != nil {
+		return "", err
+	}
+	return encodeCursor(position)
+}
+
+// cursorAttributes are the attributes of the LastEvaluatedKey of a Query on the table, "", or on one of its indexes:
+// the keys of the index and those of the table.
+var cursorAttributes = map[string][]string{
+	"":        {pkAttribute, skAttribute},
+	gsi1Index: {pkAttribute, skAttribute, gsi1PKAttribute, gsi1SKAttribute},
+	gsi2Index: {pkAttribute, skAttribute, gsi2PKAttribute, gsi2SKAttribute},
+}
+
+// decodeDynamoCursor returns the ExclusiveStartKey of a Query on index. A cursor that does not hold exactly the key
+// attributes of index was not made by that Query, and is rejected before DynamoDB gets to see it.
+func decodeDynamoCursor(cursor string, index string) (map[string]*dynamodb.AttributeValue, error) {
+	position := map[string]string{}
+	if err := decodeCursor(cursor, &position); err != nil {
+		return nil, err
+	}
+	attributes := cursorAttributes[index]
+	if len(position) != len(attributes) {
+		return nil, utils.ErrInvalidCursor
+	}
+	for _, attribute := range attributes {
+		if position[attribute] == "" {
+			return nil, utils.ErrInvalidCursor
+		}
+	}
+	return dynamodbattribute.MarshalMap(position)
+}
+
+// CountByTenant scans the whole table for the tenant of every device, the trash included.
+func (d *DeviceDynamoRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	return countDynamoByTenant(ctx, d.db, deviceItem)
+}
+
+// PendingEvents returns the oldest events of the outbox partition of the devices.
+func (d *DeviceDynamoRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	return d.outbox.pending(ctx, limit)
+}
+
+func (d *DeviceDynamoRepository) AckEvents(ctx context.Context, ids []string) error {
+	return d.outbox.ack(ctx, ids)
 }
@@ -0,0 +1,382 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"simple-api-go/db"
+	"simple-api-go/db/dynamotest"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dynamoTableInput is the table of DynamoSchema, without its TTL.
+func dynamoTableInput(name string) *dynamodb.CreateTableInput {
+	return DynamoSchema(name)[0].CreateTableInput()
+}
+
+// newFakeDynamoInstance creates the table of input on a new in-process DynamoDB, and connects to it.
+func newFakeDynamoInstance(t *testing.T, input *dynamodb.CreateTableInput) (*dynamotest.Server, *db.DynamoDBInstance) {
+	server := dynamotest.NewServer()
+	t.Cleanup(server.Close)
+	client := server.Client()
+	if _, err := client.CreateTable(input); err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+	instance, err := db.NewDynamoDBInstance(client, aws.StringValue(input.TableName))
+	if err != nil {
+		t.Fatalf("NewDynamoDBInstance() error = %v", err)
+	}
+	return server, instance
+}
+
+// newTestDynamoInstance connects to a DynamoDB endpoint served by handler.
+func newTestDynamoInstance(t *testing.T, handler http.HandlerFunc) *db.DynamoDBInstance {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	instance, err := db.NewDynamoDBInstance(dynamodb.New(sess), "devices")
+	if err != nil {
+		t.Fatalf("NewDynamoDBInstance() error = %v", err)
+	}
+	return instance
+}
+
+// newStalledDynamoInstance connects to a DynamoDB endpoint that never answers, until the request gives up.
+func newStalledDynamoInstance(t *testing.T) *db.DynamoDBInstance {
+	stop := make(chan struct{})
+	instance := newTestDynamoInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	})
+	t.Cleanup(func() { close(stop) })
+	return instance
+}
+
+func TestDeviceDynamoRepository_CreateDuplicateDevice(t *testing.T) {
+	var input dynamodb.PutItemInput
+	r := NewDynamoDeviceService(newTestDynamoInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`)
+	}))
+
+	_, err := r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"})
+	if !errors.Is(err, utils.ErrDeviceDuplicate) {
+		t.Errorf("CreateDevice() error = %v, want %v", err, utils.ErrDeviceDuplicate)
+	}
+	if got := aws.StringValue(input.ConditionExpression); got != "attribute_not_exists(#PK) OR attribute_exists(#DA)" {
+		t.Errorf("CreateDevice() condition = %q, want the put to require a missing or deleted device", got)
+	}
+}
+
+func TestDeviceDynamoRepository_Canceled(t *testing.T) {
+	r := NewDynamoDeviceService(newStalledDynamoInstance(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.GetDevice(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetDevice() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetDevice() took %v, want it to stop at the deadline", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ops := []models.DeviceBatchOperation{{Op: models.BatchCreate, Device: models.Device{ID: "1", Name: "Device 1"}}}
+	if _, err := r.WriteDevices(ctx, ops, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteDevices() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBackoff_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := backoff(ctx, batchRetryAttempts+10); !errors.Is(err, context.Canceled) {
+		t.Errorf("backoff() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("backoff() took %v, want it to stop when the context is canceled", elapsed)
+	}
+}
+
+// TestDeviceDynamoRepository_ListDevices pages through the listings that go through the model index, the tenant
+// index and a sort, and checks that they return the devices of the memory repository.
+func TestDeviceDynamoRepository_ListDevices(t *testing.T) {
+	_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	r := NewDynamoDeviceService(instance)
+	memory := NewDeviceMemoryRepository()
+	for i := 0; i < 30; i++ {
+		device := &models.Device{ID: "/devices/d" + strconv.Itoa(i), DeviceModel: "/devicemodels/A", Name: "Device " + strconv.Itoa(i%7), Serial: "S" + strconv.Itoa(i)}
+		if i%3 == 0 {
+			device.DeviceModel = "/devicemodels/B"
+		}
+		if _, err := r.CreateDevice(context.Background(), device); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+		if _, err := memory.CreateDevice(context.Background(), device); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+
+	testsList := []struct {
+		name string
+		opts ListOptions
+	}{
+		{name: "TenantIndex", opts: ListOptions{Limit: 4}},
+		{name: "ModelIndex", opts: ListOptions{Limit: 4, Filter: DeviceFilter{{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/B"}}}},
+		{name: "TenantIndexFilter", opts: ListOptions{Limit: 3, Filter: DeviceFilter{{Field: "serial", Operator: FilterPrefix, Value: "S1"}}}},
+		{name: "ModelIndexFilter", opts: ListOptions{Limit: 4, Filter: DeviceFilter{
+			{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/A"},
+			{Field: "name", Operator: FilterContains, Value: "3"},
+		}}},
+		{name: "Sort", opts: ListOptions{Limit: 5, Sort: []SortField{{Field: "name", Descending: true}}}},
+	}
+	// The devices of another tenant are in a partition of their own.
+	other := utils.WithTenant(context.Background(), "other")
+	if _, err := r.CreateDevice(other, &models.Device{ID: "/devices/d0", DeviceModel: "/devicemodels/A", Name: "Other"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	result, err := instance.Client.GetItem(&dynamodb.GetItemInput{TableName: aws.String("iotwatcher"), Key: deviceKey("other", "/devices/d0")})
+	if err != nil || aws.StringValue(result.Item[gsi2PKAttribute].S) != "other#DEVICES" || aws.StringValue(result.Item[gsi2SKAttribute].S) != "DEVICE#/devices/d0" {
+		t.Errorf("GetItem() got = %v, %v, want the device in the GSI2 partition of its tenant", result.Item, err)
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			got, want := listDeviceIDs(t, r, tt.opts), listDeviceIDs(t, memory, tt.opts)
+			if len(tt.opts.Sort) == 0 {
+				// Without a sort, the order of DynamoDB is its own.
+				slices.Sort(got)
+				slices.Sort(want)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("ListDevices() got = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// listDeviceIDs reads every page of a listing.
+func listDeviceIDs(t *testing.T, repo DeviceRepository, opts ListOptions) []string {
+	var ids []string
+	for {
+		page, err := repo.ListDevices(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListDevices() error = %v", err)
+		}
+		if len(page.Items) > opts.Limit {
+			t.Errorf("ListDevices() got %d items, want at most %d", len(page.Items), opts.Limit)
+		}
+		for _, device := range page.Items {
+			ids = append(ids, device.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func TestDeviceDynamoRepository_TamperedCursor(t *testing.T) {
+	_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	r := NewDynamoDeviceService(instance)
+	for _, id := range []string{"/devices/d1", "/devices/d2"} {
+		if _, err := r.CreateDevice(context.Background(), &models.Device{ID: id, DeviceModel: "/devicemodels/A"}); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	page, err := r.ListDevices(context.Background(), ListOptions{Limit: 1})
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("ListDevices() got = %v, %v, want a next page", page, err)
+	}
+	position := map[string]string{}
+	if err := decodeCursor(page.NextCursor, &position); err != nil {
+		t.Fatalf("decodeCursor() error = %v", err)
+	}
+
+	byModel := DeviceFilter{{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/A"}}
+	testsList := []struct {
+		name   string
+		change func(position map[string]string)
+		filter DeviceFilter
+	}{
+		{name: "ExtraAttribute", change: func(position map[string]string) { position["deletedAt"] = "2024-01-01T00:00:00Z" }},
+		{name: "MissingAttribute", change: func(position map[string]string) { delete(position, gsi2SKAttribute) }},
+		{name: "EmptyAttribute", change: func(position map[string]string) { position[skAttribute] = "" }},
+		{name: "TableKey", change: func(position map[string]string) {
+			delete(position, gsi2PKAttribute)
+			delete(position, gsi2SKAttribute)
+		}},
+		{name: "OtherIndex", change: func(position map[string]string) {}, filter: byModel},
+	}
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := maps.Clone(position)
+			tt.change(tampered)
+			cursor, err := encodeCursor(tampered)
+			if err != nil {
+				t.Fatalf("encodeCursor() error = %v", err)
+			}
+			if _, err := r.ListDevices(context.Background(), ListOptions{Limit: 1, Cursor: cursor, Filter: tt.filter}); !errors.Is(err, utils.ErrInvalidCursor) {
+				t.Errorf("ListDevices() error = %v, want %v", err, utils.ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestDeviceDynamoRepository_Purge(t *testing.T) {
+	server, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	_, err := instance.Client.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName:               aws.String("iotwatcher"),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{AttributeName: aws.String("purgeAt"), Enabled: aws.Bool(true)},
+	})
+	if err != nil {
+		t.Fatalf("UpdateTimeToLive() error = %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := NewDynamoDeviceService(instance)
+	r.now = func() time.Time { return now }
+	r.SetPurgeAfter(time.Hour)
+
+	if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1", DeviceModel: "/devicemodels/A", DeletedAt: "2024-05-01T11:00:00Z"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.DeletedAt != "" {
+		t.Fatalf("GetDevice() got = %v, %v, want a live device", device, err)
+	}
+	if err := r.DeleteDevice(context.Background(), "1", 1, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	// Past its purge period, the device is gone even before the TTL removes it.
+	now = now.Add(2 * time.Hour)
+	trash, err := r.ListDevices(context.Background(), ListOptions{Deleted: true})
+	if err != nil {
+		t.Fatalf("ListDevices() error = %v", err)
+	}
+	if len(trash.Items) != 0 {
+		t.Errorf("ListDevices() got = %v, want an empty trash", trash.Items)
+	}
+	if _, err := r.GetDeletedDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDeletedDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if _, err := r.RestoreDevice(context.Background(), "1", 0); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if removed := server.ExpireItems(now); removed != 1 {
+		t.Errorf("ExpireItems() removed %d items, want 1", removed)
+	}
+}
+
+func TestDeviceDynamoRepository_WriteDevicesAtomicWithEvents(t *testing.T) {
+	_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	r := NewDynamoDeviceService(instance)
+	ctx := withTestDeviceEvents(context.Background())
+
+	var ops []models.DeviceBatchOperation
+	for i := 0; i <= MaxDynamoAtomicEventOperations; i++ {
+		device := models.Device{ID: "/devices/event" + strconv.Itoa(i), Name: "Batch device", DeviceModel: "/devicemodels/A"}
+		ops = append(ops, models.DeviceBatchOperation{Op: models.BatchCreate, Device: device})
+	}
+	// A device and its event are two items of the transaction.
+	if _, err := r.WriteDevices(ctx, ops, true); !errors.Is(err, utils.ErrInvalidBatch) {
+		t.Errorf("WriteDevices() error = %v, want %v", err, utils.ErrInvalidBatch)
+	}
+
+	results, err := r.WriteDevices(ctx, ops[:MaxDynamoAtomicEventOperations], true)
+	if err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("WriteDevices() operation %d error = %v", i, result.Err)
+		}
+	}
+	events, err := r.PendingEvents(context.Background(), 100)
+	if err != nil || len(events) != MaxDynamoAtomicEventOperations {
+		t.Errorf("PendingEvents() got %d events, %v, want %d", len(events), err, MaxDynamoAtomicEventOperations)
+	}
+}
+
+func TestDeviceDynamoRepository_WriteDevicesChunks(t *testing.T) {
+	testsList := []struct {
+		name         string
+		events       bool
+		transactions int
+	}{
+		// One transaction per chunk, and one more for the chunk whose duplicate cancelled it.
+		{name: "WithoutEvents", transactions: 4},
+		// The devices are read before the transaction, which the duplicate never reaches.
+		{name: "WithEvents", events: true, transactions: 3},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+			r := NewDynamoDeviceService(instance)
+			if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "/devices/chunk3", Name: "Existing", DeviceModel: "/devicemodels/A"}); err != nil {
+				t.Fatalf("CreateDevice() error = %v", err)
+			}
+			transactions := 0
+			instance.Client.Handlers.Send.PushBack(func(req *request.Request) {
+				if req.Operation.Name == "TransactWriteItems" {
+					transactions++
+				}
+			})
+
+			var ops []models.DeviceBatchOperation
+			for i := 0; i < 2*batchWriteSize+10; i++ {
+				device := models.Device{ID: "/devices/chunk" + strconv.Itoa(i), Name: "Batch device", DeviceModel: "/devicemodels/A"}
+				ops = append(ops, models.DeviceBatchOperation{Op: models.BatchCreate, Device: device})
+			}
+			ctx := context.Background()
+			if tt.events {
+				ctx = withTestDeviceEvents(ctx)
+			}
+			results, err := r.WriteDevices(ctx, ops, false)
+			if err != nil {
+				t.Fatalf("WriteDevices() error = %v", err)
+			}
+			for i, result := range results {
+				if wantErr := i == 3; (result.Err != nil) != wantErr || (wantErr && !errors.Is(result.Err, utils.ErrDeviceDuplicate)) {
+					t.Errorf("WriteDevices() operation %d error = %v", i, result.Err)
+				}
+			}
+			if transactions != tt.transactions {
+				t.Errorf("WriteDevices() made %d transactions, want %d", transactions, tt.transactions)
+			}
+			page, err := r.ListDevices(context.Background(), ListOptions{Limit: 100})
+			if err != nil || len(page.Items) != len(ops) {
+				t.Errorf("ListDevices() got %d devices, %v, want %d", len(page.Items), err, len(ops))
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package repositories
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"log"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"sync"
+)
+
+// storedDevice is a device as written to disk, with the PurgeAt that the JSON of the API leaves out and its tenant.
+// The devices written before there were tenants have none, they belong to utils.DefaultTenant.
+type storedDevice struct {
+	models.Device
+	PurgeAt int64  `json:"purgeAt,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+func storeDevice(tenant string, device *models.Device) storedDevice {
+	return storedDevice{Device: *device, PurgeAt: device.PurgeAt, Tenant: tenant}
+}
+
+func (s storedDevice) device() *models.Device {
+	device := s.Device
+	device.PurgeAt = s.PurgeAt
+	return &device
+}
+
+// deviceRecord is one entry of the write-ahead log: the devices a write left behind, as they are after it, and the
+// events it added to the outbox. A record of AckEvents only has the IDs of the acknowledged events.
+type deviceRecord struct {
+	Devices []storedDevice `json:"devices"`
+	Events  []models.Event `json:"events,omitempty"`
+	Acked   []string       `json:"acked,omitempty"`
+}
+
+// deviceSnapshot is the snapshot of the devices and of the pending events. The snapshots written before there were
+// events are a bare list of devices.
+type deviceSnapshot struct {
+	Devices []storedDevice `json:"devices"`
+	Events  []models.Event `json:"events"`
+}
+
+// DeviceFileRepository is a DeviceMemoryRepository that survives restarts. Every write is applied in memory, then
+// its result is appended to the write-ahead log of a db.FileStore before the call returns; when the log can not be
+// written the write is undone and fails. The purge of the trash is not logged: a purged device that comes back
+// from the log after a restart is purged again on the next listing. The events of a write are logged in the same
+// record as its devices, and the acknowledgements in records of their own.
+//
+// Writes take turns, so the devices a write replaced are the ones it logs and the ones it undoes. The reads wait for
+// the write in progress, so they never see a device or deliver an event that is undone afterwards.
+type DeviceFileRepository struct {
+	*DeviceMemoryRepository
+	store   *db.FileStore
+	writeMu sync.RWMutex
+}
+
+// NewDeviceFileRepository loads the devices of store into memory.
+func NewDeviceFileRepository(store *db.FileStore) (*DeviceFileRepository, error) {
+	r := &DeviceFileRepository{
+		DeviceMemoryRepository: NewDeviceMemoryRepository(),
+		store:                  store,
+	}
+
+	restore := func(data []byte) error {
+		var snapshot deviceSnapshot
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			if err := json.Unmarshal(data, &snapshot.Devices); err != nil {
+				return err
+			}
+		} else if err := json.Unmarshal(data, &snapshot); err != nil {
+			return err
+		}
+		r.putDevices(snapshot.Devices)
+		r.outbox.add(snapshot.Events...)
+		return nil
+	}
+	replay := func(data []byte) error {
+		var record deviceRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		r.putDevices(record.Devices)
+		r.outbox.add(record.Events...)
+		r.outbox.ack(record.Acked)
+		return nil
+	}
+	if err := store.Load(restore, replay); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *DeviceFileRepository) putDevices(devices []storedDevice) {
+	for _, device := range devices {
+		r.namespace(cmp.Or(device.Tenant, utils.DefaultTenant))[device.ID] = device.device()
+	}
+}
+
+func (r *DeviceFileRepository) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	return r.DeviceMemoryRepository.GetDevice(ctx, id)
+}
+
+func (r *DeviceFileRepository) GetDeletedDevice(ctx context.Context, id string) (*models.Device, error) {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	return r.DeviceMemoryRepository.GetDeletedDevice(ctx, id)
+}
+
+func (r *DeviceFileRepository) GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	return r.DeviceMemoryRepository.GetDevices(ctx, ids)
+}
+
+func (r *DeviceFileRepository) ListDevices(ctx context.Context, opts ListOptions) (*models.DevicePage, error) {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	return r.DeviceMemoryRepository.ListDevices(ctx, opts)
+}
+
+func (r *DeviceFileRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	return r.DeviceMemoryRepository.CountByTenant(ctx)
+}
+
+func (r *DeviceFileRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	return r.DeviceMemoryRepository.PendingEvents(ctx, limit)
+}
+
+func (r *DeviceFileRepository) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	var created *models.Device
+	err := r.write(ctx, []string{device.ID}, func() (err error) {
+		created, err = r.DeviceMemoryRepository.CreateDevice(ctx, device)
+		return err
+	})
+	return created, err
+}
+
+func (r *DeviceFileRepository) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+	var updated *models.Device
+	err := r.write(ctx, []string{id}, func() (err error) {
+		updated, err = r.DeviceMemoryRepository.UpdateDevice(ctx, id, device)
+		return err
+	})
+	return updated, err
+}
+
+func (r *DeviceFileRepository) UpdateDeviceFunc(ctx context.Context, id string, update func(device *models.Device) error) (*models.Device, error) {
+	var updated *models.Device
+	err := r.write(ctx, []string{id}, func() (err error) {
+		updated, err = r.DeviceMemoryRepository.UpdateDeviceFunc(ctx, id, update)
+		return err
+	})
+	return updated, err
+}
+
+func (r *DeviceFileRepository) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	return r.write(ctx, []string{id}, func() error {
+		return r.DeviceMemoryRepository.DeleteDevice(ctx, id, version, deletedBy)
+	})
+}
+
+func (r *DeviceFileRepository) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	var restored *models.Device
+	err := r.write(ctx, []string{id}, func() (err error) {
+		restored, err = r.DeviceMemoryRepository.RestoreDevice(ctx, id, version)
+		return err
+	})
+	return restored, err
+}
+
+// WriteDevices logs the devices of a batch as one record, so an atomic batch is also all or nothing on disk.
+func (r *DeviceFileRepository) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]BatchResult, error) {
+	ids := make([]string, len(ops))
+	for i, op := range ops {
+		ids[i] = op.Device.ID
+	}
+
+	var results []BatchResult
+	err := r.write(ctx, ids, func() (err error) {
+		results, err = r.DeviceMemoryRepository.WriteDevices(ctx, ops, atomic)
+		return err
+	})
+	return results, err
+}
+
+// write runs apply on the memory repository and logs the devices of ids that it replaced in the namespace of the
+// tenant of ctx, along with the events it added. Every write stores a new *models.Device, so a device whose pointer
+// did not change was left alone. The reads wait until the record is synced or the write undone.
+func (r *DeviceFileRepository) write(ctx context.Context, ids []string, apply func() error) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	tenant := utils.TenantFromContext(ctx)
+	before := make(map[string]*models.Device, len(ids))
+	r.mu.RLock()
+	for _, id := range ids {
+		before[id] = r.devices(ctx)[id]
+	}
+	mark := r.outbox.mark()
+	r.mu.RUnlock()
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	var record deviceRecord
+	r.mu.RLock()
+	for _, id := range ids {
+		if device := r.devices(ctx)[id]; device != nil && device != before[id] {
+			record.Devices = append(record.Devices, storeDevice(tenant, device))
+		}
+	}
+	record.Events = r.outbox.since(mark)
+	r.mu.RUnlock()
+	if len(record.Devices) == 0 {
+		return nil
+	}
+
+	if err := r.store.Append(record); err != nil {
+		r.mu.Lock()
+		devices := r.devices(ctx)
+		for id, device := range before {
+			if device == nil {
+				delete(devices, id)
+			} else {
+				devices[id] = device
+			}
+		}
+		r.outbox.truncate(mark)
+		r.mu.Unlock()
+		return err
+	}
+
+	if r.store.NeedsSnapshot() {
+		r.snapshot()
+	}
+	return nil
+}
+
+// AckEvents logs the acknowledgement, so the events are not delivered again after a restart. It takes its turn
+// with the writes, which find the events they added at the end of the outbox.
+func (r *DeviceFileRepository) AckEvents(ctx context.Context, ids []string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := r.store.Append(deviceRecord{Acked: ids}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.outbox.ack(ids)
+	r.mu.Unlock()
+
+	if r.store.NeedsSnapshot() {
+		r.snapshot()
+	}
+	return nil
+}
+
+// snapshot compacts the log. The records are already durable, so a failure only leaves the log longer.
+func (r *DeviceFileRepository) snapshot() {
+	r.mu.RLock()
+	snapshot := deviceSnapshot{Devices: []storedDevice{}, Events: append([]models.Event{}, r.outbox.events...)}
+	for tenant, namespace := range r.tenants {
+		for _, device := range namespace {
+			snapshot.Devices = append(snapshot.Devices, storeDevice(tenant, device))
+		}
+	}
+	r.mu.RUnlock()
+	if err := r.store.Snapshot(snapshot); err != nil {
+		log.Printf("failed to snapshot the devices: %v", err)
+	}
+}
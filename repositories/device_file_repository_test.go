@@ -0,0 +1,200 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"testing"
+	"time"
+)
+
+// newTestFileStore opens the store of name in dir, which survives the store for the tests of a restart.
+func newTestFileStore(t *testing.T, dir, name string) *db.FileStore {
+	store, err := db.OpenFileStore(dir, name)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestDeviceFileRepository_Restart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	open := func() *DeviceFileRepository {
+		repo, err := NewDeviceFileRepository(newTestFileStore(t, dir, "devices"))
+		if err != nil {
+			t.Fatalf("NewDeviceFileRepository() error = %v", err)
+		}
+		repo.now = func() time.Time { return now }
+		return repo
+	}
+
+	r := open()
+	r.store.SetSnapshotEvery(3)
+	for _, id := range []string{"1", "2"} {
+		if _, err := r.CreateDevice(context.Background(), &models.Device{ID: id, Name: "Device " + id}); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Renamed", Version: 1}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	tenantB := utils.WithTenant(context.Background(), "tenant-b")
+	if _, err := r.CreateDevice(tenantB, &models.Device{ID: "1", Name: "Tenant B device"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if err := r.DeleteDevice(context.Background(), "2", 1, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	ops := []models.DeviceBatchOperation{
+		{Op: models.BatchCreate, Device: models.Device{ID: "3", Name: "Device 3"}},
+		{Op: models.BatchUpdate, Device: models.Device{ID: "1", Name: "Stale", Version: 1}},
+	}
+	if _, err := r.WriteDevices(context.Background(), ops, true); err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	if _, err := r.WriteDevices(context.Background(), ops[:1], true); err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+
+	// The second instance reads the snapshot taken after the third write and replays the writes that followed.
+	r = open()
+	if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.Name != "Renamed" || device.Version != 2 {
+		t.Errorf("GetDevice() got = %v, %v, want Renamed at version 2", device, err)
+	}
+	if device, err := r.GetDevice(context.Background(), "3"); err != nil || device.Version != 1 {
+		t.Errorf("GetDevice() got = %v, %v, want the device of the committed batch", device, err)
+	}
+	want := models.Device{ID: "2", Name: "Device 2", Version: 2, DeletedAt: "2024-05-01T12:00:00Z", DeletedBy: "operator", PurgeAt: now.Add(DefaultPurgeAfter).Unix()}
+	if got := r.tenants[utils.DefaultTenant]["2"]; got == nil || *got != want {
+		t.Errorf("devices[2] got = %v, want %v", got, want)
+	}
+
+	if _, err := r.RestoreDevice(context.Background(), "2", 2); err != nil {
+		t.Fatalf("RestoreDevice() error = %v", err)
+	}
+	r = open()
+	if device, err := r.GetDevice(context.Background(), "2"); err != nil || device.Version != 3 {
+		t.Errorf("GetDevice() got = %v, %v, want the restored device at version 3", device, err)
+	}
+	if device, err := r.GetDevice(tenantB, "1"); err != nil || device.Name != "Tenant B device" || device.Version != 1 {
+		t.Errorf("GetDevice() got = %v, %v, want the device of tenant-b", device, err)
+	}
+	if _, err := r.UpdateDevice(context.Background(), "9", &models.Device{ID: "9"}); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("UpdateDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func TestDeviceFileRepository_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewDeviceFileRepository(newTestFileStore(t, dir, "devices"))
+	if err != nil {
+		t.Fatalf("NewDeviceFileRepository() error = %v", err)
+	}
+	r.store.SetSnapshotEvery(50)
+	testConcurrentDevices(t, r)
+
+	// The log holds the writes in the order they were applied, so the restarted repository counts the same.
+	want, _ := r.GetDevice(context.Background(), "counter")
+	r, err = NewDeviceFileRepository(newTestFileStore(t, dir, "devices"))
+	if err != nil {
+		t.Fatalf("NewDeviceFileRepository() error = %v", err)
+	}
+	if got, err := r.GetDevice(context.Background(), "counter"); err != nil || *got != *want {
+		t.Errorf("GetDevice() after a restart got = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestDeviceFileRepository_AppendFailure(t *testing.T) {
+	r, err := NewDeviceFileRepository(newTestFileStore(t, t.TempDir(), "devices"))
+	if err != nil {
+		t.Fatalf("NewDeviceFileRepository() error = %v", err)
+	}
+	if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+
+	// A write that can not reach the log is undone.
+	r.store.Close()
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Renamed"}); err == nil {
+		t.Errorf("UpdateDevice() expected an error once the log is closed")
+	}
+	if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "2", Name: "Device 2"}); err == nil {
+		t.Errorf("CreateDevice() expected an error once the log is closed")
+	}
+	if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.Name != "Device 1" || device.Version != 1 {
+		t.Errorf("GetDevice() got = %v, %v, want the device as it was", device, err)
+	}
+	if _, err := r.GetDevice(context.Background(), "2"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func TestDeviceFileRepository_ReadsDuringAppendFailure(t *testing.T) {
+	r, err := NewDeviceFileRepository(newTestFileStore(t, t.TempDir(), "devices"))
+	if err != nil {
+		t.Fatalf("NewDeviceFileRepository() error = %v", err)
+	}
+	if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	r.store.Close()
+
+	// The reads running along with writes that are undone never see them.
+	done := make(chan struct{})
+	seen := make(chan string, 1)
+	go func() {
+		defer close(seen)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if device, err := r.GetDevice(context.Background(), "1"); err != nil || device.Name != "Device 1" {
+				seen <- "GetDevice() got the undone update"
+				return
+			}
+			if events, _ := r.PendingEvents(context.Background(), 10); len(events) != 0 {
+				seen <- "PendingEvents() got the event of an undone update"
+				return
+			}
+		}
+	}()
+	for i := 0; i < 5000; i++ {
+		if _, err := r.UpdateDevice(withTestDeviceEvents(context.Background()), "1", &models.Device{ID: "1", Name: "Renamed"}); err == nil {
+			t.Fatalf("UpdateDevice() expected an error once the log is closed")
+		}
+	}
+	close(done)
+	if problem, ok := <-seen; ok {
+		t.Error(problem)
+	}
+}
+
+func TestDeviceFileRepository_Canceled(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewDeviceFileRepository(newTestFileStore(t, dir, "devices"))
+	if err != nil {
+		t.Fatalf("NewDeviceFileRepository() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := r.CreateDevice(ctx, &models.Device{ID: "1", Name: "Device 1"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateDevice() error = %v, want %v", err, context.Canceled)
+	}
+
+	// Nothing reached the log either.
+	r.store.Close()
+	r, err = NewDeviceFileRepository(newTestFileStore(t, dir, "devices"))
+	if err != nil {
+		t.Fatalf("NewDeviceFileRepository() error = %v", err)
+	}
+	if _, err := r.GetDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
@@ -0,0 +1,173 @@
+package repositories
+
+import (
+	"cmp"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+)
+
+type FilterOperator string
+
+const (
+	FilterEquals   FilterOperator = "eq"
+	FilterPrefix   FilterOperator = "prefix"
+	FilterContains FilterOperator = "contains"
+)
+
+// DeviceFields are the attributes a listing can be filtered and sorted by, named as in the JSON payload.
+var DeviceFields = []string{"deviceModel", "name", "note", "serial"}
+
+type FilterCondition struct {
+	Field    string
+	Operator FilterOperator
+	Value    string
+}
+
+// DeviceFilter is a conjunction of conditions; a device matches when every condition holds.
+type DeviceFilter []FilterCondition
+
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+func (f DeviceFilter) Validate() error {
+	for _, c := range f {
+		if !slices.Contains(DeviceFields, c.Field) {
+			return utils.ErrInvalidFilter
+		}
+		if c.Operator != FilterEquals && c.Operator != FilterPrefix && c.Operator != FilterContains {
+			return utils.ErrInvalidFilter
+		}
+	}
+	return nil
+}
+
+func (f DeviceFilter) Matches(device *models.Device) bool {
+	for _, c := range f {
+		value := deviceField(device, c.Field)
+		switch c.Operator {
+		case FilterEquals:
+			if value != c.Value {
+				return false
+			}
+		case FilterPrefix:
+			if !strings.HasPrefix(value, c.Value) {
+				return false
+			}
+		case FilterContains:
+			if !strings.Contains(value, c.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// equality returns the value of the first equality condition on field, if there is one.
+func (f DeviceFilter) equality(field string) (string, bool) {
+	for _, c := range f {
+		if c.Field == field && c.Operator == FilterEquals {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+func validateSort(fields []SortField) error {
+	for _, s := range fields {
+		if !slices.Contains(DeviceFields, s.Field) {
+			return utils.ErrInvalidSort
+		}
+	}
+	return nil
+}
+
+func deviceField(device *models.Device, field string) string {
+	switch field {
+	case "deviceModel":
+		return device.DeviceModel
+	case "name":
+		return device.Name
+	case "note":
+		return device.Note
+	case "serial":
+		return device.Serial
+	}
+	return ""
+}
+
+// sortPosition is the cursor of a sorted listing: the sort values and ID of the last device on the page.
+type sortPosition struct {
+	Values []string `json:"v"`
+	ID     string   `json:"id"`
+}
+
+func positionOf(device *models.Device, fields []SortField) sortPosition {
+	position := sortPosition{ID: device.ID}
+	for _, s := range fields {
+		position.Values = append(position.Values, deviceField(device, s.Field))
+	}
+	return position
+}
+
+// comparePositions orders two positions by the sort fields and then by ID, so ties never reorder between pages.
+func comparePositions(a, b sortPosition, fields []SortField) int {
+	for i, s := range fields {
+		if c := cmp.Compare(a.Values[i], b.Values[i]); c != 0 {
+			if s.Descending {
+				return -c
+			}
+			return c
+		}
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// pageDevices filters, sorts and pages a complete set of devices. Backends that cannot sort natively use it.
+func pageDevices(devices []*models.Device, opts ListOptions) (*models.DevicePage, error) {
+	var after *sortPosition
+	if opts.Cursor != "" {
+		after = &sortPosition{}
+		if err := decodeCursor(opts.Cursor, after); err != nil {
+			return nil, err
+		}
+		if len(after.Values) != len(opts.Sort) {
+			return nil, utils.ErrInvalidCursor
+		}
+	}
+
+	matched := make([]sortPosition, 0, len(devices))
+	byID := make(map[string]*models.Device, len(devices))
+	for _, device := range devices {
+		if !opts.Filter.Matches(device) {
+			continue
+		}
+		position := positionOf(device, opts.Sort)
+		if after != nil && comparePositions(position, *after, opts.Sort) <= 0 {
+			continue
+		}
+		matched = append(matched, position)
+		byID[device.ID] = device
+	}
+	slices.SortFunc(matched, func(a, b sortPosition) int {
+		return comparePositions(a, b, opts.Sort)
+	})
+
+	limit := normalizeLimit(opts.Limit)
+	page := &models.DevicePage{Items: []*models.Device{}}
+	for _, position := range matched[:min(limit, len(matched))] {
+		page.Items = append(page.Items, byID[position.ID])
+	}
+
+	if len(matched) > limit {
+		cursor, err := encodeCursor(matched[limit-1])
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
@@ -1,48 +1,362 @@
 package repositories
 
 import (
+	"context"
+	"maps"
 	"simple-api-go/models"
 	"simple-api-go/utils"
+	"sync"
+	"time"
 )
 
+// DeviceMemoryRepository is safe for concurrent use. A stored device is never changed in place: every write stores
+// a new copy, and callers only ever get copies, so nothing they do to a device reaches the store. Nothing it does
+// blocks, so it only checks that the context is still alive when a call starts.
+//
+// Every tenant has a namespace of its own, and a call only ever looks into the namespace of the tenant of its
+// context. The events of the writes wait in an outbox shared by the tenants, see EventOutbox.
 type DeviceMemoryRepository struct {
-	devices map[string]*models.Device
+	mu sync.RWMutex
+	// tenants holds the devices of each tenant keyed by ID.
+	tenants    map[string]map[string]*models.Device
+	outbox     eventOutbox
+	purgeAfter time.Duration
+	now        func() time.Time
 }
 
 func NewDeviceMemoryRepository() *DeviceMemoryRepository {
 	return &DeviceMemoryRepository{
-		devices: make(map[string]*models.Device),
+		tenants:    make(map[string]map[string]*models.Device),
+		purgeAfter: DefaultPurgeAfter,
+		now:        time.Now,
 	}
 }
 
-func (r *DeviceMemoryRepository) GetDevice(id string) (*models.Device, error) {
-	device, ok := r.devices[id]
+// devices returns the namespace of the tenant of ctx, which is nil until the tenant stores a device. The caller
+// holds the lock.
+func (r *DeviceMemoryRepository) devices(ctx context.Context) map[string]*models.Device {
+	return r.tenants[utils.TenantFromContext(ctx)]
+}
+
+// namespace returns the namespace of tenant, and makes it when the tenant has none yet. The caller holds the write
+// lock.
+func (r *DeviceMemoryRepository) namespace(tenant string) map[string]*models.Device {
+	devices, ok := r.tenants[tenant]
 	if !ok {
-		return nil, utils.ErrDeviceNotFound
+		devices = make(map[string]*models.Device)
+		r.tenants[tenant] = devices
+	}
+	return devices
+}
+
+// CountByTenant counts the devices of every tenant, the trash included.
+func (r *DeviceMemoryRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return device, nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purge()
+	counts := make(map[string]int, len(r.tenants))
+	for tenant, devices := range r.tenants {
+		if len(devices) > 0 {
+			counts[tenant] = len(devices)
+		}
+	}
+	return counts, nil
+}
+
+// SetPurgeAfter changes how long deleted devices stay in the trash, DefaultPurgeAfter by default.
+func (r *DeviceMemoryRepository) SetPurgeAfter(purgeAfter time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purgeAfter = purgeAfter
+}
+
+func copyDevice(device *models.Device) *models.Device {
+	c := *device
+	return &c
 }
 
-func (r *DeviceMemoryRepository) CreateDevice(device *models.Device) (*models.Device, error) {
-	r.devices[device.ID] = device
-	return device, nil
+func (r *DeviceMemoryRepository) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	device, ok := r.devices(ctx)[id]
+	if !ok || device.DeletedAt != "" {
+		return nil, utils.ErrDeviceNotFound
+	}
+	return copyDevice(device), nil
 }
 
-func (r *DeviceMemoryRepository) UpdateDevice(id string, device *models.Device) (*models.Device, error) {
-	_, ok := r.devices[id]
-	//_, ok := r.devices[device.ID]
+func (r *DeviceMemoryRepository) GetDeletedDevice(ctx context.Context, id string) (*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	device, ok := r.devices(ctx)[id]
 	if !ok {
 		return nil, utils.ErrDeviceNotFound
 	}
-	r.devices[id] = device
-	return device, nil
+	return deletedDevice(copyDevice(device), r.now())
+}
+
+func (r *DeviceMemoryRepository) GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	devices := make(map[string]*models.Device, len(ids))
+	for _, id := range ids {
+		if device, ok := r.devices(ctx)[id]; ok && device.DeletedAt == "" {
+			devices[id] = copyDevice(device)
+		}
+	}
+	return devices, nil
+}
+
+// ListDevices orders devices by the sort fields and then by ID, so a cursor stays valid while devices are added or removed.
+func (r *DeviceMemoryRepository) ListDevices(ctx context.Context, opts ListOptions) (*models.DevicePage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.purge()
+	namespace := r.devices(ctx)
+	devices := make([]*models.Device, 0, len(namespace))
+	for _, device := range namespace {
+		if (device.DeletedAt != "") == opts.Deleted {
+			devices = append(devices, copyDevice(device))
+		}
+	}
+	r.mu.Unlock()
+	return pageDevices(devices, opts)
+}
+
+func (r *DeviceMemoryRepository) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stored := liveDevice(*device)
+	stored.Version = 1
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	devices := r.namespace(utils.TenantFromContext(ctx))
+	if existing, ok := devices[stored.ID]; ok && existing.DeletedAt == "" {
+		return nil, utils.ErrDeviceDuplicate
+	}
+	if err := r.store(ctx, devices, &stored); err != nil {
+		return nil, err
+	}
+	return copyDevice(&stored), nil
+}
+
+func (r *DeviceMemoryRepository) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateDevice(ctx, r.devices(ctx), id, device)
+}
+
+// UpdateDeviceFunc is the read-modify-write of UpdateDeviceFunc done under the lock, so no other write can come
+// in between and it never has to retry.
+func (r *DeviceMemoryRepository) UpdateDeviceFunc(ctx context.Context, id string, update func(device *models.Device) error) (*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devices := r.devices(ctx)
+	existing, ok := devices[id]
+	if !ok || existing.DeletedAt != "" {
+		return nil, utils.ErrDeviceNotFound
+	}
+	device := copyDevice(existing)
+	if err := update(device); err != nil {
+		return nil, err
+	}
+	device.Version = existing.Version
+	return r.updateDevice(ctx, devices, id, device)
+}
+
+func (r *DeviceMemoryRepository) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleteDevice(ctx, r.devices(ctx), id, version, deletedBy)
 }
 
-func (r *DeviceMemoryRepository) DeleteDevice(id string) error {
-	_, ok := r.devices[id]
+func (r *DeviceMemoryRepository) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.purge()
+	devices := r.devices(ctx)
+	existing, ok := devices[id]
 	if !ok {
+		return nil, utils.ErrDeviceNotFound
+	}
+	if existing.DeletedAt == "" {
+		return nil, utils.ErrDeviceNotDeleted
+	}
+	if version != 0 && version != existing.Version {
+		return nil, utils.ErrVersionMismatch
+	}
+
+	restored := liveDevice(*existing)
+	restored.Version = existing.Version + 1
+	if err := r.store(ctx, devices, &restored); err != nil {
+		return nil, err
+	}
+	return copyDevice(&restored), nil
+}
+
+// purge removes the deleted devices of every tenant whose purge period is over. The caller holds the write lock.
+func (r *DeviceMemoryRepository) purge() {
+	now := r.now().Unix()
+	for _, devices := range r.tenants {
+		maps.DeleteFunc(devices, func(_ string, device *models.Device) bool {
+			return device.PurgeAt != 0 && device.PurgeAt <= now
+		})
+	}
+}
+
+// WriteDevices applies an atomic batch to a copy of the devices, which replaces them only when every operation
+// succeeded, and takes its events back out of the outbox otherwise. The whole batch holds the lock, so no other
+// write interleaves with it.
+func (r *DeviceMemoryRepository) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := ValidateBatch(ops, atomic); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenant := utils.TenantFromContext(ctx)
+	devices := r.namespace(tenant)
+	if atomic {
+		devices = maps.Clone(devices)
+	}
+	mark := r.outbox.mark()
+
+	results := make([]BatchResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		device := op.Device
+		switch op.Op {
+		case models.BatchCreate:
+			if existing, ok := devices[device.ID]; ok && existing.DeletedAt == "" {
+				results[i].Err = utils.ErrDeviceDuplicate
+				break
+			}
+			device = liveDevice(device)
+			device.Version = 1
+			if results[i].Err = r.store(ctx, devices, &device); results[i].Err == nil {
+				results[i].Device = copyDevice(&device)
+			}
+		case models.BatchUpdate:
+			results[i].Device, results[i].Err = r.updateDevice(ctx, devices, device.ID, &device)
+		case models.BatchDelete:
+			results[i].Err = r.deleteDevice(ctx, devices, device.ID, device.Version, device.DeletedBy)
+		}
+		failed = failed || results[i].Err != nil
+	}
+
+	if atomic {
+		if failed {
+			r.outbox.truncate(mark)
+			abortBatch(results)
+			return results, nil
+		}
+		r.tenants[tenant] = devices
+	}
+	return results, nil
+}
+
+// store puts stored into devices, and its events into the outbox. The caller holds the write lock.
+func (r *DeviceMemoryRepository) store(ctx context.Context, devices map[string]*models.Device, stored *models.Device) error {
+	events, err := deviceEvents(ctx, stored)
+	if err != nil {
+		return err
+	}
+	devices[stored.ID] = stored
+	r.outbox.add(events...)
+	return nil
+}
+
+// updateDevice stores a copy of device in place of the live device id. The caller holds the write lock.
+func (r *DeviceMemoryRepository) updateDevice(ctx context.Context, devices map[string]*models.Device, id string, device *models.Device) (*models.Device, error) {
+	existing, ok := devices[id]
+	if !ok || existing.DeletedAt != "" {
+		return nil, utils.ErrDeviceNotFound
+	}
+	if device.Version != 0 && device.Version != existing.Version {
+		return nil, utils.ErrVersionMismatch
+	}
+	stored := liveDevice(*device)
+	stored.ID = id
+	stored.Version = existing.Version + 1
+	if err := r.store(ctx, devices, &stored); err != nil {
+		return nil, err
+	}
+	return copyDevice(&stored), nil
+}
+
+// deleteDevice replaces the device with its tombstone, which keeps every field. The caller holds the write lock.
+func (r *DeviceMemoryRepository) deleteDevice(ctx context.Context, devices map[string]*models.Device, id string, version int64, deletedBy string) error {
+	existing, ok := devices[id]
+	if !ok || existing.DeletedAt != "" {
 		return utils.ErrDeviceNotFound
 	}
-	delete(r.devices, id)
+	if version != 0 && version != existing.Version {
+		return utils.ErrVersionMismatch
+	}
+
+	now := r.now()
+	tombstone := *existing
+	tombstone.DeletedAt = now.UTC().Format(time.RFC3339)
+	tombstone.DeletedBy = deletedBy
+	tombstone.PurgeAt = now.Add(r.purgeAfter).Unix()
+	tombstone.Version = existing.Version + 1
+	return r.store(ctx, devices, &tombstone)
+}
+
+// PendingEvents returns the oldest events of the outbox.
+func (r *DeviceMemoryRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.outbox.pending(limit), nil
+}
+
+func (r *DeviceMemoryRepository) AckEvents(ctx context.Context, ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outbox.ack(ids)
 	return nil
 }
@@ -1,9 +1,15 @@
 package repositories
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"simple-api-go/models"
+	"simple-api-go/utils"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 type fields struct {
@@ -13,6 +19,12 @@ type args struct {
 	device *models.Device
 }
 
+// inDefaultTenant makes the devices of a test the namespace of utils.DefaultTenant, which the calls made with
+// context.Background() look into.
+func inDefaultTenant(devices map[string]*models.Device) map[string]map[string]*models.Device {
+	return map[string]map[string]*models.Device{utils.DefaultTenant: devices}
+}
+
 func TestDeviceMemoryRepository_CreateDevice(t *testing.T) {
 	testsCreate := []struct {
 		name    string
@@ -41,6 +53,7 @@ func TestDeviceMemoryRepository_CreateDevice(t *testing.T) {
 				DeviceModel: "Model A",
 				Note:        "This is a test device",
 				Serial:      "ABC123",
+				Version:     1,
 			},
 			wantErr: false,
 		},
@@ -66,27 +79,25 @@ func TestDeviceMemoryRepository_CreateDevice(t *testing.T) {
 					Serial:      "ABC123",
 				},
 			},
-			want: &models.Device{
-				ID:          "1",
-				Name:        "Device 1",
-				DeviceModel: "Model A",
-				Note:        "This is a test device",
-				Serial:      "ABC123",
-			},
-			wantErr: false,
+			want:    nil,
+			wantErr: true,
 		},
 	}
 
 	for _, tt := range testsCreate {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &DeviceMemoryRepository{
-				devices: tt.fields.devices,
+				tenants: inDefaultTenant(tt.fields.devices),
+				now:     time.Now,
 			}
-			got, err := r.CreateDevice(tt.args.device)
+			got, err := r.CreateDevice(context.Background(), tt.args.device)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreateDevice() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErr && !errors.Is(err, utils.ErrDeviceDuplicate) {
+				t.Errorf("CreateDevice() error = %v, want %v", err, utils.ErrDeviceDuplicate)
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("CreateDevice() got = %v, want %v", got, tt.want)
 			}
@@ -134,9 +145,10 @@ func TestDeviceMemoryRepository_GetDevice(t *testing.T) {
 	for _, tt := range testsGet {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &DeviceMemoryRepository{
-				devices: tt.fields.devices,
+				tenants: inDefaultTenant(tt.fields.devices),
+				now:     time.Now,
 			}
-			got, err := r.GetDevice(tt.args.device.ID)
+			got, err := r.GetDevice(context.Background(), tt.args.device.ID)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetDevice() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -148,6 +160,184 @@ func TestDeviceMemoryRepository_GetDevice(t *testing.T) {
 	}
 }
 
+func TestDeviceMemoryRepository_ListDevices(t *testing.T) {
+	devices := map[string]*models.Device{
+		"3": {ID: "3"},
+		"1": {ID: "1"},
+		"2": {ID: "2"},
+	}
+
+	testsList := []struct {
+		name       string
+		fields     fields
+		opts       ListOptions
+		wantIDs    []string
+		wantCursor bool
+		wantErr    bool
+	}{
+		{
+			name:       "FirstPage",
+			fields:     fields{devices: devices},
+			opts:       ListOptions{Limit: 2},
+			wantIDs:    []string{"1", "2"},
+			wantCursor: true,
+		},
+		{
+			name:    "AllDevices",
+			fields:  fields{devices: devices},
+			opts:    ListOptions{},
+			wantIDs: []string{"1", "2", "3"},
+		},
+		{
+			name:    "EmptyRepository",
+			fields:  fields{devices: map[string]*models.Device{}},
+			opts:    ListOptions{Limit: 2},
+			wantIDs: []string{},
+		},
+		{
+			name:    "InvalidCursor",
+			fields:  fields{devices: devices},
+			opts:    ListOptions{Cursor: "not a cursor"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DeviceMemoryRepository{
+				tenants: inDefaultTenant(tt.fields.devices),
+				now:     time.Now,
+			}
+			got, err := r.ListDevices(context.Background(), tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListDevices() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			gotIDs := []string{}
+			for _, device := range got.Items {
+				gotIDs = append(gotIDs, device.ID)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("ListDevices() got = %v, want %v", gotIDs, tt.wantIDs)
+			}
+			if (got.NextCursor != "") != tt.wantCursor {
+				t.Errorf("ListDevices() cursor = %q, wantCursor %v", got.NextCursor, tt.wantCursor)
+			}
+		})
+	}
+
+	t.Run("NextPage", func(t *testing.T) {
+		r := &DeviceMemoryRepository{tenants: inDefaultTenant(devices), now: time.Now}
+		first, err := r.ListDevices(context.Background(), ListOptions{Limit: 2})
+		if err != nil {
+			t.Fatalf("ListDevices() error = %v", err)
+		}
+		second, err := r.ListDevices(context.Background(), ListOptions{Limit: 2, Cursor: first.NextCursor})
+		if err != nil {
+			t.Fatalf("ListDevices() error = %v", err)
+		}
+		if len(second.Items) != 1 || second.Items[0].ID != "3" || second.NextCursor != "" {
+			t.Errorf("ListDevices() second page = %+v", second)
+		}
+	})
+}
+
+func TestDeviceMemoryRepository_ListDevicesFilterAndSort(t *testing.T) {
+	devices := map[string]*models.Device{
+		"1": {ID: "1", Name: "Camera", DeviceModel: "/devicemodels/A", Serial: "A020000103"},
+		"2": {ID: "2", Name: "Sensor", DeviceModel: "/devicemodels/A", Serial: "A020000102"},
+		"3": {ID: "3", Name: "Door Camera", DeviceModel: "/devicemodels/B", Serial: "B010000001"},
+		"4": {ID: "4", Name: "Camera", DeviceModel: "/devicemodels/B", Serial: "A030000001"},
+	}
+
+	testsList := []struct {
+		name    string
+		opts    ListOptions
+		wantIDs []string
+		wantErr bool
+	}{
+		{
+			name:    "EqualDeviceModel",
+			opts:    ListOptions{Filter: DeviceFilter{{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/A"}}},
+			wantIDs: []string{"1", "2"},
+		},
+		{
+			name:    "SerialPrefix",
+			opts:    ListOptions{Filter: DeviceFilter{{Field: "serial", Operator: FilterPrefix, Value: "A02"}}},
+			wantIDs: []string{"1", "2"},
+		},
+		{
+			name: "NameContainsAndModel",
+			opts: ListOptions{Filter: DeviceFilter{
+				{Field: "name", Operator: FilterContains, Value: "Camera"},
+				{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/B"},
+			}},
+			wantIDs: []string{"3", "4"},
+		},
+		{
+			name:    "SortByNameThenID",
+			opts:    ListOptions{Sort: []SortField{{Field: "name"}}},
+			wantIDs: []string{"1", "4", "3", "2"},
+		},
+		{
+			name:    "SortBySerialDescending",
+			opts:    ListOptions{Sort: []SortField{{Field: "serial", Descending: true}}},
+			wantIDs: []string{"3", "4", "1", "2"},
+		},
+		{
+			name:    "UnknownFilterField",
+			opts:    ListOptions{Filter: DeviceFilter{{Field: "id", Operator: FilterEquals, Value: "1"}}},
+			wantErr: true,
+		},
+		{
+			name:    "UnknownSortField",
+			opts:    ListOptions{Sort: []SortField{{Field: "createdAt"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DeviceMemoryRepository{tenants: inDefaultTenant(devices), now: time.Now}
+			got, err := r.ListDevices(context.Background(), tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListDevices() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			gotIDs := []string{}
+			for _, device := range got.Items {
+				gotIDs = append(gotIDs, device.ID)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("ListDevices() got = %v, want %v", gotIDs, tt.wantIDs)
+			}
+		})
+	}
+
+	t.Run("SortedPages", func(t *testing.T) {
+		r := &DeviceMemoryRepository{tenants: inDefaultTenant(devices), now: time.Now}
+		opts := ListOptions{Limit: 3, Sort: []SortField{{Field: "name", Descending: true}}}
+		first, err := r.ListDevices(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListDevices() error = %v", err)
+		}
+		opts.Cursor = first.NextCursor
+		second, err := r.ListDevices(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListDevices() error = %v", err)
+		}
+		if len(first.Items) != 3 || len(second.Items) != 1 || second.Items[0].ID != "4" || second.NextCursor != "" {
+			t.Errorf("ListDevices() pages = %+v, %+v", first, second)
+		}
+	})
+}
+
 func TestDeviceMemoryRepository_UpdateDevice(t *testing.T) {
 	testsUpdate := []struct {
 		name    string
@@ -180,17 +370,62 @@ func TestDeviceMemoryRepository_UpdateDevice(t *testing.T) {
 				DeviceModel: "New Model A",
 				Note:        "New This is a test device",
 				Serial:      "NewABC123",
+				Version:     1,
+			},
+			wantErr: false,
+		},
+		{
+			name: "UpdateExpectedVersion",
+			fields: fields{
+				devices: map[string]*models.Device{
+					"1": {
+						ID:      "1",
+						Version: 2,
+					},
+				},
+			},
+			args: args{
+				device: &models.Device{
+					ID:      "1",
+					Name:    "New Device 1",
+					Version: 2,
+				},
+			},
+			want: &models.Device{
+				ID:      "1",
+				Name:    "New Device 1",
+				Version: 3,
 			},
 			wantErr: false,
 		},
+		{
+			name: "UpdateStaleVersion",
+			fields: fields{
+				devices: map[string]*models.Device{
+					"1": {
+						ID:      "1",
+						Version: 2,
+					},
+				},
+			},
+			args: args{
+				device: &models.Device{
+					ID:      "1",
+					Name:    "New Device 1",
+					Version: 1,
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range testsUpdate {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &DeviceMemoryRepository{
-				devices: tt.fields.devices,
+				tenants: inDefaultTenant(tt.fields.devices),
+				now:     time.Now,
 			}
-			got, err := r.UpdateDevice(tt.args.device.ID, tt.args.device)
+			got, err := r.UpdateDevice(context.Background(), tt.args.device.ID, tt.args.device)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("UpdateDevice() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -226,16 +461,179 @@ func TestDeviceMemoryRepository_DeleteDevice(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "DeleteStaleVersion",
+			fields: fields{
+				devices: map[string]*models.Device{
+					"1": {
+						ID:      "1",
+						Version: 2,
+					},
+				},
+			},
+			args: args{
+				device: &models.Device{
+					ID:      "1",
+					Version: 1,
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range testDelete {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &DeviceMemoryRepository{
-				devices: tt.fields.devices,
+				tenants: inDefaultTenant(tt.fields.devices),
+				now:     time.Now,
 			}
-			if err := r.DeleteDevice(tt.args.device.ID); (err != nil) != tt.wantErr {
+			if err := r.DeleteDevice(context.Background(), tt.args.device.ID, tt.args.device.Version, "operator"); (err != nil) != tt.wantErr {
 				t.Errorf("DeleteDevice() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestDeviceMemoryRepository_Trash(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := NewDeviceMemoryRepository()
+	r.now = func() time.Time { return now }
+	r.SetPurgeAfter(24 * time.Hour)
+
+	for _, id := range []string{"1", "2"} {
+		if _, err := r.CreateDevice(context.Background(), &models.Device{ID: id, Name: "Device " + id}); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	if err := r.DeleteDevice(context.Background(), "1", 1, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	want := models.Device{ID: "1", Name: "Device 1", Version: 2, DeletedAt: "2024-05-01T12:00:00Z", DeletedBy: "operator", PurgeAt: now.Add(24 * time.Hour).Unix()}
+	if got := *r.tenants[utils.DefaultTenant]["1"]; got != want {
+		t.Errorf("DeleteDevice() stored = %v, want %v", got, want)
+	}
+	if _, err := r.GetDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1"}); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("UpdateDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+
+	live, _ := r.ListDevices(context.Background(), ListOptions{})
+	trash, _ := r.ListDevices(context.Background(), ListOptions{Deleted: true})
+	if len(live.Items) != 1 || live.Items[0].ID != "2" || len(trash.Items) != 1 || trash.Items[0].ID != "1" {
+		t.Errorf("ListDevices() got live = %v, trash = %v", live.Items, trash.Items)
+	}
+
+	if _, err := r.RestoreDevice(context.Background(), "2", 0); !errors.Is(err, utils.ErrDeviceNotDeleted) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrDeviceNotDeleted)
+	}
+	if _, err := r.RestoreDevice(context.Background(), "1", 1); !errors.Is(err, utils.ErrVersionMismatch) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+	}
+	restored, err := r.RestoreDevice(context.Background(), "1", 2)
+	if err != nil {
+		t.Fatalf("RestoreDevice() error = %v", err)
+	}
+	if want := (models.Device{ID: "1", Name: "Device 1", Version: 3}); *restored != want {
+		t.Errorf("RestoreDevice() got = %v, want %v", *restored, want)
+	}
+
+	// Once the purge period is over, the device is gone for good.
+	if err := r.DeleteDevice(context.Background(), "1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	now = now.Add(24 * time.Hour)
+	if _, err := r.RestoreDevice(context.Background(), "1", 0); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if _, ok := r.tenants[utils.DefaultTenant]["1"]; ok {
+		t.Errorf("RestoreDevice() the purged device should be removed")
+	}
+}
+
+func TestDeviceMemoryRepository_Copies(t *testing.T) {
+	r := NewDeviceMemoryRepository()
+	device := &models.Device{ID: "1", Name: "Device 1"}
+	created, _ := r.CreateDevice(context.Background(), device)
+	device.Name = "Changed by the caller"
+	created.Name = "Changed by the caller"
+
+	got, _ := r.GetDevice(context.Background(), "1")
+	if got.Name != "Device 1" {
+		t.Errorf("CreateDevice() the store should not share the device of the caller, got name %v", got.Name)
+	}
+	got.Name = "Changed by the caller"
+	page, _ := r.ListDevices(context.Background(), ListOptions{})
+	page.Items[0].Name = "Changed by the caller"
+	if got, _ := r.GetDevice(context.Background(), "1"); got.Name != "Device 1" {
+		t.Errorf("GetDevice() the store should not share the returned devices, got name %v", got.Name)
+	}
+}
+
+func TestDeviceMemoryRepository_Canceled(t *testing.T) {
+	r := NewDeviceMemoryRepository()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := r.CreateDevice(ctx, &models.Device{ID: "1", Name: "Device 1"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateDevice() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := r.ListDevices(ctx, ListOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListDevices() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := r.GetDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("CreateDevice() a canceled create should not store the device, error = %v", err)
+	}
+}
+
+// TestDeviceMemoryRepository_Concurrent is meant for go test -race: it interleaves every kind of access to the
+// same devices, and checks that no increment done through UpdateDeviceFunc is lost.
+func TestDeviceMemoryRepository_Concurrent(t *testing.T) {
+	testConcurrentDevices(t, NewDeviceMemoryRepository())
+}
+
+func testConcurrentDevices(t *testing.T, repo DeviceRepository) {
+	const workers, rounds = 8, 50
+	if _, err := repo.CreateDevice(context.Background(), &models.Device{ID: "counter", Name: "0"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := "device-" + strconv.Itoa(w%3)
+			for i := 0; i < rounds; i++ {
+				_, err := UpdateDeviceFunc(context.Background(), repo, "counter", func(device *models.Device) error {
+					n, err := strconv.Atoi(device.Name)
+					device.Name = strconv.Itoa(n + 1)
+					return err
+				})
+				if err != nil {
+					t.Errorf("UpdateDeviceFunc() error = %v", err)
+				}
+
+				// The other devices are shared by several workers, so each of these may fail; only races matter.
+				repo.CreateDevice(context.Background(), &models.Device{ID: id, Name: "Device"})
+				if device, err := repo.GetDevice(context.Background(), id); err == nil {
+					device.Note = "changed"
+					repo.UpdateDevice(context.Background(), id, device)
+				}
+				repo.ListDevices(context.Background(), ListOptions{})
+				repo.DeleteDevice(context.Background(), id, 0, "operator")
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	counter, err := repo.GetDevice(context.Background(), "counter")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if counter.Name != strconv.Itoa(workers*rounds) || counter.Version != workers*rounds+1 {
+		t.Errorf("UpdateDeviceFunc() got count = %v at version %v, want %v at version %v", counter.Name, counter.Version, workers*rounds, workers*rounds+1)
+	}
+}
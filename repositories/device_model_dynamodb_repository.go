@@ -0,0 +1,177 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+)
+
+// DeviceModelDynamoRepository stores the catalogue in the single table of dynamodb_table.go, keyed by tenant and id
+// like the devices. The models of a tenant share a GSI1 partition, which lists them in the order of their IDs.
+type DeviceModelDynamoRepository struct {
+	db *db.DynamoDBInstance
+}
+
+func NewDynamoDeviceModelRepository(db *db.DynamoDBInstance) *DeviceModelDynamoRepository {
+	return &DeviceModelDynamoRepository{
+		db: db,
+	}
+}
+
+// marshalDeviceModel is the item of a model of tenant.
+func marshalDeviceModel(tenant string, model *models.DeviceModel) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(model)
+	if err != nil {
+		return nil, err
+	}
+	setItemKeys(item, deviceModelItem, tenant, map[string]string{
+		pkAttribute:     tenantKey(tenant, modelPrefix+model.ID),
+		skAttribute:     modelSortKey,
+		gsi1PKAttribute: tenantKey(tenant, cataloguePrefix),
+		gsi1SKAttribute: modelPrefix + model.ID,
+	})
+	return item, nil
+}
+
+func (d *DeviceModelDynamoRepository) GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error) {
+	result, err := d.db.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       deviceModelKey(utils.TenantFromContext(ctx), id),
+		TableName: aws.String(d.db.GetTableName()),
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	if result.Item == nil {
+		return nil, utils.ErrDeviceModelNotFound
+	}
+
+	model := &models.DeviceModel{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, model); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// ListDeviceModels queries the GSI1 partition of the catalogue of the tenant.
+func (d *DeviceModelDynamoRepository) ListDeviceModels(ctx context.Context, query DeviceModelQuery) (*models.DeviceModelPage, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(d.db.GetTableName()),
+		IndexName:                 aws.String(gsi1Index),
+		KeyConditionExpression:    aws.String("#G1PK = :catalogue"),
+		ExpressionAttributeNames:  map[string]*string{"#G1PK": aws.String(gsi1PKAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":catalogue": stringValue(tenantKey(utils.TenantFromContext(ctx), cataloguePrefix))},
+		Limit:                     aws.Int64(int64(normalizeLimit(query.Limit))),
+	}
+	if query.Cursor != "" {
+		startKey, err := decodeDynamoCursor(query.Cursor, gsi1Index)
+		if err != nil {
+			return nil, err
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	result, err := d.db.Client.QueryWithContext(ctx, input)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	page := &models.DeviceModelPage{Items: []*models.DeviceModel{}}
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page.Items); err != nil {
+		return nil, err
+	}
+	if len(result.LastEvaluatedKey) > 0 {
+		page.NextCursor, err = encodeDynamoCursor(result.LastEvaluatedKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// CreateDeviceModel puts the model, on the condition that it does not exist.
+func (d *DeviceModelDynamoRepository) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	av, err := marshalDeviceModel(utils.TenantFromContext(ctx), model)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = d.db.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                     av,
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_not_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, utils.ErrDeviceModelDuplicate
+		}
+		return nil, contextError(ctx, err)
+	}
+	return model, nil
+}
+
+// UpdateDeviceModel replaces the stored model, on the condition that it exists.
+func (d *DeviceModelDynamoRepository) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	model.ID = id
+	av, err := marshalDeviceModel(utils.TenantFromContext(ctx), model)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = d.db.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                     av,
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, utils.ErrDeviceModelNotFound
+		}
+		return nil, contextError(ctx, err)
+	}
+	return model, nil
+}
+
+func (d *DeviceModelDynamoRepository) DeleteDeviceModel(ctx context.Context, id string) error {
+	_, err := d.db.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key:                      deviceModelKey(utils.TenantFromContext(ctx), id),
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return utils.ErrDeviceModelNotFound
+		}
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// CountByTenant scans the whole table for the tenant of every model.
+func (d *DeviceModelDynamoRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	return countDynamoByTenant(ctx, d.db, deviceModelItem)
+}
+
+// isConditionFailed reports whether a write was rejected by its ConditionExpression.
+func isConditionFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// contextError returns the error of ctx for a request it ended, rather than the RequestCanceled error of the SDK
+// that hides it, so callers can tell a cancellation or a deadline with errors.Is.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
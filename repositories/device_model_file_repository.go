@@ -0,0 +1,141 @@
+package repositories
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"sync"
+)
+
+// deviceModelRecord is one entry of the write-ahead log: the model stored under ID in the catalogue of Tenant, or
+// nil once it is deleted. The records written before there were tenants have none, they belong to
+// utils.DefaultTenant.
+type deviceModelRecord struct {
+	Tenant string              `json:"tenant,omitempty"`
+	ID     string              `json:"id"`
+	Model  *models.DeviceModel `json:"model"`
+}
+
+// DeviceModelFileRepository is a DeviceModelMemoryRepository that survives restarts. A write is appended to the
+// write-ahead log of a db.FileStore before it is applied in memory. Writes take turns, so they are applied in the
+// order of the log.
+type DeviceModelFileRepository struct {
+	*DeviceModelMemoryRepository
+	store   *db.FileStore
+	writeMu sync.Mutex
+}
+
+// NewDeviceModelFileRepository loads the catalogue of store into memory.
+func NewDeviceModelFileRepository(store *db.FileStore) (*DeviceModelFileRepository, error) {
+	r := &DeviceModelFileRepository{
+		DeviceModelMemoryRepository: NewDeviceModelMemoryRepository(),
+		store:                       store,
+	}
+
+	restore := func(snapshot []byte) error {
+		var records []deviceModelRecord
+		if err := json.Unmarshal(snapshot, &records); err != nil {
+			// The snapshots taken before there were tenants hold the catalogue of the default tenant keyed by ID.
+			var catalogue map[string]*models.DeviceModel
+			if json.Unmarshal(snapshot, &catalogue) != nil {
+				return err
+			}
+			for id, model := range catalogue {
+				records = append(records, deviceModelRecord{ID: id, Model: model})
+			}
+		}
+		for _, record := range records {
+			r.apply(record)
+		}
+		return nil
+	}
+	replay := func(data []byte) error {
+		var record deviceModelRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		r.apply(record)
+		return nil
+	}
+	if err := store.Load(restore, replay); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *DeviceModelFileRepository) apply(record deviceModelRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenant := cmp.Or(record.Tenant, utils.DefaultTenant)
+	if record.Model == nil {
+		delete(r.tenants[tenant], record.ID)
+	} else {
+		r.putDeviceModel(tenant, record.ID, record.Model)
+	}
+}
+
+func (r *DeviceModelFileRepository) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if _, err := r.GetDeviceModel(ctx, model.ID); err == nil {
+		return nil, utils.ErrDeviceModelDuplicate
+	} else if !errors.Is(err, utils.ErrDeviceModelNotFound) {
+		return nil, err
+	}
+	if err := r.write(ctx, deviceModelRecord{Tenant: utils.TenantFromContext(ctx), ID: model.ID, Model: model}); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+func (r *DeviceModelFileRepository) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if _, err := r.GetDeviceModel(ctx, id); err != nil {
+		return nil, err
+	}
+	if err := r.write(ctx, deviceModelRecord{Tenant: utils.TenantFromContext(ctx), ID: id, Model: model}); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+func (r *DeviceModelFileRepository) DeleteDeviceModel(ctx context.Context, id string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if _, err := r.GetDeviceModel(ctx, id); err != nil {
+		return err
+	}
+	return r.write(ctx, deviceModelRecord{Tenant: utils.TenantFromContext(ctx), ID: id})
+}
+
+func (r *DeviceModelFileRepository) write(ctx context.Context, record deviceModelRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := r.store.Append(record); err != nil {
+		return err
+	}
+	r.apply(record)
+
+	if r.store.NeedsSnapshot() {
+		r.mu.RLock()
+		records := []deviceModelRecord{}
+		for tenant, catalogue := range r.tenants {
+			for id, model := range catalogue {
+				records = append(records, deviceModelRecord{Tenant: tenant, ID: id, Model: model})
+			}
+		}
+		err := r.store.Snapshot(records)
+		r.mu.RUnlock()
+		if err != nil {
+			log.Printf("failed to snapshot the device models: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package repositories
+
+import (
+	"context"
+	"maps"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DeviceModelMemoryRepository is safe for concurrent use, and stores and hands out copies of the models. Every
+// tenant has a catalogue of its own.
+type DeviceModelMemoryRepository struct {
+	mu sync.RWMutex
+	// tenants holds the catalogue of each tenant keyed by ID.
+	tenants map[string]map[string]*models.DeviceModel
+}
+
+func NewDeviceModelMemoryRepository() *DeviceModelMemoryRepository {
+	return &DeviceModelMemoryRepository{
+		tenants: make(map[string]map[string]*models.DeviceModel),
+	}
+}
+
+// catalogue returns the models of the tenant of ctx, which is nil until the tenant stores one. The caller holds the
+// lock.
+func (r *DeviceModelMemoryRepository) catalogue(ctx context.Context) map[string]*models.DeviceModel {
+	return r.tenants[utils.TenantFromContext(ctx)]
+}
+
+// putDeviceModel stores a copy of model under id in the catalogue of tenant, and makes the catalogue when the tenant
+// has none yet. The caller holds the write lock.
+func (r *DeviceModelMemoryRepository) putDeviceModel(tenant, id string, model *models.DeviceModel) {
+	catalogue, ok := r.tenants[tenant]
+	if !ok {
+		catalogue = make(map[string]*models.DeviceModel)
+		r.tenants[tenant] = catalogue
+	}
+	catalogue[id] = copyDeviceModel(model)
+}
+
+// CountByTenant counts the models of every tenant.
+func (r *DeviceModelMemoryRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := make(map[string]int, len(r.tenants))
+	for tenant, catalogue := range r.tenants {
+		if len(catalogue) > 0 {
+			counts[tenant] = len(catalogue)
+		}
+	}
+	return counts, nil
+}
+
+func copyDeviceModel(model *models.DeviceModel) *models.DeviceModel {
+	c := *model
+	c.Specs = maps.Clone(model.Specs)
+	return &c
+}
+
+func (r *DeviceModelMemoryRepository) GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	model, ok := r.catalogue(ctx)[id]
+	if !ok {
+		return nil, utils.ErrDeviceModelNotFound
+	}
+	return copyDeviceModel(model), nil
+}
+
+type deviceModelCursor struct {
+	ID string `json:"id"`
+}
+
+func (r *DeviceModelMemoryRepository) ListDeviceModels(ctx context.Context, query DeviceModelQuery) (*models.DeviceModelPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var after deviceModelCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.RLock()
+	catalogue := r.catalogue(ctx)
+	matched := make([]*models.DeviceModel, 0, len(catalogue))
+	for _, model := range catalogue {
+		if model.ID > after.ID {
+			matched = append(matched, copyDeviceModel(model))
+		}
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(matched, func(a, b *models.DeviceModel) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	limit := normalizeLimit(query.Limit)
+	page := &models.DeviceModelPage{Items: []*models.DeviceModel{}}
+	page.Items = append(page.Items, matched[:min(limit, len(matched))]...)
+
+	if len(matched) > limit {
+		cursor, err := encodeCursor(deviceModelCursor{ID: matched[limit-1].ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+func (r *DeviceModelMemoryRepository) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.catalogue(ctx)[model.ID]; ok {
+		return nil, utils.ErrDeviceModelDuplicate
+	}
+	r.putDeviceModel(utils.TenantFromContext(ctx), model.ID, model)
+	return model, nil
+}
+
+func (r *DeviceModelMemoryRepository) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	catalogue := r.catalogue(ctx)
+	if _, ok := catalogue[id]; !ok {
+		return nil, utils.ErrDeviceModelNotFound
+	}
+	catalogue[id] = copyDeviceModel(model)
+	return model, nil
+}
+
+func (r *DeviceModelMemoryRepository) DeleteDeviceModel(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	catalogue := r.catalogue(ctx)
+	if _, ok := catalogue[id]; !ok {
+		return utils.ErrDeviceModelNotFound
+	}
+	delete(catalogue, id)
+	return nil
+}
@@ -0,0 +1,67 @@
+package repositories
+
+import (
+	"context"
+	"reflect"
+	"simple-api-go/models"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDeviceModelMemoryRepository_ListDeviceModels(t *testing.T) {
+	r := NewDeviceModelMemoryRepository()
+	for _, id := range []string{"/devicemodels/c", "/devicemodels/a", "/devicemodels/b"} {
+		if _, err := r.CreateDeviceModel(context.Background(), &models.DeviceModel{ID: id, Name: id}); err != nil {
+			t.Fatalf("CreateDeviceModel() error = %v", err)
+		}
+	}
+
+	first, err := r.ListDeviceModels(context.Background(), DeviceModelQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("ListDeviceModels() error = %v", err)
+	}
+	second, err := r.ListDeviceModels(context.Background(), DeviceModelQuery{Limit: 2, Cursor: first.NextCursor})
+	if err != nil {
+		t.Fatalf("ListDeviceModels() error = %v", err)
+	}
+
+	var ids []string
+	for _, model := range append(first.Items, second.Items...) {
+		ids = append(ids, model.ID)
+	}
+	want := []string{"/devicemodels/a", "/devicemodels/b", "/devicemodels/c"}
+	if !reflect.DeepEqual(ids, want) || second.NextCursor != "" {
+		t.Errorf("ListDeviceModels() got = %v, want %v on two pages", ids, want)
+	}
+
+	if _, err := r.ListDeviceModels(context.Background(), DeviceModelQuery{Cursor: "not a cursor"}); err == nil {
+		t.Errorf("ListDeviceModels() expected an error for an invalid cursor")
+	}
+}
+
+// TestDeviceModelMemoryRepository_Concurrent is meant for go test -race, with writers changing the specs of the
+// models the readers are listing.
+func TestDeviceModelMemoryRepository_Concurrent(t *testing.T) {
+	r := NewDeviceModelMemoryRepository()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := "/devicemodels/" + strconv.Itoa(w%3)
+			for i := 0; i < 50; i++ {
+				model := &models.DeviceModel{ID: id, Name: "Model", Specs: map[string]string{"round": strconv.Itoa(i)}}
+				r.CreateDeviceModel(context.Background(), model)
+				model.Specs["round"] = "changed by the caller"
+				if got, err := r.GetDeviceModel(context.Background(), id); err == nil {
+					got.Specs["round"] = "changed by the caller"
+					r.UpdateDeviceModel(context.Background(), id, got)
+				}
+				r.ListDeviceModels(context.Background(), DeviceModelQuery{})
+				r.DeleteDeviceModel(context.Background(), id)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
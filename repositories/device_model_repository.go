@@ -0,0 +1,23 @@
+package repositories
+
+import (
+	"context"
+	"simple-api-go/models"
+)
+
+// DeviceModelQuery pages through the catalogue in ID order.
+type DeviceModelQuery struct {
+	Limit  int
+	Cursor string
+}
+
+// DeviceModelRepository stores the catalogue of device models of every tenant. CreateDeviceModel fails with
+// utils.ErrDeviceModelDuplicate when the tenant has a model with the same ID, checked in the same step as the write
+// so that two concurrent creates can not both succeed.
+type DeviceModelRepository interface {
+	GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error)
+	ListDeviceModels(ctx context.Context, query DeviceModelQuery) (*models.DeviceModelPage, error)
+	CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error)
+	UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error)
+	DeleteDeviceModel(ctx context.Context, id string) error
+}
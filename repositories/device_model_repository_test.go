@@ -0,0 +1,207 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"simple-api-go/db/sqltest"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeviceModelRepository(t *testing.T) {
+	t.Run("MemoryRepository", func(t *testing.T) {
+		testDeviceModelRepository(t, NewDeviceModelMemoryRepository())
+	})
+
+	t.Run("SQLRepository", func(t *testing.T) {
+		testDeviceModelRepository(t, NewSQLDeviceModelRepository(newTestSQLInstance(t)))
+	})
+
+	t.Run("PostgresRepository", func(t *testing.T) {
+		testDeviceModelRepository(t, NewSQLDeviceModelRepository(sqltest.OpenPostgres(t)))
+	})
+
+	t.Run("FileRepository", func(t *testing.T) {
+		repo, err := NewDeviceModelFileRepository(newTestFileStore(t, t.TempDir(), "device_models"))
+		if err != nil {
+			t.Fatalf("NewDeviceModelFileRepository() error = %v", err)
+		}
+		testDeviceModelRepository(t, repo)
+	})
+
+	t.Run("DynamoDBRepository", func(t *testing.T) {
+		_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+		testDeviceModelRepository(t, NewDynamoDeviceModelRepository(instance))
+	})
+}
+
+func testDeviceModelRepository(t *testing.T, repo DeviceModelRepository) {
+	t.Run("CreateDeviceModel", func(t *testing.T) {
+		for _, id := range []string{"/devicemodels/modelTest1", "/devicemodels/modelTest2", "/devicemodels/modelTest3"} {
+			model := &models.DeviceModel{
+				ID:           id,
+				Name:         "Thermal camera",
+				Manufacturer: "Acme",
+				Category:     "Camera",
+				Specs:        map[string]string{"resolution": "640x480"},
+			}
+
+			createdModel, err := repo.CreateDeviceModel(context.Background(), model)
+			if err != nil {
+				t.Errorf("CreateDeviceModel() error = %v", err)
+				return
+			}
+
+			if createdModel.ID != model.ID {
+				t.Errorf("CreateDeviceModel() got = %v, want %v", createdModel.ID, model.ID)
+			}
+		}
+	})
+
+	t.Run("CreateDuplicateDeviceModel", func(t *testing.T) {
+		if _, err := repo.CreateDeviceModel(context.Background(), &models.DeviceModel{ID: "/devicemodels/modelTest1", Name: "Other"}); !errors.Is(err, utils.ErrDeviceModelDuplicate) {
+			t.Errorf("CreateDeviceModel() error = %v, want %v", err, utils.ErrDeviceModelDuplicate)
+		}
+
+		// Of concurrent creates of the same ID, only one succeeds.
+		var wg sync.WaitGroup
+		var created atomic.Int32
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := repo.CreateDeviceModel(context.Background(), &models.DeviceModel{ID: "/devicemodels/modelRace", Name: fmt.Sprint(i)})
+				switch {
+				case err == nil:
+					created.Add(1)
+				case !errors.Is(err, utils.ErrDeviceModelDuplicate):
+					t.Errorf("CreateDeviceModel() error = %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if created.Load() != 1 {
+			t.Errorf("CreateDeviceModel() created %d models with the same ID, want 1", created.Load())
+		}
+		if err := repo.DeleteDeviceModel(context.Background(), "/devicemodels/modelRace"); err != nil {
+			t.Errorf("DeleteDeviceModel() error = %v", err)
+		}
+	})
+
+	t.Run("GetDeviceModel", func(t *testing.T) {
+		model, err := repo.GetDeviceModel(context.Background(), "/devicemodels/modelTest1")
+		if err != nil {
+			t.Errorf("GetDeviceModel() error = %v", err)
+			return
+		}
+
+		if model.Specs["resolution"] != "640x480" {
+			t.Errorf("GetDeviceModel() got specs = %v, want %v", model.Specs, map[string]string{"resolution": "640x480"})
+		}
+	})
+
+	t.Run("ListDeviceModels", func(t *testing.T) {
+		var ids []string
+		query := DeviceModelQuery{Limit: 2}
+		for pages := 0; pages < 10; pages++ {
+			page, err := repo.ListDeviceModels(context.Background(), query)
+			if err != nil {
+				t.Errorf("ListDeviceModels() error = %v", err)
+				return
+			}
+			if len(page.Items) > query.Limit {
+				t.Errorf("ListDeviceModels() got = %v items, want at most %v", len(page.Items), query.Limit)
+			}
+			for _, model := range page.Items {
+				ids = append(ids, model.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+
+		for _, id := range []string{"/devicemodels/modelTest1", "/devicemodels/modelTest2", "/devicemodels/modelTest3"} {
+			if !slices.Contains(ids, id) {
+				t.Errorf("ListDeviceModels() got = %v, want %v among them", ids, id)
+			}
+		}
+	})
+
+	t.Run("UpdateDeviceModel", func(t *testing.T) {
+		updatedModel := &models.DeviceModel{ID: "/devicemodels/modelTest1", Name: "Thermal camera v2", Manufacturer: "Acme"}
+
+		_, err := repo.UpdateDeviceModel(context.Background(), "/devicemodels/modelTest1", updatedModel)
+		if err != nil {
+			t.Errorf("UpdateDeviceModel() error = %v", err)
+			return
+		}
+
+		model, _ := repo.GetDeviceModel(context.Background(), "/devicemodels/modelTest1")
+		if model.Name != updatedModel.Name {
+			t.Errorf("UpdateDeviceModel() got = %v, want %v", model.Name, updatedModel.Name)
+		}
+	})
+
+	t.Run("UpdateNonExistingDeviceModel", func(t *testing.T) {
+		_, err := repo.UpdateDeviceModel(context.Background(), "/devicemodels/modelTest9", &models.DeviceModel{Name: "Missing"})
+		if !errors.Is(err, utils.ErrDeviceModelNotFound) {
+			t.Errorf("UpdateDeviceModel() error = %v, want %v", err, utils.ErrDeviceModelNotFound)
+		}
+	})
+
+	t.Run("TenantIsolation", func(t *testing.T) {
+		other := utils.WithTenant(context.Background(), "tenant-b")
+		if _, err := repo.GetDeviceModel(other, "/devicemodels/modelTest1"); !errors.Is(err, utils.ErrDeviceModelNotFound) {
+			t.Errorf("GetDeviceModel() error = %v, want %v from another tenant", err, utils.ErrDeviceModelNotFound)
+		}
+		page, err := repo.ListDeviceModels(other, DeviceModelQuery{})
+		if err != nil {
+			t.Fatalf("ListDeviceModels() error = %v", err)
+		}
+		if len(page.Items) != 0 {
+			t.Errorf("ListDeviceModels() got = %v items of another tenant, want none", len(page.Items))
+		}
+		if err := repo.DeleteDeviceModel(other, "/devicemodels/modelTest1"); !errors.Is(err, utils.ErrDeviceModelNotFound) {
+			t.Errorf("DeleteDeviceModel() error = %v, want %v from another tenant", err, utils.ErrDeviceModelNotFound)
+		}
+		if _, err := repo.CreateDeviceModel(other, &models.DeviceModel{ID: "/devicemodels/modelTest1", Name: "Tenant B model"}); err != nil {
+			t.Errorf("CreateDeviceModel() error = %v, want the ID free in another tenant", err)
+		}
+		if model, _ := repo.GetDeviceModel(context.Background(), "/devicemodels/modelTest1"); model == nil || model.Name != "Thermal camera v2" {
+			t.Errorf("GetDeviceModel() got = %v, want the model of the default tenant untouched", model)
+		}
+
+		counts, err := CountByTenant(context.Background(), repo)
+		if err != nil {
+			t.Fatalf("CountByTenant() error = %v", err)
+		}
+		if want := map[string]int{utils.DefaultTenant: 3, "tenant-b": 1}; !maps.Equal(counts, want) {
+			t.Errorf("CountByTenant() got = %v, want %v", counts, want)
+		}
+	})
+
+	t.Run("DeleteDeviceModel", func(t *testing.T) {
+		for _, id := range []string{"/devicemodels/modelTest1", "/devicemodels/modelTest2", "/devicemodels/modelTest3"} {
+			if err := repo.DeleteDeviceModel(context.Background(), id); err != nil {
+				t.Errorf("DeleteDeviceModel() error = %v", err)
+				return
+			}
+		}
+
+		_, err := repo.GetDeviceModel(context.Background(), "/devicemodels/modelTest1")
+		if !errors.Is(err, utils.ErrDeviceModelNotFound) {
+			t.Errorf("DeleteDeviceModel() device model should not exist")
+		}
+
+		if err := repo.DeleteDeviceModel(context.Background(), "/devicemodels/modelTest1"); !errors.Is(err, utils.ErrDeviceModelNotFound) {
+			t.Errorf("DeleteDeviceModel() error = %v, want %v", err, utils.ErrDeviceModelNotFound)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+)
+
+// deviceModelColumns are the columns of the device_models table, in the order scanDeviceModel reads them.
+const deviceModelColumns = "id, name, manufacturer, category, specs"
+
+// DeviceModelSQLRepository stores the catalogue in the device_models table, with the specs as a JSON object. Every
+// tenant has a catalogue of its own, keyed by tenant and id.
+type DeviceModelSQLRepository struct {
+	db *db.SQLInstance
+}
+
+func NewSQLDeviceModelRepository(db *db.SQLInstance) *DeviceModelSQLRepository {
+	return &DeviceModelSQLRepository{
+		db: db,
+	}
+}
+
+func scanDeviceModel(row rowScanner) (*models.DeviceModel, error) {
+	model := &models.DeviceModel{}
+	var specs string
+	if err := row.Scan(&model.ID, &model.Name, &model.Manufacturer, &model.Category, &specs); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(specs), &model.Specs); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+func (r *DeviceModelSQLRepository) GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error) {
+	row := r.db.DB.QueryRowContext(ctx, r.db.Rebind("SELECT "+deviceModelColumns+" FROM device_models WHERE tenant = ? AND id = ?"),
+		utils.TenantFromContext(ctx), id)
+	model, err := scanDeviceModel(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.ErrDeviceModelNotFound
+	}
+	return model, err
+}
+
+// ListDeviceModels pages through the catalogue in ID order, like the memory repository.
+func (r *DeviceModelSQLRepository) ListDeviceModels(ctx context.Context, query DeviceModelQuery) (*models.DeviceModelPage, error) {
+	var after deviceModelCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := normalizeLimit(query.Limit)
+	rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind("SELECT "+deviceModelColumns+" FROM device_models WHERE tenant = ? AND id > ? ORDER BY id LIMIT ?"),
+		utils.TenantFromContext(ctx), after.ID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &models.DeviceModelPage{Items: []*models.DeviceModel{}}
+	for rows.Next() {
+		model, err := scanDeviceModel(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, model)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		cursor, err := encodeCursor(deviceModelCursor{ID: page.Items[limit-1].ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+// CreateDeviceModel inserts the model, unless the primary key of the tenant and the ID is taken already.
+func (r *DeviceModelSQLRepository) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	specs, err := json.Marshal(model.Specs)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.db.DB.ExecContext(ctx, r.db.Rebind(`INSERT INTO device_models (tenant, `+deviceModelColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (tenant, id) DO NOTHING`),
+		utils.TenantFromContext(ctx), model.ID, model.Name, model.Manufacturer, model.Category, string(specs))
+	if err != nil {
+		return nil, err
+	}
+	if err := rowAffected(result, utils.ErrDeviceModelDuplicate); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+func (r *DeviceModelSQLRepository) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	specs, err := json.Marshal(model.Specs)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.db.DB.ExecContext(ctx, r.db.Rebind("UPDATE device_models SET name = ?, manufacturer = ?, category = ?, specs = ? WHERE tenant = ? AND id = ?"),
+		model.Name, model.Manufacturer, model.Category, string(specs), utils.TenantFromContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	if err := rowAffected(result, utils.ErrDeviceModelNotFound); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+func (r *DeviceModelSQLRepository) DeleteDeviceModel(ctx context.Context, id string) error {
+	result, err := r.db.DB.ExecContext(ctx, r.db.Rebind("DELETE FROM device_models WHERE tenant = ? AND id = ?"), utils.TenantFromContext(ctx), id)
+	if err != nil {
+		return err
+	}
+	return rowAffected(result, utils.ErrDeviceModelNotFound)
+}
+
+// CountByTenant counts the models of every tenant.
+func (r *DeviceModelSQLRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	return countByTenant(ctx, r.db, "device_models")
+}
+
+// rowAffected fails with notFound when a statement matched no row.
+func rowAffected(result sql.Result, notFound error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return notFound
+	}
+	return nil
+}
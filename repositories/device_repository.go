@@ -1,10 +1,123 @@
 package repositories
 
-import "simple-api-go/models"
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"time"
+)
 
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 100
+
+	// updateAttempts bounds the compare-and-set loop of UpdateDeviceFunc under contention.
+	updateAttempts = 5
+
+	// DefaultPurgeAfter is how long a deleted device stays in the trash before it is removed for good.
+	DefaultPurgeAfter = 30 * 24 * time.Hour
+)
+
+// ListOptions controls a device listing. Cursor is the opaque NextCursor of a previous page and is only valid
+// with the same Filter and Sort. Deleted lists the trash instead of the live devices.
+type ListOptions struct {
+	Limit   int
+	Cursor  string
+	Filter  DeviceFilter
+	Sort    []SortField
+	Deleted bool
+}
+
+func (o ListOptions) Validate() error {
+	if err := o.Filter.Validate(); err != nil {
+		return err
+	}
+	return validateSort(o.Sort)
+}
+
+// DeviceRepository stores devices with a version that every write increments. UpdateDevice takes the expected
+// version from device.Version, DeleteDevice and RestoreDevice from version; they fail with utils.ErrVersionMismatch
+// when the stored version differs, and skip the check when the expected version is zero. UpdateDevice replaces
+// every field of the device and returns the record as stored. CreateDevice fails with utils.ErrDeviceDuplicate when
+// a live device has the same ID, checked in the same step as the write so that concurrent creates can not both
+// succeed. WriteDevices applies a batch of operations with one result per operation; a failed operation does not
+// fail the batch, unless atomic is set and then none is applied.
+//
+// DeleteDevice moves a device to the trash: GetDevice and ListDevices no longer see it, and it is removed for good
+// once its purge period is over, unless RestoreDevice brings it back first. GetDeletedDevice reads a device of the
+// trash, failing with utils.ErrDeviceNotDeleted when the device is live. Creating a device with the ID of a deleted
+// one replaces it. GetDevices reads the live devices of many IDs in as few requests as the backend allows, keyed by
+// ID; the IDs without a live device are left out.
+//
+// Every method gives up with the error of ctx once it is cancelled or past its deadline, and a write that gives up
+// is either applied entirely or not at all.
 type DeviceRepository interface {
-	GetDevice(id string) (*models.Device, error)
-	CreateDevice(device *models.Device) (*models.Device, error)
-	UpdateDevice(id string, device *models.Device) (*models.Device, error)
-	DeleteDevice(id string) error
+	GetDevice(ctx context.Context, id string) (*models.Device, error)
+	GetDeletedDevice(ctx context.Context, id string) (*models.Device, error)
+	GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error)
+	ListDevices(ctx context.Context, opts ListOptions) (*models.DevicePage, error)
+	CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error)
+	UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error)
+	DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error
+	RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error)
+	WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]BatchResult, error)
+}
+
+// AtomicDeviceUpdater is implemented by the repositories that can run the read-modify-write of UpdateDeviceFunc
+// atomically on their own.
+type AtomicDeviceUpdater interface {
+	UpdateDeviceFunc(ctx context.Context, id string, update func(device *models.Device) error) (*models.Device, error)
+}
+
+// UpdateDeviceFunc reads the live device id, lets update change a copy of it and stores the result with the next
+// version. It is a compare-and-set on the version: when another write gets in between, it reads the device again
+// and starts over, and gives up with utils.ErrVersionMismatch after a few attempts. update may run more than once;
+// when it fails, nothing is stored and its error is returned as is.
+func UpdateDeviceFunc(ctx context.Context, repo DeviceRepository, id string, update func(device *models.Device) error) (*models.Device, error) {
+	if updater, ok := repo.(AtomicDeviceUpdater); ok {
+		return updater.UpdateDeviceFunc(ctx, id, update)
+	}
+
+	for attempt := 1; ; attempt++ {
+		device, err := repo.GetDevice(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		version := device.Version
+		if err := update(device); err != nil {
+			return nil, err
+		}
+		device.Version = version
+
+		updated, err := repo.UpdateDevice(ctx, id, device)
+		if errors.Is(err, utils.ErrVersionMismatch) && attempt < updateAttempts {
+			continue
+		}
+		return updated, err
+	}
+}
+
+// liveDevice drops the trash fields a client may have sent along with a device to create or update.
+func liveDevice(device models.Device) models.Device {
+	device.DeletedAt, device.DeletedBy, device.PurgeAt = "", "", 0
+	return device
+}
+
+// deletedDevice returns device if it is in the trash at now, for GetDeletedDevice.
+func deletedDevice(device *models.Device, now time.Time) (*models.Device, error) {
+	switch {
+	case device.DeletedAt == "":
+		return nil, utils.ErrDeviceNotDeleted
+	case device.PurgeAt != 0 && device.PurgeAt <= now.Unix():
+		return nil, utils.ErrDeviceNotFound
+	}
+	return device, nil
+}
+
+func normalizeLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(limit, MaxListLimit)
 }
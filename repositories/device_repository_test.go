@@ -1,98 +1,75 @@
-package repositories
+package repositories_test
 
 import (
-	"errors"
-	"os"
+	"context"
+	"path/filepath"
 	"simple-api-go/db"
-	"simple-api-go/utils"
-
-	//_ "simple-api-go/repositories"
-	"simple-api-go/models"
+	"simple-api-go/db/dynamotest"
+	"simple-api-go/db/sqltest"
+	"simple-api-go/repositories"
+	"simple-api-go/repositories/repositorytest"
 	"testing"
-	//"simple-api-go/repositories"
+	"time"
 )
 
 func TestDeviceRepository(t *testing.T) {
 	t.Run("MemoryRepository", func(t *testing.T) {
-		testDeviceRepository(t, NewDeviceMemoryRepository())
+		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+			return repositories.NewDeviceMemoryRepository()
+		})
 	})
 
-	t.Run("DynamoDBRepository", func(t *testing.T) {
-		//db := setupDynamoDBInstance()
-		//defer teardownDynamoDBInstance(db)
-		// TODO: make another table for test.
-		os.Setenv("DYNAMODB_TABLE", "saeid-amn-Devices")
-		os.Setenv("REGION", "local")
-		os.Setenv("ENDPOINT_URL", "http://localhost:8000")
-
-		testDeviceRepository(t, NewDynamoDeviceService(db.CreateDynamoDBInstance()))
+	t.Run("SQLRepository", func(t *testing.T) {
+		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+			instance, err := db.OpenSQLInstance(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatalf("OpenSQLInstance() error = %v", err)
+			}
+			t.Cleanup(func() { instance.DB.Close() })
+			return repositories.NewSQLDeviceRepository(instance)
+		})
 	})
-}
-
-func testDeviceRepository(t *testing.T, repo DeviceRepository) {
-	t.Run("CreateDevice", func(t *testing.T) {
-		device := &models.Device{
-			ID:          "/devices/idTest1",
-			Name:        "Device 1",
-			DeviceModel: "/devicemodels/Model2",
-			Note:        "This is a test device",
-			Serial:      "ABC123",
-		}
-
-		createdDevice, err := repo.CreateDevice(device)
-		if err != nil {
-			t.Errorf("CreateDevice() error = %v", err)
-			return
-		}
 
-		if createdDevice.ID != device.ID {
-			t.Errorf("CreateDevice() got = %v, want %v", createdDevice.ID, device.ID)
-		}
+	t.Run("PostgresRepository", func(t *testing.T) {
+		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+			return repositories.NewSQLDeviceRepository(sqltest.OpenPostgres(t))
+		})
 	})
 
-	t.Run("GetDevice", func(t *testing.T) {
-		device, err := repo.GetDevice("/devices/idTest1")
-		if err != nil {
-			t.Errorf("GetDevice() error = %v", err)
-			return
-		}
-
-		if device.Name != "Device 1" {
-			t.Errorf("GetDevice() got = %v, want %v", device.Name, "Device 1")
-		}
+	t.Run("FileRepository", func(t *testing.T) {
+		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+			store, err := db.OpenFileStore(t.TempDir(), "devices")
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			repo, err := repositories.NewDeviceFileRepository(store)
+			if err != nil {
+				t.Fatalf("NewDeviceFileRepository() error = %v", err)
+			}
+			return repo
+		})
 	})
 
-	t.Run("UpdateDevice", func(t *testing.T) {
-		updatedDevice := &models.Device{
-			ID:          "/devices/idTest1",
-			Name:        "Updated Device",
-			DeviceModel: "/devicemodels/Model2",
-			Note:        "This is an updated device",
-			Serial:      "DEF456",
-		}
-
-		_, err := repo.UpdateDevice("/devices/idTest1", updatedDevice)
-		if err != nil {
-			t.Errorf("UpdateDevice() error = %v", err)
-			return
-		}
-
-		device, _ := repo.GetDevice("/devices/idTest1")
-		if device.Name != updatedDevice.Name {
-			t.Errorf("UpdateDevice() got = %v, want %v", device.Name, updatedDevice.Name)
-		}
+	t.Run("CacheRepository", func(t *testing.T) {
+		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+			config := repositories.DeviceCacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute}
+			return repositories.NewDeviceCacheRepository(repositories.NewDeviceMemoryRepository(), config)
+		})
 	})
 
-	t.Run("DeleteDevice", func(t *testing.T) {
-		err := repo.DeleteDevice("/devices/idTest1")
-		if err != nil {
-			t.Errorf("DeleteDevice() error = %v", err)
-			return
-		}
-
-		_, err = repo.GetDevice("/devices/idTest1")
-		if !errors.Is(err, utils.ErrDeviceNotFound) {
-			t.Errorf("DeleteDevice() device should not exist")
-		}
+	t.Run("DynamoDBRepository", func(t *testing.T) {
+		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+			server := dynamotest.NewServer()
+			t.Cleanup(server.Close)
+			if _, err := repositories.DynamoSchema("iotwatcher").Reconcile(context.Background(), server.Client()); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			instance, err := db.NewDynamoDBInstance(server.Client(), "iotwatcher")
+			if err != nil {
+				t.Fatalf("NewDynamoDBInstance() error = %v", err)
+			}
+			return repositories.NewDynamoDeviceService(instance)
+		})
 	})
 }
@@ -0,0 +1,516 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// deviceColumns are the columns of the devices table, in the order scanDevice reads them.
+const deviceColumns = "id, device_model, name, note, serial, version, deleted_at, deleted_by, purge_at"
+
+// upsertDevice writes a live device at version 1 over the row of the tenant with the same ID, if there is one.
+const upsertDevice = `INSERT INTO devices (tenant, ` + deviceColumns + `) VALUES (?, ?, ?, ?, ?, ?, 1, '', '', 0)
+ON CONFLICT (tenant, id) DO UPDATE SET device_model = excluded.device_model, name = excluded.name, note = excluded.note,
+    serial = excluded.serial, version = 1, deleted_at = '', deleted_by = '', purge_at = 0`
+
+// deviceSQLColumns maps DeviceFields to the columns of the devices table.
+var deviceSQLColumns = map[string]string{
+	"deviceModel": "device_model",
+	"name":        "name",
+	"note":        "note",
+	"serial":      "serial",
+}
+
+// sqlExecutor runs queries on the database or inside a transaction.
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rowScanner is a *sql.Row or a *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// DeviceSQLRepository stores devices in the devices table of SQLite or PostgreSQL. A deleted device keeps its row
+// with deleted_at set, and the rows whose purge_at is over are deleted on the next listing or restore. Every row
+// belongs to a tenant, and every statement is limited to the tenant of its context. The events of a write are
+// inserted into the event_outbox table in the transaction of its rows.
+type DeviceSQLRepository struct {
+	db         *db.SQLInstance
+	outbox     sqlEventOutbox
+	purgeAfter time.Duration
+	now        func() time.Time
+}
+
+func NewSQLDeviceRepository(db *db.SQLInstance) *DeviceSQLRepository {
+	return &DeviceSQLRepository{
+		db:         db,
+		outbox:     sqlEventOutbox{db: db, source: deviceEventSource},
+		purgeAfter: DefaultPurgeAfter,
+		now:        time.Now,
+	}
+}
+
+// SetPurgeAfter changes how long deleted devices stay in the trash, DefaultPurgeAfter by default.
+func (r *DeviceSQLRepository) SetPurgeAfter(purgeAfter time.Duration) {
+	r.purgeAfter = purgeAfter
+}
+
+func scanDevice(row rowScanner) (*models.Device, error) {
+	device := &models.Device{}
+	err := row.Scan(&device.ID, &device.DeviceModel, &device.Name, &device.Note, &device.Serial, &device.Version,
+		&device.DeletedAt, &device.DeletedBy, &device.PurgeAt)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// getRow reads the row of a device, deleted or not.
+func (r *DeviceSQLRepository) getRow(ctx context.Context, tx sqlExecutor, id string) (*models.Device, error) {
+	device, err := scanDevice(tx.QueryRowContext(ctx, r.db.Rebind("SELECT "+deviceColumns+" FROM devices WHERE tenant = ? AND id = ?"),
+		utils.TenantFromContext(ctx), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.ErrDeviceNotFound
+	}
+	return device, err
+}
+
+func (r *DeviceSQLRepository) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	device, err := r.getRow(ctx, r.db.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	if device.DeletedAt != "" {
+		return nil, utils.ErrDeviceNotFound
+	}
+	return device, nil
+}
+
+func (r *DeviceSQLRepository) GetDeletedDevice(ctx context.Context, id string) (*models.Device, error) {
+	device, err := r.getRow(ctx, r.db.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	return deletedDevice(device, r.now())
+}
+
+// GetDevices reads batchGetSize devices per query.
+func (r *DeviceSQLRepository) GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	devices := make(map[string]*models.Device, len(ids))
+	for start := 0; start < len(ids); start += batchGetSize {
+		chunk := ids[start:min(start+batchGetSize, len(ids))]
+		args := []any{utils.TenantFromContext(ctx)}
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", ")
+		query := "SELECT " + deviceColumns + " FROM devices WHERE tenant = ? AND deleted_at = '' AND id IN (" + placeholders + ")"
+		rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			device, err := scanDevice(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			devices[device.ID] = device
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+// ListDevices filters, sorts and pages in the database. The cursor is the position of the last device of the page,
+// so it stays valid while devices are added or removed.
+func (r *DeviceSQLRepository) ListDevices(ctx context.Context, opts ListOptions) (*models.DevicePage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	var after *sortPosition
+	if opts.Cursor != "" {
+		after = &sortPosition{}
+		if err := decodeCursor(opts.Cursor, after); err != nil {
+			return nil, err
+		}
+		if len(after.Values) != len(opts.Sort) {
+			return nil, utils.ErrInvalidCursor
+		}
+	}
+
+	if err := r.purge(ctx); err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"tenant = ?", "deleted_at = ''"}
+	if opts.Deleted {
+		conditions[1] = "deleted_at <> ''"
+	}
+	args := []any{utils.TenantFromContext(ctx)}
+	for _, c := range opts.Filter {
+		column := deviceSQLColumns[c.Field]
+		switch c.Operator {
+		case FilterEquals:
+			conditions = append(conditions, column+" = ?")
+			args = append(args, c.Value)
+		case FilterPrefix:
+			conditions = append(conditions, "substr("+column+", 1, ?) = ?")
+			args = append(args, utf8.RuneCountInString(c.Value), c.Value)
+		case FilterContains:
+			conditions = append(conditions, r.db.Contains(column))
+			args = append(args, c.Value)
+		}
+	}
+	if after != nil {
+		condition, positionArgs := afterPosition(*after, opts.Sort)
+		conditions = append(conditions, condition)
+		args = append(args, positionArgs...)
+	}
+
+	var order []string
+	for _, s := range opts.Sort {
+		if s.Descending {
+			order = append(order, deviceSQLColumns[s.Field]+" DESC")
+		} else {
+			order = append(order, deviceSQLColumns[s.Field])
+		}
+	}
+	order = append(order, "id")
+
+	limit := normalizeLimit(opts.Limit)
+	query := "SELECT " + deviceColumns + " FROM devices WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY " + strings.Join(order, ", ") + " LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &models.DevicePage{Items: []*models.Device{}}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		cursor, err := encodeCursor(positionOf(page.Items[limit-1], opts.Sort))
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+// afterPosition is the condition that a row comes after position in the order of fields and then of id, like
+// comparePositions.
+func afterPosition(position sortPosition, fields []SortField) (string, []any) {
+	var alternatives []string
+	var args []any
+	for i := 0; i <= len(fields); i++ {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, deviceSQLColumns[fields[j].Field]+" = ?")
+			args = append(args, position.Values[j])
+		}
+		if i == len(fields) {
+			terms = append(terms, "id > ?")
+			args = append(args, position.ID)
+		} else if fields[i].Descending {
+			terms = append(terms, deviceSQLColumns[fields[i].Field]+" < ?")
+			args = append(args, position.Values[i])
+		} else {
+			terms = append(terms, deviceSQLColumns[fields[i].Field]+" > ?")
+			args = append(args, position.Values[i])
+		}
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// purge deletes the devices of every tenant whose purge period is over.
+func (r *DeviceSQLRepository) purge(ctx context.Context) error {
+	_, err := r.db.DB.ExecContext(ctx, r.db.Rebind("DELETE FROM devices WHERE purge_at <> 0 AND purge_at <= ?"), r.now().Unix())
+	return err
+}
+
+func (r *DeviceSQLRepository) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	var created *models.Device
+	err := inTransaction(ctx, r.db, hasDeviceEvents(ctx), func(tx sqlExecutor) (err error) {
+		created, err = r.createDevice(ctx, tx, *device)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	*device = *created
+	return device, nil
+}
+
+// storeEvents inserts the events of device with tx, the transaction that wrote it.
+func (r *DeviceSQLRepository) storeEvents(ctx context.Context, tx sqlExecutor, device *models.Device) error {
+	events, err := deviceEvents(ctx, device)
+	if err != nil {
+		return err
+	}
+	return r.outbox.insert(ctx, tx, events)
+}
+
+// createDevice writes the device unless a live device has the same ID, which fails with utils.ErrDeviceDuplicate.
+func (r *DeviceSQLRepository) createDevice(ctx context.Context, tx sqlExecutor, device models.Device) (*models.Device, error) {
+	device = liveDevice(device)
+	device.Version = 1
+	row := tx.QueryRowContext(ctx, r.db.Rebind(upsertDevice+" WHERE devices.deleted_at <> '' RETURNING "+deviceColumns),
+		utils.TenantFromContext(ctx), device.ID, device.DeviceModel, device.Name, device.Note, device.Serial)
+	stored, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.ErrDeviceDuplicate
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storeEvents(ctx, tx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// UpdateDevice replaces every field of the device and increments the version in one statement, which checks the
+// expected version so that two concurrent updates can not both succeed.
+func (r *DeviceSQLRepository) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+	var updated *models.Device
+	err := inTransaction(ctx, r.db, hasDeviceEvents(ctx), func(tx sqlExecutor) (err error) {
+		updated, err = r.updateDevice(ctx, tx, id, device)
+		return err
+	})
+	return updated, err
+}
+
+func (r *DeviceSQLRepository) updateDevice(ctx context.Context, tx sqlExecutor, id string, device *models.Device) (*models.Device, error) {
+	query := `UPDATE devices SET device_model = ?, name = ?, note = ?, serial = ?, version = version + 1
+WHERE tenant = ? AND id = ? AND deleted_at = ''`
+	args := []any{device.DeviceModel, device.Name, device.Note, device.Serial, utils.TenantFromContext(ctx), id}
+	if device.Version != 0 {
+		query += " AND version = ?"
+		args = append(args, device.Version)
+	}
+
+	stored, err := scanDevice(tx.QueryRowContext(ctx, r.db.Rebind(query+" RETURNING "+deviceColumns), args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, r.conditionError(ctx, tx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storeEvents(ctx, tx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// DeleteDevice turns the device into a tombstone, which keeps every column and gets a purge_at.
+func (r *DeviceSQLRepository) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	return inTransaction(ctx, r.db, hasDeviceEvents(ctx), func(tx sqlExecutor) error {
+		return r.deleteDevice(ctx, tx, id, version, deletedBy)
+	})
+}
+
+func (r *DeviceSQLRepository) deleteDevice(ctx context.Context, tx sqlExecutor, id string, version int64, deletedBy string) error {
+	now := r.now()
+	query := `UPDATE devices SET deleted_at = ?, deleted_by = ?, purge_at = ?, version = version + 1
+WHERE tenant = ? AND id = ? AND deleted_at = ''`
+	args := []any{now.UTC().Format(time.RFC3339), deletedBy, now.Add(r.purgeAfter).Unix(), utils.TenantFromContext(ctx), id}
+	if version != 0 {
+		query += " AND version = ?"
+		args = append(args, version)
+	}
+
+	tombstone, err := scanDevice(tx.QueryRowContext(ctx, r.db.Rebind(query+" RETURNING "+deviceColumns), args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return r.conditionError(ctx, tx, id)
+	}
+	if err != nil {
+		return err
+	}
+	return r.storeEvents(ctx, tx, tombstone)
+}
+
+// conditionError tells why an update or a delete of a live device matched no row.
+func (r *DeviceSQLRepository) conditionError(ctx context.Context, tx sqlExecutor, id string) error {
+	device, err := r.getRow(ctx, tx, id)
+	switch {
+	case err != nil:
+		return err
+	case device.DeletedAt != "":
+		return utils.ErrDeviceNotFound
+	default:
+		return utils.ErrVersionMismatch
+	}
+}
+
+// RestoreDevice takes the device out of the trash, as long as its purge period is not over.
+func (r *DeviceSQLRepository) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	if err := r.purge(ctx); err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE devices SET deleted_at = '', deleted_by = '', purge_at = 0, version = version + 1
+WHERE tenant = ? AND id = ? AND deleted_at <> ''`
+	args := []any{utils.TenantFromContext(ctx), id}
+	if version != 0 {
+		query += " AND version = ?"
+		args = append(args, version)
+	}
+
+	var device *models.Device
+	err := inTransaction(ctx, r.db, hasDeviceEvents(ctx), func(tx sqlExecutor) (err error) {
+		device, err = scanDevice(tx.QueryRowContext(ctx, r.db.Rebind(query+" RETURNING "+deviceColumns), args...))
+		if errors.Is(err, sql.ErrNoRows) {
+			return r.restoreError(ctx, tx, id)
+		}
+		if err != nil {
+			return err
+		}
+		return r.storeEvents(ctx, tx, device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// restoreError tells why a device could not be restored.
+func (r *DeviceSQLRepository) restoreError(ctx context.Context, tx sqlExecutor, id string) error {
+	device, err := r.getRow(ctx, tx, id)
+	switch {
+	case err != nil:
+		return err
+	case device.DeletedAt == "":
+		return utils.ErrDeviceNotDeleted
+	default:
+		return utils.ErrVersionMismatch
+	}
+}
+
+// WriteDevices runs an atomic batch in one transaction, which is rolled back when an operation fails. Otherwise
+// every operation is a statement of its own, or a transaction of its own when it stores events.
+func (r *DeviceSQLRepository) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]BatchResult, error) {
+	if err := ValidateBatch(ops, atomic); err != nil {
+		return nil, err
+	}
+	if !atomic {
+		results := make([]BatchResult, len(ops))
+		for i, op := range ops {
+			err := inTransaction(ctx, r.db, hasDeviceEvents(ctx), func(tx sqlExecutor) error {
+				results[i] = r.writeDevice(ctx, tx, op)
+				return results[i].Err
+			})
+			if err != nil {
+				results[i] = BatchResult{Err: err}
+			}
+		}
+		return results, nil
+	}
+
+	tx, err := r.db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := r.writeDevices(ctx, tx, ops)
+	for _, result := range results {
+		if result.Err != nil {
+			abortBatch(results)
+			return results, nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (r *DeviceSQLRepository) writeDevices(ctx context.Context, tx sqlExecutor, ops []models.DeviceBatchOperation) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = r.writeDevice(ctx, tx, op)
+	}
+	return results
+}
+
+func (r *DeviceSQLRepository) writeDevice(ctx context.Context, tx sqlExecutor, op models.DeviceBatchOperation) BatchResult {
+	var result BatchResult
+	device := op.Device
+	switch op.Op {
+	case models.BatchCreate:
+		result.Device, result.Err = r.createDevice(ctx, tx, device)
+	case models.BatchUpdate:
+		result.Device, result.Err = r.updateDevice(ctx, tx, device.ID, &device)
+	case models.BatchDelete:
+		result.Err = r.deleteDevice(ctx, tx, device.ID, device.Version, device.DeletedBy)
+	}
+	return result
+}
+
+// CountByTenant counts the devices of every tenant, the trash included.
+func (r *DeviceSQLRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	if err := r.purge(ctx); err != nil {
+		return nil, err
+	}
+	return countByTenant(ctx, r.db, "devices")
+}
+
+// countByTenant counts the rows of table for every tenant that has any.
+func countByTenant(ctx context.Context, db *db.SQLInstance, table string) (map[string]int, error) {
+	rows, err := db.DB.QueryContext(ctx, "SELECT tenant, COUNT(*) FROM "+table+" GROUP BY tenant")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var tenant string
+		var count int
+		if err := rows.Scan(&tenant, &count); err != nil {
+			return nil, err
+		}
+		counts[tenant] = count
+	}
+	return counts, rows.Err()
+}
+
+// PendingEvents returns the oldest events the devices left in the event_outbox table.
+func (r *DeviceSQLRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	return r.outbox.pending(ctx, limit)
+}
+
+func (r *DeviceSQLRepository) AckEvents(ctx context.Context, ids []string) error {
+	return r.outbox.ack(ctx, ids)
+}
@@ -0,0 +1,157 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"testing"
+	"time"
+)
+
+// newTestSQLInstance opens a migrated SQLite database in a temporary file.
+func newTestSQLInstance(t *testing.T) *db.SQLInstance {
+	instance, err := db.OpenSQLInstance(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLInstance() error = %v", err)
+	}
+	t.Cleanup(func() { instance.DB.Close() })
+	return instance
+}
+
+func TestDeviceSQLRepository_ListDevicesFilterAndSort(t *testing.T) {
+	r := NewSQLDeviceRepository(newTestSQLInstance(t))
+	for _, device := range []*models.Device{
+		{ID: "1", Name: "Camera", DeviceModel: "/devicemodels/A", Serial: "A020000103"},
+		{ID: "2", Name: "Sensor", DeviceModel: "/devicemodels/A", Serial: "A020000102"},
+		{ID: "3", Name: "Door Camera", DeviceModel: "/devicemodels/B", Serial: "B010000001"},
+		{ID: "4", Name: "Camera", DeviceModel: "/devicemodels/B", Serial: "A030000001"},
+	} {
+		if _, err := r.CreateDevice(context.Background(), device); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+
+	testsList := []struct {
+		name    string
+		opts    ListOptions
+		wantIDs []string
+	}{
+		{
+			name:    "SerialPrefix",
+			opts:    ListOptions{Filter: DeviceFilter{{Field: "serial", Operator: FilterPrefix, Value: "A02"}}},
+			wantIDs: []string{"1", "2"},
+		},
+		{
+			name: "NameContainsAndModel",
+			opts: ListOptions{Filter: DeviceFilter{
+				{Field: "name", Operator: FilterContains, Value: "Camera"},
+				{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/B"},
+			}},
+			wantIDs: []string{"3", "4"},
+		},
+		{
+			// Filters are case sensitive like on the other backends.
+			name:    "NameContainsOtherCase",
+			opts:    ListOptions{Filter: DeviceFilter{{Field: "name", Operator: FilterContains, Value: "camera"}}},
+			wantIDs: []string{},
+		},
+		{
+			name:    "SortByNameThenID",
+			opts:    ListOptions{Sort: []SortField{{Field: "name"}}},
+			wantIDs: []string{"1", "4", "3", "2"},
+		},
+		{
+			name:    "SortBySerialDescending",
+			opts:    ListOptions{Sort: []SortField{{Field: "serial", Descending: true}}},
+			wantIDs: []string{"3", "4", "1", "2"},
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.ListDevices(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatalf("ListDevices() error = %v", err)
+			}
+			gotIDs := []string{}
+			for _, device := range got.Items {
+				gotIDs = append(gotIDs, device.ID)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("ListDevices() got = %v, want %v", gotIDs, tt.wantIDs)
+			}
+		})
+	}
+
+	t.Run("SortedPages", func(t *testing.T) {
+		opts := ListOptions{Limit: 1, Sort: []SortField{{Field: "name", Descending: true}, {Field: "deviceModel"}}}
+		gotIDs := []string{}
+		for pages := 0; pages < 10; pages++ {
+			page, err := r.ListDevices(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("ListDevices() error = %v", err)
+			}
+			for _, device := range page.Items {
+				gotIDs = append(gotIDs, device.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		if want := []string{"2", "3", "1", "4"}; !reflect.DeepEqual(gotIDs, want) {
+			t.Errorf("ListDevices() got = %v, want %v", gotIDs, want)
+		}
+	})
+}
+
+func TestDeviceSQLRepository_Purge(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := NewSQLDeviceRepository(newTestSQLInstance(t))
+	r.now = func() time.Time { return now }
+	r.SetPurgeAfter(24 * time.Hour)
+
+	if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "1", Name: "Device 1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if err := r.DeleteDevice(context.Background(), "1", 1, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	trash, err := r.ListDevices(context.Background(), ListOptions{Deleted: true})
+	if err != nil {
+		t.Fatalf("ListDevices() error = %v", err)
+	}
+	want := models.Device{ID: "1", Name: "Device 1", Version: 2, DeletedAt: "2024-05-01T12:00:00Z", DeletedBy: "operator", PurgeAt: now.Add(24 * time.Hour).Unix()}
+	if len(trash.Items) != 1 || *trash.Items[0] != want {
+		t.Errorf("ListDevices() got = %v, want %v", trash.Items, want)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if _, err := r.RestoreDevice(context.Background(), "1", 0); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if _, err := r.getRow(context.Background(), r.db.DB, "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("RestoreDevice() the purged device should be removed, error = %v", err)
+	}
+}
+
+func TestDeviceSQLRepository_Canceled(t *testing.T) {
+	r := NewSQLDeviceRepository(newTestSQLInstance(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := r.CreateDevice(ctx, &models.Device{ID: "1", Name: "Device 1"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateDevice() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := r.ListDevices(ctx, ListOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListDevices() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := r.GetDevice(context.Background(), "1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("CreateDevice() a canceled create should not store the device, error = %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package repositories
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+)
+
+// DeviceStateLogDynamoRepository stores the logs of a device in its item collection of the single table, sorted by
+// LOG#Date#State. GSI2 keeps the logs of each state of a device apart, and GSI1 is the escalation inbox of the
+// assignees. Every key starts with the tenant, so every query stays within the tenant of its context. A log that
+// has events is put in a transaction with them, into the outbox partition of the logs.
+type DeviceStateLogDynamoRepository struct {
+	db     *db.DynamoDBInstance
+	outbox dynamoEventOutbox
+}
+
+func NewDynamoDeviceStateLogRepository(db *db.DynamoDBInstance) *DeviceStateLogDynamoRepository {
+	return &DeviceStateLogDynamoRepository{
+		db:     db,
+		outbox: dynamoEventOutbox{db: db, source: deviceStateLogEventSource},
+	}
+}
+
+// deviceLogsKey is the partition of the device of tenant, which holds its logs.
+func deviceLogsKey(tenant, deviceID string) string {
+	return tenantKey(tenant, devicePrefix+deviceID)
+}
+
+// deviceStateKey is the GSI2 partition of the logs of the device of tenant in state.
+func deviceStateKey(tenant, deviceID, state string) string {
+	return deviceLogsKey(tenant, deviceID) + statePrefix + state
+}
+
+// assigneeKey is the GSI1 partition of the escalation inbox of assignee of tenant.
+func assigneeKey(tenant, assignee string) string {
+	return tenantKey(tenant, assigneePrefix+assignee)
+}
+
+// logSortKey sorts the logs of a device by date, and then by state.
+func logSortKey(log *models.DeviceStateLog) string {
+	return logPrefix + log.Date + "#" + log.State
+}
+
+// escalationSortKey sorts an escalation inbox like the memory repository: by date, device and state.
+func escalationSortKey(log *models.DeviceStateLog) string {
+	return logPrefix + log.Date + "#" + log.DeviceID + "#" + log.State
+}
+
+// marshalDeviceStateLog is the item of a log of tenant. Only the escalated logs get the keys of the escalation
+// inbox.
+func marshalDeviceStateLog(tenant string, log *models.DeviceStateLog) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(log)
+	if err != nil {
+		return nil, err
+	}
+	key := map[string]string{
+		pkAttribute:     deviceLogsKey(tenant, log.DeviceID),
+		skAttribute:     logSortKey(log),
+		gsi2PKAttribute: deviceStateKey(tenant, log.DeviceID, log.State),
+		gsi2SKAttribute: log.Date,
+	}
+	if log.EscalatedTo != "" {
+		key[gsi1PKAttribute] = assigneeKey(tenant, log.EscalatedTo)
+		key[gsi1SKAttribute] = escalationSortKey(log)
+	}
+	setItemKeys(item, deviceStateLogItem, tenant, key)
+	return item, nil
+}
+
+// unmarshalDeviceStateLogs reads the logs of items.
+func unmarshalDeviceStateLogs(items []map[string]*dynamodb.AttributeValue) ([]*models.DeviceStateLog, error) {
+	logs := []*models.DeviceStateLog{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// CreateLog moves the state guard of the device forward to the log. A log older than the guard leaves it, and is put
+// on its own.
+func (d *DeviceStateLogDynamoRepository) CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	err := d.createLog(ctx, log, d.stateGuard(ctx, log, log))
+	if cancelledOnCondition(err, 1) {
+		err = d.createLog(ctx, log, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// CreateLogAfter puts the log in a transaction with the state guard of the device, which holds the sort key of its
+// latest log. The guard must not be after latest, so of two transitions from the same log only the first is stored.
+// The devices whose logs were written before there were guards have none yet.
+func (d *DeviceStateLogDynamoRepository) CreateLogAfter(ctx context.Context, log, latest *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	err := d.createLog(ctx, log, d.stateGuard(ctx, log, latest))
+	if cancelledOnCondition(err, 1) {
+		return nil, utils.ErrStateChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// stateGuard puts log in the state guard of its device, on the condition that the guard is not after latest, or
+// that the device has no guard when latest is nil.
+func (d *DeviceStateLogDynamoRepository) stateGuard(ctx context.Context, log, latest *models.DeviceStateLog) *dynamodb.Put {
+	tenant := utils.TenantFromContext(ctx)
+	item := map[string]*dynamodb.AttributeValue{latestAttribute: stringValue(logSortKey(log))}
+	setItemKeys(item, deviceStateItem, tenant, map[string]string{
+		pkAttribute: deviceLogsKey(tenant, log.DeviceID),
+		skAttribute: stateSortKey,
+	})
+	guard := &dynamodb.Put{
+		Item:                     item,
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_not_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	}
+	if latest != nil {
+		guard.ConditionExpression = aws.String("attribute_not_exists(#PK) OR #L <= :latest")
+		guard.ExpressionAttributeNames["#L"] = aws.String(latestAttribute)
+		guard.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":latest": stringValue(logSortKey(latest))}
+	}
+	return guard
+}
+
+// createLog puts the log, with guard when it is not nil, in one transaction with its events. The guard is the
+// second item of the transaction.
+func (d *DeviceStateLogDynamoRepository) createLog(ctx context.Context, log *models.DeviceStateLog, guard *dynamodb.Put) error {
+	av, err := marshalDeviceStateLog(utils.TenantFromContext(ctx), log)
+	if err != nil {
+		return err
+	}
+	events, err := logEvents(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	put := &dynamodb.Put{Item: av, TableName: aws.String(d.db.GetTableName())}
+	if guard == nil && len(events) == 0 {
+		if _, err := d.db.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{Item: put.Item, TableName: put.TableName}); err != nil {
+			return contextError(ctx, err)
+		}
+		return nil
+	}
+	items := []*dynamodb.TransactWriteItem{{Put: put}}
+	if guard != nil {
+		items = append(items, &dynamodb.TransactWriteItem{Put: guard})
+	}
+	return d.outbox.transact(ctx, items, [][]models.Event{events})
+}
+
+// ListLogs answers a state query with the GSI2 partition of the state, between two dates when the query has them,
+// and any other query with the LOG# items of the device partition.
+func (d *DeviceStateLogDynamoRepository) ListLogs(ctx context.Context, deviceID string, query LogQuery) (*models.DeviceStateLogPage, error) {
+	tenant := utils.TenantFromContext(ctx)
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(d.db.GetTableName()),
+		ExpressionAttributeNames:  map[string]*string{},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{},
+		Limit:                     aws.Int64(int64(normalizeLimit(query.Limit))),
+	}
+
+	from, to := query.dateRange()
+	switch {
+	case query.State != "" && query.From == "" && query.To == "":
+		input.IndexName = aws.String(gsi2Index)
+		input.KeyConditionExpression = aws.String("#G2PK = :state")
+		input.ExpressionAttributeNames["#G2PK"] = aws.String(gsi2PKAttribute)
+		input.ExpressionAttributeValues[":state"] = stringValue(deviceStateKey(tenant, deviceID, query.State))
+	case query.State != "":
+		input.IndexName = aws.String(gsi2Index)
+		input.KeyConditionExpression = aws.String("#G2PK = :state AND #G2SK BETWEEN :from AND :to")
+		input.ExpressionAttributeNames["#G2PK"] = aws.String(gsi2PKAttribute)
+		input.ExpressionAttributeNames["#G2SK"] = aws.String(gsi2SKAttribute)
+		input.ExpressionAttributeValues[":state"] = stringValue(deviceStateKey(tenant, deviceID, query.State))
+		input.ExpressionAttributeValues[":from"] = stringValue(from)
+		input.ExpressionAttributeValues[":to"] = stringValue(to)
+	case query.From != "" || query.To != "":
+		// '$' follows the '#' that ends the date in the sort key, so the logs of the last date are in the range.
+		input.KeyConditionExpression = aws.String("#PK = :device AND #SK BETWEEN :from AND :to")
+		input.ExpressionAttributeNames["#PK"] = aws.String(pkAttribute)
+		input.ExpressionAttributeNames["#SK"] = aws.String(skAttribute)
+		input.ExpressionAttributeValues[":device"] = stringValue(deviceLogsKey(tenant, deviceID))
+		input.ExpressionAttributeValues[":from"] = stringValue(logPrefix + from)
+		input.ExpressionAttributeValues[":to"] = stringValue(logPrefix + to + "$")
+	default:
+		input.KeyConditionExpression = aws.String("#PK = :device AND begins_with(#SK, :log)")
+		input.ExpressionAttributeNames["#PK"] = aws.String(pkAttribute)
+		input.ExpressionAttributeNames["#SK"] = aws.String(skAttribute)
+		input.ExpressionAttributeValues[":device"] = stringValue(deviceLogsKey(tenant, deviceID))
+		input.ExpressionAttributeValues[":log"] = stringValue(logPrefix)
+	}
+
+	if query.Cursor != "" {
+		startKey, err := decodeDynamoCursor(query.Cursor, aws.StringValue(input.IndexName))
+		if err != nil {
+			return nil, err
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	result, err := d.db.Client.QueryWithContext(ctx, input)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	page := &models.DeviceStateLogPage{}
+	if page.Items, err = unmarshalDeviceStateLogs(result.Items); err != nil {
+		return nil, err
+	}
+
+	if len(result.LastEvaluatedKey) > 0 {
+		page.NextCursor, err = encodeDynamoCursor(result.LastEvaluatedKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// LatestLog reads the LOG# items of the device partition backwards and takes the first one.
+func (d *DeviceStateLogDynamoRepository) LatestLog(ctx context.Context, deviceID string) (*models.DeviceStateLog, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.db.GetTableName()),
+		KeyConditionExpression: aws.String("#PK = :device AND begins_with(#SK, :log)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#PK": aws.String(pkAttribute),
+			"#SK": aws.String(skAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":device": stringValue(deviceLogsKey(utils.TenantFromContext(ctx), deviceID)),
+			":log":    stringValue(logPrefix),
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(1),
+	}
+
+	result, err := d.db.Client.QueryWithContext(ctx, input)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+
+	logs, err := unmarshalDeviceStateLogs(result.Items[:1])
+	if err != nil {
+		return nil, err
+	}
+	return logs[0], nil
+}
+
+// ListEscalations queries the GSI1 inbox of the assignee backwards, newest first. The state is a filter on the
+// index, so it keeps reading until the page is full.
+func (d *DeviceStateLogDynamoRepository) ListEscalations(ctx context.Context, query EscalationQuery) (*models.DeviceStateLogPage, error) {
+	tenant := utils.TenantFromContext(ctx)
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.db.GetTableName()),
+		IndexName:              aws.String(gsi1Index),
+		KeyConditionExpression: aws.String("#G1PK = :assignee"),
+		ExpressionAttributeNames: map[string]*string{
+			"#G1PK": aws.String(gsi1PKAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":assignee": stringValue(assigneeKey(tenant, query.Assignee)),
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if query.Since != "" {
+		input.KeyConditionExpression = aws.String("#G1PK = :assignee AND #G1SK >= :since")
+		input.ExpressionAttributeNames["#G1SK"] = aws.String(gsi1SKAttribute)
+		input.ExpressionAttributeValues[":since"] = stringValue(logPrefix + query.Since)
+	}
+	if query.State != "" {
+		input.FilterExpression = aws.String("#S = :state")
+		input.ExpressionAttributeNames["#S"] = aws.String("State")
+		input.ExpressionAttributeValues[":state"] = stringValue(query.State)
+	}
+
+	if query.Cursor != "" {
+		startKey, err := decodeDynamoCursor(query.Cursor, aws.StringValue(input.IndexName))
+		if err != nil {
+			return nil, err
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	limit := normalizeLimit(query.Limit)
+	input.Limit = aws.Int64(int64(limit))
+	page := &models.DeviceStateLogPage{Items: []*models.DeviceStateLog{}}
+	for {
+		result, err := d.db.Client.QueryWithContext(ctx, input)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		batch, err := unmarshalDeviceStateLogs(result.Items)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, batch...)
+
+		lastKey := result.LastEvaluatedKey
+		if len(page.Items) > limit {
+			page.Items = page.Items[:limit]
+			lastKey = escalationIndexKey(tenant, page.Items[limit-1])
+		}
+		if len(lastKey) == 0 {
+			return page, nil
+		}
+		if len(page.Items) == limit {
+			page.NextCursor, err = encodeDynamoCursor(lastKey)
+			if err != nil {
+				return nil, err
+			}
+			return page, nil
+		}
+		input.ExclusiveStartKey = lastKey
+	}
+}
+
+// escalationIndexKey builds the LastEvaluatedKey DynamoDB would return for log of tenant in the escalation inbox.
+func escalationIndexKey(tenant string, log *models.DeviceStateLog) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		pkAttribute:     stringValue(deviceLogsKey(tenant, log.DeviceID)),
+		skAttribute:     stringValue(logSortKey(log)),
+		gsi1PKAttribute: stringValue(assigneeKey(tenant, log.EscalatedTo)),
+		gsi1SKAttribute: stringValue(escalationSortKey(log)),
+	}
+}
+
+// PendingEvents returns the oldest events of the outbox partition of the logs.
+func (d *DeviceStateLogDynamoRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	return d.outbox.pending(ctx, limit)
+}
+
+func (d *DeviceStateLogDynamoRepository) AckEvents(ctx context.Context, ids []string) error {
+	return d.outbox.ack(ctx, ids)
+}
+
+// CountByTenant scans the whole table for the tenant of every log.
+func (d *DeviceStateLogDynamoRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	return countDynamoByTenant(ctx, d.db, deviceStateLogItem)
+}
@@ -0,0 +1,67 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"simple-api-go/models"
+	"slices"
+	"testing"
+)
+
+// TestDeviceStateLogDynamoRepository_ListEscalations pages through the escalation index and checks that it returns
+// the logs of the memory repository in the same order.
+func TestDeviceStateLogDynamoRepository_ListEscalations(t *testing.T) {
+	_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	r := NewDynamoDeviceStateLogRepository(instance)
+	memory := NewDeviceStateLogMemoryRepository()
+	states := []string{"Critical", "Warning", "Normal"}
+	for i := 0; i < 40; i++ {
+		log := &models.DeviceStateLog{DeviceID: fmt.Sprintf("/devices/d%d", i%4), State: states[i%3], Date: fmt.Sprintf("2024-03-%02dT10:00:00.000Z", 1+i%20), Operator: "operator"}
+		log.StateDate = models.StateDateKey(log.State, log.Date)
+		if i%5 != 0 {
+			log.EscalatedTo = fmt.Sprintf("supervisor%d", i%2)
+		}
+		if _, err := r.CreateLog(context.Background(), log); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+		copied := *log
+		if _, err := memory.CreateLog(context.Background(), &copied); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+	}
+
+	testsList := []struct {
+		name  string
+		query EscalationQuery
+	}{
+		{name: "Assignee", query: EscalationQuery{Assignee: "supervisor0", Limit: 3}},
+		{name: "State", query: EscalationQuery{Assignee: "supervisor1", State: "Critical", Limit: 2}},
+		{name: "Since", query: EscalationQuery{Assignee: "supervisor1", Since: "2024-03-10T00:00:00.000Z", Limit: 4}},
+	}
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			got, want := listEscalationKeys(t, r, tt.query), listEscalationKeys(t, memory, tt.query)
+			if len(got) == 0 || !slices.Equal(got, want) {
+				t.Errorf("ListEscalations() got = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// listEscalationKeys reads every page of the escalations of query.
+func listEscalationKeys(t *testing.T, repo DeviceStateLogRepository, query EscalationQuery) []string {
+	var keys []string
+	for {
+		page, err := repo.ListEscalations(context.Background(), query)
+		if err != nil {
+			t.Fatalf("ListEscalations() error = %v", err)
+		}
+		for _, log := range page.Items {
+			keys = append(keys, log.DeviceID+"/"+log.StateDate)
+		}
+		if page.NextCursor == "" {
+			return keys
+		}
+		query.Cursor = page.NextCursor
+	}
+}
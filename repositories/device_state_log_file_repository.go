@@ -0,0 +1,178 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"sync"
+)
+
+// storedDeviceStateLog is a log as written to disk, with its tenant. The logs written before there were tenants have
+// none, they belong to utils.DefaultTenant.
+type storedDeviceStateLog struct {
+	models.DeviceStateLog
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// deviceStateLogRecord is one entry of the write-ahead log: a log and the events of its write, or the IDs of the
+// events that AckEvents acknowledged.
+type deviceStateLogRecord struct {
+	storedDeviceStateLog
+	Events []models.Event `json:"events,omitempty"`
+	Acked  []string       `json:"acked,omitempty"`
+}
+
+// deviceStateLogSnapshot is the snapshot of the logs and of the pending events. The snapshots written before there
+// were events are a bare list of logs.
+type deviceStateLogSnapshot struct {
+	Logs   []storedDeviceStateLog `json:"logs"`
+	Events []models.Event         `json:"events"`
+}
+
+// DeviceStateLogFileRepository is a DeviceStateLogMemoryRepository that survives restarts. A log is appended to
+// the write-ahead log of a db.FileStore, together with its events, before it is indexed in memory. Writes take
+// turns, so they are applied in the order of the log.
+type DeviceStateLogFileRepository struct {
+	*DeviceStateLogMemoryRepository
+	store   *db.FileStore
+	writeMu sync.Mutex
+}
+
+// NewDeviceStateLogFileRepository loads the logs of store into memory.
+func NewDeviceStateLogFileRepository(store *db.FileStore) (*DeviceStateLogFileRepository, error) {
+	r := &DeviceStateLogFileRepository{
+		DeviceStateLogMemoryRepository: NewDeviceStateLogMemoryRepository(),
+		store:                          store,
+	}
+
+	restore := func(data []byte) error {
+		var snapshot deviceStateLogSnapshot
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			if err := json.Unmarshal(data, &snapshot.Logs); err != nil {
+				return err
+			}
+		} else if err := json.Unmarshal(data, &snapshot); err != nil {
+			return err
+		}
+		for _, log := range snapshot.Logs {
+			r.DeviceStateLogMemoryRepository.CreateLog(utils.WithTenant(context.Background(), log.Tenant), &log.DeviceStateLog)
+		}
+		r.outbox.add(snapshot.Events...)
+		return nil
+	}
+	replay := func(data []byte) error {
+		var record deviceStateLogRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if record.DeviceID != "" {
+			if _, err := r.DeviceStateLogMemoryRepository.CreateLog(utils.WithTenant(context.Background(), record.Tenant), &record.DeviceStateLog); err != nil {
+				return err
+			}
+		}
+		r.outbox.add(record.Events...)
+		r.outbox.ack(record.Acked)
+		return nil
+	}
+	if err := store.Load(restore, replay); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *DeviceStateLogFileRepository) CreateLog(ctx context.Context, entry *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	return r.createLog(ctx, entry, nil, false)
+}
+
+// CreateLogAfter checks the latest log of the device before the log is appended. Writes take turns, so it is still
+// the latest when the log is indexed.
+func (r *DeviceStateLogFileRepository) CreateLogAfter(ctx context.Context, entry, latest *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	return r.createLog(ctx, entry, latest, true)
+}
+
+func (r *DeviceStateLogFileRepository) createLog(ctx context.Context, entry, latest *models.DeviceStateLog, checkLatest bool) (*models.DeviceStateLog, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if checkLatest {
+		r.mu.RLock()
+		isLatest := isLatestLog(r.logsOf(ctx).logs[entry.DeviceID], latest)
+		r.mu.RUnlock()
+		if !isLatest {
+			return nil, utils.ErrStateChanged
+		}
+	}
+	events, err := logEvents(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	record := deviceStateLogRecord{
+		storedDeviceStateLog: storedDeviceStateLog{DeviceStateLog: *entry, Tenant: utils.TenantFromContext(ctx)},
+		Events:               events,
+	}
+	if err := r.store.Append(record); err != nil {
+		return nil, err
+	}
+	// The events are built already, the memory repository must not build them again.
+	created, err := r.DeviceStateLogMemoryRepository.CreateLog(WithLogEvents(ctx, nil), entry)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.outbox.add(events...)
+	r.mu.Unlock()
+
+	if r.store.NeedsSnapshot() {
+		r.snapshot()
+	}
+	return created, nil
+}
+
+// AckEvents logs the acknowledgement, so the events are not delivered again after a restart.
+func (r *DeviceStateLogFileRepository) AckEvents(ctx context.Context, ids []string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := r.store.Append(deviceStateLogRecord{Acked: ids}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.outbox.ack(ids)
+	r.mu.Unlock()
+
+	if r.store.NeedsSnapshot() {
+		r.snapshot()
+	}
+	return nil
+}
+
+// snapshot compacts the log. The records are already durable, so a failure only leaves the log longer.
+func (r *DeviceStateLogFileRepository) snapshot() {
+	r.mu.RLock()
+	snapshot := deviceStateLogSnapshot{Logs: []storedDeviceStateLog{}, Events: append([]models.Event{}, r.outbox.events...)}
+	for tenant, tenantLogs := range r.tenants {
+		for _, deviceLogs := range tenantLogs.logs {
+			for _, log := range deviceLogs {
+				snapshot.Logs = append(snapshot.Logs, storedDeviceStateLog{DeviceStateLog: *log, Tenant: tenant})
+			}
+		}
+	}
+	err := r.store.Snapshot(snapshot)
+	r.mu.RUnlock()
+	if err != nil {
+		log.Printf("failed to snapshot the device state logs: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package repositories
+
+import (
+	"cmp"
+	"context"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DeviceStateLogMemoryRepository is safe for concurrent use, and stores and hands out copies of the logs. Every
+// tenant has its logs and its escalation index of its own. The events of the writes wait in an outbox shared by the
+// tenants, see EventOutbox.
+type DeviceStateLogMemoryRepository struct {
+	mu      sync.RWMutex
+	tenants map[string]*deviceStateLogs
+	outbox  eventOutbox
+}
+
+// deviceStateLogs are the logs of one tenant.
+type deviceStateLogs struct {
+	// logs holds the logs of each device keyed by DeviceID, sorted by State#Date like the DynamoDB table.
+	logs map[string][]*models.DeviceStateLog
+	// escalations indexes escalated logs by EscalatedTo, sorted by Date and then by the table key like the
+	// DynamoDB index.
+	escalations map[string][]*models.DeviceStateLog
+}
+
+func NewDeviceStateLogMemoryRepository() *DeviceStateLogMemoryRepository {
+	return &DeviceStateLogMemoryRepository{
+		tenants: make(map[string]*deviceStateLogs),
+	}
+}
+
+// logsOf returns the logs of the tenant of ctx, empty until the tenant stores one. The caller holds the lock.
+func (r *DeviceStateLogMemoryRepository) logsOf(ctx context.Context) *deviceStateLogs {
+	if logs, ok := r.tenants[utils.TenantFromContext(ctx)]; ok {
+		return logs
+	}
+	return &deviceStateLogs{}
+}
+
+// namespace returns the logs of the tenant of ctx, and makes room for them when the tenant has none yet. The caller
+// holds the write lock.
+func (r *DeviceStateLogMemoryRepository) namespace(ctx context.Context) *deviceStateLogs {
+	tenant := utils.TenantFromContext(ctx)
+	logs, ok := r.tenants[tenant]
+	if !ok {
+		logs = &deviceStateLogs{
+			logs:        make(map[string][]*models.DeviceStateLog),
+			escalations: make(map[string][]*models.DeviceStateLog),
+		}
+		r.tenants[tenant] = logs
+	}
+	return logs
+}
+
+// CountByTenant counts the logs of every tenant.
+func (r *DeviceStateLogMemoryRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := make(map[string]int, len(r.tenants))
+	for tenant, logs := range r.tenants {
+		for _, deviceLogs := range logs.logs {
+			counts[tenant] += len(deviceLogs)
+		}
+	}
+	return counts, nil
+}
+
+func copyDeviceStateLog(log *models.DeviceStateLog) *models.DeviceStateLog {
+	c := *log
+	return &c
+}
+
+func (r *DeviceStateLogMemoryRepository) CreateLog(ctx context.Context, created *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	return r.createLog(ctx, created, nil, false)
+}
+
+// CreateLogAfter checks the latest log of the device under the lock of the write.
+func (r *DeviceStateLogMemoryRepository) CreateLogAfter(ctx context.Context, created, latest *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	return r.createLog(ctx, created, latest, true)
+}
+
+func (r *DeviceStateLogMemoryRepository) createLog(ctx context.Context, created, latest *models.DeviceStateLog, checkLatest bool) (*models.DeviceStateLog, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	events, err := logEvents(ctx, created)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenantLogs := r.namespace(ctx)
+	logs := tenantLogs.logs[created.DeviceID]
+	if checkLatest && !isLatestLog(logs, latest) {
+		return nil, utils.ErrStateChanged
+	}
+
+	r.outbox.add(events...)
+	log := copyDeviceStateLog(created)
+	i, found := slices.BinarySearchFunc(logs, log.StateDate, func(l *models.DeviceStateLog, key string) int {
+		return strings.Compare(l.StateDate, key)
+	})
+	if found {
+		tenantLogs.unindexEscalation(logs[i])
+		logs[i] = log
+	} else {
+		tenantLogs.logs[log.DeviceID] = slices.Insert(logs, i, log)
+	}
+	tenantLogs.indexEscalation(log)
+	return created, nil
+}
+
+// PendingEvents returns the oldest events of the outbox.
+func (r *DeviceStateLogMemoryRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.outbox.pending(limit), nil
+}
+
+func (r *DeviceStateLogMemoryRepository) AckEvents(ctx context.Context, ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outbox.ack(ids)
+	return nil
+}
+
+func (l *deviceStateLogs) indexEscalation(log *models.DeviceStateLog) {
+	if log.EscalatedTo == "" {
+		return
+	}
+	index := l.escalations[log.EscalatedTo]
+	i, _ := slices.BinarySearchFunc(index, escalationKeyOf(log), compareEscalationLog)
+	l.escalations[log.EscalatedTo] = slices.Insert(index, i, log)
+}
+
+func (l *deviceStateLogs) unindexEscalation(log *models.DeviceStateLog) {
+	if log.EscalatedTo == "" {
+		return
+	}
+	l.escalations[log.EscalatedTo] = slices.DeleteFunc(l.escalations[log.EscalatedTo], func(indexed *models.DeviceStateLog) bool {
+		return indexed == log
+	})
+}
+
+func (r *DeviceStateLogMemoryRepository) LatestLog(ctx context.Context, deviceID string) (*models.DeviceStateLog, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	latest := latestLog(r.logsOf(ctx).logs[deviceID])
+	if latest == nil {
+		return nil, nil
+	}
+	return copyDeviceStateLog(latest), nil
+}
+
+type logCursor struct {
+	Key string `json:"k"`
+}
+
+// ListLogs mirrors the DynamoDB access paths: a state query walks the State#Date order, any other query walks the
+// Date order. The cursor holds the sort key of the last log on the page.
+func (r *DeviceStateLogMemoryRepository) ListLogs(ctx context.Context, deviceID string, query LogQuery) (*models.DeviceStateLogPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var after logCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	sortKey := func(log *models.DeviceStateLog) string {
+		if query.State != "" {
+			return log.StateDate
+		}
+		return log.Date + "#" + log.StateDate
+	}
+
+	from, to := query.dateRange()
+	var matched []*models.DeviceStateLog
+	r.mu.RLock()
+	for _, log := range r.logsOf(ctx).logs[deviceID] {
+		if query.State != "" && log.State != query.State {
+			continue
+		}
+		if log.Date < from || log.Date > to {
+			continue
+		}
+		if after.Key != "" && sortKey(log) <= after.Key {
+			continue
+		}
+		matched = append(matched, copyDeviceStateLog(log))
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(matched, func(a, b *models.DeviceStateLog) int {
+		return strings.Compare(sortKey(a), sortKey(b))
+	})
+
+	limit := normalizeLimit(query.Limit)
+	page := &models.DeviceStateLogPage{Items: []*models.DeviceStateLog{}}
+	page.Items = append(page.Items, matched[:min(limit, len(matched))]...)
+
+	if len(matched) > limit {
+		cursor, err := encodeCursor(logCursor{Key: sortKey(matched[limit-1])})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+// escalationKey is the position of a log in the escalation index, and the cursor of an escalation inbox.
+type escalationKey struct {
+	Date      string `json:"d"`
+	DeviceID  string `json:"id"`
+	StateDate string `json:"sd"`
+}
+
+func escalationKeyOf(log *models.DeviceStateLog) escalationKey {
+	return escalationKey{Date: log.Date, DeviceID: log.DeviceID, StateDate: log.StateDate}
+}
+
+func compareEscalationKeys(a, b escalationKey) int {
+	return cmp.Or(
+		strings.Compare(a.Date, b.Date),
+		strings.Compare(a.DeviceID, b.DeviceID),
+		strings.Compare(a.StateDate, b.StateDate),
+	)
+}
+
+func compareEscalationLog(log *models.DeviceStateLog, key escalationKey) int {
+	return compareEscalationKeys(escalationKeyOf(log), key)
+}
+
+// ListEscalations walks the escalation index of the assignee backwards, newest first.
+func (r *DeviceStateLogMemoryRepository) ListEscalations(ctx context.Context, query EscalationQuery) (*models.DeviceStateLogPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var after *escalationKey
+	if query.Cursor != "" {
+		after = &escalationKey{}
+		if err := decodeCursor(query.Cursor, after); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	limit := normalizeLimit(query.Limit)
+	page := &models.DeviceStateLogPage{Items: []*models.DeviceStateLog{}}
+	index := r.logsOf(ctx).escalations[query.Assignee]
+	for i := len(index) - 1; i >= 0; i-- {
+		log := index[i]
+		if log.Date < query.Since {
+			break
+		}
+		if after != nil && compareEscalationLog(log, *after) >= 0 {
+			continue
+		}
+		if query.State != "" && log.State != query.State {
+			continue
+		}
+		if len(page.Items) == limit {
+			cursor, err := encodeCursor(escalationKeyOf(page.Items[limit-1]))
+			if err != nil {
+				return nil, err
+			}
+			page.NextCursor = cursor
+			break
+		}
+		page.Items = append(page.Items, copyDeviceStateLog(log))
+	}
+	return page, nil
+}
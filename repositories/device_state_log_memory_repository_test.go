@@ -0,0 +1,269 @@
+package repositories
+
+import (
+	"context"
+	"reflect"
+	"simple-api-go/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLog(state, date string) *models.DeviceStateLog {
+	return &models.DeviceStateLog{
+		DeviceID:  "/devices/id1",
+		StateDate: models.StateDateKey(state, date),
+		Operator:  "operator1",
+		Date:      date,
+		State:     state,
+	}
+}
+
+func TestDeviceStateLogMemoryRepository_ListLogs(t *testing.T) {
+	r := NewDeviceStateLogMemoryRepository()
+	for _, log := range []*models.DeviceStateLog{
+		newTestLog("Warning", "2024-03-24T10:00:00.000Z"),
+		newTestLog("Critical", "2024-03-24T11:00:00.000Z"),
+		newTestLog("Normal", "2024-03-24T12:00:00.000Z"),
+		newTestLog("Critical", "2024-03-25T09:00:00.000Z"),
+		newTestLog("Critical", "2024-03-26T09:00:00.000Z"),
+	} {
+		if _, err := r.CreateLog(context.Background(), log); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+	}
+
+	testsList := []struct {
+		name      string
+		deviceID  string
+		query     LogQuery
+		wantDates []string
+		wantErr   bool
+	}{
+		{
+			name:     "AllLogsChronological",
+			deviceID: "/devices/id1",
+			query:    LogQuery{},
+			wantDates: []string{
+				"2024-03-24T10:00:00.000Z",
+				"2024-03-24T11:00:00.000Z",
+				"2024-03-24T12:00:00.000Z",
+				"2024-03-25T09:00:00.000Z",
+				"2024-03-26T09:00:00.000Z",
+			},
+		},
+		{
+			name:     "ByState",
+			deviceID: "/devices/id1",
+			query:    LogQuery{State: "Critical"},
+			wantDates: []string{
+				"2024-03-24T11:00:00.000Z",
+				"2024-03-25T09:00:00.000Z",
+				"2024-03-26T09:00:00.000Z",
+			},
+		},
+		{
+			name:     "ByStateBetween",
+			deviceID: "/devices/id1",
+			query:    LogQuery{State: "Critical", From: "2024-03-25T00:00:00.000Z", To: "2024-03-25T23:59:59.999Z"},
+			wantDates: []string{
+				"2024-03-25T09:00:00.000Z",
+			},
+		},
+		{
+			name:     "FromWithoutState",
+			deviceID: "/devices/id1",
+			query:    LogQuery{From: "2024-03-24T12:00:00.000Z"},
+			wantDates: []string{
+				"2024-03-24T12:00:00.000Z",
+				"2024-03-25T09:00:00.000Z",
+				"2024-03-26T09:00:00.000Z",
+			},
+		},
+		{
+			name:      "UnknownDevice",
+			deviceID:  "/devices/id2",
+			query:     LogQuery{},
+			wantDates: []string{},
+		},
+		{
+			name:     "InvalidCursor",
+			deviceID: "/devices/id1",
+			query:    LogQuery{Cursor: "not a cursor"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.ListLogs(context.Background(), tt.deviceID, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListLogs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			gotDates := []string{}
+			for _, log := range got.Items {
+				gotDates = append(gotDates, log.Date)
+			}
+			if !reflect.DeepEqual(gotDates, tt.wantDates) {
+				t.Errorf("ListLogs() got = %v, want %v", gotDates, tt.wantDates)
+			}
+		})
+	}
+
+	t.Run("NextPage", func(t *testing.T) {
+		first, err := r.ListLogs(context.Background(), "/devices/id1", LogQuery{State: "Critical", Limit: 2})
+		if err != nil {
+			t.Fatalf("ListLogs() error = %v", err)
+		}
+		second, err := r.ListLogs(context.Background(), "/devices/id1", LogQuery{State: "Critical", Limit: 2, Cursor: first.NextCursor})
+		if err != nil {
+			t.Fatalf("ListLogs() error = %v", err)
+		}
+		if len(first.Items) != 2 || len(second.Items) != 1 || second.Items[0].Date != "2024-03-26T09:00:00.000Z" {
+			t.Errorf("ListLogs() pages = %+v, %+v", first, second)
+		}
+	})
+}
+
+func TestDeviceStateLogMemoryRepository_ListEscalations(t *testing.T) {
+	r := NewDeviceStateLogMemoryRepository()
+	escalated := func(state, date, assignee string) *models.DeviceStateLog {
+		log := newTestLog(state, date)
+		log.EscalatedTo = assignee
+		return log
+	}
+	for _, log := range []*models.DeviceStateLog{
+		escalated("Critical", "2024-03-24T10:00:00.000Z", "supervisor1"),
+		escalated("Warning", "2024-03-24T11:00:00.000Z", "supervisor1"),
+		escalated("Critical", "2024-03-24T12:00:00.000Z", "supervisor2"),
+		escalated("Critical", "2024-03-25T09:00:00.000Z", "supervisor1"),
+		newTestLog("Normal", "2024-03-26T09:00:00.000Z"),
+		// Overwrites the log of 2024-03-24T12:00, moving it to the inbox of supervisor1.
+		escalated("Critical", "2024-03-24T12:00:00.000Z", "supervisor1"),
+	} {
+		if _, err := r.CreateLog(context.Background(), log); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+	}
+
+	testsList := []struct {
+		name      string
+		query     EscalationQuery
+		wantDates []string
+		wantErr   bool
+	}{
+		{
+			name:  "NewestFirst",
+			query: EscalationQuery{Assignee: "supervisor1"},
+			wantDates: []string{
+				"2024-03-25T09:00:00.000Z",
+				"2024-03-24T12:00:00.000Z",
+				"2024-03-24T11:00:00.000Z",
+				"2024-03-24T10:00:00.000Z",
+			},
+		},
+		{
+			name:  "ByState",
+			query: EscalationQuery{Assignee: "supervisor1", State: "Critical"},
+			wantDates: []string{
+				"2024-03-25T09:00:00.000Z",
+				"2024-03-24T12:00:00.000Z",
+				"2024-03-24T10:00:00.000Z",
+			},
+		},
+		{
+			name:  "Since",
+			query: EscalationQuery{Assignee: "supervisor1", Since: "2024-03-24T11:00:00.000Z"},
+			wantDates: []string{
+				"2024-03-25T09:00:00.000Z",
+				"2024-03-24T12:00:00.000Z",
+				"2024-03-24T11:00:00.000Z",
+			},
+		},
+		{
+			name:      "ReassignedLog",
+			query:     EscalationQuery{Assignee: "supervisor2"},
+			wantDates: []string{},
+		},
+		{
+			name:    "InvalidCursor",
+			query:   EscalationQuery{Assignee: "supervisor1", Cursor: "not a cursor"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.ListEscalations(context.Background(), tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListEscalations() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			gotDates := []string{}
+			for _, log := range got.Items {
+				gotDates = append(gotDates, log.Date)
+			}
+			if !reflect.DeepEqual(gotDates, tt.wantDates) {
+				t.Errorf("ListEscalations() got = %v, want %v", gotDates, tt.wantDates)
+			}
+		})
+	}
+
+	t.Run("NextPage", func(t *testing.T) {
+		first, err := r.ListEscalations(context.Background(), EscalationQuery{Assignee: "supervisor1", State: "Critical", Limit: 2})
+		if err != nil {
+			t.Fatalf("ListEscalations() error = %v", err)
+		}
+		second, err := r.ListEscalations(context.Background(), EscalationQuery{Assignee: "supervisor1", State: "Critical", Limit: 2, Cursor: first.NextCursor})
+		if err != nil {
+			t.Fatalf("ListEscalations() error = %v", err)
+		}
+		if len(first.Items) != 2 || len(second.Items) != 1 || second.Items[0].Date != "2024-03-24T10:00:00.000Z" || second.NextCursor != "" {
+			t.Errorf("ListEscalations() pages = %+v, %+v", first, second)
+		}
+	})
+}
+
+// TestDeviceStateLogMemoryRepository_Concurrent is meant for go test -race: logs are appended while they are read.
+func TestDeviceStateLogMemoryRepository_Concurrent(t *testing.T) {
+	r := NewDeviceStateLogMemoryRepository()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				date := time.Date(2024, 3, 24, w, i, 0, 0, time.UTC).Format("2006-01-02T15:04:05.000Z")
+				if _, err := r.CreateLog(context.Background(), newTestLog("Critical", date)); err != nil {
+					t.Errorf("CreateLog() error = %v", err)
+				}
+				r.LatestLog(context.Background(), "/devices/id1")
+				r.ListLogs(context.Background(), "/devices/id1", LogQuery{})
+				r.ListEscalations(context.Background(), EscalationQuery{})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	count := 0
+	for query := (LogQuery{}); ; {
+		page, err := r.ListLogs(context.Background(), "/devices/id1", query)
+		if err != nil {
+			t.Fatalf("ListLogs() error = %v", err)
+		}
+		count += len(page.Items)
+		if query.Cursor = page.NextCursor; query.Cursor == "" {
+			break
+		}
+	}
+	if count != 8*50 {
+		t.Errorf("ListLogs() got %v logs, want %v", count, 8*50)
+	}
+}
@@ -0,0 +1,71 @@
+package repositories
+
+import (
+	"context"
+	"simple-api-go/models"
+)
+
+// maxLogDate is the upper bound of an open ended date range.
+const maxLogDate = "9999-12-31T23:59:59.999Z"
+
+// LogQuery selects the logs of one device. From and To are inclusive bounds on Date, in models.LogDateFormat.
+// Logs come back in chronological order.
+type LogQuery struct {
+	State  string
+	From   string
+	To     string
+	Limit  int
+	Cursor string
+}
+
+// EscalationQuery selects the logs escalated to Assignee, optionally in one State and with Date at or after Since.
+// Logs come back newest first.
+type EscalationQuery struct {
+	Assignee string
+	State    string
+	Since    string
+	Limit    int
+	Cursor   string
+}
+
+type DeviceStateLogRepository interface {
+	// CreateLog stores log, replacing the log of the device with the same State#Date.
+	CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error)
+	// CreateLogAfter stores log only while latest is still the latest log of the device, nil for a device without
+	// logs, and fails with utils.ErrStateChanged otherwise. The check is part of the write, so two concurrent
+	// transitions from the same state can not both be stored.
+	CreateLogAfter(ctx context.Context, log, latest *models.DeviceStateLog) (*models.DeviceStateLog, error)
+	ListLogs(ctx context.Context, deviceID string, query LogQuery) (*models.DeviceStateLogPage, error)
+	ListEscalations(ctx context.Context, query EscalationQuery) (*models.DeviceStateLogPage, error)
+	// LatestLog returns the log with the latest Date, which holds the current state of the device, or nil when
+	// the device has no logs yet.
+	LatestLog(ctx context.Context, deviceID string) (*models.DeviceStateLog, error)
+}
+
+// isLatestLog tells whether latest is the latest log of logs, the logs of one device; nil when there are none.
+func isLatestLog(logs []*models.DeviceStateLog, latest *models.DeviceStateLog) bool {
+	current := latestLog(logs)
+	if current == nil || latest == nil {
+		return current == nil && latest == nil
+	}
+	return current.StateDate == latest.StateDate
+}
+
+// latestLog returns the log of logs with the latest Date, the one of the latest State#Date among equal dates.
+func latestLog(logs []*models.DeviceStateLog) *models.DeviceStateLog {
+	var latest *models.DeviceStateLog
+	for _, log := range logs {
+		if latest == nil || log.Date+"#"+log.StateDate > latest.Date+"#"+latest.StateDate {
+			latest = log
+		}
+	}
+	return latest
+}
+
+func (q LogQuery) dateRange() (string, string) {
+	to := q.To
+	if to == "" {
+		to = maxLogDate
+	}
+	return q.From, to
+}
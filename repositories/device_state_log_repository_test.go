@@ -0,0 +1,268 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"simple-api-go/db/sqltest"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeviceStateLogRepository(t *testing.T) {
+	t.Run("MemoryRepository", func(t *testing.T) {
+		testDeviceStateLogRepository(t, NewDeviceStateLogMemoryRepository())
+	})
+
+	t.Run("SQLRepository", func(t *testing.T) {
+		testDeviceStateLogRepository(t, NewSQLDeviceStateLogRepository(newTestSQLInstance(t)))
+	})
+
+	t.Run("PostgresRepository", func(t *testing.T) {
+		testDeviceStateLogRepository(t, NewSQLDeviceStateLogRepository(sqltest.OpenPostgres(t)))
+	})
+
+	t.Run("FileRepository", func(t *testing.T) {
+		repo, err := NewDeviceStateLogFileRepository(newTestFileStore(t, t.TempDir(), "device_state_logs"))
+		if err != nil {
+			t.Fatalf("NewDeviceStateLogFileRepository() error = %v", err)
+		}
+		testDeviceStateLogRepository(t, repo)
+	})
+
+	t.Run("DynamoDBRepository", func(t *testing.T) {
+		_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+		testDeviceStateLogRepository(t, NewDynamoDeviceStateLogRepository(instance))
+	})
+}
+
+func testDeviceStateLogRepository(t *testing.T, repo DeviceStateLogRepository) {
+	logs := []*models.DeviceStateLog{
+		newTestLog("Warning", "2024-03-24T10:00:00.000Z"),
+		newTestLog("Critical", "2024-03-24T11:00:00.000Z"),
+		newTestLog("Critical", "2024-03-25T09:00:00.000Z"),
+	}
+	for _, log := range logs {
+		log.DeviceID = "/devices/logTest1"
+	}
+	logs[1].EscalatedTo = "supervisorTest1"
+	logs[2].EscalatedTo = "supervisorTest1"
+
+	t.Run("CreateLog", func(t *testing.T) {
+		for _, log := range logs {
+			createdLog, err := repo.CreateLog(context.Background(), log)
+			if err != nil {
+				t.Errorf("CreateLog() error = %v", err)
+				return
+			}
+
+			if createdLog.StateDate != log.StateDate {
+				t.Errorf("CreateLog() got = %v, want %v", createdLog.StateDate, log.StateDate)
+			}
+		}
+	})
+
+	t.Run("LatestLog", func(t *testing.T) {
+		latest, err := repo.LatestLog(context.Background(), "/devices/logTest1")
+		if err != nil {
+			t.Errorf("LatestLog() error = %v", err)
+			return
+		}
+
+		if latest == nil || latest.Date != "2024-03-25T09:00:00.000Z" {
+			t.Errorf("LatestLog() got = %+v, want the log of 2024-03-25", latest)
+		}
+
+		latest, err = repo.LatestLog(context.Background(), "/devices/logTest2")
+		if err != nil || latest != nil {
+			t.Errorf("LatestLog() got = %+v, %v, want no log", latest, err)
+		}
+	})
+
+	t.Run("ListLogsByState", func(t *testing.T) {
+		page, err := repo.ListLogs(context.Background(), "/devices/logTest1", LogQuery{State: "Critical"})
+		if err != nil {
+			t.Errorf("ListLogs() error = %v", err)
+			return
+		}
+
+		if len(page.Items) != 2 {
+			t.Errorf("ListLogs() got = %v items, want %v", len(page.Items), 2)
+		}
+	})
+
+	t.Run("ListLogsBetween", func(t *testing.T) {
+		page, err := repo.ListLogs(context.Background(), "/devices/logTest1", LogQuery{From: "2024-03-24T10:30:00.000Z", To: "2024-03-24T23:59:59.999Z"})
+		if err != nil {
+			t.Errorf("ListLogs() error = %v", err)
+			return
+		}
+
+		if len(page.Items) != 1 || page.Items[0].State != "Critical" {
+			t.Errorf("ListLogs() got = %+v, want the Critical log of 2024-03-24", page.Items)
+		}
+	})
+
+	t.Run("ListLogsPaged", func(t *testing.T) {
+		var dates []string
+		query := LogQuery{Limit: 1}
+		for pages := 0; pages < 10; pages++ {
+			page, err := repo.ListLogs(context.Background(), "/devices/logTest1", query)
+			if err != nil {
+				t.Errorf("ListLogs() error = %v", err)
+				return
+			}
+			for _, log := range page.Items {
+				dates = append(dates, log.Date)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+
+		if len(dates) != 3 || dates[0] != "2024-03-24T10:00:00.000Z" || dates[2] != "2024-03-25T09:00:00.000Z" {
+			t.Errorf("ListLogs() got = %v, want the logs in chronological order", dates)
+		}
+	})
+
+	t.Run("ListEscalations", func(t *testing.T) {
+		var dates []string
+		query := EscalationQuery{Assignee: "supervisorTest1", Limit: 1}
+		for pages := 0; pages < 10; pages++ {
+			page, err := repo.ListEscalations(context.Background(), query)
+			if err != nil {
+				t.Errorf("ListEscalations() error = %v", err)
+				return
+			}
+			for _, log := range page.Items {
+				dates = append(dates, log.Date)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+
+		want := []string{"2024-03-25T09:00:00.000Z", "2024-03-24T11:00:00.000Z"}
+		if !slices.Equal(dates, want) {
+			t.Errorf("ListEscalations() got = %v, want %v", dates, want)
+		}
+	})
+
+	t.Run("TenantIsolation", func(t *testing.T) {
+		other := utils.WithTenant(context.Background(), "tenant-b")
+		if latest, err := repo.LatestLog(other, "/devices/logTest1"); err != nil || latest != nil {
+			t.Errorf("LatestLog() got = %+v, %v, want no log from another tenant", latest, err)
+		}
+		page, err := repo.ListLogs(other, "/devices/logTest1", LogQuery{})
+		if err != nil {
+			t.Fatalf("ListLogs() error = %v", err)
+		}
+		if len(page.Items) != 0 {
+			t.Errorf("ListLogs() got = %v items of another tenant, want none", len(page.Items))
+		}
+
+		log := newTestLog("Critical", "2024-03-26T09:00:00.000Z")
+		log.DeviceID = "/devices/logTest1"
+		log.EscalatedTo = "supervisorTest1"
+		if _, err := repo.CreateLog(other, log); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+		page, err = repo.ListEscalations(other, EscalationQuery{Assignee: "supervisorTest1"})
+		if err != nil {
+			t.Fatalf("ListEscalations() error = %v", err)
+		}
+		if len(page.Items) != 1 || page.Items[0].DeviceID != "/devices/logTest1" || page.Items[0].EscalatedTo != "supervisorTest1" {
+			t.Errorf("ListEscalations() got = %+v, want only the log of tenant-b", page.Items)
+		}
+		if latest, _ := repo.LatestLog(context.Background(), "/devices/logTest1"); latest == nil || latest.Date != "2024-03-25T09:00:00.000Z" {
+			t.Errorf("LatestLog() got = %+v, want the log of the default tenant of 2024-03-25", latest)
+		}
+
+		counts, err := CountByTenant(context.Background(), repo)
+		if err != nil {
+			t.Fatalf("CountByTenant() error = %v", err)
+		}
+		if want := map[string]int{utils.DefaultTenant: 3, "tenant-b": 1}; !maps.Equal(counts, want) {
+			t.Errorf("CountByTenant() got = %v, want %v", counts, want)
+		}
+	})
+
+	t.Run("ListEscalationsSince", func(t *testing.T) {
+		page, err := repo.ListEscalations(context.Background(), EscalationQuery{Assignee: "supervisorTest1", State: "Critical", Since: "2024-03-25T00:00:00.000Z"})
+		if err != nil {
+			t.Errorf("ListEscalations() error = %v", err)
+			return
+		}
+
+		if len(page.Items) != 1 || page.Items[0].Date != "2024-03-25T09:00:00.000Z" {
+			t.Errorf("ListEscalations() got = %+v, want the Critical log of 2024-03-25", page.Items)
+		}
+	})
+
+	t.Run("CreateLogAfter", func(t *testing.T) {
+		ctx := context.Background()
+		newLog := func(state, date string) *models.DeviceStateLog {
+			log := newTestLog(state, date)
+			log.DeviceID = "/devices/logTest3"
+			return log
+		}
+		first, second := newLog("Normal", "2024-03-24T10:00:00.000Z"), newLog("Warning", "2024-03-24T11:00:00.000Z")
+
+		if _, err := repo.CreateLogAfter(ctx, first, nil); err != nil {
+			t.Fatalf("CreateLogAfter() error = %v", err)
+		}
+		if _, err := repo.CreateLogAfter(ctx, second, nil); !errors.Is(err, utils.ErrStateChanged) {
+			t.Errorf("CreateLogAfter() error = %v, want %v for a device that has logs", err, utils.ErrStateChanged)
+		}
+		if _, err := repo.CreateLogAfter(ctx, second, first); err != nil {
+			t.Fatalf("CreateLogAfter() error = %v", err)
+		}
+		if _, err := repo.CreateLogAfter(ctx, newLog("Critical", "2024-03-24T12:00:00.000Z"), first); !errors.Is(err, utils.ErrStateChanged) {
+			t.Errorf("CreateLogAfter() error = %v, want %v after a stale log", err, utils.ErrStateChanged)
+		}
+
+		// Of the transitions from the same log, only one is stored.
+		var wg sync.WaitGroup
+		var stored atomic.Int32
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := repo.CreateLogAfter(ctx, newLog("Critical", fmt.Sprintf("2024-03-24T13:00:0%d.000Z", i)), second)
+				switch {
+				case err == nil:
+					stored.Add(1)
+				case !errors.Is(err, utils.ErrStateChanged):
+					t.Errorf("CreateLogAfter() error = %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if stored.Load() != 1 {
+			t.Errorf("CreateLogAfter() stored %d concurrent transitions, want 1", stored.Load())
+		}
+
+		// A log that CreateLog writes becomes the latest as well.
+		latest, err := repo.LatestLog(ctx, "/devices/logTest3")
+		if err != nil {
+			t.Fatalf("LatestLog() error = %v", err)
+		}
+		written := newLog("Normal", "2024-03-25T10:00:00.000Z")
+		if _, err := repo.CreateLog(ctx, written); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+		if _, err := repo.CreateLogAfter(ctx, newLog("Warning", "2024-03-25T11:00:00.000Z"), latest); !errors.Is(err, utils.ErrStateChanged) {
+			t.Errorf("CreateLogAfter() error = %v, want %v after a log of CreateLog", err, utils.ErrStateChanged)
+		}
+		if _, err := repo.CreateLogAfter(ctx, newLog("Warning", "2024-03-25T11:00:00.000Z"), written); err != nil {
+			t.Errorf("CreateLogAfter() error = %v", err)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+)
+
+// deviceStateLogColumns are the columns of the device_state_logs table, in the order scanDeviceStateLog reads them.
+const deviceStateLogColumns = "device_id, state_date, operator, date, state, escalated_to"
+
+// DeviceStateLogSQLRepository stores logs in the device_state_logs table, keyed by device_id and state_date like the
+// DynamoDB table, with an index on date for the history and one on escalated_to for the escalation inboxes. Every
+// key and index starts with the tenant. The events of a log are inserted into the event_outbox table in the
+// transaction of its row.
+type DeviceStateLogSQLRepository struct {
+	db     *db.SQLInstance
+	outbox sqlEventOutbox
+}
+
+func NewSQLDeviceStateLogRepository(db *db.SQLInstance) *DeviceStateLogSQLRepository {
+	return &DeviceStateLogSQLRepository{
+		db:     db,
+		outbox: sqlEventOutbox{db: db, source: deviceStateLogEventSource},
+	}
+}
+
+func scanDeviceStateLog(row rowScanner) (*models.DeviceStateLog, error) {
+	log := &models.DeviceStateLog{}
+	err := row.Scan(&log.DeviceID, &log.StateDate, &log.Operator, &log.Date, &log.State, &log.EscalatedTo)
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (r *DeviceStateLogSQLRepository) CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	err := inTransaction(ctx, r.db, hasLogEvents(ctx), func(tx sqlExecutor) error {
+		_, err := tx.ExecContext(ctx, r.db.Rebind(`INSERT INTO device_state_logs (tenant, `+deviceStateLogColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+`+upsertDeviceStateLog), utils.TenantFromContext(ctx), log.DeviceID, log.StateDate, log.Operator, log.Date, log.State, log.EscalatedTo)
+		if err != nil {
+			return err
+		}
+		return r.insertEvents(ctx, tx, log)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// CreateLogAfter inserts the log only when no log of the device is newer than latest, or when the device has no
+// logs at all for a nil latest. SQLite has one connection, so the transaction runs alone; on PostgreSQL it locks
+// the row of the device first, and the insert sees the logs of the transactions that held the lock before it.
+func (r *DeviceStateLogSQLRepository) CreateLogAfter(ctx context.Context, log, latest *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	tenant := utils.TenantFromContext(ctx)
+	newer, args := "", []any{tenant, log.DeviceID, log.StateDate, log.Operator, log.Date, log.State, log.EscalatedTo, tenant, log.DeviceID}
+	if latest != nil {
+		newer = " AND (date, state_date) > (?, ?)"
+		args = append(args, latest.Date, latest.StateDate)
+	}
+
+	err := inTransaction(ctx, r.db, true, func(tx sqlExecutor) error {
+		if r.db.GetDriver() == db.PostgresDriver {
+			_, err := tx.ExecContext(ctx, r.db.Rebind("SELECT 1 FROM devices WHERE tenant = ? AND id = ? FOR UPDATE"), tenant, log.DeviceID)
+			if err != nil {
+				return err
+			}
+		}
+		result, err := tx.ExecContext(ctx, r.db.Rebind(`INSERT INTO device_state_logs (tenant, `+deviceStateLogColumns+`)
+SELECT ?, ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM device_state_logs WHERE tenant = ? AND device_id = ?`+newer+`)
+`+upsertDeviceStateLog), args...)
+		if err != nil {
+			return err
+		}
+		if inserted, err := result.RowsAffected(); err != nil {
+			return err
+		} else if inserted == 0 {
+			return utils.ErrStateChanged
+		}
+		return r.insertEvents(ctx, tx, log)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// upsertDeviceStateLog replaces the log of the device with the same State#Date.
+const upsertDeviceStateLog = `ON CONFLICT (tenant, device_id, state_date) DO UPDATE SET operator = excluded.operator, date = excluded.date,
+    state = excluded.state, escalated_to = excluded.escalated_to`
+
+func (r *DeviceStateLogSQLRepository) insertEvents(ctx context.Context, tx sqlExecutor, log *models.DeviceStateLog) error {
+	events, err := logEvents(ctx, log)
+	if err != nil {
+		return err
+	}
+	return r.outbox.insert(ctx, tx, events)
+}
+
+// PendingEvents returns the oldest events the logs left in the event_outbox table.
+func (r *DeviceStateLogSQLRepository) PendingEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	return r.outbox.pending(ctx, limit)
+}
+
+func (r *DeviceStateLogSQLRepository) AckEvents(ctx context.Context, ids []string) error {
+	return r.outbox.ack(ctx, ids)
+}
+
+func (r *DeviceStateLogSQLRepository) LatestLog(ctx context.Context, deviceID string) (*models.DeviceStateLog, error) {
+	row := r.db.DB.QueryRowContext(ctx, r.db.Rebind("SELECT "+deviceStateLogColumns+
+		" FROM device_state_logs WHERE tenant = ? AND device_id = ? ORDER BY date DESC, state_date DESC LIMIT 1"), utils.TenantFromContext(ctx), deviceID)
+	log, err := scanDeviceStateLog(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return log, err
+}
+
+// ListLogs walks the logs of the device in Date order, which is also the State#Date order of the logs of one state.
+// The cursor is the escalationKey of the last log on the page.
+func (r *DeviceStateLogSQLRepository) ListLogs(ctx context.Context, deviceID string, query LogQuery) (*models.DeviceStateLogPage, error) {
+	from, to := query.dateRange()
+	sqlQuery := "SELECT " + deviceStateLogColumns + " FROM device_state_logs WHERE tenant = ? AND device_id = ? AND date >= ? AND date <= ?"
+	args := []any{utils.TenantFromContext(ctx), deviceID, from, to}
+	if query.State != "" {
+		sqlQuery += " AND state = ?"
+		args = append(args, query.State)
+	}
+	if query.Cursor != "" {
+		var after escalationKey
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+		sqlQuery += " AND (date, state_date) > (?, ?)"
+		args = append(args, after.Date, after.StateDate)
+	}
+	sqlQuery += " ORDER BY date, state_date"
+
+	return r.queryLogs(ctx, sqlQuery, args, normalizeLimit(query.Limit))
+}
+
+// ListEscalations walks the escalation index of the assignee backwards, newest first.
+func (r *DeviceStateLogSQLRepository) ListEscalations(ctx context.Context, query EscalationQuery) (*models.DeviceStateLogPage, error) {
+	sqlQuery := "SELECT " + deviceStateLogColumns + " FROM device_state_logs WHERE tenant = ? AND escalated_to = ? AND date >= ?"
+	args := []any{utils.TenantFromContext(ctx), query.Assignee, query.Since}
+	if query.State != "" {
+		sqlQuery += " AND state = ?"
+		args = append(args, query.State)
+	}
+	if query.Cursor != "" {
+		var after escalationKey
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+		sqlQuery += " AND (date, device_id, state_date) < (?, ?, ?)"
+		args = append(args, after.Date, after.DeviceID, after.StateDate)
+	}
+	sqlQuery += " ORDER BY date DESC, device_id DESC, state_date DESC"
+
+	return r.queryLogs(ctx, sqlQuery, args, normalizeLimit(query.Limit))
+}
+
+// CountByTenant counts the logs of every tenant.
+func (r *DeviceStateLogSQLRepository) CountByTenant(ctx context.Context) (map[string]int, error) {
+	return countByTenant(ctx, r.db, "device_state_logs")
+}
+
+// queryLogs reads one page of logs, with one more row than limit to know whether another page follows.
+func (r *DeviceStateLogSQLRepository) queryLogs(ctx context.Context, query string, args []any, limit int) (*models.DeviceStateLogPage, error) {
+	rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind(query+" LIMIT ?"), append(args, limit+1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &models.DeviceStateLogPage{Items: []*models.DeviceStateLog{}}
+	for rows.Next() {
+		log, err := scanDeviceStateLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, log)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		cursor, err := encodeCursor(escalationKeyOf(page.Items[limit-1]))
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
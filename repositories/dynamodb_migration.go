@@ -0,0 +1,191 @@
+package repositories
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"strings"
+)
+
+// LegacyDynamoTables names the tables of the DynamoDB repositories from before the single table: the devices and
+// the device models keyed by id, and the state logs keyed by DeviceID and State#Date. An empty name skips its table.
+type LegacyDynamoTables struct {
+	Devices         string
+	DeviceModels    string
+	DeviceStateLogs string
+}
+
+// DynamoMigration counts the items of a migration: Copied into the single table, Skipped because the single table
+// already had them, and Backfilled with the keys of the indexes added since they were written.
+type DynamoMigration struct {
+	Copied     int `json:"copied"`
+	Skipped    int `json:"skipped"`
+	Backfilled int `json:"backfilled"`
+}
+
+// MigrateDynamoTables copies the items of the legacy tables into the single table of target. The keys written before
+// there were tenants belong to utils.DefaultTenant, and the ones that start with a tenant, see tenantKey, to that
+// tenant.
+//
+// An item is only put when the single table does not have it yet, so the migration can be run again after it was
+// interrupted, or while the API already writes to the single table, without reverting any newer write. The devices
+// of the single table then get the GSI2 keys they miss, see backfillDeviceKeys.
+func MigrateDynamoTables(ctx context.Context, target *db.DynamoDBInstance, legacy LegacyDynamoTables) (DynamoMigration, error) {
+	var migration DynamoMigration
+	tables := []struct {
+		name    string
+		marshal func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error)
+	}{
+		{legacy.DeviceModels, migrateDeviceModel},
+		{legacy.Devices, migrateDevice},
+		{legacy.DeviceStateLogs, migrateDeviceStateLog},
+	}
+	for _, table := range tables {
+		if table.name == "" {
+			continue
+		}
+		var putErr error
+		input := &dynamodb.ScanInput{TableName: aws.String(table.name), ConsistentRead: aws.Bool(true)}
+		err := target.Client.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, legacyItem := range page.Items {
+				item, err := table.marshal(legacyItem)
+				if err != nil {
+					putErr = err
+					return false
+				}
+				copied, err := putIfAbsent(ctx, target, item)
+				if err != nil {
+					putErr = err
+					return false
+				}
+				if copied {
+					migration.Copied++
+				} else {
+					migration.Skipped++
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return migration, contextError(ctx, err)
+		}
+		if putErr != nil {
+			return migration, putErr
+		}
+	}
+
+	backfilled, err := backfillDeviceKeys(ctx, target)
+	migration.Backfilled = backfilled
+	return migration, err
+}
+
+// backfillDeviceKeys adds the GSI2 keys to the devices of the table of target written before the devices of a
+// tenant were listed from GSI2, which the listings do not find without them, and returns how many it changed. A
+// device deleted or given the keys by another write meanwhile is left as it is.
+func backfillDeviceKeys(ctx context.Context, target *db.DynamoDBInstance) (int, error) {
+	backfilled := 0
+	var updateErr error
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(target.GetTableName()),
+		ConsistentRead:            aws.Bool(true),
+		FilterExpression:          aws.String("#TY = :type AND attribute_not_exists(#GPK)"),
+		ProjectionExpression:      aws.String("#PK, #SK, #TN, #ID"),
+		ExpressionAttributeNames:  map[string]*string{"#PK": aws.String(pkAttribute), "#SK": aws.String(skAttribute), "#TN": aws.String(tenantAttribute), "#ID": aws.String("id"), "#TY": aws.String(typeAttribute), "#GPK": aws.String(gsi2PKAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":type": stringValue(deviceItem)},
+	}
+	err := target.Client.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			tenant, id := aws.StringValue(item[tenantAttribute].S), aws.StringValue(item["id"].S)
+			_, err := target.Client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+				TableName:                aws.String(target.GetTableName()),
+				Key:                      map[string]*dynamodb.AttributeValue{pkAttribute: item[pkAttribute], skAttribute: item[skAttribute]},
+				UpdateExpression:         aws.String("SET #GPK = :partition, #GSK = :sort"),
+				ConditionExpression:      aws.String("attribute_exists(#PK) AND attribute_not_exists(#GPK)"),
+				ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute), "#GPK": aws.String(gsi2PKAttribute), "#GSK": aws.String(gsi2SKAttribute)},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":partition": stringValue(tenantDevicesKey(tenant)),
+					":sort":      stringValue(devicePrefix + id),
+				},
+			})
+			switch {
+			case err == nil:
+				backfilled++
+			case !isConditionFailed(err):
+				updateErr = contextError(ctx, err)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return backfilled, contextError(ctx, err)
+	}
+	return backfilled, updateErr
+}
+
+// putIfAbsent puts item into the table of target, unless the table has an item with its key. It reports whether
+// item was put.
+func putIfAbsent(ctx context.Context, target *db.DynamoDBInstance, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	_, err := target.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                     item,
+		TableName:                aws.String(target.GetTableName()),
+		ConditionExpression:      aws.String("attribute_not_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case isConditionFailed(err):
+		return false, nil
+	default:
+		return false, contextError(ctx, err)
+	}
+}
+
+// splitLegacyKey returns the tenant of a key of the legacy tables, and the key without it. The keys that do not
+// start with a valid tenant predate the tenants.
+func splitLegacyKey(key string) (string, string) {
+	if tenant, rest, ok := strings.Cut(key, tenantSeparator); ok && utils.ValidateTenant(tenant) == nil {
+		return tenant, rest
+	}
+	return utils.DefaultTenant, key
+}
+
+func migrateDevice(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	device, err := unmarshalDevice(item)
+	if err != nil {
+		return nil, err
+	}
+	tenant, id := splitLegacyKey(device.ID)
+	device.ID = id
+	return marshalDevice(tenant, device)
+}
+
+func migrateDeviceModel(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	model := &models.DeviceModel{}
+	if err := dynamodbattribute.UnmarshalMap(item, model); err != nil {
+		return nil, err
+	}
+	tenant, id := splitLegacyKey(model.ID)
+	model.ID = id
+	return marshalDeviceModel(tenant, model)
+}
+
+// migrateDeviceStateLog takes the tenant of a log from its DeviceID. When the DeviceID starts with the tenant, so
+// does the EscalatedTo.
+func migrateDeviceStateLog(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	log := &models.DeviceStateLog{}
+	if err := dynamodbattribute.UnmarshalMap(item, log); err != nil {
+		return nil, err
+	}
+	tenant, deviceID := splitLegacyKey(log.DeviceID)
+	if deviceID != log.DeviceID {
+		log.DeviceID = deviceID
+		log.EscalatedTo = untenantKey(tenant, log.EscalatedTo)
+	}
+	return marshalDeviceStateLog(tenant, log)
+}
@@ -0,0 +1,157 @@
+package repositories
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"maps"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"testing"
+)
+
+// legacyTableInput is a table of serverless.yml from before the single table, without its indexes.
+func legacyTableInput(name string, keys ...string) *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{TableName: aws.String(name), BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	for i, key := range keys {
+		keyType := dynamodb.KeyTypeHash
+		if i > 0 {
+			keyType = dynamodb.KeyTypeRange
+		}
+		input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{AttributeName: aws.String(key), AttributeType: aws.String("S")})
+		input.KeySchema = append(input.KeySchema, &dynamodb.KeySchemaElement{AttributeName: aws.String(key), KeyType: aws.String(keyType)})
+	}
+	return input
+}
+
+func TestMigrateDynamoTables(t *testing.T) {
+	server, target := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	client := server.Client()
+	legacy := LegacyDynamoTables{Devices: "devices", DeviceModels: "device_models", DeviceStateLogs: "device_state_logs"}
+	for _, input := range []*dynamodb.CreateTableInput{
+		legacyTableInput(legacy.Devices, "id"),
+		legacyTableInput(legacy.DeviceModels, "id"),
+		legacyTableInput(legacy.DeviceStateLogs, "DeviceID", "State#Date"),
+	} {
+		if _, err := client.CreateTable(input); err != nil {
+			t.Fatalf("CreateTable() error = %v", err)
+		}
+	}
+	put := func(table string, item any) {
+		t.Helper()
+		av, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			t.Fatalf("MarshalMap() error = %v", err)
+		}
+		if _, err := client.PutItem(&dynamodb.PutItemInput{TableName: aws.String(table), Item: av}); err != nil {
+			t.Fatalf("PutItem() error = %v", err)
+		}
+	}
+
+	// The bare keys of the original tables, and the tenant keys written since there are tenants.
+	put(legacy.DeviceModels, models.DeviceModel{ID: "/devicemodels/id1", Name: "Multi sensor"})
+	put(legacy.DeviceModels, models.DeviceModel{ID: "tenant-b#/devicemodels/id1", Name: "Camera"})
+	put(legacy.Devices, models.Device{ID: "/devices/id1", DeviceModel: "/devicemodels/id1", Name: "Sensor", Version: 3})
+	put(legacy.Devices, models.Device{ID: "tenant-b#/devices/id1", DeviceModel: "/devicemodels/id1", Name: "Camera", Version: 1})
+	put(legacy.DeviceStateLogs, models.DeviceStateLog{DeviceID: "/devices/id1", StateDate: "Critical#2024-03-24T10:00:00.000Z", State: "Critical", Date: "2024-03-24T10:00:00.000Z", EscalatedTo: "supervisor1"})
+	put(legacy.DeviceStateLogs, models.DeviceStateLog{DeviceID: "tenant-b#/devices/id1", StateDate: "Critical#2024-03-25T10:00:00.000Z", State: "Critical", Date: "2024-03-25T10:00:00.000Z", EscalatedTo: "tenant-b#supervisor1"})
+
+	// A device the API already wrote to the single table is newer than its legacy item.
+	devices := NewDynamoDeviceService(target)
+	tenantB := utils.WithTenant(context.Background(), "tenant-b")
+	if _, err := devices.CreateDevice(tenantB, &models.Device{ID: "/devices/id1", DeviceModel: "/devicemodels/id1", Name: "New camera"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+
+	migration, err := MigrateDynamoTables(context.Background(), target, legacy)
+	if err != nil {
+		t.Fatalf("MigrateDynamoTables() error = %v", err)
+	}
+	if migration != (DynamoMigration{Copied: 5, Skipped: 1}) {
+		t.Errorf("MigrateDynamoTables() got = %+v, want 5 items copied and 1 skipped", migration)
+	}
+	if migration, err = MigrateDynamoTables(context.Background(), target, legacy); err != nil || migration != (DynamoMigration{Skipped: 6}) {
+		t.Errorf("MigrateDynamoTables() got = %+v, %v, want every item skipped the second time", migration, err)
+	}
+
+	if device, err := devices.GetDevice(context.Background(), "/devices/id1"); err != nil || device.Name != "Sensor" || device.Version != 3 {
+		t.Errorf("GetDevice() got = %v, %v, want the legacy device in the default tenant", device, err)
+	}
+	if device, err := devices.GetDevice(tenantB, "/devices/id1"); err != nil || device.Name != "New camera" {
+		t.Errorf("GetDevice() got = %v, %v, want the device written to the single table", device, err)
+	}
+	page, err := devices.ListDevices(context.Background(), ListOptions{Filter: DeviceFilter{{Field: "deviceModel", Operator: FilterEquals, Value: "/devicemodels/id1"}}})
+	if err != nil || len(page.Items) != 1 {
+		t.Errorf("ListDevices() got = %v, %v, want the device of the model in the default tenant", page, err)
+	}
+
+	modelRepo := NewDynamoDeviceModelRepository(target)
+	if model, err := modelRepo.GetDeviceModel(tenantB, "/devicemodels/id1"); err != nil || model.Name != "Camera" {
+		t.Errorf("GetDeviceModel() got = %v, %v, want the model of tenant-b", model, err)
+	}
+
+	logRepo := NewDynamoDeviceStateLogRepository(target)
+	escalations, err := logRepo.ListEscalations(tenantB, EscalationQuery{Assignee: "supervisor1"})
+	if err != nil || len(escalations.Items) != 1 || escalations.Items[0].DeviceID != "/devices/id1" || escalations.Items[0].EscalatedTo != "supervisor1" {
+		t.Errorf("ListEscalations() got = %+v, %v, want the log of tenant-b", escalations, err)
+	}
+	if latest, err := logRepo.LatestLog(context.Background(), "/devices/id1"); err != nil || latest == nil || latest.Date != "2024-03-24T10:00:00.000Z" {
+		t.Errorf("LatestLog() got = %+v, %v, want the log of the default tenant", latest, err)
+	}
+
+	counts, err := CountByTenant(context.Background(), devices)
+	if want := map[string]int{utils.DefaultTenant: 1, "tenant-b": 1}; err != nil || !maps.Equal(counts, want) {
+		t.Errorf("CountByTenant() got = %v, %v, want %v, the models and logs of the table are not devices", counts, err, want)
+	}
+}
+
+func TestMigrateDynamoTables_Backfill(t *testing.T) {
+	server, target := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	devices := NewDynamoDeviceService(target)
+	if _, err := devices.CreateDevice(context.Background(), &models.Device{ID: "/devices/new", DeviceModel: "/devicemodels/id1", Name: "New"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	// A device written before the devices of a tenant were listed from GSI2.
+	item, err := marshalDevice("tenant-b", &models.Device{ID: "/devices/old", DeviceModel: "/devicemodels/id1", Name: "Old", Version: 1})
+	if err != nil {
+		t.Fatalf("marshalDevice() error = %v", err)
+	}
+	delete(item, gsi2PKAttribute)
+	delete(item, gsi2SKAttribute)
+	if _, err := server.Client().PutItem(&dynamodb.PutItemInput{TableName: aws.String("iotwatcher"), Item: item}); err != nil {
+		t.Fatalf("PutItem() error = %v", err)
+	}
+
+	tenantB := utils.WithTenant(context.Background(), "tenant-b")
+	if page, err := devices.ListDevices(tenantB, ListOptions{}); err != nil || len(page.Items) != 0 {
+		t.Fatalf("ListDevices() got = %v, %v, want the device without keys missing", page, err)
+	}
+	migration, err := MigrateDynamoTables(context.Background(), target, LegacyDynamoTables{})
+	if err != nil || migration != (DynamoMigration{Backfilled: 1}) {
+		t.Fatalf("MigrateDynamoTables() got = %+v, %v, want 1 device backfilled", migration, err)
+	}
+	if migration, err = MigrateDynamoTables(context.Background(), target, LegacyDynamoTables{}); err != nil || migration != (DynamoMigration{}) {
+		t.Errorf("MigrateDynamoTables() got = %+v, %v, want nothing left to backfill", migration, err)
+	}
+	if page, err := devices.ListDevices(tenantB, ListOptions{}); err != nil || len(page.Items) != 1 || page.Items[0].Name != "Old" || page.Items[0].Version != 1 {
+		t.Errorf("ListDevices() got = %v, %v, want the backfilled device as it was", page, err)
+	}
+}
+
+func TestSplitLegacyKey(t *testing.T) {
+	tests := []struct {
+		key, tenant, rest string
+	}{
+		{"/devices/id1", utils.DefaultTenant, "/devices/id1"},
+		{"id1", utils.DefaultTenant, "id1"},
+		{"tenant-b#/devices/id1", "tenant-b", "/devices/id1"},
+		{"default#id1", utils.DefaultTenant, "id1"},
+		{"/devices/a#b", utils.DefaultTenant, "/devices/a#b"},
+	}
+	for _, tt := range tests {
+		if tenant, rest := splitLegacyKey(tt.key); tenant != tt.tenant || rest != tt.rest {
+			t.Errorf("splitLegacyKey(%q) got = %q, %q, want %q, %q", tt.key, tenant, rest, tt.tenant, tt.rest)
+		}
+	}
+}
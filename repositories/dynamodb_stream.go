@@ -0,0 +1,127 @@
+package repositories
+
+import (
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"simple-api-go/models"
+)
+
+// DynamoStreamChange is a change of a device or a state log of the single table, as its stream reports it. The old
+// image is nil for an item that was created and the new one for an item that was removed, by the TTL or outside the
+// API.
+type DynamoStreamChange struct {
+	Tenant    string
+	OldDevice *models.Device
+	NewDevice *models.Device
+	OldLog    *models.DeviceStateLog
+	NewLog    *models.DeviceStateLog
+	// External tells a write made outside the repositories, or by one that stored no event. The writes with events
+	// have them delivered from the outbox already.
+	External bool
+}
+
+// DecodeDynamoStreamRecord decodes a record of the stream of the single table. It returns nil for the items that
+// are neither a device nor a state log, such as the device models and the outbox.
+func DecodeDynamoStreamRecord(record events.DynamoDBEventRecord) (*DynamoStreamChange, error) {
+	oldImage := streamItem(record.Change.OldImage)
+	newImage := streamItem(record.Change.NewImage)
+	image := newImage
+	if image == nil {
+		image = oldImage
+	}
+	if image == nil {
+		return nil, fmt.Errorf("stream record %s has no image, the stream must report NEW_AND_OLD_IMAGES", record.EventID)
+	}
+
+	change := &DynamoStreamChange{
+		Tenant: stringAttribute(image, tenantAttribute),
+		External: newImage == nil || stringAttribute(newImage, writeEventAttribute) == "" ||
+			stringAttribute(newImage, writeEventAttribute) == stringAttribute(oldImage, writeEventAttribute),
+	}
+	var err error
+	switch stringAttribute(image, typeAttribute) {
+	case deviceItem:
+		change.OldDevice, err = unmarshalStreamImage[models.Device](oldImage)
+		if err == nil {
+			change.NewDevice, err = unmarshalStreamImage[models.Device](newImage)
+		}
+	case deviceStateLogItem:
+		change.OldLog, err = unmarshalStreamImage[models.DeviceStateLog](oldImage)
+		if err == nil {
+			change.NewLog, err = unmarshalStreamImage[models.DeviceStateLog](newImage)
+		}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stream record %s: %w", record.EventID, err)
+	}
+	return change, nil
+}
+
+// stringAttribute is the string attribute name of item, empty when it has none.
+func stringAttribute(item map[string]*dynamodb.AttributeValue, name string) string {
+	if value, ok := item[name]; ok {
+		return aws.StringValue(value.S)
+	}
+	return ""
+}
+
+func unmarshalStreamImage[T any](image map[string]*dynamodb.AttributeValue) (*T, error) {
+	if image == nil {
+		return nil, nil
+	}
+	value := new(T)
+	if err := dynamodbattribute.UnmarshalMap(image, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// streamItem is an image of a stream record as the item the SDK reads, nil when the record has no such image.
+func streamItem(image map[string]events.DynamoDBAttributeValue) map[string]*dynamodb.AttributeValue {
+	if len(image) == 0 {
+		return nil
+	}
+	return streamMap(image)
+}
+
+func streamMap(values map[string]events.DynamoDBAttributeValue) map[string]*dynamodb.AttributeValue {
+	item := make(map[string]*dynamodb.AttributeValue, len(values))
+	for name, value := range values {
+		item[name] = streamAttributeValue(value)
+	}
+	return item
+}
+
+func streamAttributeValue(value events.DynamoDBAttributeValue) *dynamodb.AttributeValue {
+	switch value.DataType() {
+	case events.DataTypeString:
+		return &dynamodb.AttributeValue{S: aws.String(value.String())}
+	case events.DataTypeNumber:
+		return &dynamodb.AttributeValue{N: aws.String(value.Number())}
+	case events.DataTypeBinary:
+		return &dynamodb.AttributeValue{B: value.Binary()}
+	case events.DataTypeBoolean:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(value.Boolean())}
+	case events.DataTypeStringSet:
+		return &dynamodb.AttributeValue{SS: aws.StringSlice(value.StringSet())}
+	case events.DataTypeNumberSet:
+		return &dynamodb.AttributeValue{NS: aws.StringSlice(value.NumberSet())}
+	case events.DataTypeBinarySet:
+		return &dynamodb.AttributeValue{BS: value.BinarySet()}
+	case events.DataTypeList:
+		list := make([]*dynamodb.AttributeValue, len(value.List()))
+		for i, element := range value.List() {
+			list[i] = streamAttributeValue(element)
+		}
+		return &dynamodb.AttributeValue{L: list}
+	case events.DataTypeMap:
+		return &dynamodb.AttributeValue{M: streamMap(value.Map())}
+	default:
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+	}
+}
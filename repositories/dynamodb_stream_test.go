@@ -0,0 +1,114 @@
+package repositories
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"reflect"
+	"simple-api-go/models"
+	"testing"
+)
+
+// streamImage is item as the stream reports it. The items of the repositories only have strings, numbers, and nulls
+// for the empty strings.
+func streamImage(t *testing.T, item map[string]*dynamodb.AttributeValue) map[string]events.DynamoDBAttributeValue {
+	image := map[string]events.DynamoDBAttributeValue{}
+	for name, value := range item {
+		switch {
+		case value.S != nil:
+			image[name] = events.NewStringAttribute(*value.S)
+		case value.N != nil:
+			image[name] = events.NewNumberAttribute(*value.N)
+		case aws.BoolValue(value.NULL):
+			image[name] = events.NewNullAttribute()
+		default:
+			t.Fatalf("attribute %s is neither a string, a number nor null", name)
+		}
+	}
+	return image
+}
+
+func TestDecodeDynamoStreamRecord(t *testing.T) {
+	_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+	r := NewDynamoDeviceService(instance)
+	ctx := withTestDeviceEvents(context.Background())
+	item := func() map[string]events.DynamoDBAttributeValue {
+		output, err := instance.Client.GetItem(&dynamodb.GetItemInput{TableName: aws.String("iotwatcher"), Key: deviceKey("default", "1")})
+		if err != nil {
+			t.Fatalf("GetItem() error = %v", err)
+		}
+		return streamImage(t, output.Item)
+	}
+
+	if _, err := r.CreateDevice(ctx, &models.Device{ID: "1", Name: "Device 1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	created := item()
+	if _, err := r.UpdateDevice(ctx, "1", &models.Device{ID: "1", Name: "Renamed"}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	updated := item()
+	// A write without events leaves the writeEvent of the last one, like a write made outside the API.
+	if _, err := r.UpdateDevice(context.Background(), "1", &models.Device{ID: "1", Name: "Renamed again"}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	updatedAround := item()
+
+	record := func(oldImage, newImage map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+		return events.DynamoDBEventRecord{EventID: "1", Change: events.DynamoDBStreamRecord{OldImage: oldImage, NewImage: newImage}}
+	}
+	device := func(name string, version int64) *models.Device {
+		return &models.Device{ID: "1", Name: name, Version: version}
+	}
+	log := newTestLog("Warning", "2024-03-24T10:00:00.000Z")
+	logItem, err := marshalDeviceStateLog("acme", log)
+	if err != nil {
+		t.Fatalf("marshalDeviceStateLog() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		record events.DynamoDBEventRecord
+		want   *DynamoStreamChange
+	}{
+		{"CreatedWithEvents", record(nil, created), &DynamoStreamChange{Tenant: "default", NewDevice: device("Device 1", 1)}},
+		{"UpdatedWithEvents", record(created, updated), &DynamoStreamChange{Tenant: "default", OldDevice: device("Device 1", 1), NewDevice: device("Renamed", 2)}},
+		{"UpdatedWithoutEvents", record(updated, updatedAround), &DynamoStreamChange{Tenant: "default", OldDevice: device("Renamed", 2), NewDevice: device("Renamed again", 3), External: true}},
+		{"Removed", record(updatedAround, nil), &DynamoStreamChange{Tenant: "default", OldDevice: device("Renamed again", 3), External: true}},
+		{"LogCreated", record(nil, streamImage(t, logItem)), &DynamoStreamChange{Tenant: "acme", NewLog: log, External: true}},
+		{"DeviceModel", record(nil, map[string]events.DynamoDBAttributeValue{"type": events.NewStringAttribute(deviceModelItem)}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeDynamoStreamRecord(tt.record)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeDynamoStreamRecord() got = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := DecodeDynamoStreamRecord(record(nil, nil)); err == nil {
+		t.Errorf("DecodeDynamoStreamRecord() error = nil, want an error for a record without images")
+	}
+}
+
+func TestStreamAttributeValue(t *testing.T) {
+	value := events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+		"list":    events.NewListAttribute([]events.DynamoDBAttributeValue{events.NewBooleanAttribute(true), events.NewNullAttribute()}),
+		"binary":  events.NewBinaryAttribute([]byte("b")),
+		"strings": events.NewStringSetAttribute([]string{"a", "b"}),
+		"numbers": events.NewNumberSetAttribute([]string{"1"}),
+		"empty":   events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{}),
+	})
+	want := &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		"list":    {L: []*dynamodb.AttributeValue{{BOOL: aws.Bool(true)}, {NULL: aws.Bool(true)}}},
+		"binary":  {B: []byte("b")},
+		"strings": {SS: aws.StringSlice([]string{"a", "b"})},
+		"numbers": {NS: aws.StringSlice([]string{"1"})},
+		"empty":   {M: map[string]*dynamodb.AttributeValue{}},
+	}}
+	if got := streamAttributeValue(value); !reflect.DeepEqual(got, want) {
+		t.Errorf("streamAttributeValue() got = %v, want %v", got, want)
+	}
+}
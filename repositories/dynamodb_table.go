@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"simple-api-go/db"
+)
+
+// The DynamoDB repositories share a single table. Every item has the generic PK and SK keys, whose values start
+// with the tenant and the type of the item, and the keys of the overloaded global secondary indexes of the access
+// patterns it serves:
+//
+//	item       PK                        SK                  GSI1PK                          GSI1SK                       GSI2PK                                  GSI2SK
+//	device     <tenant>#DEVICE#<id>      DEVICE              <tenant>#MODEL#<model>          DEVICE#<id>                  <tenant>#DEVICES                        DEVICE#<id>
+//	model      <tenant>#MODEL#<id>       MODEL               <tenant>#CATALOGUE              MODEL#<id>
+//	state log  <tenant>#DEVICE#<device>  LOG#<date>#<state>  <tenant>#ASSIGNEE#<user>        LOG#<date>#<device>#<state>  <tenant>#DEVICE#<device>#STATE#<state>  <date>
+//	state      <tenant>#DEVICE#<device>  STATE
+//	event      OUTBOX#<source>           <event id>
+//	webhook    <tenant>#WEBHOOK#<id>     WEBHOOK             <tenant>#WEBHOOKS               WEBHOOK#<id>
+//	delivery   <tenant>#WEBHOOK#<id>     DELIVERY#<event>    <tenant>#WEBHOOK#<id>#<status>  DELIVERY#<event>             DELIVERY#PENDING                        <next attempt>
+//
+// A device and its logs form one item collection, in the order of their dates, with the state item that guards
+// the transitions of the device. GSI1 lists the devices of a model, which the device listings query for a
+// deviceModel equality filter, the catalogue of models, and the escalation inbox of an assignee, which only the
+// escalated logs are in. GSI2 lists the devices of a tenant, trash included, which the other device listings
+// query, and the logs of a device in one state. The events of the writes wait in the outbox partition of their
+// repository until they are delivered, see EventOutbox. A webhook and its deliveries form one item collection;
+// GSI1 lists the webhooks of a tenant and the deliveries of a webhook in one status, and the pending deliveries of
+// every tenant wait in one GSI2 partition, in the order of their next attempts.
+const (
+	pkAttribute     = "PK"
+	skAttribute     = "SK"
+	gsi1PKAttribute = "GSI1PK"
+	gsi1SKAttribute = "GSI1SK"
+	gsi2PKAttribute = "GSI2PK"
+	gsi2SKAttribute = "GSI2SK"
+
+	gsi1Index = "GSI1"
+	gsi2Index = "GSI2"
+
+	// typeAttribute tells the items apart in the scans of the table.
+	typeAttribute = "type"
+	// tenantAttribute holds the tenant of every item, for the scans that are not keyed by tenant.
+	tenantAttribute = "tenant"
+	// purgeAttribute is the TTL of the table, only the deleted devices have it.
+	purgeAttribute = "purgeAt"
+	// latestAttribute is the sort key of the latest log of the state guard of a device.
+	latestAttribute = "latest"
+)
+
+// The types of the items, and the prefixes of their keys.
+const (
+	deviceItem         = "Device"
+	deviceModelItem    = "DeviceModel"
+	deviceStateLogItem = "DeviceStateLog"
+	eventItem          = "Event"
+	webhookItem        = "Webhook"
+	deliveryItem       = "WebhookDelivery"
+	deviceStateItem    = "DeviceState"
+
+	devicePrefix    = "DEVICE#"
+	modelPrefix     = "MODEL#"
+	logPrefix       = "LOG#"
+	assigneePrefix  = "ASSIGNEE#"
+	statePrefix     = "#STATE#"
+	deviceSortKey   = "DEVICE"
+	modelSortKey    = "MODEL"
+	cataloguePrefix = "CATALOGUE"
+	devicesKey      = "DEVICES"
+	outboxPrefix    = "OUTBOX#"
+	webhookPrefix   = "WEBHOOK#"
+	webhookSortKey  = "WEBHOOK"
+	webhooksPrefix  = "WEBHOOKS"
+	deliveryPrefix  = "DELIVERY#"
+	pendingKey      = "DELIVERY#PENDING"
+	stateSortKey    = "STATE"
+)
+
+// DynamoSchema declares the single table of the DynamoDB repositories, as serverless.yml provisions it. Reconcile
+// it to create the table, and Drift to compare the table with it. Its stream reports the old and new images of the
+// changed items, see DecodeDynamoStreamRecord.
+func DynamoSchema(table string) db.DynamoSchema {
+	return db.DynamoSchema{{
+		Name:     table,
+		HashKey:  pkAttribute,
+		RangeKey: skAttribute,
+		Indexes: []db.DynamoIndex{
+			{Name: gsi1Index, HashKey: gsi1PKAttribute, RangeKey: gsi1SKAttribute},
+			{Name: gsi2Index, HashKey: gsi2PKAttribute, RangeKey: gsi2SKAttribute},
+		},
+		TTLAttribute:   purgeAttribute,
+		StreamViewType: dynamodb.StreamViewTypeNewAndOldImages,
+	}}
+}
+
+// stringValue is an attribute value of type S.
+func stringValue(s string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(s)}
+}
+
+// deviceKey is the key of the device id of tenant.
+func deviceKey(tenant, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		pkAttribute: stringValue(tenantKey(tenant, devicePrefix+id)),
+		skAttribute: stringValue(deviceSortKey),
+	}
+}
+
+// deviceModelKey is the key of the device model id of tenant.
+func deviceModelKey(tenant, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		pkAttribute: stringValue(tenantKey(tenant, modelPrefix+id)),
+		skAttribute: stringValue(modelSortKey),
+	}
+}
+
+// modelDevicesKey is the GSI1 partition of the devices of the model of tenant.
+func modelDevicesKey(tenant, model string) string {
+	return tenantKey(tenant, modelPrefix+model)
+}
+
+// tenantDevicesKey is the GSI2 partition of the devices of tenant.
+func tenantDevicesKey(tenant string) string {
+	return tenantKey(tenant, devicesKey)
+}
+
+// setItemKeys adds the type and the tenant of an item, and the keys in key, to item.
+func setItemKeys(item map[string]*dynamodb.AttributeValue, itemType, tenant string, key map[string]string) {
+	item[typeAttribute] = stringValue(itemType)
+	item[tenantAttribute] = stringValue(tenant)
+	for name, value := range key {
+		item[name] = stringValue(value)
+	}
+}
+
+// countDynamoByTenant counts the items of itemType in the table of db for every tenant that has any.
+func countDynamoByTenant(ctx context.Context, db *db.DynamoDBInstance, itemType string) (map[string]int, error) {
+	counts := map[string]int{}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(db.GetTableName()),
+		FilterExpression:          aws.String("#TY = :type"),
+		ProjectionExpression:      aws.String("#TN"),
+		ExpressionAttributeNames:  map[string]*string{"#TN": aws.String(tenantAttribute), "#TY": aws.String(typeAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":type": stringValue(itemType)},
+	}
+	err := db.Client.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if tenant, ok := item[tenantAttribute]; ok {
+				counts[aws.StringValue(tenant.S)]++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return counts, nil
+}
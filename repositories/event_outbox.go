@@ -0,0 +1,135 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"slices"
+)
+
+// ErrEventOutboxUnsupported is returned by a repository that wraps another one which has no EventOutbox.
+var ErrEventOutboxUnsupported = errors.New("the repository can not store events")
+
+// DefaultEventBatchSize is how many events PendingEvents returns when it is asked for none in particular.
+const DefaultEventBatchSize = 100
+
+// DeviceEventsFunc builds the events of a device write from the device as the write stored it.
+type DeviceEventsFunc func(stored *models.Device) ([]models.Event, error)
+
+// LogEventsFunc builds the events of a log write from the log as the write stored it.
+type LogEventsFunc func(stored *models.DeviceStateLog) ([]models.Event, error)
+
+type deviceEventsContextKey struct{}
+
+type logEventsContextKey struct{}
+
+// WithDeviceEvents makes every device written with the returned context store the events events builds for it in
+// its outbox, in the same write as the device: either both are stored or neither is. events runs once for every
+// device a write changes, as part of the write, so its failure fails the write.
+func WithDeviceEvents(ctx context.Context, events DeviceEventsFunc) context.Context {
+	return context.WithValue(ctx, deviceEventsContextKey{}, events)
+}
+
+// WithLogEvents is WithDeviceEvents for the logs written with the returned context.
+func WithLogEvents(ctx context.Context, events LogEventsFunc) context.Context {
+	return context.WithValue(ctx, logEventsContextKey{}, events)
+}
+
+// deviceEvents builds the events of stored for the outbox, none when ctx asks for none.
+func deviceEvents(ctx context.Context, stored *models.Device) ([]models.Event, error) {
+	events, ok := ctx.Value(deviceEventsContextKey{}).(DeviceEventsFunc)
+	if !ok || events == nil {
+		return nil, nil
+	}
+	return events(copyDevice(stored))
+}
+
+// hasDeviceEvents tells whether the device writes of ctx store events, for the backends that write otherwise.
+func hasDeviceEvents(ctx context.Context) bool {
+	events, ok := ctx.Value(deviceEventsContextKey{}).(DeviceEventsFunc)
+	return ok && events != nil
+}
+
+// logEvents builds the events of stored for the outbox, none when ctx asks for none.
+func logEvents(ctx context.Context, stored *models.DeviceStateLog) ([]models.Event, error) {
+	events, ok := ctx.Value(logEventsContextKey{}).(LogEventsFunc)
+	if !ok || events == nil {
+		return nil, nil
+	}
+	return events(copyDeviceStateLog(stored))
+}
+
+// hasLogEvents tells whether the log writes of ctx store events.
+func hasLogEvents(ctx context.Context) bool {
+	events, ok := ctx.Value(logEventsContextKey{}).(LogEventsFunc)
+	return ok && events != nil
+}
+
+// EventOutbox is implemented by the repositories that store the events of WithDeviceEvents and WithLogEvents. An
+// event stays pending until it is acknowledged, so a dispatcher that crashes before AckEvents delivers it again.
+// Both methods reach the events of every tenant, whatever the tenant of ctx.
+type EventOutbox interface {
+	// PendingEvents returns up to limit events that are not acknowledged yet, oldest first.
+	PendingEvents(ctx context.Context, limit int) ([]models.Event, error)
+	// AckEvents removes the events of ids from the outbox. The IDs it does not have are ignored.
+	AckEvents(ctx context.Context, ids []string) error
+}
+
+// eventOutbox is the outbox of the memory repositories, guarded by the lock of its repository.
+type eventOutbox struct {
+	events []models.Event
+}
+
+// add appends events, skipping the ones already in the outbox so that a replayed log adds them once.
+func (o *eventOutbox) add(events ...models.Event) {
+	for _, event := range events {
+		if !slices.ContainsFunc(o.events, func(pending models.Event) bool { return pending.ID == event.ID }) {
+			o.events = append(o.events, event)
+		}
+	}
+}
+
+// mark is where the events of a write start, to take them back with since or truncate.
+func (o *eventOutbox) mark() int {
+	return len(o.events)
+}
+
+// since returns the events added after mark.
+func (o *eventOutbox) since(mark int) []models.Event {
+	return slices.Clone(o.events[mark:])
+}
+
+// truncate drops the events added after mark, when their write is undone.
+func (o *eventOutbox) truncate(mark int) {
+	o.events = o.events[:mark]
+}
+
+func (o *eventOutbox) pending(limit int) []models.Event {
+	if limit <= 0 {
+		limit = DefaultEventBatchSize
+	}
+	return slices.Clone(o.events[:min(limit, len(o.events))])
+}
+
+func (o *eventOutbox) ack(ids []string) {
+	o.events = slices.DeleteFunc(o.events, func(event models.Event) bool {
+		return slices.Contains(ids, event.ID)
+	})
+}
+
+// pendingEvents and ackEvents forward to the outbox of repo, or fail with ErrEventOutboxUnsupported.
+func pendingEvents(ctx context.Context, repo any, limit int) ([]models.Event, error) {
+	outbox, ok := repo.(EventOutbox)
+	if !ok {
+		return nil, ErrEventOutboxUnsupported
+	}
+	return outbox.PendingEvents(ctx, limit)
+}
+
+func ackEvents(ctx context.Context, repo any, ids []string) error {
+	outbox, ok := repo.(EventOutbox)
+	if !ok {
+		return ErrEventOutboxUnsupported
+	}
+	return outbox.AckEvents(ctx, ids)
+}
@@ -0,0 +1,132 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"simple-api-go/db"
+	"simple-api-go/models"
+)
+
+const (
+	// eventAttribute holds the JSON of the event of an outbox item.
+	eventAttribute = "event"
+	// writeEventAttribute holds the ID of the first event of the last write of an item that stored events. A write
+	// made outside the repositories leaves it out or unchanged, which is how the stream tells it apart.
+	writeEventAttribute = "writeEvent"
+)
+
+// dynamoEventOutbox is the OUTBOX# partition of one source in the single table. Its items are sorted by the ID of
+// their event, which is the order the events occurred in.
+type dynamoEventOutbox struct {
+	db     *db.DynamoDBInstance
+	source string
+}
+
+// outboxKey is the partition of the outbox of source. It holds the events of every tenant, so it has no tenant.
+func outboxKey(source string) string {
+	return outboxPrefix + source
+}
+
+// puts are the items of a transaction that add events to the outbox.
+func (o dynamoEventOutbox) puts(events []models.Event) ([]*dynamodb.TransactWriteItem, error) {
+	items := make([]*dynamodb.TransactWriteItem, len(events))
+	for i, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		item := map[string]*dynamodb.AttributeValue{eventAttribute: stringValue(string(data))}
+		setItemKeys(item, eventItem, event.Tenant, map[string]string{
+			pkAttribute: outboxKey(o.source),
+			skAttribute: event.ID,
+		})
+		items[i] = &dynamodb.TransactWriteItem{Put: &dynamodb.Put{Item: item, TableName: aws.String(o.db.GetTableName())}}
+	}
+	return items, nil
+}
+
+func (o dynamoEventOutbox) pending(ctx context.Context, limit int) ([]models.Event, error) {
+	if limit <= 0 {
+		limit = DefaultEventBatchSize
+	}
+	result, err := o.db.Client.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(o.db.GetTableName()),
+		KeyConditionExpression:    aws.String("#PK = :outbox"),
+		ExpressionAttributeNames:  map[string]*string{"#PK": aws.String(pkAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":outbox": stringValue(outboxKey(o.source))},
+		ConsistentRead:            aws.Bool(true),
+		Limit:                     aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	events := make([]models.Event, len(result.Items))
+	for i, item := range result.Items {
+		if err := json.Unmarshal([]byte(aws.StringValue(item[eventAttribute].S)), &events[i]); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (o dynamoEventOutbox) ack(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		_, err := o.db.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(o.db.GetTableName()),
+			Key: map[string]*dynamodb.AttributeValue{
+				pkAttribute: stringValue(outboxKey(o.source)),
+				skAttribute: stringValue(id),
+			},
+		})
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// transact writes items and the events of their write in one transaction, events[i] being the events of items[i].
+// When it is cancelled, the reasons of items come first in the TransactionCanceledException.
+func (o dynamoEventOutbox) transact(ctx context.Context, items []*dynamodb.TransactWriteItem, events [][]models.Event) error {
+	var all []models.Event
+	for i, itemEvents := range events {
+		if len(itemEvents) > 0 {
+			markWrite(items[i], itemEvents[0].ID)
+		}
+		all = append(all, itemEvents...)
+	}
+	puts, err := o.puts(all)
+	if err != nil {
+		return err
+	}
+	_, err = o.db.Client.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: append(items, puts...)})
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// markWrite stores eventID in the writeEvent attribute of the item of a put or an update. The updates of the
+// repositories end with their SET clause.
+func markWrite(item *dynamodb.TransactWriteItem, eventID string) {
+	switch {
+	case item.Put != nil:
+		item.Put.Item[writeEventAttribute] = stringValue(eventID)
+	case item.Update != nil:
+		item.Update.UpdateExpression = aws.String(aws.StringValue(item.Update.UpdateExpression) + ", #WE = :writeEvent")
+		item.Update.ExpressionAttributeNames["#WE"] = aws.String(writeEventAttribute)
+		item.Update.ExpressionAttributeValues[":writeEvent"] = stringValue(eventID)
+	}
+}
+
+// cancelledOnCondition tells whether err is a transaction cancelled because the condition of its item at index
+// failed.
+func cancelledOnCondition(err error, index int) bool {
+	var cancelled *dynamodb.TransactionCanceledException
+	return errors.As(err, &cancelled) && index < len(cancelled.CancellationReasons) &&
+		aws.StringValue(cancelled.CancellationReasons[index].Code) == "ConditionalCheckFailed"
+}
@@ -0,0 +1,87 @@
+package repositories
+
+import (
+	"context"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"strings"
+)
+
+// The sources of the event_outbox table, one for each repository that writes to it.
+const (
+	deviceEventSource         = "devices"
+	deviceStateLogEventSource = "device_state_logs"
+)
+
+// sqlEventOutbox is the part of the event_outbox table of one source.
+type sqlEventOutbox struct {
+	db     *db.SQLInstance
+	source string
+}
+
+// insert adds events to the outbox with tx, the transaction of the rows they report.
+func (o sqlEventOutbox) insert(ctx context.Context, tx sqlExecutor, events []models.Event) error {
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx, o.db.Rebind("INSERT INTO event_outbox (id, source, tenant, type, occurred_at, data) VALUES (?, ?, ?, ?, ?, ?)"),
+			event.ID, o.source, event.Tenant, event.Type, event.OccurredAt, string(event.Data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o sqlEventOutbox) pending(ctx context.Context, limit int) ([]models.Event, error) {
+	if limit <= 0 {
+		limit = DefaultEventBatchSize
+	}
+	rows, err := o.db.DB.QueryContext(ctx, o.db.Rebind("SELECT id, tenant, type, occurred_at, data FROM event_outbox WHERE source = ? ORDER BY id LIMIT ?"),
+		o.source, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.Event{}
+	for rows.Next() {
+		var event models.Event
+		var data string
+		if err := rows.Scan(&event.ID, &event.Tenant, &event.Type, &event.OccurredAt, &data); err != nil {
+			return nil, err
+		}
+		event.Data = []byte(data)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (o sqlEventOutbox) ack(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []any{o.source}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	_, err := o.db.DB.ExecContext(ctx, o.db.Rebind("DELETE FROM event_outbox WHERE source = ? AND id IN ("+placeholders+")"), args...)
+	return err
+}
+
+// inTransaction runs write in a transaction of its own when it stores events, so that they are inserted together
+// with the rows they report. Otherwise write runs on the database as it is.
+func inTransaction(ctx context.Context, instance *db.SQLInstance, hasEvents bool, write func(tx sqlExecutor) error) error {
+	if !hasEvents {
+		return write(instance.DB)
+	}
+	tx, err := instance.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := write(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
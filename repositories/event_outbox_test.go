@@ -0,0 +1,253 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simple-api-go/db/sqltest"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withTestDeviceEvents emits an event for every stored device, typed like the services do.
+func withTestDeviceEvents(ctx context.Context) context.Context {
+	tenant := utils.TenantFromContext(ctx)
+	return WithDeviceEvents(ctx, func(stored *models.Device) ([]models.Event, error) {
+		var data models.EventData = models.DeviceUpdated{Device: *stored}
+		switch {
+		case stored.DeletedAt != "":
+			data = models.DeviceDeleted{Device: *stored}
+		case stored.Version == 1:
+			data = models.DeviceCreated{Device: *stored}
+		}
+		event, err := models.NewEvent(tenant, data, time.Now())
+		return []models.Event{event}, err
+	})
+}
+
+// eventSummaries describes events as "type id@version", to compare them with what a test expects.
+func eventSummaries(t *testing.T, events []models.Event) []string {
+	summaries := []string{}
+	for _, event := range events {
+		data, err := event.Decode()
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		switch data := data.(type) {
+		case *models.DeviceCreated:
+			summaries = append(summaries, fmt.Sprintf("%s %s@%d", event.Type, data.Device.ID, data.Device.Version))
+		case *models.DeviceUpdated:
+			summaries = append(summaries, fmt.Sprintf("%s %s@%d", event.Type, data.Device.ID, data.Device.Version))
+		case *models.DeviceDeleted:
+			summaries = append(summaries, fmt.Sprintf("%s %s@%d", event.Type, data.Device.ID, data.Device.Version))
+		case *models.StateChanged:
+			summaries = append(summaries, fmt.Sprintf("%s %s->%s", event.Type, data.From, data.Log.State))
+		}
+	}
+	return summaries
+}
+
+func pendingSummaries(t *testing.T, outbox EventOutbox) []string {
+	events, err := outbox.PendingEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("PendingEvents() error = %v", err)
+	}
+	return eventSummaries(t, events)
+}
+
+type deviceOutboxRepository interface {
+	DeviceRepository
+	EventOutbox
+}
+
+func TestDeviceRepository_EventOutbox(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) deviceOutboxRepository
+	}{
+		{"Memory", func(t *testing.T) deviceOutboxRepository { return NewDeviceMemoryRepository() }},
+		{"File", func(t *testing.T) deviceOutboxRepository {
+			repo, err := NewDeviceFileRepository(newTestFileStore(t, t.TempDir(), "devices"))
+			if err != nil {
+				t.Fatalf("NewDeviceFileRepository() error = %v", err)
+			}
+			return repo
+		}},
+		{"SQL", func(t *testing.T) deviceOutboxRepository { return NewSQLDeviceRepository(newTestSQLInstance(t)) }},
+		{"Postgres", func(t *testing.T) deviceOutboxRepository { return NewSQLDeviceRepository(sqltest.OpenPostgres(t)) }},
+		{"DynamoDB", func(t *testing.T) deviceOutboxRepository {
+			_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+			return NewDynamoDeviceService(instance)
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			r := backend.open(t)
+			ctx := withTestDeviceEvents(context.Background())
+
+			if _, err := r.CreateDevice(ctx, &models.Device{ID: "1", Name: "Device 1"}); err != nil {
+				t.Fatalf("CreateDevice() error = %v", err)
+			}
+			if _, err := r.CreateDevice(context.Background(), &models.Device{ID: "2", Name: "Device 2"}); err != nil {
+				t.Fatalf("CreateDevice() error = %v", err)
+			}
+			if _, err := r.UpdateDevice(ctx, "1", &models.Device{ID: "1", Name: "Renamed", Version: 1}); err != nil {
+				t.Fatalf("UpdateDevice() error = %v", err)
+			}
+			if _, err := r.UpdateDevice(ctx, "1", &models.Device{ID: "1", Name: "Stale", Version: 1}); !errors.Is(err, utils.ErrVersionMismatch) {
+				t.Fatalf("UpdateDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+			}
+			if err := r.DeleteDevice(ctx, "2", 0, "operator"); err != nil {
+				t.Fatalf("DeleteDevice() error = %v", err)
+			}
+			if _, err := r.RestoreDevice(ctx, "2", 0); err != nil {
+				t.Fatalf("RestoreDevice() error = %v", err)
+			}
+
+			// An atomic batch that fails stores neither its devices nor their events.
+			ops := []models.DeviceBatchOperation{
+				{Op: models.BatchCreate, Device: models.Device{ID: "3", Name: "Device 3"}},
+				{Op: models.BatchUpdate, Device: models.Device{ID: "1", Name: "Stale", Version: 1}},
+			}
+			results, err := r.WriteDevices(ctx, ops, true)
+			if err != nil || !errors.Is(results[0].Err, utils.ErrBatchAborted) {
+				t.Fatalf("WriteDevices() got = %v, %v, want an aborted batch", results, err)
+			}
+			ops[1] = models.DeviceBatchOperation{Op: models.BatchDelete, Device: models.Device{ID: "1"}}
+			results, err = r.WriteDevices(ctx, ops, true)
+			if err != nil || results[0].Err != nil || results[1].Err != nil {
+				t.Fatalf("WriteDevices() got = %v, %v, want the batch applied", results, err)
+			}
+
+			// A failing event fails its write.
+			failing := WithDeviceEvents(context.Background(), func(*models.Device) ([]models.Event, error) {
+				return nil, errors.New("no event")
+			})
+			if _, err := r.CreateDevice(failing, &models.Device{ID: "4", Name: "Device 4"}); err == nil {
+				t.Errorf("CreateDevice() error = nil, want the error of the event")
+			}
+			if _, err := r.GetDevice(context.Background(), "4"); !errors.Is(err, utils.ErrDeviceNotFound) {
+				t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+			}
+
+			want := []string{
+				"DeviceCreated 1@1",
+				"DeviceUpdated 1@2",
+				"DeviceDeleted 2@2",
+				"DeviceUpdated 2@3",
+				"DeviceCreated 3@1",
+				"DeviceDeleted 1@3",
+			}
+			if got := pendingSummaries(t, r); !slices.Equal(got, want) {
+				t.Fatalf("PendingEvents() got = %v, want %v", got, want)
+			}
+
+			events, err := r.PendingEvents(context.Background(), 2)
+			if err != nil || len(events) != 2 {
+				t.Fatalf("PendingEvents() got = %v, %v, want 2 events", events, err)
+			}
+			if err := r.AckEvents(context.Background(), []string{events[0].ID, events[1].ID, "unknown"}); err != nil {
+				t.Fatalf("AckEvents() error = %v", err)
+			}
+			if got := pendingSummaries(t, r); !slices.Equal(got, want[2:]) {
+				t.Errorf("PendingEvents() got = %v, want %v", got, want[2:])
+			}
+		})
+	}
+}
+
+type logOutboxRepository interface {
+	DeviceStateLogRepository
+	EventOutbox
+}
+
+func TestDeviceStateLogRepository_EventOutbox(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) logOutboxRepository
+	}{
+		{"Memory", func(t *testing.T) logOutboxRepository { return NewDeviceStateLogMemoryRepository() }},
+		{"File", func(t *testing.T) logOutboxRepository {
+			repo, err := NewDeviceStateLogFileRepository(newTestFileStore(t, t.TempDir(), "device_state_logs"))
+			if err != nil {
+				t.Fatalf("NewDeviceStateLogFileRepository() error = %v", err)
+			}
+			return repo
+		}},
+		{"SQL", func(t *testing.T) logOutboxRepository { return NewSQLDeviceStateLogRepository(newTestSQLInstance(t)) }},
+		{"Postgres", func(t *testing.T) logOutboxRepository { return NewSQLDeviceStateLogRepository(sqltest.OpenPostgres(t)) }},
+		{"DynamoDB", func(t *testing.T) logOutboxRepository {
+			_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+			return NewDynamoDeviceStateLogRepository(instance)
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			r := backend.open(t)
+			stateChanged := func(from string) context.Context {
+				return WithLogEvents(context.Background(), func(stored *models.DeviceStateLog) ([]models.Event, error) {
+					event, err := models.NewEvent(utils.DefaultTenant, models.StateChanged{Log: *stored, From: from}, time.Now())
+					return []models.Event{event}, err
+				})
+			}
+
+			if _, err := r.CreateLog(stateChanged(""), newTestLog("Normal", "2024-03-24T10:00:00.000Z")); err != nil {
+				t.Fatalf("CreateLog() error = %v", err)
+			}
+			if _, err := r.CreateLog(context.Background(), newTestLog("Warning", "2024-03-24T11:00:00.000Z")); err != nil {
+				t.Fatalf("CreateLog() error = %v", err)
+			}
+			if _, err := r.CreateLog(stateChanged("Warning"), newTestLog("Critical", "2024-03-24T12:00:00.000Z")); err != nil {
+				t.Fatalf("CreateLog() error = %v", err)
+			}
+
+			want := []string{"StateChanged ->Normal", "StateChanged Warning->Critical"}
+			if got := pendingSummaries(t, r); !slices.Equal(got, want) {
+				t.Fatalf("PendingEvents() got = %v, want %v", got, want)
+			}
+			events, _ := r.PendingEvents(context.Background(), 1)
+			if err := r.AckEvents(context.Background(), []string{events[0].ID}); err != nil {
+				t.Fatalf("AckEvents() error = %v", err)
+			}
+			if got := pendingSummaries(t, r); !slices.Equal(got, want[1:]) {
+				t.Errorf("PendingEvents() got = %v, want %v", got, want[1:])
+			}
+		})
+	}
+}
+
+func TestDeviceFileRepository_EventOutboxRestart(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *DeviceFileRepository {
+		repo, err := NewDeviceFileRepository(newTestFileStore(t, dir, "devices"))
+		if err != nil {
+			t.Fatalf("NewDeviceFileRepository() error = %v", err)
+		}
+		return repo
+	}
+
+	r := open()
+	r.store.SetSnapshotEvery(2)
+	ctx := withTestDeviceEvents(context.Background())
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := r.CreateDevice(ctx, &models.Device{ID: id, Name: "Device " + id}); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	events, _ := r.PendingEvents(context.Background(), 1)
+	if err := r.AckEvents(context.Background(), []string{events[0].ID}); err != nil {
+		t.Fatalf("AckEvents() error = %v", err)
+	}
+
+	// The second instance reads the events of the snapshot and of the log, less the acknowledged one.
+	r = open()
+	want := []string{"DeviceCreated 2@1", "DeviceCreated 3@1"}
+	if got := pendingSummaries(t, r); !slices.Equal(got, want) {
+		t.Errorf("PendingEvents() got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,814 @@
+// Package repositorytest checks that a repository backend behaves like the others. A new backend runs the
+// conformance suite from its tests, with a factory that hands out an empty repository:
+//
+//	func TestDeviceRepository(t *testing.T) {
+//		repositorytest.TestDeviceRepository(t, func(t *testing.T) repositories.DeviceRepository {
+//			return NewMyDeviceRepository(...)
+//		})
+//	}
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// DeviceRepositoryFactory returns an empty repository for one test. It may register its cleanup with t.
+type DeviceRepositoryFactory func(t *testing.T) repositories.DeviceRepository
+
+// TestDeviceRepository runs the conformance suite of repositories.DeviceRepository, each test on a repository of
+// its own.
+func TestDeviceRepository(t *testing.T, newRepo DeviceRepositoryFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repositories.DeviceRepository)
+	}{
+		{"CreateDevice", testCreateDevice},
+		{"CreateDuplicateDevice", testCreateDuplicateDevice},
+		{"CreateDeletedDevice", testCreateDeletedDevice},
+		{"CreateDeviceConcurrently", testCreateDeviceConcurrently},
+		{"GetDeviceNotFound", testGetDeviceNotFound},
+		{"GetDevices", testGetDevices},
+		{"ListDevicesPages", testListDevicesPages},
+		{"ListDevicesFilterAndSort", testListDevicesFilterAndSort},
+		{"ListDevicesInvalid", testListDevicesInvalid},
+		{"UpdateDevice", testUpdateDevice},
+		{"UpdateDeviceReplacesFields", testUpdateDeviceReplacesFields},
+		{"UpdateDeviceKeepsID", testUpdateDeviceKeepsID},
+		{"UpdateDeviceNotFound", testUpdateDeviceNotFound},
+		{"UpdateDeviceVersion", testUpdateDeviceVersion},
+		{"UpdateDeviceConcurrently", testUpdateDeviceConcurrently},
+		{"UpdateDeviceFunc", testUpdateDeviceFunc},
+		{"DeleteDevice", testDeleteDevice},
+		{"ListDeletedDevices", testListDeletedDevices},
+		{"RestoreDevice", testRestoreDevice},
+		{"WriteDevicesAtomic", testWriteDevicesAtomic},
+		{"WriteDevicesAtomicLimit", testWriteDevicesAtomicLimit},
+		{"WriteDevicesPerItem", testWriteDevicesPerItem},
+		{"WriteDevicesConcurrently", testWriteDevicesConcurrently},
+		{"WriteDevicesInvalid", testWriteDevicesInvalid},
+		{"TenantIsolation", testTenantIsolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+const testDeviceModel = "/devicemodels/Model2"
+
+func newTestDevice(id string) *models.Device {
+	return &models.Device{ID: id, Name: "Device " + id, DeviceModel: testDeviceModel, Note: "A test device", Serial: "ABC123"}
+}
+
+// mustCreate creates the devices of ids, and stops the test when one of them fails.
+func mustCreate(t *testing.T, repo repositories.DeviceRepository, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := repo.CreateDevice(context.Background(), newTestDevice(id)); err != nil {
+			t.Fatalf("CreateDevice(%s) error = %v", id, err)
+		}
+	}
+}
+
+func testCreateDevice(t *testing.T, repo repositories.DeviceRepository) {
+	created, err := repo.CreateDevice(context.Background(), newTestDevice("/devices/idTest1"))
+	if err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	want := *newTestDevice("/devices/idTest1")
+	want.Version = 1
+	if *created != want {
+		t.Errorf("CreateDevice() got = %v, want %v", *created, want)
+	}
+
+	stored, err := repo.GetDevice(context.Background(), "/devices/idTest1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if *stored != want {
+		t.Errorf("GetDevice() got = %v, want %v", *stored, want)
+	}
+}
+
+func testCreateDuplicateDevice(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+
+	other := &models.Device{ID: "/devices/idTest1", Name: "Other device", DeviceModel: testDeviceModel}
+	if _, err := repo.CreateDevice(context.Background(), other); !errors.Is(err, utils.ErrDeviceDuplicate) {
+		t.Errorf("CreateDevice() error = %v, want %v", err, utils.ErrDeviceDuplicate)
+	}
+	if stored, _ := repo.GetDevice(context.Background(), "/devices/idTest1"); stored == nil || stored.Name != "Device /devices/idTest1" {
+		t.Errorf("CreateDevice() a duplicate should not replace the device, got %v", stored)
+	}
+}
+
+func testCreateDeletedDevice(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	created, err := repo.CreateDevice(context.Background(), &models.Device{ID: "/devices/idTest1", Name: "New device", DeviceModel: testDeviceModel})
+	if err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if created.Version != 1 || created.DeletedAt != "" || created.Name != "New device" {
+		t.Errorf("CreateDevice() got = %v, want a live device at version 1", *created)
+	}
+}
+
+func testCreateDeviceConcurrently(t *testing.T, repo repositories.DeviceRepository) {
+	const creates = 8
+	errs := make(chan error, creates)
+	for i := 0; i < creates; i++ {
+		go func() {
+			device := &models.Device{ID: "/devices/idTestRace", Name: "Device " + strconv.Itoa(i), DeviceModel: testDeviceModel}
+			_, err := repo.CreateDevice(context.Background(), device)
+			errs <- err
+		}()
+	}
+
+	created := 0
+	for i := 0; i < creates; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			created++
+		case !errors.Is(err, utils.ErrDeviceDuplicate):
+			t.Errorf("CreateDevice() error = %v, want %v", err, utils.ErrDeviceDuplicate)
+		}
+	}
+	if created != 1 {
+		t.Errorf("CreateDevice() %d concurrent creates of the same ID succeeded, want 1", created)
+	}
+}
+
+func testGetDevices(t *testing.T, repo repositories.DeviceRepository) {
+	var ids []string
+	for i := 0; i < 120; i++ {
+		ids = append(ids, "/devices/bulk"+strconv.Itoa(i))
+	}
+	mustCreate(t, repo, ids...)
+	if err := repo.DeleteDevice(context.Background(), ids[1], 0, "operator1"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	other := utils.WithTenant(context.Background(), "tenant-b")
+	if _, err := repo.CreateDevice(other, newTestDevice("/devices/bulkOther")); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+
+	// More IDs than one request of a backend takes, an ID twice, a deleted device, a missing one and the device of
+	// another tenant.
+	devices, err := repo.GetDevices(context.Background(), append(ids, ids[0], "/devices/bulkMissing", "/devices/bulkOther"))
+	if err != nil {
+		t.Fatalf("GetDevices() error = %v", err)
+	}
+	if len(devices) != len(ids)-1 {
+		t.Errorf("GetDevices() got %d devices, want %d", len(devices), len(ids)-1)
+	}
+	if device := devices[ids[0]]; device == nil || device.Name != "Device "+ids[0] || device.Version != 1 {
+		t.Errorf("GetDevices() got %v, want the device %s", device, ids[0])
+	}
+	if _, ok := devices[ids[1]]; ok {
+		t.Errorf("GetDevices() got the deleted device %s", ids[1])
+	}
+
+	if devices, err := repo.GetDevices(context.Background(), nil); err != nil || len(devices) != 0 {
+		t.Errorf("GetDevices() got = %v, %v, want no devices", devices, err)
+	}
+}
+
+func testGetDeviceNotFound(t *testing.T, repo repositories.DeviceRepository) {
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTestMissing"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+
+	mustCreate(t, repo, "/devices/idTest1")
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTest1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v for a deleted device", err, utils.ErrDeviceNotFound)
+	}
+}
+
+// testListDevicesPages walks the pages of a listing and checks that every live device comes exactly once.
+func testListDevicesPages(t *testing.T, repo repositories.DeviceRepository) {
+	const devices, limit = 7, 3
+	want := map[string]bool{}
+	for i := 0; i < devices; i++ {
+		id := "/devices/idTestPage" + strconv.Itoa(i)
+		mustCreate(t, repo, id)
+		want[id] = true
+	}
+	mustCreate(t, repo, "/devices/idTestDeleted")
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTestDeleted", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	got := map[string]bool{}
+	opts := repositories.ListOptions{Limit: limit}
+	for pages := 0; ; pages++ {
+		if pages > devices {
+			t.Fatalf("ListDevices() did not end after %d pages", pages)
+		}
+		page, err := repo.ListDevices(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListDevices() error = %v", err)
+		}
+		if len(page.Items) > limit {
+			t.Errorf("ListDevices() got %d items, want at most %d", len(page.Items), limit)
+		}
+		for _, device := range page.Items {
+			if got[device.ID] {
+				t.Errorf("ListDevices() returned %v twice", device.ID)
+			}
+			got[device.ID] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("ListDevices() got = %v, want %v", got, want)
+	}
+	for id := range want {
+		if !got[id] {
+			t.Errorf("ListDevices() did not return %v", id)
+		}
+	}
+}
+
+func testListDevicesFilterAndSort(t *testing.T, repo repositories.DeviceRepository) {
+	for _, device := range []*models.Device{
+		{ID: "1", Name: "Alpha", DeviceModel: "/devicemodels/A", Serial: "A02-1"},
+		{ID: "2", Name: "Delta", DeviceModel: "/devicemodels/A", Serial: "A02-0"},
+		{ID: "3", Name: "Charlie Camera", DeviceModel: "/devicemodels/B", Serial: "C01"},
+		{ID: "4", Name: "Bravo Camera", DeviceModel: "/devicemodels/B", Serial: "B01"},
+	} {
+		if _, err := repo.CreateDevice(context.Background(), device); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		opts    repositories.ListOptions
+		wantIDs []string
+	}{
+		{
+			name: "ModelAndSerialPrefix",
+			opts: repositories.ListOptions{
+				Filter: repositories.DeviceFilter{
+					{Field: "deviceModel", Operator: repositories.FilterEquals, Value: "/devicemodels/A"},
+					{Field: "serial", Operator: repositories.FilterPrefix, Value: "A02"},
+				},
+				Sort: []repositories.SortField{{Field: "name", Descending: true}},
+			},
+			wantIDs: []string{"2", "1"},
+		},
+		{
+			name: "NameContains",
+			opts: repositories.ListOptions{
+				Filter: repositories.DeviceFilter{{Field: "name", Operator: repositories.FilterContains, Value: "Camera"}},
+				Sort:   []repositories.SortField{{Field: "name"}},
+			},
+			wantIDs: []string{"4", "3"},
+		},
+		{
+			name:    "SortBySerial",
+			opts:    repositories.ListOptions{Sort: []repositories.SortField{{Field: "serial"}}},
+			wantIDs: []string{"2", "1", "4", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := repo.ListDevices(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatalf("ListDevices() error = %v", err)
+			}
+			gotIDs := []string{}
+			for _, device := range page.Items {
+				gotIDs = append(gotIDs, device.ID)
+			}
+			if len(gotIDs) != len(tt.wantIDs) {
+				t.Fatalf("ListDevices() got = %v, want %v", gotIDs, tt.wantIDs)
+			}
+			for i := range gotIDs {
+				if gotIDs[i] != tt.wantIDs[i] {
+					t.Fatalf("ListDevices() got = %v, want %v", gotIDs, tt.wantIDs)
+				}
+			}
+		})
+	}
+}
+
+func testListDevicesInvalid(t *testing.T, repo repositories.DeviceRepository) {
+	if _, err := repo.ListDevices(context.Background(), repositories.ListOptions{Cursor: "not a cursor"}); !errors.Is(err, utils.ErrInvalidCursor) {
+		t.Errorf("ListDevices() error = %v, want %v", err, utils.ErrInvalidCursor)
+	}
+	opts := repositories.ListOptions{Filter: repositories.DeviceFilter{{Field: "id", Operator: repositories.FilterEquals, Value: "1"}}}
+	if _, err := repo.ListDevices(context.Background(), opts); !errors.Is(err, utils.ErrInvalidFilter) {
+		t.Errorf("ListDevices() error = %v, want %v", err, utils.ErrInvalidFilter)
+	}
+	opts = repositories.ListOptions{Sort: []repositories.SortField{{Field: "createdAt"}}}
+	if _, err := repo.ListDevices(context.Background(), opts); !errors.Is(err, utils.ErrInvalidSort) {
+		t.Errorf("ListDevices() error = %v, want %v", err, utils.ErrInvalidSort)
+	}
+}
+
+func testUpdateDevice(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+
+	updatedDevice := &models.Device{
+		ID:          "/devices/idTest1",
+		Name:        "Updated Device",
+		DeviceModel: testDeviceModel,
+		Note:        "This is an updated device",
+		Serial:      "DEF456",
+	}
+	stored, err := repo.UpdateDevice(context.Background(), "/devices/idTest1", updatedDevice)
+	if err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	want := *updatedDevice
+	want.Version = 2
+	if *stored != want {
+		t.Errorf("UpdateDevice() got = %v, want %v", *stored, want)
+	}
+
+	device, err := repo.GetDevice(context.Background(), "/devices/idTest1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if *device != want {
+		t.Errorf("GetDevice() got = %v, want %v", *device, want)
+	}
+}
+
+func testUpdateDeviceReplacesFields(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest2")
+
+	// Every field is replaced, so leaving out the note clears it.
+	replacement := &models.Device{ID: "/devices/idTest2", Name: "Device 2", DeviceModel: testDeviceModel, Serial: "GHI789"}
+	stored, err := repo.UpdateDevice(context.Background(), "/devices/idTest2", replacement)
+	if err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	want := models.Device{ID: "/devices/idTest2", Name: "Device 2", DeviceModel: testDeviceModel, Serial: "GHI789", Version: 2}
+	if *stored != want {
+		t.Errorf("UpdateDevice() got = %v, want %v", *stored, want)
+	}
+}
+
+// testUpdateDeviceKeepsID checks that the ID of the device argument is ignored, and that the soft delete fields
+// of a caller can not put a device in the trash.
+func testUpdateDeviceKeepsID(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+
+	device := newTestDevice("/devices/idTestOther")
+	device.DeletedAt = "2024-05-01T12:00:00Z"
+	device.DeletedBy = "operator"
+	stored, err := repo.UpdateDevice(context.Background(), "/devices/idTest1", device)
+	if err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if stored.ID != "/devices/idTest1" || stored.DeletedAt != "" || stored.DeletedBy != "" {
+		t.Errorf("UpdateDevice() got = %v, want the live device /devices/idTest1", *stored)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTest1"); err != nil {
+		t.Errorf("GetDevice() error = %v", err)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTestOther"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func testUpdateDeviceNotFound(t *testing.T, repo repositories.DeviceRepository) {
+	if _, err := repo.UpdateDevice(context.Background(), "/devices/idTestMissing", newTestDevice("/devices/idTestMissing")); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("UpdateDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTestMissing"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("UpdateDevice() should not create a missing device, error = %v", err)
+	}
+
+	// A deleted device is not found, whatever the expected version.
+	mustCreate(t, repo, "/devices/idTest1")
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	for _, version := range []int64{0, 1, 2} {
+		device := newTestDevice("/devices/idTest1")
+		device.Version = version
+		if _, err := repo.UpdateDevice(context.Background(), "/devices/idTest1", device); !errors.Is(err, utils.ErrDeviceNotFound) {
+			t.Errorf("UpdateDevice() version %d error = %v, want %v", version, err, utils.ErrDeviceNotFound)
+		}
+	}
+}
+
+func testUpdateDeviceVersion(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+
+	device := newTestDevice("/devices/idTest1")
+	device.Version = 1
+	updated, err := repo.UpdateDevice(context.Background(), "/devices/idTest1", device)
+	if err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if updated.Version != 2 {
+		t.Errorf("UpdateDevice() got version = %v, want %v", updated.Version, 2)
+	}
+
+	stale := newTestDevice("/devices/idTest1")
+	stale.Name = "Stale Device"
+	stale.Version = 1
+	if _, err := repo.UpdateDevice(context.Background(), "/devices/idTest1", stale); !errors.Is(err, utils.ErrVersionMismatch) {
+		t.Errorf("UpdateDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+	}
+	if stored, _ := repo.GetDevice(context.Background(), "/devices/idTest1"); stored == nil || stored.Name == "Stale Device" || stored.Version != 2 {
+		t.Errorf("UpdateDevice() a stale update should not be stored, got %v", stored)
+	}
+
+	// Zero skips the check.
+	updated, err = repo.UpdateDevice(context.Background(), "/devices/idTest1", newTestDevice("/devices/idTest1"))
+	if err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if updated.Version != 3 {
+		t.Errorf("UpdateDevice() got version = %v, want %v", updated.Version, 3)
+	}
+}
+
+// testUpdateDeviceConcurrently races updates that all expect the same version: exactly one of every round wins,
+// while readers keep listing the devices.
+func testUpdateDeviceConcurrently(t *testing.T, repo repositories.DeviceRepository) {
+	const workers, rounds = 4, 5
+	mustCreate(t, repo, "/devices/idTest1")
+
+	for round := 1; round <= rounds; round++ {
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				device := newTestDevice("/devices/idTest1")
+				device.Name = "Worker " + strconv.Itoa(w)
+				device.Version = int64(round)
+				_, err := repo.UpdateDevice(context.Background(), "/devices/idTest1", device)
+				errs <- err
+				if _, err := repo.ListDevices(context.Background(), repositories.ListOptions{}); err != nil {
+					t.Errorf("ListDevices() error = %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		won := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, utils.ErrVersionMismatch):
+				t.Errorf("UpdateDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("UpdateDevice() %d updates of version %d succeeded, want 1", won, round)
+		}
+	}
+
+	device, err := repo.GetDevice(context.Background(), "/devices/idTest1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if device.Version != rounds+1 {
+		t.Errorf("GetDevice() got version = %v, want %v", device.Version, rounds+1)
+	}
+}
+
+func testUpdateDeviceFunc(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTestFunc")
+
+	updated, err := repositories.UpdateDeviceFunc(context.Background(), repo, "/devices/idTestFunc", func(device *models.Device) error {
+		device.Note = "Updated in place"
+		device.Version = 42
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateDeviceFunc() error = %v", err)
+	}
+	if updated.Note != "Updated in place" || updated.Name != "Device /devices/idTestFunc" || updated.Version != 2 {
+		t.Errorf("UpdateDeviceFunc() got = %v, want the updated note at version 2", *updated)
+	}
+
+	errUpdate := errors.New("rejected")
+	if _, err := repositories.UpdateDeviceFunc(context.Background(), repo, "/devices/idTestFunc", func(device *models.Device) error { return errUpdate }); !errors.Is(err, errUpdate) {
+		t.Errorf("UpdateDeviceFunc() error = %v, want %v", err, errUpdate)
+	}
+	if stored, _ := repo.GetDevice(context.Background(), "/devices/idTestFunc"); stored == nil || stored.Version != 2 {
+		t.Errorf("UpdateDeviceFunc() a rejected update should not be stored, got %v", stored)
+	}
+	if _, err := repositories.UpdateDeviceFunc(context.Background(), repo, "/devices/idTestMissing", func(device *models.Device) error { return nil }); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("UpdateDeviceFunc() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func testDeleteDevice(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 2, "operator"); !errors.Is(err, utils.ErrVersionMismatch) {
+		t.Errorf("DeleteDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+	}
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 1, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTest1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("DeleteDevice() device should not exist")
+	}
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 0, "operator"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("DeleteDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTestMissing", 0, "operator"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("DeleteDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func testListDeletedDevices(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1", "/devices/idTest2")
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	opts := repositories.ListOptions{Deleted: true, Filter: repositories.DeviceFilter{{Field: "deviceModel", Operator: repositories.FilterEquals, Value: testDeviceModel}}}
+	page, err := repo.ListDevices(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("ListDevices() error = %v", err)
+	}
+	if len(page.Items) != 1 {
+		t.Fatalf("ListDevices() got %d devices in the trash, want 1", len(page.Items))
+	}
+	deleted := page.Items[0]
+	if deleted.ID != "/devices/idTest1" || deleted.DeletedAt == "" || deleted.DeletedBy != "operator" || deleted.Version != 2 {
+		t.Errorf("ListDevices() got = %v, want /devices/idTest1 deleted by operator at version 2", *deleted)
+	}
+}
+
+func testRestoreDevice(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1")
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest1", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	deleted, err := repo.GetDeletedDevice(context.Background(), "/devices/idTest1")
+	if err != nil || deleted.Version != 2 || deleted.DeletedBy != "operator" || deleted.DeviceModel != testDeviceModel {
+		t.Errorf("GetDeletedDevice() got = %v, %v, want the device deleted by operator at version 2", deleted, err)
+	}
+
+	if _, err := repo.RestoreDevice(context.Background(), "/devices/idTest1", 1); !errors.Is(err, utils.ErrVersionMismatch) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrVersionMismatch)
+	}
+	restored, err := repo.RestoreDevice(context.Background(), "/devices/idTest1", 2)
+	if err != nil {
+		t.Fatalf("RestoreDevice() error = %v", err)
+	}
+	if restored.DeletedAt != "" || restored.DeletedBy != "" || restored.Version != 3 || restored.Name != "Device /devices/idTest1" {
+		t.Errorf("RestoreDevice() got = %v, want the live device at version 3", *restored)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/idTest1"); err != nil {
+		t.Errorf("GetDevice() error = %v", err)
+	}
+	if _, err := repo.RestoreDevice(context.Background(), "/devices/idTest1", 0); !errors.Is(err, utils.ErrDeviceNotDeleted) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrDeviceNotDeleted)
+	}
+	if _, err := repo.GetDeletedDevice(context.Background(), "/devices/idTest1"); !errors.Is(err, utils.ErrDeviceNotDeleted) {
+		t.Errorf("GetDeletedDevice() error = %v, want %v", err, utils.ErrDeviceNotDeleted)
+	}
+	if _, err := repo.GetDeletedDevice(context.Background(), "/devices/idTestMissing"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDeletedDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+	if _, err := repo.RestoreDevice(context.Background(), "/devices/idTestMissing", 0); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
+	}
+}
+
+func testWriteDevicesAtomic(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/batch0")
+
+	ops := []models.DeviceBatchOperation{
+		{Op: models.BatchCreate, Device: *newTestDevice("/devices/batch1")},
+		{Op: models.BatchUpdate, Device: models.Device{ID: "/devices/batch0", Name: "Stale", DeviceModel: testDeviceModel, Version: 2}},
+	}
+	results, err := repo.WriteDevices(context.Background(), ops, true)
+	if err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	if !errors.Is(results[0].Err, utils.ErrBatchAborted) || !errors.Is(results[1].Err, utils.ErrVersionMismatch) {
+		t.Errorf("WriteDevices() got = %v, %v, want %v, %v", results[0].Err, results[1].Err, utils.ErrBatchAborted, utils.ErrVersionMismatch)
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/batch1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("WriteDevices() an aborted batch should not create devices")
+	}
+
+	ops[1] = models.DeviceBatchOperation{Op: models.BatchUpdate, Device: models.Device{ID: "/devices/batch0", Name: "Renamed", DeviceModel: testDeviceModel, Version: 1}}
+	ops = append(ops, models.DeviceBatchOperation{Op: models.BatchCreate, Device: *newTestDevice("/devices/batch2")})
+	results, err = repo.WriteDevices(context.Background(), ops, true)
+	if err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("WriteDevices() operation %d error = %v", i, result.Err)
+		}
+	}
+	if results[0].Device == nil || results[0].Device.Version != 1 {
+		t.Errorf("WriteDevices() got created = %v, want version 1", results[0].Device)
+	}
+	if results[1].Device == nil || results[1].Device.Version != 2 || results[1].Device.Name != "Renamed" {
+		t.Errorf("WriteDevices() got updated = %v, want version 2", results[1].Device)
+	}
+}
+
+func testWriteDevicesAtomicLimit(t *testing.T, repo repositories.DeviceRepository) {
+	var ops []models.DeviceBatchOperation
+	for i := 0; i <= repositories.MaxAtomicBatchOperations; i++ {
+		ops = append(ops, models.DeviceBatchOperation{Op: models.BatchCreate, Device: *newTestDevice("/devices/batchAtomic" + strconv.Itoa(i))})
+	}
+	if _, err := repo.WriteDevices(context.Background(), ops, true); !errors.Is(err, utils.ErrInvalidBatch) {
+		t.Errorf("WriteDevices() error = %v, want %v", err, utils.ErrInvalidBatch)
+	}
+
+	ops = ops[:repositories.MaxAtomicBatchOperations]
+	results, err := repo.WriteDevices(context.Background(), ops, true)
+	if err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("WriteDevices() operation %d error = %v", i, result.Err)
+		}
+	}
+	if _, err := repo.GetDevice(context.Background(), ops[len(ops)-1].Device.ID); err != nil {
+		t.Errorf("GetDevice() error = %v", err)
+	}
+}
+
+func testWriteDevicesPerItem(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/batch0", "/devices/batch1", "/devices/batch2")
+
+	ops := []models.DeviceBatchOperation{
+		{Op: models.BatchCreate, Device: *newTestDevice("/devices/batch1")},
+		{Op: models.BatchDelete, Device: models.Device{ID: "/devices/batch0", Version: 1}},
+		{Op: models.BatchDelete, Device: models.Device{ID: "/devices/batch3"}},
+		{Op: models.BatchUpdate, Device: models.Device{ID: "/devices/batch2", Name: "Stale", DeviceModel: testDeviceModel, Version: 2}},
+	}
+	// More creates than one DynamoDB batch request takes.
+	for i := 0; i < 30; i++ {
+		ops = append(ops, models.DeviceBatchOperation{Op: models.BatchCreate, Device: *newTestDevice("/devices/batchMany" + strconv.Itoa(i))})
+	}
+
+	results, err := repo.WriteDevices(context.Background(), ops, false)
+	if err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	if !errors.Is(results[0].Err, utils.ErrDeviceDuplicate) {
+		t.Errorf("WriteDevices() create error = %v, want %v", results[0].Err, utils.ErrDeviceDuplicate)
+	}
+	if results[1].Err != nil {
+		t.Errorf("WriteDevices() delete error = %v", results[1].Err)
+	}
+	if !errors.Is(results[2].Err, utils.ErrDeviceNotFound) {
+		t.Errorf("WriteDevices() delete error = %v, want %v", results[2].Err, utils.ErrDeviceNotFound)
+	}
+	if !errors.Is(results[3].Err, utils.ErrVersionMismatch) {
+		t.Errorf("WriteDevices() update error = %v, want %v", results[3].Err, utils.ErrVersionMismatch)
+	}
+	for i := 0; i < 30; i++ {
+		id := "/devices/batchMany" + strconv.Itoa(i)
+		if results[4+i].Err != nil {
+			t.Errorf("WriteDevices() create %s error = %v", id, results[4+i].Err)
+		}
+		if _, err := repo.GetDevice(context.Background(), id); err != nil {
+			t.Errorf("GetDevice(%s) error = %v", id, err)
+		}
+	}
+	if _, err := repo.GetDevice(context.Background(), "/devices/batch0"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("WriteDevices() the deleted device should not exist, error = %v", err)
+	}
+}
+
+// testWriteDevicesConcurrently checks that the creates of batches that are not atomic never overwrite each other.
+func testWriteDevicesConcurrently(t *testing.T, repo repositories.DeviceRepository) {
+	const batches, devices = 8, 5
+	results := make(chan []repositories.BatchResult, batches)
+	for i := 0; i < batches; i++ {
+		go func() {
+			var ops []models.DeviceBatchOperation
+			for n := 0; n < devices; n++ {
+				device := newTestDevice("/devices/batchRace" + strconv.Itoa(n))
+				device.Name = "Batch " + strconv.Itoa(i)
+				ops = append(ops, models.DeviceBatchOperation{Op: models.BatchCreate, Device: *device})
+			}
+			batch, err := repo.WriteDevices(context.Background(), ops, false)
+			if err != nil {
+				t.Errorf("WriteDevices() error = %v", err)
+			}
+			results <- batch
+		}()
+	}
+
+	created := make([]string, devices)
+	for i := 0; i < batches; i++ {
+		for n, result := range <-results {
+			switch {
+			case result.Err == nil && created[n] != "":
+				t.Errorf("WriteDevices() created /devices/batchRace%d twice", n)
+			case result.Err == nil:
+				created[n] = result.Device.Name
+			case !errors.Is(result.Err, utils.ErrDeviceDuplicate):
+				t.Errorf("WriteDevices() error = %v, want %v", result.Err, utils.ErrDeviceDuplicate)
+			}
+		}
+	}
+	for n, name := range created {
+		device, err := repo.GetDevice(context.Background(), "/devices/batchRace"+strconv.Itoa(n))
+		if err != nil || device.Name != name {
+			t.Errorf("GetDevice() got = %v, %v, want the device of the batch that created it, %q", device, err, name)
+		}
+	}
+}
+
+func testWriteDevicesInvalid(t *testing.T, repo repositories.DeviceRepository) {
+	ops := []models.DeviceBatchOperation{
+		{Op: models.BatchDelete, Device: models.Device{ID: "/devices/batch1"}},
+		{Op: models.BatchCreate, Device: *newTestDevice("/devices/batch1")},
+	}
+	if _, err := repo.WriteDevices(context.Background(), ops, false); !errors.Is(err, utils.ErrInvalidBatch) {
+		t.Errorf("WriteDevices() error = %v, want %v", err, utils.ErrInvalidBatch)
+	}
+}
+
+// testTenantIsolation checks that a tenant can neither see nor touch the devices of another, and may reuse their IDs.
+func testTenantIsolation(t *testing.T, repo repositories.DeviceRepository) {
+	mustCreate(t, repo, "/devices/idTest1", "/devices/idTest2")
+	other := utils.WithTenant(context.Background(), "tenant-b")
+
+	if _, err := repo.GetDevice(other, "/devices/idTest1"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("GetDevice() error = %v, want %v from another tenant", err, utils.ErrDeviceNotFound)
+	}
+	page, err := repo.ListDevices(other, repositories.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListDevices() error = %v", err)
+	}
+	if len(page.Items) != 0 {
+		t.Errorf("ListDevices() got %d devices of another tenant, want none", len(page.Items))
+	}
+	if _, err := repo.UpdateDevice(other, "/devices/idTest1", newTestDevice("/devices/idTest1")); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("UpdateDevice() error = %v, want %v from another tenant", err, utils.ErrDeviceNotFound)
+	}
+	if err := repo.DeleteDevice(other, "/devices/idTest1", 0, "intruder"); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("DeleteDevice() error = %v, want %v from another tenant", err, utils.ErrDeviceNotFound)
+	}
+	if err := repo.DeleteDevice(context.Background(), "/devices/idTest2", 0, "operator"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if _, err := repo.RestoreDevice(other, "/devices/idTest2", 0); !errors.Is(err, utils.ErrDeviceNotFound) {
+		t.Errorf("RestoreDevice() error = %v, want %v from another tenant", err, utils.ErrDeviceNotFound)
+	}
+
+	created, err := repo.CreateDevice(other, &models.Device{ID: "/devices/idTest1", Name: "Tenant B device", DeviceModel: testDeviceModel})
+	if err != nil {
+		t.Fatalf("CreateDevice() error = %v, want the ID free in another tenant", err)
+	}
+	if created.Version != 1 {
+		t.Errorf("CreateDevice() got version %d, want 1", created.Version)
+	}
+	stored, err := repo.GetDevice(context.Background(), "/devices/idTest1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if stored.Name != "Device /devices/idTest1" || stored.Version != 1 {
+		t.Errorf("GetDevice() got = %v, want the device of the default tenant untouched", *stored)
+	}
+
+	if counter, ok := repo.(repositories.TenantCounter); ok {
+		counts, err := counter.CountByTenant(context.Background())
+		if err != nil {
+			t.Fatalf("CountByTenant() error = %v", err)
+		}
+		want := map[string]int{utils.DefaultTenant: 2, "tenant-b": 1}
+		if !maps.Equal(counts, want) {
+			t.Errorf("CountByTenant() got = %v, want %v", counts, want)
+		}
+	}
+}
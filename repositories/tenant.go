@@ -0,0 +1,40 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrTenantUsageUnsupported is returned by CountByTenant for a repository that can not count its records.
+var ErrTenantUsageUnsupported = errors.New("the repository can not count the records of its tenants")
+
+// tenantSeparator ends the tenant prefix of a key. utils.ValidateTenant keeps it out of tenants, so two tenants
+// never share a key.
+const tenantSeparator = "#"
+
+// tenantKey scopes key to tenant, for the backends that keep every tenant in the same key space.
+func tenantKey(tenant, key string) string {
+	return tenant + tenantSeparator + key
+}
+
+// untenantKey returns the key that tenantKey scoped to tenant.
+func untenantKey(tenant, key string) string {
+	return strings.TrimPrefix(key, tenant+tenantSeparator)
+}
+
+// TenantCounter is implemented by the repositories that can count the records of every tenant, for the admin
+// endpoints. It reads the whole store, whatever the tenant of ctx.
+type TenantCounter interface {
+	CountByTenant(ctx context.Context) (map[string]int, error)
+}
+
+// CountByTenant returns how many records repo holds for each tenant that has any, or
+// ErrTenantUsageUnsupported when repo is not a TenantCounter.
+func CountByTenant(ctx context.Context, repo any) (map[string]int, error) {
+	counter, ok := repo.(TenantCounter)
+	if !ok {
+		return nil, ErrTenantUsageUnsupported
+	}
+	return counter.CountByTenant(ctx)
+}
@@ -0,0 +1,345 @@
+package repositories
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"time"
+)
+
+// WebhookDynamoRepository stores the webhooks in the single table of dynamodb_table.go, each in the partition of
+// its deliveries. The webhooks of a tenant share a GSI1 partition, and so do the deliveries of a webhook in one
+// status; the pending deliveries of every tenant share a GSI2 partition sorted by their next attempts.
+type WebhookDynamoRepository struct {
+	db *db.DynamoDBInstance
+}
+
+func NewDynamoWebhookRepository(db *db.DynamoDBInstance) *WebhookDynamoRepository {
+	return &WebhookDynamoRepository{
+		db: db,
+	}
+}
+
+// webhookPartition is the partition of the webhook id of tenant and its deliveries.
+func webhookPartition(tenant, id string) string {
+	return tenantKey(tenant, webhookPrefix+id)
+}
+
+// webhookKey is the key of the webhook id of tenant.
+func webhookKey(tenant, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		pkAttribute: stringValue(webhookPartition(tenant, id)),
+		skAttribute: stringValue(webhookSortKey),
+	}
+}
+
+// deliveryKey is the key of the delivery id of the webhook webhookID of tenant.
+func deliveryKey(tenant, webhookID, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		pkAttribute: stringValue(webhookPartition(tenant, webhookID)),
+		skAttribute: stringValue(deliveryPrefix + id),
+	}
+}
+
+// deliveryStatusKey is the GSI1 partition of the deliveries of the webhook webhookID of tenant in status.
+func deliveryStatusKey(tenant, webhookID, status string) string {
+	return webhookPartition(tenant, webhookID) + "#" + status
+}
+
+// marshalWebhook is the item of a webhook of tenant.
+func marshalWebhook(tenant string, webhook *models.Webhook) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(webhook)
+	if err != nil {
+		return nil, err
+	}
+	setItemKeys(item, webhookItem, tenant, map[string]string{
+		pkAttribute:     webhookPartition(tenant, webhook.ID),
+		skAttribute:     webhookSortKey,
+		gsi1PKAttribute: tenantKey(tenant, webhooksPrefix),
+		gsi1SKAttribute: webhookPrefix + webhook.ID,
+	})
+	return item, nil
+}
+
+// marshalDelivery is the item of a delivery of tenant. Only a pending delivery is in the GSI2 partition of the due
+// deliveries.
+func marshalDelivery(tenant string, delivery *models.WebhookDelivery) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(delivery)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{
+		pkAttribute:     webhookPartition(tenant, delivery.WebhookID),
+		skAttribute:     deliveryPrefix + delivery.ID,
+		gsi1PKAttribute: deliveryStatusKey(tenant, delivery.WebhookID, delivery.Status),
+		gsi1SKAttribute: deliveryPrefix + delivery.ID,
+	}
+	if delivery.Status == models.DeliveryPending {
+		keys[gsi2PKAttribute] = pendingKey
+		keys[gsi2SKAttribute] = delivery.NextAttemptAt
+	}
+	setItemKeys(item, deliveryItem, tenant, keys)
+	return item, nil
+}
+
+func unmarshalDeliveries(items []map[string]*dynamodb.AttributeValue) ([]*models.WebhookDelivery, error) {
+	deliveries := []*models.WebhookDelivery{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &deliveries); err != nil {
+		return nil, err
+	}
+	for _, delivery := range deliveries {
+		if delivery.Attempts == nil {
+			delivery.Attempts = []models.WebhookAttempt{}
+		}
+	}
+	return deliveries, nil
+}
+
+func (d *WebhookDynamoRepository) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	result, err := d.db.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       webhookKey(utils.TenantFromContext(ctx), id),
+		TableName: aws.String(d.db.GetTableName()),
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if result.Item == nil {
+		return nil, utils.ErrWebhookNotFound
+	}
+
+	webhook := &models.Webhook{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// ListWebhooks queries the GSI1 partition of the webhooks of the tenant.
+func (d *WebhookDynamoRepository) ListWebhooks(ctx context.Context, query WebhookQuery) (*models.WebhookPage, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(d.db.GetTableName()),
+		IndexName:                 aws.String(gsi1Index),
+		KeyConditionExpression:    aws.String("#G1PK = :webhooks"),
+		ExpressionAttributeNames:  map[string]*string{"#G1PK": aws.String(gsi1PKAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":webhooks": stringValue(tenantKey(utils.TenantFromContext(ctx), webhooksPrefix))},
+		Limit:                     aws.Int64(int64(normalizeLimit(query.Limit))),
+	}
+	items, next, err := d.query(ctx, input, query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	page := &models.WebhookPage{Items: []*models.Webhook{}, NextCursor: next}
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &page.Items); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// query runs input from cursor, and returns the items it reads and the cursor of the next page.
+func (d *WebhookDynamoRepository) query(ctx context.Context, input *dynamodb.QueryInput, cursor string) ([]map[string]*dynamodb.AttributeValue, string, error) {
+	if cursor != "" {
+		startKey, err := decodeDynamoCursor(cursor, aws.StringValue(input.IndexName))
+		if err != nil {
+			return nil, "", err
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	result, err := d.db.Client.QueryWithContext(ctx, input)
+	if err != nil {
+		return nil, "", contextError(ctx, err)
+	}
+	if len(result.LastEvaluatedKey) == 0 {
+		return result.Items, "", nil
+	}
+	next, err := encodeDynamoCursor(result.LastEvaluatedKey)
+	return result.Items, next, err
+}
+
+func (d *WebhookDynamoRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+	item, err := marshalWebhook(utils.TenantFromContext(ctx), webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = d.db.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(d.db.GetTableName()),
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return webhook, nil
+}
+
+// DeleteWebhook deletes the webhook, on the condition that it exists, and then the rest of its item collection.
+func (d *WebhookDynamoRepository) DeleteWebhook(ctx context.Context, id string) error {
+	tenant := utils.TenantFromContext(ctx)
+	_, err := d.db.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key:                      webhookKey(tenant, id),
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return utils.ErrWebhookNotFound
+		}
+		return contextError(ctx, err)
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(d.db.GetTableName()),
+		KeyConditionExpression:    aws.String("#PK = :webhook"),
+		ProjectionExpression:      aws.String("#PK, #SK"),
+		ExpressionAttributeNames:  map[string]*string{"#PK": aws.String(pkAttribute), "#SK": aws.String(skAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":webhook": stringValue(webhookPartition(tenant, id))},
+	}
+	var deleteErr error
+	err = d.db.Client.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, key := range page.Items {
+			_, deleteErr = d.db.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(d.db.GetTableName())})
+			if deleteErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = deleteErr
+	}
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// AddDeliveries puts every delivery in a transaction with a check of its webhook, on the condition that the
+// delivery does not exist yet. A delivery whose condition or check fails is left out.
+func (d *WebhookDynamoRepository) AddDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) error {
+	tenant := utils.TenantFromContext(ctx)
+	for _, delivery := range deliveries {
+		item, err := marshalDelivery(tenant, delivery)
+		if err != nil {
+			return err
+		}
+		_, err = d.db.Client.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				Item:                     item,
+				TableName:                aws.String(d.db.GetTableName()),
+				ConditionExpression:      aws.String("attribute_not_exists(#PK)"),
+				ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+			}},
+			{ConditionCheck: &dynamodb.ConditionCheck{
+				Key:                      webhookKey(tenant, delivery.WebhookID),
+				TableName:                aws.String(d.db.GetTableName()),
+				ConditionExpression:      aws.String("attribute_exists(#PK)"),
+				ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+			}},
+		}})
+		if err != nil && !cancelledOnCondition(err, 0) && !cancelledOnCondition(err, 1) {
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (d *WebhookDynamoRepository) GetDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+	result, err := d.db.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       deliveryKey(utils.TenantFromContext(ctx), webhookID, id),
+		TableName: aws.String(d.db.GetTableName()),
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if result.Item == nil {
+		return nil, utils.ErrDeliveryNotFound
+	}
+
+	deliveries, err := unmarshalDeliveries([]map[string]*dynamodb.AttributeValue{result.Item})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries[0], nil
+}
+
+// ListDeliveries queries the DELIVERY# items of the partition of the webhook, or the GSI1 partition of the
+// deliveries in the status of query.
+func (d *WebhookDynamoRepository) ListDeliveries(ctx context.Context, webhookID string, query WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error) {
+	tenant := utils.TenantFromContext(ctx)
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.db.GetTableName()),
+		KeyConditionExpression: aws.String("#PK = :partition AND begins_with(#SK, :delivery)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#PK": aws.String(pkAttribute),
+			"#SK": aws.String(skAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": stringValue(webhookPartition(tenant, webhookID)),
+			":delivery":  stringValue(deliveryPrefix),
+		},
+		Limit: aws.Int64(int64(normalizeLimit(query.Limit))),
+	}
+	if query.Status != "" {
+		input.IndexName = aws.String(gsi1Index)
+		input.ExpressionAttributeNames["#PK"] = aws.String(gsi1PKAttribute)
+		input.ExpressionAttributeNames["#SK"] = aws.String(gsi1SKAttribute)
+		input.ExpressionAttributeValues[":partition"] = stringValue(deliveryStatusKey(tenant, webhookID, query.Status))
+	}
+
+	items, next, err := d.query(ctx, input, query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := unmarshalDeliveries(items)
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebhookDeliveryPage{Items: deliveries, NextCursor: next}, nil
+}
+
+// UpdateDelivery replaces the stored delivery, on the condition that it exists.
+func (d *WebhookDynamoRepository) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	item, err := marshalDelivery(utils.TenantFromContext(ctx), delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                     item,
+		TableName:                aws.String(d.db.GetTableName()),
+		ConditionExpression:      aws.String("attribute_exists(#PK)"),
+		ExpressionAttributeNames: map[string]*string{"#PK": aws.String(pkAttribute)},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return utils.ErrDeliveryNotFound
+		}
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// DueDeliveries queries the GSI2 partition of the pending deliveries up to now. The index is eventually
+// consistent, so a delivery attempted a moment ago may come back once more.
+func (d *WebhookDynamoRepository) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*models.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = DefaultDeliveryBatchSize
+	}
+	result, err := d.db.Client.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.db.GetTableName()),
+		IndexName:                 aws.String(gsi2Index),
+		KeyConditionExpression:    aws.String("#G2PK = :pending AND #G2SK <= :now"),
+		ExpressionAttributeNames:  map[string]*string{"#G2PK": aws.String(gsi2PKAttribute), "#G2SK": aws.String(gsi2SKAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pending": stringValue(pendingKey), ":now": stringValue(deliveryTime(now))},
+		Limit:                     aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return unmarshalDeliveries(result.Items)
+}
@@ -0,0 +1,149 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"sync"
+)
+
+// webhookRecord is one entry of the write-ahead log, in the webhooks of Tenant: the webhook stored under ID, or its
+// deletion when Webhook is nil, or else the deliveries stored as they are.
+type webhookRecord struct {
+	Tenant     string                    `json:"tenant"`
+	ID         string                    `json:"id,omitempty"`
+	Webhook    *models.Webhook           `json:"webhook,omitempty"`
+	Deliveries []*models.WebhookDelivery `json:"deliveries,omitempty"`
+}
+
+// WebhookFileRepository is a WebhookMemoryRepository that survives restarts. A write is appended to the
+// write-ahead log of a db.FileStore before it is applied in memory, every attempt of a delivery included. Writes
+// take turns, so they are applied in the order of the log.
+type WebhookFileRepository struct {
+	*WebhookMemoryRepository
+	store   *db.FileStore
+	writeMu sync.Mutex
+}
+
+// NewWebhookFileRepository loads the webhooks of store into memory.
+func NewWebhookFileRepository(store *db.FileStore) (*WebhookFileRepository, error) {
+	r := &WebhookFileRepository{
+		WebhookMemoryRepository: NewWebhookMemoryRepository(),
+		store:                   store,
+	}
+
+	restore := func(snapshot []byte) error {
+		var records []webhookRecord
+		if err := json.Unmarshal(snapshot, &records); err != nil {
+			return err
+		}
+		for _, record := range records {
+			r.apply(record)
+		}
+		return nil
+	}
+	replay := func(data []byte) error {
+		var record webhookRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		r.apply(record)
+		return nil
+	}
+	if err := store.Load(restore, replay); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *WebhookFileRepository) apply(record webhookRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case record.Webhook != nil:
+		r.putWebhook(record.Tenant, record.Webhook)
+	case record.ID != "":
+		delete(r.tenants[record.Tenant], record.ID)
+	}
+	for _, delivery := range record.Deliveries {
+		r.putDelivery(record.Tenant, delivery)
+	}
+}
+
+func (r *WebhookFileRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if err := r.write(ctx, webhookRecord{Tenant: utils.TenantFromContext(ctx), ID: webhook.ID, Webhook: webhook}); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (r *WebhookFileRepository) DeleteWebhook(ctx context.Context, id string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if _, err := r.GetWebhook(ctx, id); err != nil {
+		return err
+	}
+	return r.write(ctx, webhookRecord{Tenant: utils.TenantFromContext(ctx), ID: id})
+}
+
+func (r *WebhookFileRepository) AddDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	record := webhookRecord{Tenant: utils.TenantFromContext(ctx)}
+	for _, delivery := range deliveries {
+		if _, err := r.GetDelivery(ctx, delivery.WebhookID, delivery.ID); err == nil {
+			continue
+		}
+		if _, err := r.GetWebhook(ctx, delivery.WebhookID); err == nil {
+			record.Deliveries = append(record.Deliveries, delivery)
+		}
+	}
+	if len(record.Deliveries) == 0 {
+		return ctx.Err()
+	}
+	return r.write(ctx, record)
+}
+
+func (r *WebhookFileRepository) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if _, err := r.GetDelivery(ctx, delivery.WebhookID, delivery.ID); err != nil {
+		return err
+	}
+	return r.write(ctx, webhookRecord{Tenant: utils.TenantFromContext(ctx), Deliveries: []*models.WebhookDelivery{delivery}})
+}
+
+func (r *WebhookFileRepository) write(ctx context.Context, record webhookRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := r.store.Append(record); err != nil {
+		return err
+	}
+	r.apply(record)
+
+	if r.store.NeedsSnapshot() {
+		r.mu.RLock()
+		records := []webhookRecord{}
+		for tenant, webhooks := range r.tenants {
+			for id, entry := range webhooks {
+				record := webhookRecord{Tenant: tenant, ID: id, Webhook: entry.webhook}
+				for _, delivery := range entry.deliveries {
+					record.Deliveries = append(record.Deliveries, delivery)
+				}
+				records = append(records, record)
+			}
+		}
+		err := r.store.Snapshot(records)
+		r.mu.RUnlock()
+		if err != nil {
+			log.Printf("failed to snapshot the webhooks: %v", err)
+		}
+	}
+	return nil
+}
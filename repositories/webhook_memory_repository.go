@@ -0,0 +1,254 @@
+package repositories
+
+import (
+	"cmp"
+	"context"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookEntry is a webhook and its deliveries keyed by ID.
+type webhookEntry struct {
+	webhook    *models.Webhook
+	deliveries map[string]*models.WebhookDelivery
+}
+
+// WebhookMemoryRepository is safe for concurrent use, and stores and hands out copies of the webhooks and their
+// deliveries.
+type WebhookMemoryRepository struct {
+	mu sync.RWMutex
+	// tenants holds the webhooks of each tenant keyed by ID.
+	tenants map[string]map[string]*webhookEntry
+}
+
+func NewWebhookMemoryRepository() *WebhookMemoryRepository {
+	return &WebhookMemoryRepository{
+		tenants: make(map[string]map[string]*webhookEntry),
+	}
+}
+
+func copyWebhook(webhook *models.Webhook) *models.Webhook {
+	c := *webhook
+	c.Events = slices.Clone(webhook.Events)
+	return &c
+}
+
+func copyWebhookDelivery(delivery *models.WebhookDelivery) *models.WebhookDelivery {
+	c := *delivery
+	c.Event.Data = slices.Clone(delivery.Event.Data)
+	c.Attempts = slices.Clone(delivery.Attempts)
+	return &c
+}
+
+// entry returns the webhook id of tenant, nil when it has none. The caller holds the lock.
+func (r *WebhookMemoryRepository) entry(tenant, id string) *webhookEntry {
+	return r.tenants[tenant][id]
+}
+
+// putWebhook stores a copy of webhook in tenant, and keeps the deliveries of the webhook it replaces. The caller
+// holds the write lock.
+func (r *WebhookMemoryRepository) putWebhook(tenant string, webhook *models.Webhook) {
+	webhooks, ok := r.tenants[tenant]
+	if !ok {
+		webhooks = make(map[string]*webhookEntry)
+		r.tenants[tenant] = webhooks
+	}
+	entry, ok := webhooks[webhook.ID]
+	if !ok {
+		entry = &webhookEntry{deliveries: make(map[string]*models.WebhookDelivery)}
+		webhooks[webhook.ID] = entry
+	}
+	entry.webhook = copyWebhook(webhook)
+}
+
+// putDelivery stores a copy of delivery in tenant, unless its webhook is gone. The caller holds the write lock.
+func (r *WebhookMemoryRepository) putDelivery(tenant string, delivery *models.WebhookDelivery) {
+	if entry := r.entry(tenant, delivery.WebhookID); entry != nil {
+		entry.deliveries[delivery.ID] = copyWebhookDelivery(delivery)
+	}
+}
+
+func (r *WebhookMemoryRepository) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry := r.entry(utils.TenantFromContext(ctx), id)
+	if entry == nil {
+		return nil, utils.ErrWebhookNotFound
+	}
+	return copyWebhook(entry.webhook), nil
+}
+
+func (r *WebhookMemoryRepository) ListWebhooks(ctx context.Context, query WebhookQuery) (*models.WebhookPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var after webhookCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.RLock()
+	var matched []*models.Webhook
+	for id, entry := range r.tenants[utils.TenantFromContext(ctx)] {
+		if id > after.ID {
+			matched = append(matched, copyWebhook(entry.webhook))
+		}
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(matched, func(a, b *models.Webhook) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	limit := normalizeLimit(query.Limit)
+	page := &models.WebhookPage{Items: []*models.Webhook{}}
+	page.Items = append(page.Items, matched[:min(limit, len(matched))]...)
+	if len(matched) > limit {
+		cursor, err := encodeCursor(webhookCursor{ID: matched[limit-1].ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+func (r *WebhookMemoryRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.putWebhook(utils.TenantFromContext(ctx), webhook)
+	return webhook, nil
+}
+
+func (r *WebhookMemoryRepository) DeleteWebhook(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenant := utils.TenantFromContext(ctx)
+	if r.entry(tenant, id) == nil {
+		return utils.ErrWebhookNotFound
+	}
+	delete(r.tenants[tenant], id)
+	return nil
+}
+
+// AddDeliveries skips the deliveries of the webhooks that were deleted in the meantime.
+func (r *WebhookMemoryRepository) AddDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenant := utils.TenantFromContext(ctx)
+	for _, delivery := range deliveries {
+		if entry := r.entry(tenant, delivery.WebhookID); entry != nil && entry.deliveries[delivery.ID] == nil {
+			r.putDelivery(tenant, delivery)
+		}
+	}
+	return nil
+}
+
+func (r *WebhookMemoryRepository) GetDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry := r.entry(utils.TenantFromContext(ctx), webhookID)
+	if entry == nil || entry.deliveries[id] == nil {
+		return nil, utils.ErrDeliveryNotFound
+	}
+	return copyWebhookDelivery(entry.deliveries[id]), nil
+}
+
+func (r *WebhookMemoryRepository) ListDeliveries(ctx context.Context, webhookID string, query WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var after webhookCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.RLock()
+	var matched []*models.WebhookDelivery
+	if entry := r.entry(utils.TenantFromContext(ctx), webhookID); entry != nil {
+		for id, delivery := range entry.deliveries {
+			if id > after.ID && (query.Status == "" || delivery.Status == query.Status) {
+				matched = append(matched, copyWebhookDelivery(delivery))
+			}
+		}
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(matched, func(a, b *models.WebhookDelivery) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	limit := normalizeLimit(query.Limit)
+	page := &models.WebhookDeliveryPage{Items: []*models.WebhookDelivery{}}
+	page.Items = append(page.Items, matched[:min(limit, len(matched))]...)
+	if len(matched) > limit {
+		cursor, err := encodeCursor(webhookCursor{ID: matched[limit-1].ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+func (r *WebhookMemoryRepository) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenant := utils.TenantFromContext(ctx)
+	if entry := r.entry(tenant, delivery.WebhookID); entry == nil || entry.deliveries[delivery.ID] == nil {
+		return utils.ErrDeliveryNotFound
+	}
+	r.putDelivery(tenant, delivery)
+	return nil
+}
+
+func (r *WebhookMemoryRepository) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*models.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultDeliveryBatchSize
+	}
+	due := deliveryTime(now)
+
+	r.mu.RLock()
+	matched := []*models.WebhookDelivery{}
+	for _, webhooks := range r.tenants {
+		for _, entry := range webhooks {
+			for _, delivery := range entry.deliveries {
+				if delivery.Status == models.DeliveryPending && delivery.NextAttemptAt <= due {
+					matched = append(matched, copyWebhookDelivery(delivery))
+				}
+			}
+		}
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(matched, func(a, b *models.WebhookDelivery) int {
+		return cmp.Or(strings.Compare(a.NextAttemptAt, b.NextAttemptAt), strings.Compare(a.ID, b.ID))
+	})
+	return matched[:min(limit, len(matched))], nil
+}
@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"context"
+	"simple-api-go/models"
+	"time"
+)
+
+// DefaultDeliveryBatchSize is how many deliveries DueDeliveries returns when it is asked for none in particular.
+const DefaultDeliveryBatchSize = 100
+
+// WebhookQuery pages through the webhooks of a tenant in ID order.
+type WebhookQuery struct {
+	Limit  int
+	Cursor string
+}
+
+// WebhookDeliveryQuery pages through the deliveries of a webhook in ID order, only the ones in Status when it is
+// set.
+type WebhookDeliveryQuery struct {
+	Status string
+	Limit  int
+	Cursor string
+}
+
+// WebhookRepository stores the webhooks of every tenant and their deliveries. Every method is scoped to the tenant
+// of ctx but DueDeliveries, which reads the deliveries of every tenant.
+type WebhookRepository interface {
+	GetWebhook(ctx context.Context, id string) (*models.Webhook, error)
+	ListWebhooks(ctx context.Context, query WebhookQuery) (*models.WebhookPage, error)
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error)
+	// DeleteWebhook deletes the webhook and its deliveries.
+	DeleteWebhook(ctx context.Context, id string) error
+
+	// AddDeliveries stores the deliveries it does not have yet, and leaves the ones it has as they are, so an event
+	// delivered again to the subscribers never resets its deliveries.
+	AddDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) error
+	GetDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error)
+	ListDeliveries(ctx context.Context, webhookID string, query WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error)
+	// UpdateDelivery replaces a stored delivery, or fails with utils.ErrDeliveryNotFound.
+	UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error
+	// DueDeliveries returns up to limit pending deliveries of every tenant whose next attempt is at now or before,
+	// the most overdue first.
+	DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*models.WebhookDelivery, error)
+}
+
+// deliveryTime formats the time of a delivery so that the times order lexicographically, like the events.
+func deliveryTime(t time.Time) string {
+	return t.UTC().Format(models.EventTimeFormat)
+}
+
+type webhookCursor struct {
+	ID string `json:"id"`
+}
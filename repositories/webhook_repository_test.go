@@ -0,0 +1,205 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/db/sqltest"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestDelivery(webhookID, eventID, nextAttemptAt string) *models.WebhookDelivery {
+	return &models.WebhookDelivery{
+		ID:            eventID,
+		WebhookID:     webhookID,
+		Event:         models.Event{ID: eventID, Type: models.EventDeviceCreated, Tenant: "acme", Data: []byte(`{"device":{}}`)},
+		Status:        models.DeliveryPending,
+		Attempts:      []models.WebhookAttempt{},
+		NextAttemptAt: nextAttemptAt,
+	}
+}
+
+// deliveryIDs lists the deliveries as "webhook/id".
+func deliveryIDs(deliveries []*models.WebhookDelivery) []string {
+	ids := []string{}
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.WebhookID+"/"+delivery.ID)
+	}
+	return ids
+}
+
+func TestWebhookRepository(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) WebhookRepository
+	}{
+		{"Memory", func(t *testing.T) WebhookRepository { return NewWebhookMemoryRepository() }},
+		{"File", func(t *testing.T) WebhookRepository {
+			repo, err := NewWebhookFileRepository(newTestFileStore(t, t.TempDir(), "webhooks"))
+			if err != nil {
+				t.Fatalf("NewWebhookFileRepository() error = %v", err)
+			}
+			return repo
+		}},
+		{"SQL", func(t *testing.T) WebhookRepository { return NewSQLWebhookRepository(newTestSQLInstance(t)) }},
+		{"Postgres", func(t *testing.T) WebhookRepository { return NewSQLWebhookRepository(sqltest.OpenPostgres(t)) }},
+		{"DynamoDB", func(t *testing.T) WebhookRepository {
+			_, instance := newFakeDynamoInstance(t, dynamoTableInput("iotwatcher"))
+			return NewDynamoWebhookRepository(instance)
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			r := backend.open(t)
+			acme := utils.WithTenant(context.Background(), "acme")
+			globex := utils.WithTenant(context.Background(), "globex")
+
+			for _, id := range []string{"w1", "w2", "w3"} {
+				webhook := &models.Webhook{ID: id, URL: "https://mes.example.com/" + id, Events: []string{models.EventStateChanged}, Secret: "secret", CreatedAt: "2024-03-24T10:00:00.000000000Z"}
+				if _, err := r.CreateWebhook(acme, webhook); err != nil {
+					t.Fatalf("CreateWebhook() error = %v", err)
+				}
+			}
+			if _, err := r.CreateWebhook(globex, &models.Webhook{ID: "w1", URL: "https://globex.example.com", Secret: "secret", CreatedAt: "2024-03-24T10:00:00.000000000Z"}); err != nil {
+				t.Fatalf("CreateWebhook() error = %v", err)
+			}
+
+			webhook, err := r.GetWebhook(acme, "w1")
+			if err != nil || webhook.URL != "https://mes.example.com/w1" || !slices.Equal(webhook.Events, []string{models.EventStateChanged}) || webhook.Secret != "secret" {
+				t.Errorf("GetWebhook() got = %+v, %v, want the webhook of acme", webhook, err)
+			}
+			if _, err := r.GetWebhook(globex, "w2"); !errors.Is(err, utils.ErrWebhookNotFound) {
+				t.Errorf("GetWebhook() error = %v, want %v", err, utils.ErrWebhookNotFound)
+			}
+
+			var ids []string
+			query := WebhookQuery{Limit: 2}
+			for pages := 0; pages < 5; pages++ {
+				page, err := r.ListWebhooks(acme, query)
+				if err != nil {
+					t.Fatalf("ListWebhooks() error = %v", err)
+				}
+				for _, webhook := range page.Items {
+					ids = append(ids, webhook.ID)
+				}
+				if query.Cursor = page.NextCursor; query.Cursor == "" {
+					break
+				}
+			}
+			if want := []string{"w1", "w2", "w3"}; !slices.Equal(ids, want) {
+				t.Errorf("ListWebhooks() got = %v, want %v", ids, want)
+			}
+
+			// A delivery is added once, and never for a webhook the tenant does not have.
+			deliveries := []*models.WebhookDelivery{
+				newTestDelivery("w1", "e1", "2024-03-24T10:00:02.000000000Z"),
+				newTestDelivery("w2", "e1", "2024-03-24T10:00:01.000000000Z"),
+				newTestDelivery("w9", "e1", "2024-03-24T10:00:00.000000000Z"),
+			}
+			if err := r.AddDeliveries(acme, deliveries); err != nil {
+				t.Fatalf("AddDeliveries() error = %v", err)
+			}
+			if err := r.AddDeliveries(acme, []*models.WebhookDelivery{newTestDelivery("w1", "e2", "2024-03-24T10:00:03.000000000Z")}); err != nil {
+				t.Fatalf("AddDeliveries() error = %v", err)
+			}
+			if err := r.AddDeliveries(globex, []*models.WebhookDelivery{newTestDelivery("w1", "e3", "2024-03-24T10:00:00.000000000Z")}); err != nil {
+				t.Fatalf("AddDeliveries() error = %v", err)
+			}
+			delivered := newTestDelivery("w1", "e1", "")
+			delivered.Status = models.DeliveryDelivered
+			delivered.Attempts = []models.WebhookAttempt{{At: "2024-03-24T10:00:01.000000000Z", StatusCode: 500}, {At: "2024-03-24T10:00:02.000000000Z", StatusCode: 204}}
+			delivered.FailedAttempts = 1
+			if err := r.UpdateDelivery(acme, delivered); err != nil {
+				t.Fatalf("UpdateDelivery() error = %v", err)
+			}
+			if err := r.AddDeliveries(acme, []*models.WebhookDelivery{newTestDelivery("w1", "e1", "2024-03-24T10:00:00.000000000Z")}); err != nil {
+				t.Fatalf("AddDeliveries() error = %v", err)
+			}
+			if err := r.UpdateDelivery(acme, newTestDelivery("w3", "e1", "2024-03-24T10:00:00.000000000Z")); !errors.Is(err, utils.ErrDeliveryNotFound) {
+				t.Errorf("UpdateDelivery() error = %v, want %v", err, utils.ErrDeliveryNotFound)
+			}
+
+			got, err := r.GetDelivery(acme, "w1", "e1")
+			if err != nil || got.Status != models.DeliveryDelivered || len(got.Attempts) != 2 || got.Attempts[1].StatusCode != 204 || got.FailedAttempts != 1 || string(got.Event.Data) != `{"device":{}}` {
+				t.Errorf("GetDelivery() got = %+v, %v, want the delivered delivery", got, err)
+			}
+			if _, err := r.GetDelivery(acme, "w9", "e1"); !errors.Is(err, utils.ErrDeliveryNotFound) {
+				t.Errorf("GetDelivery() error = %v, want %v", err, utils.ErrDeliveryNotFound)
+			}
+
+			page, err := r.ListDeliveries(acme, "w1", WebhookDeliveryQuery{})
+			if want := []string{"w1/e1", "w1/e2"}; err != nil || !slices.Equal(deliveryIDs(page.Items), want) {
+				t.Errorf("ListDeliveries() got = %v, %v, want %v", deliveryIDs(page.Items), err, want)
+			}
+			page, err = r.ListDeliveries(acme, "w1", WebhookDeliveryQuery{Status: models.DeliveryPending})
+			if want := []string{"w1/e2"}; err != nil || !slices.Equal(deliveryIDs(page.Items), want) {
+				t.Errorf("ListDeliveries() got = %v, %v, want %v", deliveryIDs(page.Items), err, want)
+			}
+
+			// The due deliveries of every tenant, the most overdue first.
+			due, err := r.DueDeliveries(context.Background(), time.Date(2024, 3, 24, 10, 0, 2, 0, time.UTC), 0)
+			if want := []string{"w1/e3", "w2/e1"}; err != nil || !slices.Equal(deliveryIDs(due), want) {
+				t.Errorf("DueDeliveries() got = %v, %v, want %v", deliveryIDs(due), err, want)
+			}
+			due, err = r.DueDeliveries(context.Background(), time.Date(2024, 3, 24, 11, 0, 0, 0, time.UTC), 1)
+			if want := []string{"w1/e3"}; err != nil || !slices.Equal(deliveryIDs(due), want) {
+				t.Errorf("DueDeliveries() got = %v, %v, want %v", deliveryIDs(due), err, want)
+			}
+
+			// Deleting a webhook deletes its deliveries.
+			if err := r.DeleteWebhook(acme, "w1"); err != nil {
+				t.Fatalf("DeleteWebhook() error = %v", err)
+			}
+			if err := r.DeleteWebhook(acme, "w1"); !errors.Is(err, utils.ErrWebhookNotFound) {
+				t.Errorf("DeleteWebhook() error = %v, want %v", err, utils.ErrWebhookNotFound)
+			}
+			if _, err := r.GetDelivery(acme, "w1", "e2"); !errors.Is(err, utils.ErrDeliveryNotFound) {
+				t.Errorf("GetDelivery() error = %v, want %v", err, utils.ErrDeliveryNotFound)
+			}
+			due, err = r.DueDeliveries(context.Background(), time.Date(2024, 3, 24, 11, 0, 0, 0, time.UTC), 0)
+			if want := []string{"w1/e3", "w2/e1"}; err != nil || !slices.Equal(deliveryIDs(due), want) {
+				t.Errorf("DueDeliveries() got = %v, %v, want %v", deliveryIDs(due), err, want)
+			}
+		})
+	}
+}
+
+func TestWebhookFileRepository_Restart(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *WebhookFileRepository {
+		repo, err := NewWebhookFileRepository(newTestFileStore(t, dir, "webhooks"))
+		if err != nil {
+			t.Fatalf("NewWebhookFileRepository() error = %v", err)
+		}
+		return repo
+	}
+
+	r := open()
+	r.store.SetSnapshotEvery(2)
+	ctx := utils.WithTenant(context.Background(), "acme")
+	for _, id := range []string{"w1", "w2"} {
+		if _, err := r.CreateWebhook(ctx, &models.Webhook{ID: id, URL: "https://mes.example.com"}); err != nil {
+			t.Fatalf("CreateWebhook() error = %v", err)
+		}
+	}
+	if err := r.AddDeliveries(ctx, []*models.WebhookDelivery{newTestDelivery("w1", "e1", "2024-03-24T10:00:00.000000000Z"), newTestDelivery("w2", "e1", "2024-03-24T10:00:00.000000000Z")}); err != nil {
+		t.Fatalf("AddDeliveries() error = %v", err)
+	}
+	if err := r.DeleteWebhook(ctx, "w2"); err != nil {
+		t.Fatalf("DeleteWebhook() error = %v", err)
+	}
+
+	// The second instance reads the webhooks of the snapshot and of the log.
+	r = open()
+	page, err := r.ListWebhooks(ctx, WebhookQuery{})
+	if err != nil || len(page.Items) != 1 || page.Items[0].ID != "w1" {
+		t.Fatalf("ListWebhooks() got = %v, %v, want w1", page, err)
+	}
+	if _, err := r.GetDelivery(ctx, "w1", "e1"); err != nil {
+		t.Errorf("GetDelivery() error = %v", err)
+	}
+}
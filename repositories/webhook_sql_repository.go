@@ -0,0 +1,260 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"simple-api-go/db"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"time"
+)
+
+// The columns of the webhooks and webhook_deliveries tables, in the order scanWebhook and scanWebhookDelivery read
+// them.
+const (
+	webhookColumns         = "id, url, events, secret, created_at"
+	webhookDeliveryColumns = "webhook_id, id, status, next_attempt_at, event, attempts, failed_attempts"
+)
+
+// WebhookSQLRepository stores the webhooks in the webhooks table, and their deliveries in the webhook_deliveries
+// table, with the event and the attempts of a delivery as JSON.
+type WebhookSQLRepository struct {
+	db *db.SQLInstance
+}
+
+func NewSQLWebhookRepository(db *db.SQLInstance) *WebhookSQLRepository {
+	return &WebhookSQLRepository{
+		db: db,
+	}
+}
+
+func scanWebhook(row rowScanner) (*models.Webhook, error) {
+	webhook := &models.Webhook{}
+	var events string
+	if err := row.Scan(&webhook.ID, &webhook.URL, &events, &webhook.Secret, &webhook.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(events), &webhook.Events); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func scanWebhookDelivery(row rowScanner) (*models.WebhookDelivery, error) {
+	delivery := &models.WebhookDelivery{}
+	var event, attempts string
+	if err := row.Scan(&delivery.WebhookID, &delivery.ID, &delivery.Status, &delivery.NextAttemptAt, &event, &attempts, &delivery.FailedAttempts); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(event), &delivery.Event); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(attempts), &delivery.Attempts); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// deliveryJSON is the event and the attempts of delivery, as the webhook_deliveries table stores them.
+func deliveryJSON(delivery *models.WebhookDelivery) (event, attempts string, err error) {
+	eventData, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return "", "", err
+	}
+	attemptsData, err := json.Marshal(delivery.Attempts)
+	if err != nil {
+		return "", "", err
+	}
+	return string(eventData), string(attemptsData), nil
+}
+
+func (r *WebhookSQLRepository) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	row := r.db.DB.QueryRowContext(ctx, r.db.Rebind("SELECT "+webhookColumns+" FROM webhooks WHERE tenant = ? AND id = ?"),
+		utils.TenantFromContext(ctx), id)
+	webhook, err := scanWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+func (r *WebhookSQLRepository) ListWebhooks(ctx context.Context, query WebhookQuery) (*models.WebhookPage, error) {
+	var after webhookCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := normalizeLimit(query.Limit)
+	rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind("SELECT "+webhookColumns+" FROM webhooks WHERE tenant = ? AND id > ? ORDER BY id LIMIT ?"),
+		utils.TenantFromContext(ctx), after.ID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &models.WebhookPage{Items: []*models.Webhook{}}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		cursor, err := encodeCursor(webhookCursor{ID: page.Items[limit-1].ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+func (r *WebhookSQLRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+	events, err := json.Marshal(append([]string{}, webhook.Events...))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = r.db.DB.ExecContext(ctx, r.db.Rebind("INSERT INTO webhooks (tenant, "+webhookColumns+") VALUES (?, ?, ?, ?, ?, ?)"),
+		utils.TenantFromContext(ctx), webhook.ID, webhook.URL, string(events), webhook.Secret, webhook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// DeleteWebhook deletes the webhook and its deliveries in one transaction.
+func (r *WebhookSQLRepository) DeleteWebhook(ctx context.Context, id string) error {
+	tenant := utils.TenantFromContext(ctx)
+	return inTransaction(ctx, r.db, true, func(tx sqlExecutor) error {
+		result, err := tx.ExecContext(ctx, r.db.Rebind("DELETE FROM webhooks WHERE tenant = ? AND id = ?"), tenant, id)
+		if err != nil {
+			return err
+		}
+		if err := rowAffected(result, utils.ErrWebhookNotFound); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, r.db.Rebind("DELETE FROM webhook_deliveries WHERE tenant = ? AND webhook_id = ?"), tenant, id)
+		return err
+	})
+}
+
+func (r *WebhookSQLRepository) AddDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) error {
+	tenant := utils.TenantFromContext(ctx)
+	return inTransaction(ctx, r.db, len(deliveries) > 1, func(tx sqlExecutor) error {
+		for _, delivery := range deliveries {
+			event, attempts, err := deliveryJSON(delivery)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, r.db.Rebind(`INSERT INTO webhook_deliveries (tenant, `+webhookDeliveryColumns+`)
+SELECT ?, ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM webhooks WHERE tenant = ? AND id = ?)
+ON CONFLICT (tenant, webhook_id, id) DO NOTHING`),
+				tenant, delivery.WebhookID, delivery.ID, delivery.Status, delivery.NextAttemptAt, event, attempts, delivery.FailedAttempts, tenant, delivery.WebhookID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *WebhookSQLRepository) GetDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+	row := r.db.DB.QueryRowContext(ctx, r.db.Rebind("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE tenant = ? AND webhook_id = ? AND id = ?"),
+		utils.TenantFromContext(ctx), webhookID, id)
+	delivery, err := scanWebhookDelivery(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.ErrDeliveryNotFound
+	}
+	return delivery, err
+}
+
+func (r *WebhookSQLRepository) ListDeliveries(ctx context.Context, webhookID string, query WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error) {
+	var after webhookCursor
+	if query.Cursor != "" {
+		if err := decodeCursor(query.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := normalizeLimit(query.Limit)
+	where := "tenant = ? AND webhook_id = ? AND id > ?"
+	args := []any{utils.TenantFromContext(ctx), webhookID, after.ID}
+	if query.Status != "" {
+		where += " AND status = ?"
+		args = append(args, query.Status)
+	}
+	rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE "+where+" ORDER BY id LIMIT ?"),
+		append(args, limit+1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &models.WebhookDeliveryPage{Items: []*models.WebhookDelivery{}}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		cursor, err := encodeCursor(webhookCursor{ID: page.Items[limit-1].ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+func (r *WebhookSQLRepository) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	event, attempts, err := deliveryJSON(delivery)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.DB.ExecContext(ctx, r.db.Rebind("UPDATE webhook_deliveries SET status = ?, next_attempt_at = ?, event = ?, attempts = ?, failed_attempts = ? WHERE tenant = ? AND webhook_id = ? AND id = ?"),
+		delivery.Status, delivery.NextAttemptAt, event, attempts, delivery.FailedAttempts, utils.TenantFromContext(ctx), delivery.WebhookID, delivery.ID)
+	if err != nil {
+		return err
+	}
+	return rowAffected(result, utils.ErrDeliveryNotFound)
+}
+
+func (r *WebhookSQLRepository) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*models.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = DefaultDeliveryBatchSize
+	}
+	rows, err := r.db.DB.QueryContext(ctx, r.db.Rebind("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?"),
+		models.DeliveryPending, deliveryTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*models.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
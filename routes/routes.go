@@ -3,15 +3,311 @@ package routes
 import (
 	"net/http"
 	"simple-api-go/handlers"
+	"simple-api-go/models"
+	"simple-api-go/openapi"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"strconv"
 )
 
-func SetupRoutes(handler *handlers.DeviceHandler) *http.ServeMux {
+// Route is an endpoint of the API: its handler, and what the OpenAPI document tells about it.
+type Route struct {
+	openapi.Endpoint
+	Handler http.HandlerFunc
+	// Admin routes take the admin token instead of a tenant.
+	Admin bool
+	// Validated routes check their requests against the OpenAPI document first, when SetupRoutes validates.
+	Validated bool
+}
+
+// SetupRoutes serves the API of the tenant that tenantHandler resolves for each request, the admin endpoints
+// across tenants, and the OpenAPI document of both at /openapi.json with its Redoc page at /docs. With validate the
+// requests of the device endpoints are checked against the document before they reach the handler. No handler
+// reads more than utils.MaxBodySize of a body.
+func SetupRoutes(handler *handlers.DeviceHandler, logHandler *handlers.DeviceStateLogHandler, modelHandler *handlers.DeviceModelHandler, tenantHandler *handlers.TenantHandler, webhookHandler *handlers.WebhookHandler, validate bool) *http.ServeMux {
+	table := Routes(handler, logHandler, modelHandler, tenantHandler, webhookHandler)
+	doc := OpenAPI(table)
+	validator := openapi.NewValidator(doc)
+
 	router := http.NewServeMux()
+	for _, route := range table {
+		var next http.Handler = limitBody(route.Handler)
+		if validate && route.Validated {
+			next = validator.Validate(route.Pattern, next)
+		}
+		if !route.Admin {
+			next = tenantHandler.Resolve(next)
+		}
+		router.Handle(route.Pattern, next)
+	}
 
-	router.HandleFunc("POST /api/devices", handler.CreateDevice)
-	router.HandleFunc("GET /api/devices/{id}", handler.GetDevice)
-	router.HandleFunc("PUT /api/devices/{id}", handler.UpdateDevice)
-	router.HandleFunc("DELETE /api/devices/{id}", handler.DeleteDevice)
+	router.Handle("GET /openapi.json", doc)
+	router.HandleFunc("GET /docs", openapi.ServeDocs)
 
 	return router
 }
+
+// limitBody makes the body of a request fail to read past utils.MaxBodySize, so a handler decoding it gives up.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, utils.MaxBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OpenAPI is the document of the routes of table.
+func OpenAPI(table []Route) *openapi.Document {
+	endpoints := make([]openapi.Endpoint, len(table))
+	for i, route := range table {
+		endpoints[i] = route.Endpoint
+		if route.Admin {
+			endpoints[i].Security = []openapi.SecurityRequirement{{"adminToken": {}}}
+		} else {
+			endpoints[i].Params = append([]*openapi.Parameter{tenantParam}, endpoints[i].Params...)
+		}
+	}
+
+	doc := openapi.Build(openapi.Info{
+		Title:       "IoTWatcher",
+		Version:     "1.0.0",
+		Description: "Tracks the health of the IoT devices of a smart factory: the devices, their models, the history of their states and the webhooks of their events.",
+	}, endpoints)
+	doc.Components.SecuritySchemes = map[string]*openapi.SecurityScheme{
+		"tenantToken": {Type: "http", Scheme: "bearer", Description: "A token of TENANT_TOKENS, which acts for its tenant."},
+		"adminToken":  {Type: "http", Scheme: "bearer", Description: "ADMIN_TOKEN, for the admin endpoints."},
+	}
+	// Without TENANT_TOKENS the tenant comes from X-Tenant-ID alone.
+	doc.Security = []openapi.SecurityRequirement{{}, {"tenantToken": {}}}
+	return doc
+}
+
+// The parameters that several routes share.
+var (
+	tenantParam = &openapi.Parameter{
+		Name: handlers.TenantHeader, In: openapi.InHeader,
+		Description: "The tenant of the request, DEFAULT_TENANT when left out. With a tenant token it can only repeat the tenant of the token, and without TRUST_TENANT_HEADER it can only name DEFAULT_TENANT.",
+		Schema:      &openapi.Schema{Type: "string", Pattern: utils.TenantPattern},
+	}
+	limitParam = &openapi.Parameter{
+		Name: "limit", In: openapi.InQuery,
+		Description: "The size of the page.",
+		Schema:      &openapi.Schema{Type: "integer", Minimum: bound(1), Maximum: bound(repositories.MaxListLimit)},
+	}
+	cursorParam = &openapi.Parameter{
+		Name: "cursor", In: openapi.InQuery,
+		Description: "The nextCursor of the previous page.",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	ifMatchParam = &openapi.Parameter{
+		Name: "If-Match", In: openapi.InHeader,
+		Description: `The ETag of the version of the device the request expects, e.g. "3". Left out or * to skip the check.`,
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	operatorParam = &openapi.Parameter{
+		Name: "X-Operator", In: openapi.InHeader,
+		Description: "Who deletes the device, kept as its deletedBy.",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	deviceIDParam = &openapi.Parameter{
+		Name: "id", In: openapi.InPath, Required: true,
+		Description: "The ID of the device without its /devices/ prefix.",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+)
+
+func bound(value int64) *int64 {
+	return &value
+}
+
+// deviceListParams are the parameters of the device listings: a filter on every field, as field=value (exact),
+// field=value* (prefix) or field~=value (contains), and the sort fields.
+func deviceListParams() []*openapi.Parameter {
+	params := []*openapi.Parameter{limitParam, cursorParam, {
+		Name: "sort", In: openapi.InQuery,
+		Description: "Comma separated fields to sort by, each prefixed with - for descending order, e.g. -serial,name.",
+		Schema:      &openapi.Schema{Type: "string"},
+	}}
+	for _, field := range repositories.DeviceFields {
+		params = append(params,
+			&openapi.Parameter{Name: field, In: openapi.InQuery, Description: "Devices whose " + field + " is the value, or starts with it when it ends with *.", Schema: &openapi.Schema{Type: "string"}},
+			&openapi.Parameter{Name: field + "~", In: openapi.InQuery, Description: "Devices whose " + field + " contains the value.", Schema: &openapi.Schema{Type: "string"}},
+		)
+	}
+	return params
+}
+
+// Routes is the route table of the API, which SetupRoutes serves and OpenAPI describes.
+func Routes(handler *handlers.DeviceHandler, logHandler *handlers.DeviceStateLogHandler, modelHandler *handlers.DeviceModelHandler, tenantHandler *handlers.TenantHandler, webhookHandler *handlers.WebhookHandler) []Route {
+	return []Route{
+		{Handler: handler.ListDevices, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/devices", OperationID: "listDevices", Tag: "devices",
+			Summary: "List the devices, page by page",
+			Params:  deviceListParams(), Responses: map[int]any{http.StatusOK: models.DevicePage{}}, Errors: []int{http.StatusBadRequest},
+		}},
+		{Handler: handler.CreateDevice, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/devices", OperationID: "createDevice", Tag: "devices",
+			Summary:     "Create a device",
+			Description: "The device model must exist. The response carries the version of the device as its ETag.",
+			Body:        models.Device{}, Responses: map[int]any{http.StatusCreated: models.Device{}}, Errors: []int{http.StatusBadRequest, http.StatusConflict},
+		}},
+		{Handler: handler.BatchDevices, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/devices:batch", OperationID: "batchDevices", Tag: "devices",
+			Summary:     "Create, update and delete many devices",
+			Description: "At most " + strconv.Itoa(repositories.MaxBatchOperations) + " operations, or " + strconv.Itoa(repositories.MaxAtomicBatchOperations) + " with atomic (" + strconv.Itoa(repositories.MaxDynamoAtomicEventOperations) + " on DynamoDB with events). Every result has the status its operation would have on its own endpoint.",
+			Params:      []*openapi.Parameter{operatorParam},
+			Body:        models.DeviceBatchRequest{}, Responses: map[int]any{http.StatusOK: models.DeviceBatchResponse{}}, Errors: []int{http.StatusBadRequest},
+		}},
+		{Handler: handler.ListDeletedDevices, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/devices/trash", OperationID: "listDeletedDevices", Tag: "devices",
+			Summary: "List the devices in the trash",
+			Params:  deviceListParams(), Responses: map[int]any{http.StatusOK: models.DevicePage{}}, Errors: []int{http.StatusBadRequest},
+		}},
+		{Handler: handler.GetDevice, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/devices/{id}", OperationID: "getDevice", Tag: "devices",
+			Summary: "Read a device",
+			Params:  []*openapi.Parameter{deviceIDParam}, Responses: map[int]any{http.StatusOK: models.Device{}}, Errors: []int{http.StatusNotFound},
+		}},
+		{Handler: handler.DeviceAction, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/devices/{id}", OperationID: "deviceAction", Tag: "devices",
+			Summary:     "Run a custom method of a device",
+			Description: "{id}:restore takes the device out of the trash.",
+			Params: []*openapi.Parameter{{
+				Name: "id", In: openapi.InPath, Required: true,
+				Description: "The ID of the device without its /devices/ prefix, then the method, e.g. id1:restore.",
+				Schema:      &openapi.Schema{Type: "string", Pattern: "^[A-Za-z0-9]+:restore$"},
+			}, ifMatchParam},
+			Responses: map[int]any{http.StatusOK: models.Device{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed},
+		}},
+		{Handler: handler.UpdateDevice, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "PUT /api/devices/{id}", OperationID: "updateDevice", Tag: "devices",
+			Summary: "Replace a device, a field left out is cleared",
+			Params:  []*openapi.Parameter{deviceIDParam, ifMatchParam},
+			Body:    models.Device{}, Responses: map[int]any{http.StatusOK: models.Device{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusPreconditionFailed},
+		}},
+		{Handler: handler.PatchDevice, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "PATCH /api/devices/{id}", OperationID: "patchDevice", Tag: "devices",
+			Summary:     "Change some fields of a device",
+			Description: "A JSON merge patch (RFC 7396) of the device: a null clears a field. The merged device is validated like a PUT.",
+			Params:      []*openapi.Parameter{deviceIDParam, ifMatchParam},
+			Body:        map[string]any{}, BodyTypes: []string{"application/merge-patch+json", "application/json"},
+			Responses: map[int]any{http.StatusOK: models.Device{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusUnsupportedMediaType},
+		}},
+		{Handler: handler.DeleteDevice, Validated: true, Endpoint: openapi.Endpoint{
+			Pattern: "DELETE /api/devices/{id}", OperationID: "deleteDevice", Tag: "devices",
+			Summary:     "Move a device to the trash",
+			Description: "The device is removed for good after DEVICE_PURGE_AFTER, unless it is restored.",
+			Params:      []*openapi.Parameter{deviceIDParam, ifMatchParam, operatorParam},
+			Responses:   map[int]any{http.StatusNoContent: nil}, Errors: []int{http.StatusNotFound, http.StatusPreconditionFailed},
+		}},
+
+		{Handler: logHandler.CreateLog, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/devices/{id}/logs", OperationID: "createLog", Tag: "state logs",
+			Summary:     "Record a state change of a device",
+			Description: "The state machine decides which transitions are legal. Date is optional (RFC3339) and defaults to now.",
+			Params:      []*openapi.Parameter{deviceIDParam},
+			Body:        models.DeviceStateLog{}, Responses: map[int]any{http.StatusCreated: models.DeviceStateLog{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		}},
+		{Handler: logHandler.ListLogs, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/devices/{id}/logs", OperationID: "listLogs", Tag: "state logs",
+			Summary: "List the logs of a device, by date",
+			Params: []*openapi.Parameter{deviceIDParam, limitParam, cursorParam,
+				{Name: "state", In: openapi.InQuery, Description: "Only the logs of this state.", Schema: &openapi.Schema{Type: "string"}},
+				{Name: "from", In: openapi.InQuery, Description: "The first date, RFC3339.", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "to", In: openapi.InQuery, Description: "The last date, RFC3339.", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			},
+			Responses: map[int]any{http.StatusOK: models.DeviceStateLogPage{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+		}},
+		{Handler: logHandler.ListEscalations, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/escalations", OperationID: "listEscalations", Tag: "state logs",
+			Summary: "List the escalation inbox of an assignee, newest first",
+			Params: []*openapi.Parameter{limitParam, cursorParam,
+				{Name: "assignee", In: openapi.InQuery, Required: true, Description: "Whom the logs were escalated to.", Schema: &openapi.Schema{Type: "string"}},
+				{Name: "state", In: openapi.InQuery, Description: "Only the logs of this state.", Schema: &openapi.Schema{Type: "string"}},
+				{Name: "since", In: openapi.InQuery, Description: "The first date, RFC3339.", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			},
+			Responses: map[int]any{http.StatusOK: models.EscalationPage{}}, Errors: []int{http.StatusBadRequest},
+		}},
+
+		{Handler: modelHandler.ListDeviceModels, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/devicemodels", OperationID: "listDeviceModels", Tag: "device models",
+			Summary: "List the catalogue of device models",
+			Params:  []*openapi.Parameter{limitParam, cursorParam}, Responses: map[int]any{http.StatusOK: models.DeviceModelPage{}}, Errors: []int{http.StatusBadRequest},
+		}},
+		{Handler: modelHandler.CreateDeviceModel, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/devicemodels", OperationID: "createDeviceModel", Tag: "device models",
+			Summary: "Create a device model",
+			Body:    models.DeviceModel{}, Responses: map[int]any{http.StatusCreated: models.DeviceModel{}}, Errors: []int{http.StatusBadRequest, http.StatusConflict},
+		}},
+		{Handler: modelHandler.GetDeviceModel, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/devicemodels/{id}", OperationID: "getDeviceModel", Tag: "device models",
+			Summary:   "Read a device model",
+			Responses: map[int]any{http.StatusOK: models.DeviceModel{}}, Errors: []int{http.StatusNotFound},
+		}},
+		{Handler: modelHandler.UpdateDeviceModel, Endpoint: openapi.Endpoint{
+			Pattern: "PUT /api/devicemodels/{id}", OperationID: "updateDeviceModel", Tag: "device models",
+			Summary: "Replace a device model",
+			Body:    models.DeviceModel{}, Responses: map[int]any{http.StatusOK: models.DeviceModel{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+		}},
+		{Handler: modelHandler.DeleteDeviceModel, Endpoint: openapi.Endpoint{
+			Pattern: "DELETE /api/devicemodels/{id}", OperationID: "deleteDeviceModel", Tag: "device models",
+			Summary:     "Delete a device model",
+			Description: "A model that devices still refer to is refused, unless cascade deletes the devices too.",
+			Params:      []*openapi.Parameter{{Name: "cascade", In: openapi.InQuery, Description: "Delete the devices of the model too.", Schema: &openapi.Schema{Type: "boolean"}}},
+			Responses:   map[int]any{http.StatusNoContent: nil}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		}},
+
+		{Handler: webhookHandler.ListWebhooks, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/webhooks", OperationID: "listWebhooks", Tag: "webhooks",
+			Summary: "List the webhooks of the tenant",
+			Params:  []*openapi.Parameter{limitParam, cursorParam}, Responses: map[int]any{http.StatusOK: models.WebhookPage{}}, Errors: []int{http.StatusBadRequest},
+		}},
+		{Handler: webhookHandler.CreateWebhook, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/webhooks", OperationID: "createWebhook", Tag: "webhooks",
+			Summary:     "Subscribe a URL to the domain events",
+			Description: "The response is the only one that shows the secret that signs the deliveries, generated unless the request sets one.",
+			Body:        models.Webhook{}, Responses: map[int]any{http.StatusCreated: models.Webhook{}}, Errors: []int{http.StatusBadRequest},
+		}},
+		{Handler: webhookHandler.GetWebhook, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/webhooks/{id}", OperationID: "getWebhook", Tag: "webhooks",
+			Summary:   "Read a webhook",
+			Responses: map[int]any{http.StatusOK: models.Webhook{}}, Errors: []int{http.StatusNotFound},
+		}},
+		{Handler: webhookHandler.WebhookAction, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/webhooks/{id}", OperationID: "webhookAction", Tag: "webhooks",
+			Summary:     "Run a custom method of a webhook",
+			Description: "{id}:replay sends the dead deliveries of the webhook again.",
+			Responses:   map[int]any{http.StatusOK: models.WebhookReplay{}}, Errors: []int{http.StatusNotFound},
+		}},
+		{Handler: webhookHandler.DeleteWebhook, Endpoint: openapi.Endpoint{
+			Pattern: "DELETE /api/webhooks/{id}", OperationID: "deleteWebhook", Tag: "webhooks",
+			Summary:   "Delete a webhook with its deliveries",
+			Responses: map[int]any{http.StatusNoContent: nil}, Errors: []int{http.StatusNotFound},
+		}},
+		{Handler: webhookHandler.ListDeliveries, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/webhooks/{id}/deliveries", OperationID: "listDeliveries", Tag: "webhooks",
+			Summary: "List the delivery log of a webhook",
+			Params: []*openapi.Parameter{limitParam, cursorParam,
+				{Name: "status", In: openapi.InQuery, Description: "Only the deliveries of this status, dead for the dead letters.", Schema: &openapi.Schema{Type: "string", Enum: []string{models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead}}},
+			},
+			Responses: map[int]any{http.StatusOK: models.WebhookDeliveryPage{}}, Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+		}},
+		{Handler: webhookHandler.DeliveryAction, Endpoint: openapi.Endpoint{
+			Pattern: "POST /api/webhooks/{id}/deliveries/{delivery}", OperationID: "deliveryAction", Tag: "webhooks",
+			Summary:     "Run a custom method of a delivery",
+			Description: "{delivery}:replay sends a dead delivery again.",
+			Responses:   map[int]any{http.StatusOK: models.WebhookDelivery{}}, Errors: []int{http.StatusNotFound, http.StatusConflict},
+		}},
+
+		{Handler: tenantHandler.RequireAdmin(tenantHandler.ListTenants), Admin: true, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/admin/tenants", OperationID: "listTenants", Tag: "admin",
+			Summary:   "List the tenants that store anything, with their usage",
+			Responses: map[int]any{http.StatusOK: []models.TenantUsage{}}, Errors: []int{http.StatusUnauthorized, http.StatusNotImplemented},
+		}},
+		{Handler: tenantHandler.RequireAdmin(tenantHandler.GetTenant), Admin: true, Endpoint: openapi.Endpoint{
+			Pattern: "GET /api/admin/tenants/{tenant}", OperationID: "getTenant", Tag: "admin",
+			Summary:   "Read the usage of a tenant",
+			Params:    []*openapi.Parameter{{Name: "tenant", In: openapi.InPath, Required: true, Schema: &openapi.Schema{Type: "string", Pattern: utils.TenantPattern}}},
+			Responses: map[int]any{http.StatusOK: models.TenantUsage{}}, Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusNotImplemented},
+		}},
+	}
+}
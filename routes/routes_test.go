@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simple-api-go/handlers"
+	"simple-api-go/openapi"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestRouter(t *testing.T, validate bool) *http.ServeMux {
+	t.Helper()
+	deviceRepo := repositories.NewDeviceMemoryRepository()
+	modelRepo := repositories.NewDeviceModelMemoryRepository()
+	logRepo := repositories.NewDeviceStateLogMemoryRepository()
+	machine, err := services.NewStateMachine(services.DefaultStateMachineConfig)
+	if err != nil {
+		t.Fatalf("NewStateMachine() error = %v", err)
+	}
+
+	return SetupRoutes(
+		handlers.NewDeviceHandler(services.NewDeviceService(deviceRepo, modelRepo)),
+		handlers.NewDeviceStateLogHandler(services.NewDeviceStateLogService(logRepo, deviceRepo, machine)),
+		handlers.NewDeviceModelHandler(services.NewDeviceModelService(modelRepo, deviceRepo)),
+		handlers.NewTenantHandler(services.NewTenantService(deviceRepo, modelRepo, logRepo), handlers.TenantConfig{Default: "default"}),
+		handlers.NewWebhookHandler(services.NewWebhookService(repositories.NewWebhookMemoryRepository())),
+		validate,
+	)
+}
+
+func TestOpenAPI(t *testing.T) {
+	table := Routes(nil, nil, nil, nil, nil)
+	doc := OpenAPI(table)
+
+	for _, route := range table {
+		method, path, _ := strings.Cut(route.Pattern, " ")
+		operation := doc.Paths[path][strings.ToLower(method)]
+		if operation == nil {
+			t.Errorf("route %s has no operation", route.Pattern)
+			continue
+		}
+		hasTenant := slices.ContainsFunc(operation.Parameters, func(p *openapi.Parameter) bool { return p.Name == handlers.TenantHeader })
+		if hasTenant == route.Admin {
+			t.Errorf("route %s: tenant parameter %v, admin %v", route.Pattern, hasTenant, route.Admin)
+		}
+		if route.Admin && len(operation.Security) == 0 {
+			t.Errorf("admin route %s has no security", route.Pattern)
+		}
+	}
+}
+
+func TestSetupRoutes(t *testing.T) {
+	testsList := []struct {
+		name        string
+		validate    bool
+		method      string
+		url         string
+		contentType string
+		body        string
+		wantCode    int
+		wantMessage string
+	}{
+		{name: "OpenAPIDocument", method: "GET", url: "/openapi.json", wantCode: http.StatusOK},
+		{name: "Docs", method: "GET", url: "/docs", wantCode: http.StatusOK},
+		{name: "Validated", validate: true, method: "POST", url: "/api/devices", body: `{"id":"/devices/1","serial":"a-b"}`, wantCode: http.StatusBadRequest, wantMessage: "body.serial must match ^[A-Za-z0-9]+$"},
+		{name: "ValidatedQuery", validate: true, method: "GET", url: "/api/devices?limit=0", wantCode: http.StatusBadRequest, wantMessage: "query parameter limit must be between 1 and 100"},
+		{name: "ValidQuery", validate: true, method: "GET", url: "/api/devices?limit=1&sort=-name", wantCode: http.StatusOK},
+		{name: "NotValidated", method: "POST", url: "/api/devices", body: `{"id":"/devices/1","serial":"a-b"}`, wantCode: http.StatusBadRequest},
+		{name: "TooLarge", validate: true, method: "POST", url: "/api/devices", body: `{"id":"/devices/1","note":"` + strings.Repeat("a", utils.MaxBodySize) + `"}`, wantCode: http.StatusRequestEntityTooLarge},
+		// A handler stops reading at the same size without the validator, with the same answer.
+		{name: "TooLargeNotValidated", method: "POST", url: "/api/devices", body: `{"id":"/devices/1","note":"` + strings.Repeat("a", utils.MaxBodySize) + `"}`, wantCode: http.StatusRequestEntityTooLarge, wantMessage: "body is too large, It must be at most 1048576 bytes"},
+		{name: "PatchTooLarge", method: "PATCH", url: "/api/devices/1", contentType: "application/merge-patch+json", body: `{"note":"` + strings.Repeat("a", utils.MaxBodySize) + `"}`, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "WebhookTooLarge", validate: true, method: "POST", url: "/api/webhooks", body: `{"url":"https://example.com/` + strings.Repeat("a", utils.MaxBodySize) + `"}`, wantCode: http.StatusRequestEntityTooLarge},
+		// Only the device endpoints are validated.
+		{name: "OtherRoutesNotValidated", validate: true, method: "POST", url: "/api/webhooks", contentType: "text/plain", body: `{"url":"https://example.com/hook"}`, wantCode: http.StatusCreated},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(t, tt.validate)
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("unexpected status code: got %v, want %v (%s)", rr.Code, tt.wantCode, rr.Body)
+			}
+			if tt.wantMessage != "" {
+				var response struct{ Message string }
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.Message != tt.wantMessage {
+					t.Errorf("unexpected message: got %q, %v, want %q", response.Message, err, tt.wantMessage)
+				}
+			}
+			if tt.url == "/openapi.json" {
+				var doc openapi.Document
+				if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil || doc.Paths["/api/devices/{id}"]["put"] == nil {
+					t.Errorf("unexpected document: %v", err)
+				}
+			}
+		})
+	}
+}
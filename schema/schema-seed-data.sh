@@ -1,3 +1,4 @@
-aws dynamodb create-table --endpoint-url http://localhost:8000 --cli-input-json file://schema/devices.create.json --profile default
-aws dynamodb batch-write-item --endpoint-url http://localhost:8000 --request-items file://schema/devices.seed.json --profile default
-aws dynamodb scan --table-name  saeid-amn-Devices --profile default
\ No newline at end of file
+# The tables are declared in Go, see repositories.DynamoSchema: create or reconcile them, then seed them.
+RUNNING_MODE='schema' DATABASE_TYPE='dynamodb' DYNAMODB_TABLE='saeid-amn-Main' ENDPOINT='http://localhost:8000' go run .
+aws dynamodb batch-write-item --endpoint-url http://localhost:8000 --request-items file://schema/main.seed.json --profile default
+aws dynamodb scan --table-name  saeid-amn-Main --profile default
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"time"
+)
+
+type DeviceModelService interface {
+	CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error)
+	GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error)
+	ListDeviceModels(ctx context.Context, query repositories.DeviceModelQuery) (*models.DeviceModelPage, error)
+	UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error)
+	DeleteDeviceModel(ctx context.Context, id string, cascade bool) error
+}
+
+type deviceModelService struct {
+	repo       repositories.DeviceModelRepository
+	deviceRepo repositories.DeviceRepository
+}
+
+func NewDeviceModelService(repo repositories.DeviceModelRepository, deviceRepo repositories.DeviceRepository) DeviceModelService {
+	return &deviceModelService{
+		repo:       repo,
+		deviceRepo: deviceRepo,
+	}
+}
+
+func (s *deviceModelService) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	return s.repo.CreateDeviceModel(ctx, model)
+}
+
+func (s *deviceModelService) GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error) {
+	return s.repo.GetDeviceModel(ctx, id)
+}
+
+func (s *deviceModelService) ListDeviceModels(ctx context.Context, query repositories.DeviceModelQuery) (*models.DeviceModelPage, error) {
+	return s.repo.ListDeviceModels(ctx, query)
+}
+
+func (s *deviceModelService) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	return s.repo.UpdateDeviceModel(ctx, id, model)
+}
+
+// DeleteDeviceModel refuses to delete a model that devices still refer to, unless cascade is set, in which
+// case those devices are deleted first. The devices in the trash do not count: they can not be restored until the
+// model is created again. When a device can not be deleted, the ones deleted before it are restored and the model
+// is left as it was.
+//
+// The models and the devices may live in different stores, so the delete can not check the devices in the same
+// step. Instead the devices of the model are listed again once it is deleted: a device written in between makes
+// the model come back and the delete fail with utils.ErrDeviceModelInUse, or with cascade goes to the trash too. A
+// device write that checked the model before the delete and lands after that second listing still refers to the
+// deleted model, as does one the listing misses on DynamoDB, whose index lags behind the writes.
+func (s *deviceModelService) DeleteDeviceModel(ctx context.Context, id string, cascade bool) error {
+	model, err := s.repo.GetDeviceModel(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	deviceIDs, err := s.devicesOf(ctx, id, cascade)
+	if err != nil {
+		return err
+	}
+	if len(deviceIDs) > 0 && !cascade {
+		return utils.ErrDeviceModelInUse
+	}
+	if err := s.trashDevices(ctx, id, deviceIDs); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteDeviceModel(ctx, id); err != nil {
+		return err
+	}
+
+	written, err := s.devicesOf(ctx, id, cascade)
+	if err != nil || len(written) == 0 {
+		return err
+	}
+	if cascade {
+		return s.trashDevices(ctx, id, written)
+	}
+	if _, err := s.repo.CreateDeviceModel(ctx, model); err != nil {
+		return err
+	}
+	return utils.ErrDeviceModelInUse
+}
+
+// trashDevices moves the devices of a model to the trash, deleted by the model, each with its DeviceDeleted. When
+// one fails, the ones it moved are restored.
+func (s *deviceModelService) trashDevices(ctx context.Context, modelID string, deviceIDs []string) error {
+	deviceCtx := withDeviceEvents(ctx, time.Now)
+	var trashed []string
+	for _, deviceID := range deviceIDs {
+		err := s.deviceRepo.DeleteDevice(deviceCtx, deviceID, 0, modelID)
+		switch {
+		case err == nil:
+			trashed = append(trashed, deviceID)
+		case !errors.Is(err, utils.ErrDeviceNotFound):
+			for _, trashedID := range trashed {
+				if _, restoreErr := s.deviceRepo.RestoreDevice(deviceCtx, trashedID, 0); restoreErr != nil {
+					err = errors.Join(err, restoreErr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// devicesOf returns the IDs of the live devices of a model; only the first one unless all is set.
+func (s *deviceModelService) devicesOf(ctx context.Context, modelID string, all bool) ([]string, error) {
+	opts := repositories.ListOptions{
+		Limit:  repositories.MaxListLimit,
+		Filter: repositories.DeviceFilter{{Field: "deviceModel", Operator: repositories.FilterEquals, Value: modelID}},
+	}
+	if !all {
+		opts.Limit = 1
+	}
+
+	var ids []string
+	for {
+		page, err := s.deviceRepo.ListDevices(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range page.Items {
+			ids = append(ids, device.ID)
+		}
+		if !all || page.NextCursor == "" {
+			return ids, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,185 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"testing"
+)
+
+// MockDeviceModelRepository runs afterDelete once a model is deleted, as a concurrent request would.
+type MockDeviceModelRepository struct {
+	models      map[string]*models.DeviceModel
+	afterDelete func()
+}
+
+func (m *MockDeviceModelRepository) GetDeviceModel(ctx context.Context, id string) (*models.DeviceModel, error) {
+	model, ok := m.models[id]
+	if !ok {
+		return nil, utils.ErrDeviceModelNotFound
+	}
+	return model, nil
+}
+
+func (m *MockDeviceModelRepository) ListDeviceModels(ctx context.Context, query repositories.DeviceModelQuery) (*models.DeviceModelPage, error) {
+	page := &models.DeviceModelPage{}
+	for _, model := range m.models {
+		page.Items = append(page.Items, model)
+	}
+	return page, nil
+}
+
+func (m *MockDeviceModelRepository) CreateDeviceModel(ctx context.Context, model *models.DeviceModel) (*models.DeviceModel, error) {
+	m.models[model.ID] = model
+	return model, nil
+}
+
+func (m *MockDeviceModelRepository) UpdateDeviceModel(ctx context.Context, id string, model *models.DeviceModel) (*models.DeviceModel, error) {
+	if _, ok := m.models[id]; !ok {
+		return nil, utils.ErrDeviceModelNotFound
+	}
+	m.models[id] = model
+	return model, nil
+}
+
+func (m *MockDeviceModelRepository) DeleteDeviceModel(ctx context.Context, id string) error {
+	if _, ok := m.models[id]; !ok {
+		return utils.ErrDeviceModelNotFound
+	}
+	delete(m.models, id)
+	if m.afterDelete != nil {
+		m.afterDelete()
+	}
+	return nil
+}
+
+func TestDeviceModelService(t *testing.T) {
+	deviceRepo := &MockDeviceRepository{
+		devices: map[string]*models.Device{
+			"/devices/id1": {ID: "/devices/id1", DeviceModel: "/devicemodels/id1"},
+			"/devices/id2": {ID: "/devices/id2", DeviceModel: "/devicemodels/id1"},
+			"/devices/id3": {ID: "/devices/id3", DeviceModel: "/devicemodels/id2"},
+		},
+	}
+	modelRepo := &MockDeviceModelRepository{
+		models: map[string]*models.DeviceModel{
+			"/devicemodels/id1": {ID: "/devicemodels/id1", Name: "Sensor"},
+			"/devicemodels/id2": {ID: "/devicemodels/id2", Name: "Camera"},
+			"/devicemodels/id3": {ID: "/devicemodels/id3", Name: "Gateway"},
+		},
+	}
+	modelService := services.NewDeviceModelService(modelRepo, deviceRepo)
+
+	t.Run("DeleteUnusedDeviceModel", func(t *testing.T) {
+		if err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id3", false); err != nil {
+			t.Errorf("DeleteDeviceModel() error = %v", err)
+		}
+	})
+
+	t.Run("DeleteDeviceModelInUse", func(t *testing.T) {
+		err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id1", false)
+		if !errors.Is(err, utils.ErrDeviceModelInUse) {
+			t.Errorf("DeleteDeviceModel() error = %v, want %v", err, utils.ErrDeviceModelInUse)
+		}
+		if _, err := modelService.GetDeviceModel(context.Background(), "/devicemodels/id1"); err != nil {
+			t.Errorf("DeleteDeviceModel() model in use should not be deleted")
+		}
+	})
+
+	t.Run("DeleteDeviceModelCascade", func(t *testing.T) {
+		if err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id1", true); err != nil {
+			t.Errorf("DeleteDeviceModel() error = %v", err)
+			return
+		}
+
+		if len(deviceRepo.devices) != 1 || deviceRepo.devices["/devices/id3"] == nil {
+			t.Errorf("DeleteDeviceModel() got devices = %v, want only the device of another model", deviceRepo.devices)
+		}
+	})
+
+	// The devices the cascade moved to the trash stay there until their model is back.
+	t.Run("RestoreDeviceOfDeletedModel", func(t *testing.T) {
+		deviceService := services.NewDeviceService(deviceRepo, modelRepo)
+		if _, err := deviceService.RestoreDevice(context.Background(), "/devices/id1", 0); !errors.Is(err, utils.ErrUnknownDeviceModel) {
+			t.Errorf("RestoreDevice() error = %v, want %v", err, utils.ErrUnknownDeviceModel)
+		}
+		if deviceRepo.trash["/devices/id1"] == nil {
+			t.Errorf("RestoreDevice() the device should stay in the trash")
+		}
+
+		modelRepo.models["/devicemodels/id1"] = &models.DeviceModel{ID: "/devicemodels/id1", Name: "Sensor"}
+		if _, err := deviceService.RestoreDevice(context.Background(), "/devices/id1", 0); err != nil {
+			t.Errorf("RestoreDevice() error = %v", err)
+		}
+	})
+
+	t.Run("DeleteDeviceModelOfTrashedDevice", func(t *testing.T) {
+		if err := deviceRepo.DeleteDevice(context.Background(), "/devices/id3", 0, "operator"); err != nil {
+			t.Fatalf("DeleteDevice() error = %v", err)
+		}
+		if err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id2", false); err != nil {
+			t.Errorf("DeleteDeviceModel() error = %v, want the devices in the trash not to count", err)
+		}
+	})
+
+	t.Run("DeleteDeviceModelCascadeFailure", func(t *testing.T) {
+		modelRepo.models["/devicemodels/id4"] = &models.DeviceModel{ID: "/devicemodels/id4", Name: "Meter"}
+		for _, id := range []string{"/devices/id4", "/devices/id5", "/devices/id6"} {
+			deviceRepo.devices[id] = &models.Device{ID: id, DeviceModel: "/devicemodels/id4"}
+		}
+		failure := errors.New("backend unavailable")
+		deviceRepo.deleteErrs = map[string]error{"/devices/id5": failure}
+		defer func() { deviceRepo.deleteErrs = nil }()
+
+		if err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id4", true); !errors.Is(err, failure) {
+			t.Errorf("DeleteDeviceModel() error = %v, want %v", err, failure)
+		}
+		// The devices deleted before the failure are restored, and the model is still there.
+		for _, id := range []string{"/devices/id4", "/devices/id5", "/devices/id6"} {
+			if deviceRepo.devices[id] == nil {
+				t.Errorf("DeleteDeviceModel() left %s in the trash", id)
+			}
+		}
+		if _, err := modelRepo.GetDeviceModel(context.Background(), "/devicemodels/id4"); err != nil {
+			t.Errorf("GetDeviceModel() error = %v, want the model left as it was", err)
+		}
+	})
+
+	// A device written with the model between the listing of its devices and its delete.
+	t.Run("DeleteDeviceModelWhileInUse", func(t *testing.T) {
+		modelRepo.models["/devicemodels/id5"] = &models.DeviceModel{ID: "/devicemodels/id5", Name: "Valve"}
+		modelRepo.afterDelete = func() {
+			deviceRepo.devices["/devices/id7"] = &models.Device{ID: "/devices/id7", DeviceModel: "/devicemodels/id5"}
+		}
+		defer func() { modelRepo.afterDelete = nil }()
+
+		if err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id5", false); !errors.Is(err, utils.ErrDeviceModelInUse) {
+			t.Errorf("DeleteDeviceModel() error = %v, want %v", err, utils.ErrDeviceModelInUse)
+		}
+		if model, err := modelRepo.GetDeviceModel(context.Background(), "/devicemodels/id5"); err != nil || model.Name != "Valve" {
+			t.Errorf("GetDeviceModel() got = %v, %v, want the model back", model, err)
+		}
+
+		modelRepo.afterDelete = func() {
+			deviceRepo.devices["/devices/id8"] = &models.Device{ID: "/devices/id8", DeviceModel: "/devicemodels/id5"}
+		}
+		if err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id5", true); err != nil {
+			t.Errorf("DeleteDeviceModel() error = %v", err)
+		}
+		for _, id := range []string{"/devices/id7", "/devices/id8"} {
+			if deviceRepo.devices[id] != nil || deviceRepo.trash[id] == nil {
+				t.Errorf("DeleteDeviceModel() with cascade left %s out of the trash", id)
+			}
+		}
+	})
+
+	t.Run("DeleteNonExistingDeviceModel", func(t *testing.T) {
+		err := modelService.DeleteDeviceModel(context.Background(), "/devicemodels/id9", true)
+		if !errors.Is(err, utils.ErrDeviceModelNotFound) {
+			t.Errorf("DeleteDeviceModel() error = %v, want %v", err, utils.ErrDeviceModelNotFound)
+		}
+	})
+}
@@ -1,9 +1,13 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"simple-api-go/models"
 	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"time"
 )
 
 var (
@@ -12,34 +16,142 @@ var (
 )
 
 type DeviceService interface {
-	CreateDevice(device *models.Device) (*models.Device, error)
-	GetDevice(id string) (*models.Device, error)
-	UpdateDevice(id string, device *models.Device) (*models.Device, error)
-	DeleteDevice(id string) error
+	CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error)
+	GetDevice(ctx context.Context, id string) (*models.Device, error)
+	ListDevices(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error)
+	UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error)
+	// PatchDevice lets patch change the device and stores it as one compare-and-set, so a concurrent write is never
+	// lost: patch runs again on the newer device instead. version, when not zero, must be the version of the device.
+	PatchDevice(ctx context.Context, id string, version int64, patch func(device *models.Device) error) (*models.Device, error)
+	// DeleteDevice moves the device to the trash if its version is still version; zero skips the check.
+	DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error
+	// RestoreDevice takes the device out of the trash if its version is still version; zero skips the check.
+	RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error)
+	// WriteDevices applies a batch of operations and reports each of them, see DeviceRepository.
+	WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error)
 }
 
+// deviceService emits a DeviceCreated, DeviceUpdated or DeviceDeleted for every device it writes, which the
+// repository stores in its outbox along with the device.
 type deviceService struct {
-	repo repositories.DeviceRepository
+	repo      repositories.DeviceRepository
+	modelRepo repositories.DeviceModelRepository
+	now       func() time.Time
 }
 
-func NewDeviceService(repo repositories.DeviceRepository) DeviceService {
+func NewDeviceService(repo repositories.DeviceRepository, modelRepo repositories.DeviceModelRepository) DeviceService {
 	return &deviceService{
-		repo: repo,
+		repo:      repo,
+		modelRepo: modelRepo,
+		now:       time.Now,
 	}
 }
 
-func (s *deviceService) GetDevice(id string) (*models.Device, error) {
-	return s.repo.GetDevice(id)
+func (s *deviceService) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	return s.repo.GetDevice(ctx, id)
 }
 
-func (s *deviceService) CreateDevice(device *models.Device) (*models.Device, error) {
-	return s.repo.CreateDevice(device)
+func (s *deviceService) ListDevices(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+	return s.repo.ListDevices(ctx, opts)
 }
 
-func (s *deviceService) UpdateDevice(id string, device *models.Device) (*models.Device, error) {
-	return s.repo.UpdateDevice(id, device)
+func (s *deviceService) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
+	if err := s.checkDeviceModel(ctx, device.DeviceModel); err != nil {
+		return nil, err
+	}
+	return s.repo.CreateDevice(withDeviceEvents(ctx, s.now), device)
+}
+
+func (s *deviceService) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
+	if err := s.checkDeviceModel(ctx, device.DeviceModel); err != nil {
+		return nil, err
+	}
+	return s.repo.UpdateDevice(withDeviceEvents(ctx, s.now), id, device)
 }
 
-func (s *deviceService) DeleteDevice(id string) error {
-	return s.repo.DeleteDevice(id)
+func (s *deviceService) PatchDevice(ctx context.Context, id string, version int64, patch func(device *models.Device) error) (*models.Device, error) {
+	return repositories.UpdateDeviceFunc(withDeviceEvents(ctx, s.now), s.repo, id, func(device *models.Device) error {
+		if version != 0 && version != device.Version {
+			return utils.ErrVersionMismatch
+		}
+		if err := patch(device); err != nil {
+			return err
+		}
+		return s.checkDeviceModel(ctx, device.DeviceModel)
+	})
+}
+
+// checkDeviceModel makes sure a device refers to a model of the catalogue.
+func (s *deviceService) checkDeviceModel(ctx context.Context, id string) error {
+	_, err := s.modelRepo.GetDeviceModel(ctx, id)
+	if errors.Is(err, utils.ErrDeviceModelNotFound) {
+		return fmt.Errorf("%w '%s'", utils.ErrUnknownDeviceModel, id)
+	}
+	return err
+}
+
+func (s *deviceService) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	return s.repo.DeleteDevice(withDeviceEvents(ctx, s.now), id, version, deletedBy)
+}
+
+// RestoreDevice checks the model of the deleted device first: the model may have been deleted while the device was
+// in the trash, and the device then stays there until the model is back.
+func (s *deviceService) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	deleted, err := s.repo.GetDeletedDevice(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDeviceModel(ctx, deleted.DeviceModel); err != nil {
+		return nil, err
+	}
+	return s.repo.RestoreDevice(withDeviceEvents(ctx, s.now), id, version)
+}
+
+// WriteDevices checks the model of every created or updated device before writing the batch. An operation with
+// an unknown model fails on its own, or aborts the whole batch when it is atomic.
+func (s *deviceService) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error) {
+	if err := repositories.ValidateBatch(ops, atomic); err != nil {
+		return nil, err
+	}
+
+	results := make([]repositories.BatchResult, len(ops))
+	checked := map[string]error{}
+	var valid []int
+	for i, op := range ops {
+		if op.Op == models.BatchCreate || op.Op == models.BatchUpdate {
+			err, ok := checked[op.Device.DeviceModel]
+			if !ok {
+				err = s.checkDeviceModel(ctx, op.Device.DeviceModel)
+				checked[op.Device.DeviceModel] = err
+			}
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+		}
+		valid = append(valid, i)
+	}
+
+	if len(valid) < len(ops) && atomic {
+		for _, i := range valid {
+			results[i].Err = utils.ErrBatchAborted
+		}
+		return results, nil
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	batch := make([]models.DeviceBatchOperation, len(valid))
+	for n, i := range valid {
+		batch[n] = ops[i]
+	}
+	written, err := s.repo.WriteDevices(withDeviceEvents(ctx, s.now), batch, atomic)
+	if err != nil {
+		return nil, err
+	}
+	for n, i := range valid {
+		results[i] = written[n]
+	}
+	return results, nil
 }
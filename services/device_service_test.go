@@ -1,19 +1,26 @@
 package services_test
 
 import (
+	"context"
 	"errors"
 	"simple-api-go/utils"
 	"testing"
 
 	"simple-api-go/models"
+	"simple-api-go/repositories"
 	"simple-api-go/services"
 )
 
+// MockDeviceRepository moves the devices it deletes to trash, created when needed, and fails to delete the ones of
+// deleteErrs. It records the IDs of every GetDevices.
 type MockDeviceRepository struct {
-	devices map[string]*models.Device
+	devices    map[string]*models.Device
+	trash      map[string]*models.Device
+	deleteErrs map[string]error
+	bulkReads  [][]string
 }
 
-func (m *MockDeviceRepository) GetDevice(id string) (*models.Device, error) {
+func (m *MockDeviceRepository) GetDevice(ctx context.Context, id string) (*models.Device, error) {
 	device, ok := m.devices[id]
 	if !ok {
 		return nil, utils.ErrDeviceNotFound
@@ -21,12 +28,44 @@ func (m *MockDeviceRepository) GetDevice(id string) (*models.Device, error) {
 	return device, nil
 }
 
-func (m *MockDeviceRepository) CreateDevice(device *models.Device) (*models.Device, error) {
+func (m *MockDeviceRepository) GetDevices(ctx context.Context, ids []string) (map[string]*models.Device, error) {
+	m.bulkReads = append(m.bulkReads, ids)
+	devices := map[string]*models.Device{}
+	for _, id := range ids {
+		if device, ok := m.devices[id]; ok {
+			devices[id] = device
+		}
+	}
+	return devices, nil
+}
+
+func (m *MockDeviceRepository) GetDeletedDevice(ctx context.Context, id string) (*models.Device, error) {
+	if _, ok := m.devices[id]; ok {
+		return nil, utils.ErrDeviceNotDeleted
+	}
+	device, ok := m.trash[id]
+	if !ok {
+		return nil, utils.ErrDeviceNotFound
+	}
+	return device, nil
+}
+
+func (m *MockDeviceRepository) ListDevices(ctx context.Context, opts repositories.ListOptions) (*models.DevicePage, error) {
+	page := &models.DevicePage{}
+	for _, device := range m.devices {
+		if opts.Filter.Matches(device) {
+			page.Items = append(page.Items, device)
+		}
+	}
+	return page, nil
+}
+
+func (m *MockDeviceRepository) CreateDevice(ctx context.Context, device *models.Device) (*models.Device, error) {
 	m.devices[device.ID] = device
 	return device, nil
 }
 
-func (m *MockDeviceRepository) UpdateDevice(id string, device *models.Device) (*models.Device, error) {
+func (m *MockDeviceRepository) UpdateDevice(ctx context.Context, id string, device *models.Device) (*models.Device, error) {
 	_, ok := m.devices[id]
 	if !ok {
 		return nil, utils.ErrDeviceNotFound
@@ -35,15 +74,52 @@ func (m *MockDeviceRepository) UpdateDevice(id string, device *models.Device) (*
 	return device, nil
 }
 
-func (m *MockDeviceRepository) DeleteDevice(id string) error {
-	_, ok := m.devices[id]
+func (m *MockDeviceRepository) DeleteDevice(ctx context.Context, id string, version int64, deletedBy string) error {
+	if err := m.deleteErrs[id]; err != nil {
+		return err
+	}
+	device, ok := m.devices[id]
 	if !ok {
 		return utils.ErrDeviceNotFound
 	}
+	if m.trash == nil {
+		m.trash = map[string]*models.Device{}
+	}
+	deleted := *device
+	deleted.DeletedAt, deleted.DeletedBy = "2024-05-01T12:00:00Z", deletedBy
+	m.trash[id] = &deleted
 	delete(m.devices, id)
 	return nil
 }
 
+func (m *MockDeviceRepository) RestoreDevice(ctx context.Context, id string, version int64) (*models.Device, error) {
+	device, err := m.GetDeletedDevice(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	restored := *device
+	restored.DeletedAt, restored.DeletedBy = "", ""
+	m.devices[id] = &restored
+	delete(m.trash, id)
+	return &restored, nil
+}
+
+func (m *MockDeviceRepository) WriteDevices(ctx context.Context, ops []models.DeviceBatchOperation, atomic bool) ([]repositories.BatchResult, error) {
+	results := make([]repositories.BatchResult, len(ops))
+	for i, op := range ops {
+		device := op.Device
+		switch op.Op {
+		case models.BatchCreate:
+			results[i].Device, results[i].Err = m.CreateDevice(ctx, &device)
+		case models.BatchUpdate:
+			results[i].Device, results[i].Err = m.UpdateDevice(ctx, device.ID, &device)
+		case models.BatchDelete:
+			results[i].Err = m.DeleteDevice(ctx, device.ID, device.Version, device.DeletedBy)
+		}
+	}
+	return results, nil
+}
+
 func TestDeviceService(t *testing.T) {
 	mockRepo := &MockDeviceRepository{
 		devices: map[string]*models.Device{
@@ -57,10 +133,18 @@ func TestDeviceService(t *testing.T) {
 		},
 	}
 
-	deviceService := services.NewDeviceService(mockRepo)
+	modelRepo := &MockDeviceModelRepository{
+		models: map[string]*models.DeviceModel{
+			"Model A": {ID: "Model A"},
+			"Model B": {ID: "Model B"},
+			"Model C": {ID: "Model C"},
+		},
+	}
+
+	deviceService := services.NewDeviceService(mockRepo, modelRepo)
 
 	t.Run("GetDevice", func(t *testing.T) {
-		device, err := deviceService.GetDevice("idTest1")
+		device, err := deviceService.GetDevice(context.Background(), "idTest1")
 		if err != nil {
 			t.Errorf("GetDevice() error = %v", err)
 			return
@@ -71,6 +155,18 @@ func TestDeviceService(t *testing.T) {
 		}
 	})
 
+	t.Run("ListDevices", func(t *testing.T) {
+		page, err := deviceService.ListDevices(context.Background(), repositories.ListOptions{})
+		if err != nil {
+			t.Errorf("ListDevices() error = %v", err)
+			return
+		}
+
+		if len(page.Items) != 1 {
+			t.Errorf("ListDevices() got = %v items, want %v", len(page.Items), 1)
+		}
+	})
+
 	t.Run("CreateDevice", func(t *testing.T) {
 		device := &models.Device{
 			ID:          "2",
@@ -80,7 +176,7 @@ func TestDeviceService(t *testing.T) {
 			Serial:      "DEF456",
 		}
 
-		createdDevice, err := deviceService.CreateDevice(device)
+		createdDevice, err := deviceService.CreateDevice(context.Background(), device)
 		if err != nil {
 			t.Errorf("CreateDevice() error = %v", err)
 			return
@@ -91,6 +187,27 @@ func TestDeviceService(t *testing.T) {
 		}
 	})
 
+	t.Run("CreateDeviceUnknownModel", func(t *testing.T) {
+		device := &models.Device{ID: "3", Name: "Device 3", DeviceModel: "Model D", Serial: "JKL012"}
+
+		_, err := deviceService.CreateDevice(context.Background(), device)
+		if !errors.Is(err, utils.ErrUnknownDeviceModel) {
+			t.Errorf("CreateDevice() error = %v, want %v", err, utils.ErrUnknownDeviceModel)
+		}
+		if _, err := deviceService.GetDevice(context.Background(), "3"); !errors.Is(err, utils.ErrDeviceNotFound) {
+			t.Errorf("CreateDevice() device with an unknown model should not be stored")
+		}
+	})
+
+	t.Run("UpdateDeviceUnknownModel", func(t *testing.T) {
+		device := &models.Device{ID: "idTest1", Name: "Device 1", DeviceModel: "Model D", Serial: "ABC123"}
+
+		_, err := deviceService.UpdateDevice(context.Background(), "idTest1", device)
+		if !errors.Is(err, utils.ErrUnknownDeviceModel) {
+			t.Errorf("UpdateDevice() error = %v, want %v", err, utils.ErrUnknownDeviceModel)
+		}
+	})
+
 	t.Run("UpdateDevice", func(t *testing.T) {
 		updatedDevice := &models.Device{
 			ID:          "idTest1",
@@ -100,33 +217,91 @@ func TestDeviceService(t *testing.T) {
 			Serial:      "GHI789",
 		}
 
-		_, err := deviceService.UpdateDevice("idTest1", updatedDevice)
+		_, err := deviceService.UpdateDevice(context.Background(), "idTest1", updatedDevice)
 		if err != nil {
 			t.Errorf("UpdateDevice() error = %v", err)
 			return
 		}
 
-		device, _ := deviceService.GetDevice("idTest1")
+		device, _ := deviceService.GetDevice(context.Background(), "idTest1")
 		if device.Name != updatedDevice.Name {
 			t.Errorf("UpdateDevice() got = %v, want %v", device.Name, updatedDevice.Name)
 		}
 	})
 
+	t.Run("PatchDevice", func(t *testing.T) {
+		patched, err := deviceService.PatchDevice(context.Background(), "idTest1", 0, func(device *models.Device) error {
+			device.Note = "Patched"
+			return nil
+		})
+		if err != nil {
+			t.Errorf("PatchDevice() error = %v", err)
+			return
+		}
+		if patched.Note != "Patched" || patched.Name != "Updated Device" {
+			t.Errorf("PatchDevice() got = %v, want the stored device with the patched note", patched)
+		}
+
+		_, err = deviceService.PatchDevice(context.Background(), "idTest1", 0, func(device *models.Device) error {
+			device.DeviceModel = "Model D"
+			return nil
+		})
+		if !errors.Is(err, utils.ErrUnknownDeviceModel) {
+			t.Errorf("PatchDevice() error = %v, want %v", err, utils.ErrUnknownDeviceModel)
+		}
+
+		_, err = deviceService.PatchDevice(context.Background(), "idTest1", 7, func(device *models.Device) error { return nil })
+		if !errors.Is(err, utils.ErrVersionMismatch) {
+			t.Errorf("PatchDevice() stale version error = %v, want %v", err, utils.ErrVersionMismatch)
+		}
+	})
+
+	t.Run("WriteDevicesUnknownModel", func(t *testing.T) {
+		ops := []models.DeviceBatchOperation{
+			{Op: models.BatchCreate, Device: models.Device{ID: "4", Name: "Device 4", DeviceModel: "Model D", Serial: "MNO345"}},
+			{Op: models.BatchCreate, Device: models.Device{ID: "5", Name: "Device 5", DeviceModel: "Model A", Serial: "PQR678"}},
+		}
+
+		results, err := deviceService.WriteDevices(context.Background(), ops, true)
+		if err != nil {
+			t.Errorf("WriteDevices() error = %v", err)
+			return
+		}
+		if !errors.Is(results[0].Err, utils.ErrUnknownDeviceModel) || !errors.Is(results[1].Err, utils.ErrBatchAborted) {
+			t.Errorf("WriteDevices() atomic got = %v, %v, want %v, %v", results[0].Err, results[1].Err, utils.ErrUnknownDeviceModel, utils.ErrBatchAborted)
+		}
+		if _, err := deviceService.GetDevice(context.Background(), "5"); !errors.Is(err, utils.ErrDeviceNotFound) {
+			t.Errorf("WriteDevices() an aborted batch should not store any device")
+		}
+
+		results, err = deviceService.WriteDevices(context.Background(), ops, false)
+		if err != nil {
+			t.Errorf("WriteDevices() error = %v", err)
+			return
+		}
+		if !errors.Is(results[0].Err, utils.ErrUnknownDeviceModel) || results[1].Err != nil {
+			t.Errorf("WriteDevices() got = %v, %v, want %v, <nil>", results[0].Err, results[1].Err, utils.ErrUnknownDeviceModel)
+		}
+		if _, err := deviceService.GetDevice(context.Background(), "5"); err != nil {
+			t.Errorf("WriteDevices() the device with a known model should be stored: %v", err)
+		}
+	})
+
 	t.Run("DeleteDevice", func(t *testing.T) {
-		err := deviceService.DeleteDevice("idTest1")
+		err := deviceService.DeleteDevice(context.Background(), "idTest1", 0, "operator")
 		if err != nil {
 			t.Errorf("DeleteDevice() error = %v", err)
 			return
 		}
 
-		_, err = deviceService.GetDevice("idTest1")
+		_, err = deviceService.GetDevice(context.Background(), "idTest1")
 		if !errors.Is(err, utils.ErrDeviceNotFound) {
 			t.Errorf("DeleteDevice() device should not exist")
 		}
 	})
 
 	t.Run("DeviceNotFound", func(t *testing.T) {
-		_, err := deviceService.GetDevice("non-existent-id")
+		_, err := deviceService.GetDevice(context.Background(), "non-existent-id")
 		if !errors.Is(err, utils.ErrDeviceNotFound) {
 			t.Errorf("GetDevice() error = %v, want %v", err, utils.ErrDeviceNotFound)
 		}
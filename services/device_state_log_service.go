@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"slices"
+	"time"
+)
+
+type DeviceStateLogService interface {
+	CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error)
+	ListLogs(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error)
+	ListEscalations(ctx context.Context, query repositories.EscalationQuery) (*models.EscalationPage, error)
+}
+
+type deviceStateLogService struct {
+	repo       repositories.DeviceStateLogRepository
+	deviceRepo repositories.DeviceRepository
+	machine    *StateMachine
+	now        func() time.Time
+}
+
+func NewDeviceStateLogService(repo repositories.DeviceStateLogRepository, deviceRepo repositories.DeviceRepository, machine *StateMachine) DeviceStateLogService {
+	return &deviceStateLogService{
+		repo:       repo,
+		deviceRepo: deviceRepo,
+		machine:    machine,
+		now:        time.Now,
+	}
+}
+
+// CreateLog moves the device to the state of the log, if the state machine allows it from the state of the
+// latest log. It stamps the log with the current time unless a Date is given, which must not be before the latest
+// log, and derives the State#Date sort key. The log is only stored while the latest log is still the one it was
+// checked against, so a concurrent transition fails with utils.ErrStateChanged. The log emits a StateChanged from
+// the state of the latest log.
+func (s *deviceStateLogService) CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	date := s.now()
+	if log.Date != "" {
+		parsed, err := time.Parse(time.RFC3339, log.Date)
+		if err != nil {
+			return nil, utils.ErrInvalidDate
+		}
+		date = parsed
+	}
+	log.Date = models.FormatLogDate(date)
+	log.StateDate = models.StateDateKey(log.State, log.Date)
+
+	if _, err := s.deviceRepo.GetDevice(ctx, log.DeviceID); err != nil {
+		return nil, err
+	}
+
+	current, err := s.repo.LatestLog(ctx, log.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && log.Date < current.Date {
+		return nil, utils.ErrLogBeforeLatest
+	}
+	if err := s.machine.Check(current, log); err != nil {
+		return nil, err
+	}
+
+	from := ""
+	if current != nil {
+		from = current.State
+	}
+	return s.repo.CreateLogAfter(withStateChanged(ctx, from, s.now), log, current)
+}
+
+// ListLogs accepts From and To as RFC3339 timestamps and normalizes them to the stored date format.
+func (s *deviceStateLogService) ListLogs(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error) {
+	if _, err := s.deviceRepo.GetDevice(ctx, deviceID); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if query.From, err = normalizeLogDate(query.From); err != nil {
+		return nil, err
+	}
+	if query.To, err = normalizeLogDate(query.To); err != nil {
+		return nil, err
+	}
+	if query.From != "" && query.To != "" && query.From > query.To {
+		return nil, utils.ErrInvalidDate
+	}
+	return s.repo.ListLogs(ctx, deviceID, query)
+}
+
+// ListEscalations joins every escalated log with the current name and serial of its device, reading the devices of
+// a page in one GetDevices. Logs of devices that were deleted since are kept with an empty name and serial.
+func (s *deviceStateLogService) ListEscalations(ctx context.Context, query repositories.EscalationQuery) (*models.EscalationPage, error) {
+	var err error
+	if query.Since, err = normalizeLogDate(query.Since); err != nil {
+		return nil, err
+	}
+
+	logs, err := s.repo.ListEscalations(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(logs.Items))
+	for _, log := range logs.Items {
+		if !slices.Contains(ids, log.DeviceID) {
+			ids = append(ids, log.DeviceID)
+		}
+	}
+	devices, err := s.deviceRepo.GetDevices(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.EscalationPage{Items: []*models.Escalation{}, NextCursor: logs.NextCursor}
+	for _, log := range logs.Items {
+		escalation := &models.Escalation{DeviceStateLog: *log}
+		if device := devices[log.DeviceID]; device != nil {
+			escalation.DeviceName = device.Name
+			escalation.DeviceSerial = device.Serial
+		}
+		page.Items = append(page.Items, escalation)
+	}
+	return page, nil
+}
+
+func normalizeLogDate(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", utils.ErrInvalidDate
+	}
+	return models.FormatLogDate(parsed), nil
+}
@@ -0,0 +1,233 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"testing"
+	"time"
+)
+
+type MockDeviceStateLogRepository struct {
+	logs      []*models.DeviceStateLog
+	lastQuery repositories.LogQuery
+	// afterLatest runs once LatestLog has read the latest log, as a concurrent request would.
+	afterLatest func()
+}
+
+func (m *MockDeviceStateLogRepository) CreateLog(ctx context.Context, log *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	m.logs = append(m.logs, log)
+	return log, nil
+}
+
+func (m *MockDeviceStateLogRepository) CreateLogAfter(ctx context.Context, log, latest *models.DeviceStateLog) (*models.DeviceStateLog, error) {
+	if current := m.latestLog(log.DeviceID); current != latest {
+		return nil, utils.ErrStateChanged
+	}
+	return m.CreateLog(ctx, log)
+}
+
+func (m *MockDeviceStateLogRepository) ListLogs(ctx context.Context, deviceID string, query repositories.LogQuery) (*models.DeviceStateLogPage, error) {
+	m.lastQuery = query
+	page := &models.DeviceStateLogPage{}
+	for _, log := range m.logs {
+		if log.DeviceID == deviceID {
+			page.Items = append(page.Items, log)
+		}
+	}
+	return page, nil
+}
+
+func (m *MockDeviceStateLogRepository) ListEscalations(ctx context.Context, query repositories.EscalationQuery) (*models.DeviceStateLogPage, error) {
+	page := &models.DeviceStateLogPage{}
+	for i := len(m.logs) - 1; i >= 0; i-- {
+		if m.logs[i].EscalatedTo == query.Assignee {
+			page.Items = append(page.Items, m.logs[i])
+		}
+	}
+	return page, nil
+}
+
+func (m *MockDeviceStateLogRepository) LatestLog(ctx context.Context, deviceID string) (*models.DeviceStateLog, error) {
+	latest := m.latestLog(deviceID)
+	if m.afterLatest != nil {
+		m.afterLatest()
+	}
+	return latest, nil
+}
+
+func (m *MockDeviceStateLogRepository) latestLog(deviceID string) *models.DeviceStateLog {
+	var latest *models.DeviceStateLog
+	for _, log := range m.logs {
+		if log.DeviceID == deviceID && (latest == nil || log.Date > latest.Date) {
+			latest = log
+		}
+	}
+	return latest
+}
+
+func newTestStateMachine(t *testing.T) *services.StateMachine {
+	machine, err := services.NewStateMachine(services.DefaultStateMachineConfig)
+	if err != nil {
+		t.Fatalf("NewStateMachine() error = %v", err)
+	}
+	return machine
+}
+
+func TestDeviceStateLogService(t *testing.T) {
+	deviceRepo := &MockDeviceRepository{
+		devices: map[string]*models.Device{
+			"/devices/id1": {ID: "/devices/id1", Name: "Device 1"},
+		},
+	}
+	logRepo := &MockDeviceStateLogRepository{}
+	logService := services.NewDeviceStateLogService(logRepo, deviceRepo, newTestStateMachine(t))
+
+	t.Run("CreateLog", func(t *testing.T) {
+		log := &models.DeviceStateLog{
+			DeviceID: "/devices/id1",
+			State:    "Normal",
+			Operator: "operator1",
+			Date:     "2024-03-24T14:40:00+02:00",
+		}
+
+		createdLog, err := logService.CreateLog(context.Background(), log)
+		if err != nil {
+			t.Errorf("CreateLog() error = %v", err)
+			return
+		}
+
+		if createdLog.Date != "2024-03-24T12:40:00.000Z" {
+			t.Errorf("CreateLog() got date = %v, want %v", createdLog.Date, "2024-03-24T12:40:00.000Z")
+		}
+		if createdLog.StateDate != "Normal#2024-03-24T12:40:00.000Z" {
+			t.Errorf("CreateLog() got sort key = %v, want %v", createdLog.StateDate, "Normal#2024-03-24T12:40:00.000Z")
+		}
+	})
+
+	t.Run("CreateLogWithoutDate", func(t *testing.T) {
+		createdLog, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Warning", Operator: "operator1"})
+		if err != nil {
+			t.Errorf("CreateLog() error = %v", err)
+			return
+		}
+
+		if len(createdLog.Date) != len(models.LogDateFormat) {
+			t.Errorf("CreateLog() got date = %v, want the current time in %v", createdLog.Date, models.LogDateFormat)
+		}
+	})
+
+	t.Run("IllegalTransition", func(t *testing.T) {
+		_, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Normal", Operator: "operator1"})
+		if !errors.Is(err, utils.ErrIllegalTransition) {
+			t.Errorf("CreateLog() error = %v, want %v", err, utils.ErrIllegalTransition)
+		}
+	})
+
+	t.Run("TransitionRequiresField", func(t *testing.T) {
+		_, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Critical", Operator: "operator1"})
+		if !errors.Is(err, utils.ErrTransitionRequires) {
+			t.Errorf("CreateLog() error = %v, want %v", err, utils.ErrTransitionRequires)
+		}
+
+		_, err = logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Critical", Operator: "operator1", EscalatedTo: "supervisor1"})
+		if err != nil {
+			t.Errorf("CreateLog() error = %v", err)
+		}
+	})
+
+	t.Run("LogBeforeLatest", func(t *testing.T) {
+		_, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "UnderMaintenance", Operator: "operator1", Date: "2024-03-24T12:00:00Z"})
+		if !errors.Is(err, utils.ErrLogBeforeLatest) {
+			t.Errorf("CreateLog() error = %v, want %v", err, utils.ErrLogBeforeLatest)
+		}
+	})
+
+	t.Run("ConcurrentTransition", func(t *testing.T) {
+		logRepo := &MockDeviceStateLogRepository{}
+		logService := services.NewDeviceStateLogService(logRepo, deviceRepo, newTestStateMachine(t))
+		logRepo.afterLatest = func() {
+			logRepo.afterLatest = nil
+			logRepo.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Normal", Date: models.FormatLogDate(time.Now())})
+		}
+
+		_, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Normal", Operator: "operator1"})
+		if !errors.Is(err, utils.ErrStateChanged) {
+			t.Errorf("CreateLog() error = %v, want %v", err, utils.ErrStateChanged)
+		}
+		if len(logRepo.logs) != 1 {
+			t.Errorf("CreateLog() stored %d logs, want only the concurrent one", len(logRepo.logs))
+		}
+	})
+
+	t.Run("UnknownState", func(t *testing.T) {
+		_, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Exploded", Operator: "operator1"})
+		if !errors.Is(err, utils.ErrUnknownState) {
+			t.Errorf("CreateLog() error = %v, want %v", err, utils.ErrUnknownState)
+		}
+	})
+
+	t.Run("CreateLogUnknownDevice", func(t *testing.T) {
+		_, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id2", State: "Normal", Operator: "operator1"})
+		if !errors.Is(err, utils.ErrDeviceNotFound) {
+			t.Errorf("CreateLog() error = %v, want %v", err, utils.ErrDeviceNotFound)
+		}
+	})
+
+	t.Run("ListEscalations", func(t *testing.T) {
+		escalations := &MockDeviceStateLogRepository{logs: []*models.DeviceStateLog{
+			{DeviceID: "/devices/id1", State: "Warning", EscalatedTo: "supervisor1", Date: "2024-03-24T09:00:00.000Z"},
+			{DeviceID: "/devices/id1", State: "Critical", EscalatedTo: "supervisor1", Date: "2024-03-24T10:00:00.000Z"},
+			{DeviceID: "/devices/deleted", State: "Critical", EscalatedTo: "supervisor1", Date: "2024-03-24T11:00:00.000Z"},
+			{DeviceID: "/devices/id1", State: "Warning", EscalatedTo: "supervisor2", Date: "2024-03-24T12:00:00.000Z"},
+		}}
+		escalationService := services.NewDeviceStateLogService(escalations, deviceRepo, newTestStateMachine(t))
+
+		page, err := escalationService.ListEscalations(context.Background(), repositories.EscalationQuery{Assignee: "supervisor1"})
+		if err != nil {
+			t.Errorf("ListEscalations() error = %v", err)
+			return
+		}
+
+		if len(page.Items) != 3 {
+			t.Fatalf("ListEscalations() got = %v items, want %v", len(page.Items), 3)
+		}
+		if page.Items[0].DeviceName != "" || page.Items[1].DeviceName != "Device 1" || page.Items[2].DeviceName != "Device 1" {
+			t.Errorf("ListEscalations() got device names %q, %q and %q, want %q, %q and %q", page.Items[0].DeviceName, page.Items[1].DeviceName, page.Items[2].DeviceName, "", "Device 1", "Device 1")
+		}
+		// The devices of the page are read in one call, each one once.
+		if want := [][]string{{"/devices/deleted", "/devices/id1"}}; !reflect.DeepEqual(deviceRepo.bulkReads, want) {
+			t.Errorf("ListEscalations() read the devices %v, want %v", deviceRepo.bulkReads, want)
+		}
+	})
+
+	t.Run("ListEscalationsInvalidSince", func(t *testing.T) {
+		_, err := logService.ListEscalations(context.Background(), repositories.EscalationQuery{Assignee: "supervisor1", Since: "yesterday"})
+		if !errors.Is(err, utils.ErrInvalidDate) {
+			t.Errorf("ListEscalations() error = %v, want %v", err, utils.ErrInvalidDate)
+		}
+	})
+
+	t.Run("ListLogsNormalizesDates", func(t *testing.T) {
+		_, err := logService.ListLogs(context.Background(), "/devices/id1", repositories.LogQuery{From: "2024-03-24T00:00:00Z", To: "2024-03-25T00:00:00+01:00"})
+		if err != nil {
+			t.Errorf("ListLogs() error = %v", err)
+			return
+		}
+
+		if logRepo.lastQuery.From != "2024-03-24T00:00:00.000Z" || logRepo.lastQuery.To != "2024-03-24T23:00:00.000Z" {
+			t.Errorf("ListLogs() got query = %+v", logRepo.lastQuery)
+		}
+	})
+
+	t.Run("ListLogsInvalidRange", func(t *testing.T) {
+		_, err := logService.ListLogs(context.Background(), "/devices/id1", repositories.LogQuery{From: "2024-03-25T00:00:00Z", To: "2024-03-24T00:00:00Z"})
+		if !errors.Is(err, utils.ErrInvalidDate) {
+			t.Errorf("ListLogs() error = %v, want %v", err, utils.ErrInvalidDate)
+		}
+	})
+}
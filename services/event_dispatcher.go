@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"sync"
+)
+
+// Subscriber receives the domain events of the outboxes of an EventDispatcher, with ctx in the tenant of the event.
+// An event may arrive more than once, so handling it must be idempotent, e.g. by its ID.
+type Subscriber interface {
+	HandleEvent(ctx context.Context, event models.Event) error
+}
+
+// SubscriberFunc adapts a function to a Subscriber.
+type SubscriberFunc func(ctx context.Context, event models.Event) error
+
+func (f SubscriberFunc) HandleEvent(ctx context.Context, event models.Event) error {
+	return f(ctx, event)
+}
+
+// EventDispatcher delivers the events of outboxes to its subscribers, at least once: an event is acknowledged only
+// once every subscriber handled it, and an event a subscriber fails is delivered again, to all of them, by the next
+// Dispatch. The events of one outbox are delivered in order, so a failing event holds back the ones after it.
+type EventDispatcher struct {
+	outboxes  []repositories.EventOutbox
+	batchSize int
+
+	mu          sync.RWMutex
+	subscribers []Subscriber
+}
+
+func NewEventDispatcher(outboxes ...repositories.EventOutbox) *EventDispatcher {
+	return &EventDispatcher{
+		outboxes:  outboxes,
+		batchSize: repositories.DefaultEventBatchSize,
+	}
+}
+
+// Subscribe adds subscriber to the subscribers of the next events.
+func (d *EventDispatcher) Subscribe(subscriber Subscriber) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscribers = append(d.subscribers, subscriber)
+}
+
+// Dispatch delivers the pending events of every outbox and returns how many it acknowledged. It goes on with the
+// other outboxes when one fails, and returns their errors joined.
+func (d *EventDispatcher) Dispatch(ctx context.Context) (int, error) {
+	d.mu.RLock()
+	subscribers := append([]Subscriber{}, d.subscribers...)
+	d.mu.RUnlock()
+
+	delivered := 0
+	var errs []error
+	for _, outbox := range d.outboxes {
+		n, err := d.drain(ctx, outbox, subscribers)
+		delivered += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// drain delivers the events of outbox a batch at a time, until it has none left or an event fails.
+func (d *EventDispatcher) drain(ctx context.Context, outbox repositories.EventOutbox, subscribers []Subscriber) (int, error) {
+	delivered := 0
+	for {
+		events, err := outbox.PendingEvents(ctx, d.batchSize)
+		if err != nil {
+			return delivered, err
+		}
+
+		ids := make([]string, 0, len(events))
+		var failed error
+		for _, event := range events {
+			if err := deliver(ctx, event, subscribers); err != nil {
+				failed = fmt.Errorf("event %s: %w", event.ID, err)
+				break
+			}
+			ids = append(ids, event.ID)
+		}
+		if err := outbox.AckEvents(ctx, ids); err != nil {
+			return delivered, err
+		}
+		delivered += len(ids)
+
+		if failed != nil || len(events) < d.batchSize {
+			return delivered, failed
+		}
+	}
+}
+
+// Deliver hands event to every subscriber, for the events that come from elsewhere than the outboxes, such as the
+// stream of the table. It stops at the first subscriber that fails.
+func (d *EventDispatcher) Deliver(ctx context.Context, event models.Event) error {
+	d.mu.RLock()
+	subscribers := append([]Subscriber{}, d.subscribers...)
+	d.mu.RUnlock()
+	return deliver(ctx, event, subscribers)
+}
+
+func deliver(ctx context.Context, event models.Event, subscribers []Subscriber) error {
+	ctx = utils.WithTenant(ctx, event.Tenant)
+	for _, subscriber := range subscribers {
+		if err := subscriber.HandleEvent(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
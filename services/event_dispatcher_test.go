@@ -0,0 +1,180 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"slices"
+	"testing"
+)
+
+// pendingTypes returns the types of the events pending in outbox, oldest first.
+func pendingTypes(t *testing.T, outbox repositories.EventOutbox) []string {
+	events, err := outbox.PendingEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("PendingEvents() error = %v", err)
+	}
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestDeviceService_Events(t *testing.T) {
+	deviceRepo := repositories.NewDeviceMemoryRepository()
+	modelRepo := repositories.NewDeviceModelMemoryRepository()
+	deviceService := services.NewDeviceService(deviceRepo, modelRepo)
+	modelService := services.NewDeviceModelService(modelRepo, deviceRepo)
+	ctx := utils.WithTenant(context.Background(), "acme")
+
+	if _, err := modelService.CreateDeviceModel(ctx, &models.DeviceModel{ID: "model1", Name: "Model 1"}); err != nil {
+		t.Fatalf("CreateDeviceModel() error = %v", err)
+	}
+	if _, err := deviceService.CreateDevice(ctx, &models.Device{ID: "/devices/id1", Name: "Device 1", DeviceModel: "model1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if _, err := deviceService.UpdateDevice(ctx, "/devices/id1", &models.Device{ID: "/devices/id1", Name: "Renamed", DeviceModel: "model1"}); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if _, err := deviceService.PatchDevice(ctx, "/devices/id1", 0, func(device *models.Device) error {
+		device.Note = "Patched"
+		return nil
+	}); err != nil {
+		t.Fatalf("PatchDevice() error = %v", err)
+	}
+	if err := deviceService.DeleteDevice(ctx, "/devices/id1", 0, "operator1"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if _, err := deviceService.RestoreDevice(ctx, "/devices/id1", 0); err != nil {
+		t.Fatalf("RestoreDevice() error = %v", err)
+	}
+	ops := []models.DeviceBatchOperation{{Op: models.BatchCreate, Device: models.Device{ID: "/devices/id2", Name: "Device 2", DeviceModel: "model1"}}}
+	if _, err := deviceService.WriteDevices(ctx, ops, true); err != nil {
+		t.Fatalf("WriteDevices() error = %v", err)
+	}
+	if err := modelService.DeleteDeviceModel(ctx, "model1", true); err != nil {
+		t.Fatalf("DeleteDeviceModel() error = %v", err)
+	}
+
+	want := []string{
+		models.EventDeviceCreated,
+		models.EventDeviceUpdated,
+		models.EventDeviceUpdated,
+		models.EventDeviceDeleted,
+		models.EventDeviceUpdated,
+		models.EventDeviceCreated,
+		models.EventDeviceDeleted,
+		models.EventDeviceDeleted,
+	}
+	if got := pendingTypes(t, deviceRepo); !slices.Equal(got, want) {
+		t.Errorf("PendingEvents() got = %v, want %v", got, want)
+	}
+
+	events, _ := deviceRepo.PendingEvents(context.Background(), 1)
+	data, err := events[0].Decode()
+	created, ok := data.(*models.DeviceCreated)
+	if err != nil || !ok || created.Device.Name != "Device 1" || created.Device.Version != 1 || events[0].Tenant != "acme" {
+		t.Errorf("Decode() got = %+v, %v, want the device created in acme", data, err)
+	}
+}
+
+func TestDeviceStateLogService_StateChanged(t *testing.T) {
+	deviceRepo := &MockDeviceRepository{
+		devices: map[string]*models.Device{
+			"/devices/id1": {ID: "/devices/id1", Name: "Device 1"},
+		},
+	}
+	logRepo := repositories.NewDeviceStateLogMemoryRepository()
+	logService := services.NewDeviceStateLogService(logRepo, deviceRepo, newTestStateMachine(t))
+
+	for _, state := range []string{"Normal", "Warning"} {
+		if _, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: state, Operator: "operator1"}); err != nil {
+			t.Fatalf("CreateLog() error = %v", err)
+		}
+	}
+	// A log the state machine refuses emits nothing.
+	if _, err := logService.CreateLog(context.Background(), &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Normal", Operator: "operator1"}); !errors.Is(err, utils.ErrIllegalTransition) {
+		t.Fatalf("CreateLog() error = %v, want %v", err, utils.ErrIllegalTransition)
+	}
+
+	events, err := logRepo.PendingEvents(context.Background(), 0)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("PendingEvents() got = %v, %v, want 2 events", events, err)
+	}
+	var moves []string
+	for _, event := range events {
+		data, err := event.Decode()
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		changed := data.(*models.StateChanged)
+		moves = append(moves, changed.From+"->"+changed.Log.State)
+	}
+	if want := []string{"->Normal", "Normal->Warning"}; !slices.Equal(moves, want) {
+		t.Errorf("StateChanged got = %v, want %v", moves, want)
+	}
+}
+
+func TestEventDispatcher_Dispatch(t *testing.T) {
+	deviceRepo := repositories.NewDeviceMemoryRepository()
+	modelRepo := repositories.NewDeviceModelMemoryRepository()
+	deviceService := services.NewDeviceService(deviceRepo, modelRepo)
+	for _, tenant := range []string{"acme", "globex"} {
+		ctx := utils.WithTenant(context.Background(), tenant)
+		if _, err := modelRepo.CreateDeviceModel(ctx, &models.DeviceModel{ID: "model1", Name: "Model 1"}); err != nil {
+			t.Fatalf("CreateDeviceModel() error = %v", err)
+		}
+		if _, err := deviceService.CreateDevice(ctx, &models.Device{ID: "/devices/id1", Name: "Device 1", DeviceModel: "model1"}); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	if err := deviceService.DeleteDevice(utils.WithTenant(context.Background(), "acme"), "/devices/id1", 0, "operator1"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	dispatcher := services.NewEventDispatcher(deviceRepo)
+	var received, audited []string
+	dispatcher.Subscribe(services.SubscriberFunc(func(ctx context.Context, event models.Event) error {
+		received = append(received, utils.TenantFromContext(ctx)+" "+event.Type)
+		return nil
+	}))
+	failing := true
+	dispatcher.Subscribe(services.SubscriberFunc(func(ctx context.Context, event models.Event) error {
+		if failing && event.Tenant == "globex" {
+			return errors.New("audit unavailable")
+		}
+		audited = append(audited, event.Tenant+" "+event.Type)
+		return nil
+	}))
+
+	// The failing event stays in the outbox, with the events after it.
+	delivered, err := dispatcher.Dispatch(context.Background())
+	if delivered != 1 || err == nil {
+		t.Fatalf("Dispatch() got = %v, %v, want 1 event and the error of the subscriber", delivered, err)
+	}
+	if got := pendingTypes(t, deviceRepo); !slices.Equal(got, []string{models.EventDeviceCreated, models.EventDeviceDeleted}) {
+		t.Errorf("PendingEvents() got = %v, want the events from the failing one", got)
+	}
+
+	// The next Dispatch delivers them again, to every subscriber.
+	failing = false
+	delivered, err = dispatcher.Dispatch(context.Background())
+	if delivered != 2 || err != nil {
+		t.Fatalf("Dispatch() got = %v, %v, want 2 events", delivered, err)
+	}
+	wantReceived := []string{"acme DeviceCreated", "globex DeviceCreated", "globex DeviceCreated", "acme DeviceDeleted"}
+	if !slices.Equal(received, wantReceived) {
+		t.Errorf("received got = %v, want %v", received, wantReceived)
+	}
+	wantAudited := []string{"acme DeviceCreated", "globex DeviceCreated", "acme DeviceDeleted"}
+	if !slices.Equal(audited, wantAudited) {
+		t.Errorf("audited got = %v, want %v", audited, wantAudited)
+	}
+	if got := pendingTypes(t, deviceRepo); len(got) != 0 {
+		t.Errorf("PendingEvents() got = %v, want none", got)
+	}
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"context"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"time"
+)
+
+// withDeviceEvents makes the device writes of ctx emit the domain event of every device they store, see
+// repositories.WithDeviceEvents.
+func withDeviceEvents(ctx context.Context, now func() time.Time) context.Context {
+	tenant := utils.TenantFromContext(ctx)
+	return repositories.WithDeviceEvents(ctx, func(stored *models.Device) ([]models.Event, error) {
+		event, err := models.NewEvent(tenant, deviceEvent(stored), now())
+		if err != nil {
+			return nil, err
+		}
+		return []models.Event{event}, nil
+	})
+}
+
+// deviceEvent tells what a write did from the device it stored: a tombstone was deleted, a device at version 1 was
+// created, and any other device was updated, patched or restored.
+func deviceEvent(stored *models.Device) models.EventData {
+	switch {
+	case stored.DeletedAt != "":
+		return models.DeviceDeleted{Device: *stored}
+	case stored.Version == 1:
+		return models.DeviceCreated{Device: *stored}
+	default:
+		return models.DeviceUpdated{Device: *stored}
+	}
+}
+
+// withStateChanged makes the log written with ctx emit a StateChanged from the state from.
+func withStateChanged(ctx context.Context, from string, now func() time.Time) context.Context {
+	tenant := utils.TenantFromContext(ctx)
+	return repositories.WithLogEvents(ctx, func(stored *models.DeviceStateLog) ([]models.Event, error) {
+		event, err := models.NewEvent(tenant, models.StateChanged{Log: *stored, From: from}, now())
+		if err != nil {
+			return nil, err
+		}
+		return []models.Event{event}, nil
+	})
+}
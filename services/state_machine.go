@@ -0,0 +1,149 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"simple-api-go/models"
+	"simple-api-go/utils"
+	"slices"
+)
+
+// Transition allows a device to move From one state To another. Required names the log fields, as in the JSON
+// payload, that must be set to make the move.
+type Transition struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Required []string `json:"required,omitempty"`
+}
+
+// StateMachineConfig is the transition table of a factory. Initial lists the states a device can start in.
+type StateMachineConfig struct {
+	Initial     []string     `json:"initial"`
+	Transitions []Transition `json:"transitions"`
+}
+
+// DefaultStateMachineConfig is used when no configuration file is given.
+var DefaultStateMachineConfig = StateMachineConfig{
+	Initial: []string{"Normal"},
+	Transitions: []Transition{
+		{From: "Normal", To: "Warning"},
+		{From: "Warning", To: "Critical", Required: []string{"EscalatedTo"}},
+		{From: "Critical", To: "UnderMaintenance"},
+		{From: "UnderMaintenance", To: "Normal"},
+	},
+}
+
+// transitionFields reads the log fields a transition can require.
+var transitionFields = map[string]func(log *models.DeviceStateLog) string{
+	"Operator":    func(log *models.DeviceStateLog) string { return log.Operator },
+	"EscalatedTo": func(log *models.DeviceStateLog) string { return log.EscalatedTo },
+}
+
+// stateNameRegex matches the states a log can be created with, see validateDeviceStateLog.
+var stateNameRegex = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+type StateMachine struct {
+	states      []string
+	initial     []string
+	transitions map[string]map[string]Transition
+}
+
+// NewStateMachine checks the configuration: states must be alphanumeric, required fields must exist and a move
+// must not be listed twice.
+func NewStateMachine(config StateMachineConfig) (*StateMachine, error) {
+	if len(config.Initial) == 0 {
+		return nil, errors.New("state machine: at least one initial state is required")
+	}
+
+	m := &StateMachine{transitions: make(map[string]map[string]Transition)}
+	addState := func(state string) error {
+		if !stateNameRegex.MatchString(state) {
+			return fmt.Errorf("state machine: invalid state %q, It must be alphanumeric", state)
+		}
+		if !slices.Contains(m.states, state) {
+			m.states = append(m.states, state)
+		}
+		return nil
+	}
+
+	for _, state := range config.Initial {
+		if err := addState(state); err != nil {
+			return nil, err
+		}
+		m.initial = append(m.initial, state)
+	}
+	for _, t := range config.Transitions {
+		if err := addState(t.From); err != nil {
+			return nil, err
+		}
+		if err := addState(t.To); err != nil {
+			return nil, err
+		}
+		for _, field := range t.Required {
+			if _, ok := transitionFields[field]; !ok {
+				return nil, fmt.Errorf("state machine: field %q of %s -> %s can not be required", field, t.From, t.To)
+			}
+		}
+		if _, ok := m.transitions[t.From][t.To]; ok {
+			return nil, fmt.Errorf("state machine: transition %s -> %s is listed twice", t.From, t.To)
+		}
+		if m.transitions[t.From] == nil {
+			m.transitions[t.From] = make(map[string]Transition)
+		}
+		m.transitions[t.From][t.To] = t
+	}
+	return m, nil
+}
+
+// LoadStateMachine reads a JSON StateMachineConfig from path.
+func LoadStateMachine(path string) (*StateMachine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config StateMachineConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("state machine: %s: %w", path, err)
+	}
+	return NewStateMachine(config)
+}
+
+// Check validates moving a device from the state of its current log to the state of next. current is nil for a
+// device without logs, which must start in an initial state.
+func (m *StateMachine) Check(current, next *models.DeviceStateLog) error {
+	if !slices.Contains(m.states, next.State) {
+		return fmt.Errorf("%w %q, It must be one of %v", utils.ErrUnknownState, next.State, m.states)
+	}
+
+	if current == nil {
+		if !slices.Contains(m.initial, next.State) {
+			return fmt.Errorf("%w: a device must start in one of %v, not %s", utils.ErrIllegalTransition, m.initial, next.State)
+		}
+		return nil
+	}
+
+	t, ok := m.transitions[current.State][next.State]
+	if !ok {
+		return fmt.Errorf("%w from %s to %s, allowed: %v", utils.ErrIllegalTransition, current.State, next.State, m.next(current.State))
+	}
+	for _, field := range t.Required {
+		if transitionFields[field](next) == "" {
+			return fmt.Errorf("%w: %s is required to move from %s to %s", utils.ErrTransitionRequires, field, t.From, t.To)
+		}
+	}
+	return nil
+}
+
+// next lists the states reachable from state, in a stable order for error messages.
+func (m *StateMachine) next(state string) []string {
+	var states []string
+	for to := range m.transitions[state] {
+		states = append(states, to)
+	}
+	slices.Sort(states)
+	return states
+}
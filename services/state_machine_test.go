@@ -0,0 +1,119 @@
+package services_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"simple-api-go/models"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"testing"
+)
+
+func TestLoadStateMachine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state-machine.json")
+	config := `{
+		"initial": ["Idle"],
+		"transitions": [
+			{"from": "Idle", "to": "Running"},
+			{"from": "Running", "to": "Jammed", "required": ["EscalatedTo"]},
+			{"from": "Jammed", "to": "Idle"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	machine, err := services.LoadStateMachine(path)
+	if err != nil {
+		t.Fatalf("LoadStateMachine() error = %v", err)
+	}
+
+	testsList := []struct {
+		name    string
+		current *models.DeviceStateLog
+		next    *models.DeviceStateLog
+		wantErr error
+	}{
+		{
+			name:    "InitialState",
+			current: nil,
+			next:    &models.DeviceStateLog{State: "Idle"},
+		},
+		{
+			name:    "NotAnInitialState",
+			current: nil,
+			next:    &models.DeviceStateLog{State: "Running"},
+			wantErr: utils.ErrIllegalTransition,
+		},
+		{
+			name:    "AllowedTransition",
+			current: &models.DeviceStateLog{State: "Idle"},
+			next:    &models.DeviceStateLog{State: "Running"},
+		},
+		{
+			name:    "IllegalTransition",
+			current: &models.DeviceStateLog{State: "Idle"},
+			next:    &models.DeviceStateLog{State: "Jammed", EscalatedTo: "supervisor1"},
+			wantErr: utils.ErrIllegalTransition,
+		},
+		{
+			name:    "MissingRequiredField",
+			current: &models.DeviceStateLog{State: "Running"},
+			next:    &models.DeviceStateLog{State: "Jammed"},
+			wantErr: utils.ErrTransitionRequires,
+		},
+		{
+			name:    "RequiredField",
+			current: &models.DeviceStateLog{State: "Running"},
+			next:    &models.DeviceStateLog{State: "Jammed", EscalatedTo: "supervisor1"},
+		},
+		{
+			name:    "DefaultStatesAreNotLoaded",
+			current: &models.DeviceStateLog{State: "Idle"},
+			next:    &models.DeviceStateLog{State: "Normal"},
+			wantErr: utils.ErrUnknownState,
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			err := machine.Check(tt.current, tt.next)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Check() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewStateMachine_InvalidConfig(t *testing.T) {
+	testsList := []struct {
+		name   string
+		config services.StateMachineConfig
+	}{
+		{
+			name:   "NoInitialState",
+			config: services.StateMachineConfig{Transitions: []services.Transition{{From: "Normal", To: "Warning"}}},
+		},
+		{
+			name:   "InvalidStateName",
+			config: services.StateMachineConfig{Initial: []string{"Normal"}, Transitions: []services.Transition{{From: "Normal", To: "Under Maintenance"}}},
+		},
+		{
+			name:   "UnknownRequiredField",
+			config: services.StateMachineConfig{Initial: []string{"Normal"}, Transitions: []services.Transition{{From: "Normal", To: "Warning", Required: []string{"Pager"}}}},
+		},
+		{
+			name:   "DuplicatedTransition",
+			config: services.StateMachineConfig{Initial: []string{"Normal"}, Transitions: []services.Transition{{From: "Normal", To: "Warning"}, {From: "Normal", To: "Warning"}}},
+		},
+	}
+
+	for _, tt := range testsList {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := services.NewStateMachine(tt.config); err == nil {
+				t.Errorf("NewStateMachine() expected an error")
+			}
+		})
+	}
+}
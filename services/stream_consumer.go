@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"time"
+)
+
+// StreamConsumer turns the records of the DynamoDB stream of the table into domain events, and delivers them to the
+// subscribers of an EventDispatcher. It reports the writes made outside the API, such as the seed script or another
+// service, and leaves the others to the outbox, which delivers their events already.
+//
+// The event of a record takes the ID of the record, so the subscribers that ignore the IDs they have seen handle a
+// record the stream delivers again once. A StateChanged from the stream has no From, the record of a log does not
+// tell the state before it.
+type StreamConsumer struct {
+	dispatcher *EventDispatcher
+}
+
+func NewStreamConsumer(dispatcher *EventDispatcher) *StreamConsumer {
+	return &StreamConsumer{dispatcher: dispatcher}
+}
+
+// HandleStream delivers the events of the records of a batch in order. When one fails, it returns its error and
+// reports that record as a batch item failure, skipping the rest, so the stream delivers them again from there.
+func (c *StreamConsumer) HandleStream(ctx context.Context, batch events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	response := events.DynamoDBEventResponse{BatchItemFailures: []events.DynamoDBBatchItemFailure{}}
+	for _, record := range batch.Records {
+		if err := c.handleRecord(ctx, record); err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{ItemIdentifier: record.Change.SequenceNumber})
+			return response, fmt.Errorf("stream record %s: %w", record.EventID, err)
+		}
+	}
+	return response, nil
+}
+
+func (c *StreamConsumer) handleRecord(ctx context.Context, record events.DynamoDBEventRecord) error {
+	change, err := repositories.DecodeDynamoStreamRecord(record)
+	if err != nil || change == nil || !change.External {
+		return err
+	}
+	data := streamEvent(change)
+	if data == nil {
+		return nil
+	}
+
+	occurredAt := record.Change.ApproximateCreationDateTime.Time
+	if occurredAt.IsZero() {
+		occurredAt = time.Now()
+	}
+	event, err := models.NewEvent(change.Tenant, data, occurredAt)
+	if err != nil {
+		return err
+	}
+	event.ID = record.EventID
+	return c.dispatcher.Deliver(ctx, event)
+}
+
+// streamEvent tells what a change of the table did, like deviceEvent, from the images of the item: nil when it has
+// nothing to report, such as the TTL removing a deleted device or a change of a log.
+func streamEvent(change *repositories.DynamoStreamChange) models.EventData {
+	old, stored := change.OldDevice, change.NewDevice
+	switch {
+	case change.NewLog != nil && change.OldLog == nil:
+		return models.StateChanged{Log: *change.NewLog}
+	case stored == nil && old != nil && old.DeletedAt == "":
+		return models.DeviceDeleted{Device: *old}
+	case stored == nil:
+		return nil
+	case stored.DeletedAt != "" && (old == nil || old.DeletedAt == ""):
+		return models.DeviceDeleted{Device: *stored}
+	case stored.DeletedAt != "":
+		return nil
+	case old == nil || old.DeletedAt != "" && stored.Version <= 1:
+		return models.DeviceCreated{Device: *stored}
+	default:
+		return models.DeviceUpdated{Device: *stored}
+	}
+}
@@ -0,0 +1,90 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"simple-api-go/models"
+	"simple-api-go/services"
+	"slices"
+	"testing"
+)
+
+// deviceImage is the item of a device of acme as the stream reports it, with the writeEvent of its last write.
+func deviceImage(name string, version string, deletedAt string, writeEvent string) map[string]events.DynamoDBAttributeValue {
+	image := map[string]events.DynamoDBAttributeValue{
+		"type":    events.NewStringAttribute("Device"),
+		"tenant":  events.NewStringAttribute("acme"),
+		"id":      events.NewStringAttribute("/devices/id1"),
+		"name":    events.NewStringAttribute(name),
+		"version": events.NewNumberAttribute(version),
+	}
+	if deletedAt != "" {
+		image["deletedAt"] = events.NewStringAttribute(deletedAt)
+	}
+	if writeEvent != "" {
+		image["writeEvent"] = events.NewStringAttribute(writeEvent)
+	}
+	return image
+}
+
+func TestStreamConsumer_HandleStream(t *testing.T) {
+	record := func(id string, oldImage, newImage map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+		return events.DynamoDBEventRecord{EventID: id, Change: events.DynamoDBStreamRecord{SequenceNumber: "seq-" + id, OldImage: oldImage, NewImage: newImage}}
+	}
+	batch := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		record("1", nil, deviceImage("Device 1", "1", "", "")),
+		record("2", deviceImage("Device 1", "1", "", ""), deviceImage("Renamed", "2", "", "")),
+		// The API wrote this one, its event comes from the outbox.
+		record("3", deviceImage("Renamed", "2", "", ""), deviceImage("By the API", "3", "", "event-3")),
+		record("4", deviceImage("By the API", "3", "", "event-3"), deviceImage("By the API", "4", "2024-03-24T14:40:00Z", "event-3")),
+		record("5", deviceImage("By the API", "4", "2024-03-24T14:40:00Z", "event-3"), deviceImage("By the API", "5", "", "event-3")),
+		// The TTL removes a deleted device.
+		record("6", deviceImage("By the API", "4", "2024-03-24T14:40:00Z", ""), nil),
+		record("7", deviceImage("By the API", "5", "", "event-3"), nil),
+		record("8", nil, map[string]events.DynamoDBAttributeValue{
+			"type":     events.NewStringAttribute("DeviceStateLog"),
+			"tenant":   events.NewStringAttribute("acme"),
+			"DeviceID": events.NewStringAttribute("/devices/id1"),
+			"State":    events.NewStringAttribute("Warning"),
+		}),
+		record("9", nil, map[string]events.DynamoDBAttributeValue{"type": events.NewStringAttribute("DeviceModel")}),
+	}}
+
+	dispatcher := services.NewEventDispatcher()
+	var received []string
+	dispatcher.Subscribe(services.SubscriberFunc(func(ctx context.Context, event models.Event) error {
+		received = append(received, event.ID+" "+event.Type+" "+event.Tenant)
+		return nil
+	}))
+	consumer := services.NewStreamConsumer(dispatcher)
+
+	response, err := consumer.HandleStream(context.Background(), batch)
+	if err != nil || len(response.BatchItemFailures) != 0 {
+		t.Fatalf("HandleStream() got = %v, %v, want every record handled", response, err)
+	}
+	want := []string{
+		"1 DeviceCreated acme",
+		"2 DeviceUpdated acme",
+		"4 DeviceDeleted acme",
+		"5 DeviceUpdated acme",
+		"7 DeviceDeleted acme",
+		"8 StateChanged acme",
+	}
+	if !slices.Equal(received, want) {
+		t.Errorf("HandleStream() delivered %v, want %v", received, want)
+	}
+
+	// A record that fails is reported, and the stream delivers it again with the ones after it.
+	dispatcher.Subscribe(services.SubscriberFunc(func(ctx context.Context, event models.Event) error {
+		if event.ID == "2" {
+			return errors.New("audit unavailable")
+		}
+		return nil
+	}))
+	response, err = consumer.HandleStream(context.Background(), batch)
+	failures := []events.DynamoDBBatchItemFailure{{ItemIdentifier: "seq-2"}}
+	if err == nil || !slices.Equal(response.BatchItemFailures, failures) {
+		t.Errorf("HandleStream() got = %v, %v, want %v", response, err, failures)
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+)
+
+// TenantService reports what every tenant stores, for the admin endpoints. It reads across tenants, whatever the
+// tenant of ctx.
+type TenantService interface {
+	ListTenants(ctx context.Context) ([]models.TenantUsage, error)
+	GetTenant(ctx context.Context, tenant string) (*models.TenantUsage, error)
+}
+
+type tenantService struct {
+	deviceRepo repositories.DeviceRepository
+	modelRepo  repositories.DeviceModelRepository
+	logRepo    repositories.DeviceStateLogRepository
+}
+
+func NewTenantService(deviceRepo repositories.DeviceRepository, modelRepo repositories.DeviceModelRepository, logRepo repositories.DeviceStateLogRepository) TenantService {
+	return &tenantService{
+		deviceRepo: deviceRepo,
+		modelRepo:  modelRepo,
+		logRepo:    logRepo,
+	}
+}
+
+// ListTenants returns the usage of every tenant that stores anything, sorted by tenant.
+func (s *tenantService) ListTenants(ctx context.Context) ([]models.TenantUsage, error) {
+	devices, err := repositories.CountByTenant(ctx, s.deviceRepo)
+	if err != nil {
+		return nil, err
+	}
+	deviceModels, err := repositories.CountByTenant(ctx, s.modelRepo)
+	if err != nil {
+		return nil, err
+	}
+	stateLogs, err := repositories.CountByTenant(ctx, s.logRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]*models.TenantUsage{}
+	tenant := func(name string) *models.TenantUsage {
+		if usage[name] == nil {
+			usage[name] = &models.TenantUsage{Tenant: name}
+		}
+		return usage[name]
+	}
+	for name, count := range devices {
+		tenant(name).Devices = count
+	}
+	for name, count := range deviceModels {
+		tenant(name).DeviceModels = count
+	}
+	for name, count := range stateLogs {
+		tenant(name).StateLogs = count
+	}
+
+	tenants := make([]models.TenantUsage, 0, len(usage))
+	for _, u := range usage {
+		tenants = append(tenants, *u)
+	}
+	slices.SortFunc(tenants, func(a, b models.TenantUsage) int {
+		return strings.Compare(a.Tenant, b.Tenant)
+	})
+	return tenants, nil
+}
+
+// GetTenant returns the usage of tenant, or utils.ErrTenantNotFound when it stores nothing.
+func (s *tenantService) GetTenant(ctx context.Context, tenant string) (*models.TenantUsage, error) {
+	tenants, err := s.ListTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, usage := range tenants {
+		if usage.Tenant == tenant {
+			return &usage, nil
+		}
+	}
+	return nil, utils.ErrTenantNotFound
+}
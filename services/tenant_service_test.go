@@ -0,0 +1,72 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"testing"
+)
+
+func TestTenantService(t *testing.T) {
+	deviceRepo := repositories.NewDeviceMemoryRepository()
+	modelRepo := repositories.NewDeviceModelMemoryRepository()
+	logRepo := repositories.NewDeviceStateLogMemoryRepository()
+
+	tenantB := utils.WithTenant(context.Background(), "tenant-b")
+	tenantC := utils.WithTenant(context.Background(), "tenant-c")
+	for _, ctx := range []context.Context{context.Background(), tenantB} {
+		if _, err := modelRepo.CreateDeviceModel(ctx, &models.DeviceModel{ID: "/devicemodels/id1"}); err != nil {
+			t.Fatalf("CreateDeviceModel() error = %v", err)
+		}
+	}
+	for _, id := range []string{"/devices/id1", "/devices/id2"} {
+		if _, err := deviceRepo.CreateDevice(tenantB, &models.Device{ID: id, Name: "Device"}); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	if _, err := logRepo.CreateLog(tenantC, &models.DeviceStateLog{DeviceID: "/devices/id1", State: "Warning", Date: "2024-03-24T10:00:00.000Z"}); err != nil {
+		t.Fatalf("CreateLog() error = %v", err)
+	}
+
+	service := services.NewTenantService(deviceRepo, modelRepo, logRepo)
+
+	t.Run("ListTenants", func(t *testing.T) {
+		tenants, err := service.ListTenants(context.Background())
+		if err != nil {
+			t.Fatalf("ListTenants() error = %v", err)
+		}
+		want := []models.TenantUsage{
+			{Tenant: utils.DefaultTenant, DeviceModels: 1},
+			{Tenant: "tenant-b", Devices: 2, DeviceModels: 1},
+			{Tenant: "tenant-c", StateLogs: 1},
+		}
+		if !reflect.DeepEqual(tenants, want) {
+			t.Errorf("ListTenants() got = %v, want %v", tenants, want)
+		}
+	})
+
+	t.Run("GetTenant", func(t *testing.T) {
+		usage, err := service.GetTenant(context.Background(), "tenant-b")
+		if err != nil {
+			t.Fatalf("GetTenant() error = %v", err)
+		}
+		if *usage != (models.TenantUsage{Tenant: "tenant-b", Devices: 2, DeviceModels: 1}) {
+			t.Errorf("GetTenant() got = %v", *usage)
+		}
+
+		if _, err := service.GetTenant(context.Background(), "tenant-z"); !errors.Is(err, utils.ErrTenantNotFound) {
+			t.Errorf("GetTenant() error = %v, want %v", err, utils.ErrTenantNotFound)
+		}
+	})
+
+	t.Run("UnsupportedRepository", func(t *testing.T) {
+		service := services.NewTenantService(deviceRepo, &MockDeviceModelRepository{}, logRepo)
+		if _, err := service.ListTenants(context.Background()); !errors.Is(err, repositories.ErrTenantUsageUnsupported) {
+			t.Errorf("ListTenants() error = %v, want %v", err, repositories.ErrTenantUsageUnsupported)
+		}
+	})
+}
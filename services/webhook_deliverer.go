@@ -0,0 +1,282 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultWebhookMaxAttempts = 8
+	DefaultWebhookBackoff     = 30 * time.Second
+	DefaultWebhookMaxBackoff  = time.Hour
+	DefaultWebhookTimeout     = 10 * time.Second
+)
+
+// The headers of a webhook request. The signature is "sha256=" and the hex HMAC-SHA256 of the timestamp, a dot and
+// the body, keyed by the secret of the webhook, see SignWebhook. A receiver checks it, and refuses a timestamp far
+// from its clock so that a captured request can not be sent again later. The delivery ID is the same for every
+// attempt of a delivery, so a receiver can drop the ones it already handled.
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// WebhookDeliveryConfig tells how a WebhookDeliverer retries a delivery that fails.
+type WebhookDeliveryConfig struct {
+	// MaxAttempts is how many attempts fail in a row before the delivery is dead.
+	MaxAttempts int
+	// Backoff is the delay after the first failure, doubled after each one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout bounds every attempt, the response included.
+	Timeout time.Duration
+	// AllowPrivateAddresses lets the deliveries reach the addresses PublicAddress refuses, for a receiver on the
+	// same host or network, as in the tests.
+	AllowPrivateAddresses bool
+}
+
+// RetryDelay is the delay after the failure number failures of a delivery: the backoff of the failure, less a
+// random jitter of up to half of it, so that the deliveries that failed together do not come back together.
+func (c WebhookDeliveryConfig) RetryDelay(failures int) time.Duration {
+	delay := c.Backoff
+	for i := 1; i < failures && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.MaxBackoff)
+	if delay <= 0 {
+		return 0
+	}
+	return delay - rand.N(delay/2+1)
+}
+
+// SignWebhook is the value of the WebhookSignatureHeader of a request with body, sent at timestamp, for a webhook
+// with secret.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// specialPrefixes are the special-purpose ranges of the IANA registries that netip has no predicate for. Some reach
+// the network of the API through a gateway, like the shared address space of a carrier-grade NAT or the NAT64
+// prefixes, the others are reserved, for benchmarks or documentation, and have nothing public to deliver to.
+var specialPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space, carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and the broadcast address
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, Teredo included
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, which embeds any IPv4 address
+}
+
+// PublicAddress tells whether a webhook may be delivered to ip. Loopback, private, link-local, unspecified,
+// multicast and the other special-purpose addresses are refused, so that a webhook can not make the API reach its
+// own host or network.
+func PublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range specialPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic refuses a connection to an address that is not public. It runs after the name of the receiver was
+// resolved, on the address that is dialed, so a name that resolves to a private address is refused as well.
+func dialPublic(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || !PublicAddress(ip) {
+		return fmt.Errorf("%w: %s", utils.ErrWebhookAddress, host)
+	}
+	return nil
+}
+
+// newWebhookClient is the client of the deliveries. It never follows a redirect, which could lead to an address
+// the webhook could not have, and the redirect fails the attempt with its status. Unless config allows private
+// addresses, it only connects to public ones, and without a proxy, which would connect for it.
+func newWebhookClient(config WebhookDeliveryConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !config.AllowPrivateAddresses {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublic}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// WebhookDeliverer delivers the domain events to the webhooks of their tenant. As a Subscriber it only stores a
+// pending delivery for every webhook that matches an event, so a receiver that is down never holds back the
+// events; DeliverDue then sends the deliveries.
+type WebhookDeliverer struct {
+	repo   repositories.WebhookRepository
+	config WebhookDeliveryConfig
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewWebhookDeliverer(repo repositories.WebhookRepository, config WebhookDeliveryConfig) *WebhookDeliverer {
+	return &WebhookDeliverer{
+		repo:   repo,
+		config: config,
+		client: newWebhookClient(config),
+		now:    time.Now,
+	}
+}
+
+// HandleEvent stores a delivery of event for every webhook of its tenant that matches it, due now.
+func (d *WebhookDeliverer) HandleEvent(ctx context.Context, event models.Event) error {
+	now := d.now().UTC().Format(models.EventTimeFormat)
+	var deliveries []*models.WebhookDelivery
+	query := repositories.WebhookQuery{Limit: repositories.MaxListLimit}
+	for {
+		page, err := d.repo.ListWebhooks(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, webhook := range page.Items {
+			if webhook.Matches(event.Type) {
+				deliveries = append(deliveries, &models.WebhookDelivery{
+					ID:            event.ID,
+					WebhookID:     webhook.ID,
+					Event:         event,
+					Status:        models.DeliveryPending,
+					Attempts:      []models.WebhookAttempt{},
+					NextAttemptAt: now,
+				})
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.repo.AddDeliveries(ctx, deliveries)
+}
+
+// DeliverDue makes an attempt at the deliveries that are due, a batch of them, and returns how many it delivered.
+// A failed attempt is recorded in its delivery, which is retried after RetryDelay or, after MaxAttempts, is dead.
+// The error only reports the deliveries it could not read or record, which are attempted again by the next call.
+func (d *WebhookDeliverer) DeliverDue(ctx context.Context) (int, error) {
+	due, err := d.repo.DueDeliveries(ctx, d.now(), repositories.DefaultDeliveryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var errs []error
+	for _, delivery := range due {
+		deliveryCtx := utils.WithTenant(ctx, delivery.Event.Tenant)
+		webhook, err := d.repo.GetWebhook(deliveryCtx, delivery.WebhookID)
+		if errors.Is(err, utils.ErrWebhookNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		d.attempt(deliveryCtx, webhook, delivery)
+		if err := d.repo.UpdateDelivery(deliveryCtx, delivery); err != nil && !errors.Is(err, utils.ErrDeliveryNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		if delivery.Status == models.DeliveryDelivered {
+			delivered++
+		}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// attempt sends delivery to webhook once, and records the attempt and what comes next in delivery.
+func (d *WebhookDeliverer) attempt(ctx context.Context, webhook *models.Webhook, delivery *models.WebhookDelivery) {
+	now := d.now()
+	attempt := models.WebhookAttempt{At: now.UTC().Format(models.EventTimeFormat)}
+	attempt.StatusCode, attempt.Error = d.send(ctx, webhook, delivery, now)
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	if attempt.Error == "" {
+		delivery.Status, delivery.NextAttemptAt = models.DeliveryDelivered, ""
+		return
+	}
+	delivery.FailedAttempts++
+	if delivery.FailedAttempts >= d.config.MaxAttempts {
+		delivery.Status, delivery.NextAttemptAt = models.DeliveryDead, ""
+		return
+	}
+	delivery.NextAttemptAt = now.Add(d.config.RetryDelay(delivery.FailedAttempts)).UTC().Format(models.EventTimeFormat)
+}
+
+// send posts the event of delivery to webhook, and returns the status of the response and why the attempt failed,
+// nothing when it answered with a 2xx status.
+func (d *WebhookDeliverer) send(ctx context.Context, webhook *models.Webhook, delivery *models.WebhookDelivery, now time.Time) (int, string) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err.Error()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, timestamp, body))
+	request.Header.Set(WebhookEventHeader, delivery.Event.Type)
+	request.Header.Set(WebhookDeliveryHeader, delivery.ID)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, "unexpected status " + response.Status
+	}
+	return response.StatusCode, ""
+}
@@ -0,0 +1,253 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local receiver of webhook requests that checks their signature, and answers with status.
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	status   int
+	received []string
+}
+
+func newWebhookReceiver(t *testing.T, secret string, status int) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{t: t, secret: secret, status: status}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	want := services.SignWebhook(r.secret, req.Header.Get(services.WebhookTimestampHeader), body)
+	if req.Header.Get(services.WebhookSignatureHeader) != want {
+		r.t.Errorf("%s = %q, want %q", services.WebhookSignatureHeader, req.Header.Get(services.WebhookSignatureHeader), want)
+	}
+	var event models.Event
+	if err := json.Unmarshal(body, &event); err != nil || event.Type != req.Header.Get(services.WebhookEventHeader) || event.ID != req.Header.Get(services.WebhookDeliveryHeader) {
+		r.t.Errorf("request got = %s, %v, want the event of its headers", body, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, event.Tenant+" "+event.Type)
+	w.WriteHeader(r.status)
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *webhookReceiver) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.received)
+}
+
+func TestWebhookDeliverer(t *testing.T) {
+	deviceRepo := repositories.NewDeviceMemoryRepository()
+	modelRepo := repositories.NewDeviceModelMemoryRepository()
+	webhookRepo := repositories.NewWebhookMemoryRepository()
+	deviceService := services.NewDeviceService(deviceRepo, modelRepo)
+	webhookService := services.NewWebhookService(webhookRepo)
+	ctx := utils.WithTenant(context.Background(), "acme")
+
+	audit, auditServer := newWebhookReceiver(t, "audit-secret", http.StatusNoContent)
+	mes, mesServer := newWebhookReceiver(t, "mes-secret", http.StatusInternalServerError)
+	if _, err := webhookService.CreateWebhook(ctx, &models.Webhook{URL: auditServer.URL, Secret: "audit-secret"}); err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+	mesHook, err := webhookService.CreateWebhook(ctx, &models.Webhook{URL: mesServer.URL, Events: []string{models.EventDeviceDeleted}, Secret: "mes-secret"})
+	if err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+	// Another tenant never receives the events of acme.
+	other, otherServer := newWebhookReceiver(t, "other", http.StatusNoContent)
+	if _, err := webhookService.CreateWebhook(utils.WithTenant(context.Background(), "globex"), &models.Webhook{URL: otherServer.URL, Secret: "other"}); err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+
+	deliverer := services.NewWebhookDeliverer(webhookRepo, services.WebhookDeliveryConfig{MaxAttempts: 3, Timeout: time.Second, AllowPrivateAddresses: true})
+	dispatcher := services.NewEventDispatcher(deviceRepo)
+	dispatcher.Subscribe(deliverer)
+
+	if _, err := modelRepo.CreateDeviceModel(ctx, &models.DeviceModel{ID: "model1", Name: "Model 1"}); err != nil {
+		t.Fatalf("CreateDeviceModel() error = %v", err)
+	}
+	if _, err := deviceService.CreateDevice(ctx, &models.Device{ID: "/devices/id1", Name: "Device 1", DeviceModel: "model1"}); err != nil {
+		t.Fatalf("CreateDevice() error = %v", err)
+	}
+	if err := deviceService.DeleteDevice(ctx, "/devices/id1", 0, "operator1"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if _, err := dispatcher.Dispatch(context.Background()); err != nil {
+		t.Fatalf("Dispatch() error = %v", err)
+	}
+
+	// Without a backoff every failed delivery is due again at once, until it is dead.
+	for i := 0; i < 4; i++ {
+		if _, err := deliverer.DeliverDue(context.Background()); err != nil {
+			t.Fatalf("DeliverDue() error = %v", err)
+		}
+	}
+	if want := []string{"acme DeviceCreated", "acme DeviceDeleted"}; !slices.Equal(audit.events(), want) {
+		t.Errorf("audit received = %v, want %v", audit.events(), want)
+	}
+	if want := []string{"acme DeviceDeleted", "acme DeviceDeleted", "acme DeviceDeleted"}; !slices.Equal(mes.events(), want) {
+		t.Errorf("mes received = %v, want %v", mes.events(), want)
+	}
+	if got := other.events(); len(got) != 0 {
+		t.Errorf("other received = %v, want nothing", got)
+	}
+
+	dead, err := webhookService.ListDeliveries(ctx, mesHook.ID, repositories.WebhookDeliveryQuery{Status: models.DeliveryDead})
+	if err != nil || len(dead.Items) != 1 || dead.Items[0].FailedAttempts != 3 || dead.Items[0].Attempts[2].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("ListDeliveries() got = %+v, %v, want the dead DeviceDeleted", dead, err)
+	}
+
+	// An event delivered again to the subscribers leaves its deliveries as they are.
+	if err := deliverer.HandleEvent(ctx, dead.Items[0].Event); err != nil {
+		t.Fatalf("HandleEvent() error = %v", err)
+	}
+	if _, err := webhookService.ReplayDelivery(ctx, mesHook.ID, dead.Items[0].ID); err != nil {
+		t.Fatalf("ReplayDelivery() error = %v", err)
+	}
+	mes.setStatus(http.StatusOK)
+	if delivered, err := deliverer.DeliverDue(context.Background()); delivered != 1 || err != nil {
+		t.Fatalf("DeliverDue() got = %v, %v, want 1 delivery", delivered, err)
+	}
+	delivery, err := webhookRepo.GetDelivery(ctx, mesHook.ID, dead.Items[0].ID)
+	if err != nil || delivery.Status != models.DeliveryDelivered || len(delivery.Attempts) != 4 || delivery.FailedAttempts != 0 {
+		t.Errorf("GetDelivery() got = %+v, %v, want the delivery delivered at its fourth attempt", delivery, err)
+	}
+}
+
+// deliverOnce stores a DeviceCreated delivery for a webhook to url, makes one attempt at it and returns it.
+func deliverOnce(t *testing.T, config services.WebhookDeliveryConfig, url string) *models.WebhookDelivery {
+	t.Helper()
+	webhookRepo := repositories.NewWebhookMemoryRepository()
+	ctx := utils.WithTenant(context.Background(), "acme")
+	webhook, err := services.NewWebhookService(webhookRepo).CreateWebhook(ctx, &models.Webhook{URL: url, Secret: "secret"})
+	if err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+	deliverer := services.NewWebhookDeliverer(webhookRepo, config)
+	event := models.Event{ID: "event1", Type: models.EventDeviceCreated, Tenant: "acme"}
+	if err := deliverer.HandleEvent(ctx, event); err != nil {
+		t.Fatalf("HandleEvent() error = %v", err)
+	}
+	if _, err := deliverer.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("DeliverDue() error = %v", err)
+	}
+	delivery, err := webhookRepo.GetDelivery(ctx, webhook.ID, event.ID)
+	if err != nil || len(delivery.Attempts) != 1 {
+		t.Fatalf("GetDelivery() got = %+v, %v, want one attempt", delivery, err)
+	}
+	return delivery
+}
+
+func TestWebhookDeliverer_PrivateAddress(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", http.StatusNoContent)
+	config := services.WebhookDeliveryConfig{MaxAttempts: 3, Timeout: time.Second}
+	// The name is refused once it resolves, as the address is.
+	for _, url := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		delivery := deliverOnce(t, config, url)
+		if attempt := delivery.Attempts[0]; delivery.Status != models.DeliveryPending || !strings.Contains(attempt.Error, utils.ErrWebhookAddress.Error()) {
+			t.Errorf("delivery to %s got = %+v, want an attempt refused with %v", url, delivery, utils.ErrWebhookAddress)
+		}
+	}
+	if got := receiver.events(); len(got) != 0 {
+		t.Errorf("receiver got = %v, want nothing", got)
+	}
+}
+
+func TestWebhookDeliverer_Redirect(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", http.StatusNoContent)
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+
+	delivery := deliverOnce(t, services.WebhookDeliveryConfig{MaxAttempts: 3, Timeout: time.Second, AllowPrivateAddresses: true}, redirect.URL)
+	if attempt := delivery.Attempts[0]; delivery.Status != models.DeliveryPending || attempt.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("delivery got = %+v, want an attempt failed with the redirect", delivery)
+	}
+	if got := receiver.events(); len(got) != 0 {
+		t.Errorf("receiver got = %v, want nothing", got)
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b:1::a00:1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"192.0.0.8", false},
+		{"192.0.2.10", false},
+		{"198.51.100.7", false},
+		{"203.0.113.9", false},
+		{"255.255.255.255", false},
+		{"0.1.2.3", false},
+		{"2001:db8::1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"2002:a00:1::", false},
+	} {
+		if got := services.PublicAddress(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("PublicAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookDeliveryConfig_RetryDelay(t *testing.T) {
+	config := services.WebhookDeliveryConfig{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	for _, tt := range []struct {
+		failures int
+		max      time.Duration
+	}{{1, time.Second}, {2, 2 * time.Second}, {4, 8 * time.Second}, {5, 10 * time.Second}, {100, 10 * time.Second}} {
+		for i := 0; i < 20; i++ {
+			if got := config.RetryDelay(tt.failures); got < tt.max/2 || got > tt.max {
+				t.Errorf("RetryDelay(%d) = %v, want between %v and %v", tt.failures, got, tt.max/2, tt.max)
+			}
+		}
+	}
+}
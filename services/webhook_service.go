@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/utils"
+	"time"
+)
+
+type WebhookService interface {
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error)
+	GetWebhook(ctx context.Context, id string) (*models.Webhook, error)
+	ListWebhooks(ctx context.Context, query repositories.WebhookQuery) (*models.WebhookPage, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	ListDeliveries(ctx context.Context, webhookID string, query repositories.WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error)
+	ReplayDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error)
+	ReplayDeadDeliveries(ctx context.Context, webhookID string) (int, error)
+}
+
+type webhookService struct {
+	repo repositories.WebhookRepository
+	now  func() time.Time
+}
+
+func NewWebhookService(repo repositories.WebhookRepository) WebhookService {
+	return &webhookService{
+		repo: repo,
+		now:  time.Now,
+	}
+}
+
+// randomHex is n random bytes in hex.
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// CreateWebhook gives the webhook an ID, and a secret unless it comes with one. It returns the secret, which the
+// other methods never do.
+func (s *webhookService) CreateWebhook(ctx context.Context, webhook *models.Webhook) (*models.Webhook, error) {
+	var err error
+	if webhook.ID, err = randomHex(8); err != nil {
+		return nil, err
+	}
+	if webhook.Secret == "" {
+		if webhook.Secret, err = randomHex(32); err != nil {
+			return nil, err
+		}
+	}
+	webhook.CreatedAt = s.now().UTC().Format(models.EventTimeFormat)
+	return s.repo.CreateWebhook(ctx, webhook)
+}
+
+func (s *webhookService) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	webhook, err := s.repo.GetWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Secret = ""
+	return webhook, nil
+}
+
+func (s *webhookService) ListWebhooks(ctx context.Context, query repositories.WebhookQuery) (*models.WebhookPage, error) {
+	page, err := s.repo.ListWebhooks(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, webhook := range page.Items {
+		webhook.Secret = ""
+	}
+	return page, nil
+}
+
+func (s *webhookService) DeleteWebhook(ctx context.Context, id string) error {
+	return s.repo.DeleteWebhook(ctx, id)
+}
+
+// ListDeliveries is the delivery log of a webhook; the dead deliveries with the status of query set to
+// models.DeliveryDead.
+func (s *webhookService) ListDeliveries(ctx context.Context, webhookID string, query repositories.WebhookDeliveryQuery) (*models.WebhookDeliveryPage, error) {
+	if _, err := s.repo.GetWebhook(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListDeliveries(ctx, webhookID, query)
+}
+
+// ReplayDelivery makes a dead delivery pending again, due now, with its attempts to come counted from zero. It
+// keeps the attempts it made so far in its log.
+func (s *webhookService) ReplayDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+	delivery, err := s.repo.GetDelivery(ctx, webhookID, id)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.Status != models.DeliveryDead {
+		return nil, utils.ErrDeliveryNotDead
+	}
+	delivery.Status = models.DeliveryPending
+	delivery.FailedAttempts = 0
+	delivery.NextAttemptAt = s.now().UTC().Format(models.EventTimeFormat)
+	if err := s.repo.UpdateDelivery(ctx, delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// ReplayDeadDeliveries replays every dead delivery of a webhook, and returns how many it replayed.
+func (s *webhookService) ReplayDeadDeliveries(ctx context.Context, webhookID string) (int, error) {
+	if _, err := s.repo.GetWebhook(ctx, webhookID); err != nil {
+		return 0, err
+	}
+
+	// A replayed delivery leaves the dead ones, so every page starts from the first dead delivery left.
+	replayed := 0
+	query := repositories.WebhookDeliveryQuery{Status: models.DeliveryDead, Limit: repositories.MaxListLimit}
+	for {
+		page, err := s.repo.ListDeliveries(ctx, webhookID, query)
+		if err != nil {
+			return replayed, err
+		}
+		for _, delivery := range page.Items {
+			if _, err := s.ReplayDelivery(ctx, webhookID, delivery.ID); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+		if page.NextCursor == "" {
+			return replayed, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,78 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"simple-api-go/models"
+	"simple-api-go/repositories"
+	"simple-api-go/services"
+	"simple-api-go/utils"
+	"testing"
+)
+
+func TestWebhookService(t *testing.T) {
+	repo := repositories.NewWebhookMemoryRepository()
+	service := services.NewWebhookService(repo)
+	ctx := context.Background()
+
+	created, err := service.CreateWebhook(ctx, &models.Webhook{URL: "https://example.com/hook", Events: []string{models.EventDeviceCreated}})
+	if err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+	if created.ID == "" || len(created.Secret) != 64 || created.CreatedAt == "" {
+		t.Errorf("CreateWebhook() got = %+v, want an ID, a generated secret and a creation time", created)
+	}
+
+	t.Run("HidesTheSecret", func(t *testing.T) {
+		webhook, err := service.GetWebhook(ctx, created.ID)
+		if err != nil || webhook.Secret != "" || webhook.URL != created.URL {
+			t.Errorf("GetWebhook() got = %+v, %v, want the webhook without its secret", webhook, err)
+		}
+		page, err := service.ListWebhooks(ctx, repositories.WebhookQuery{})
+		if err != nil || len(page.Items) != 1 || page.Items[0].Secret != "" {
+			t.Errorf("ListWebhooks() got = %+v, %v, want the webhook without its secret", page, err)
+		}
+		// The deliverer still signs with it.
+		if stored, _ := repo.GetWebhook(ctx, created.ID); stored.Secret != created.Secret {
+			t.Errorf("stored secret = %q, want %q", stored.Secret, created.Secret)
+		}
+	})
+
+	t.Run("ReplayDelivery", func(t *testing.T) {
+		err := repo.AddDeliveries(ctx, []*models.WebhookDelivery{
+			{ID: "event1", WebhookID: created.ID, Status: models.DeliveryPending, Attempts: []models.WebhookAttempt{}, NextAttemptAt: "2024-03-24T10:00:00.000000000Z"},
+			{ID: "event2", WebhookID: created.ID, Status: models.DeliveryDead, Attempts: []models.WebhookAttempt{{At: "2024-03-24T10:00:00.000000000Z", StatusCode: 500}}, FailedAttempts: 8},
+			{ID: "event3", WebhookID: created.ID, Status: models.DeliveryDead, Attempts: []models.WebhookAttempt{}, FailedAttempts: 8},
+		})
+		if err != nil {
+			t.Fatalf("AddDeliveries() error = %v", err)
+		}
+
+		if _, err := service.ReplayDelivery(ctx, created.ID, "event1"); !errors.Is(err, utils.ErrDeliveryNotDead) {
+			t.Errorf("ReplayDelivery() error = %v, want %v", err, utils.ErrDeliveryNotDead)
+		}
+		if _, err := service.ReplayDelivery(ctx, created.ID, "unknown"); !errors.Is(err, utils.ErrDeliveryNotFound) {
+			t.Errorf("ReplayDelivery() error = %v, want %v", err, utils.ErrDeliveryNotFound)
+		}
+
+		delivery, err := service.ReplayDelivery(ctx, created.ID, "event2")
+		if err != nil || delivery.Status != models.DeliveryPending || delivery.FailedAttempts != 0 || delivery.NextAttemptAt == "" || len(delivery.Attempts) != 1 {
+			t.Errorf("ReplayDelivery() got = %+v, %v, want it pending and due with its attempts kept", delivery, err)
+		}
+		if replayed, err := service.ReplayDeadDeliveries(ctx, created.ID); replayed != 1 || err != nil {
+			t.Errorf("ReplayDeadDeliveries() got = %v, %v, want 1", replayed, err)
+		}
+		if page, err := service.ListDeliveries(ctx, created.ID, repositories.WebhookDeliveryQuery{Status: models.DeliveryDead}); err != nil || len(page.Items) != 0 {
+			t.Errorf("ListDeliveries() got = %+v, %v, want no dead delivery", page, err)
+		}
+	})
+
+	t.Run("UnknownWebhook", func(t *testing.T) {
+		if _, err := service.ListDeliveries(ctx, "unknown", repositories.WebhookDeliveryQuery{}); !errors.Is(err, utils.ErrWebhookNotFound) {
+			t.Errorf("ListDeliveries() error = %v, want %v", err, utils.ErrWebhookNotFound)
+		}
+		if _, err := service.ReplayDeadDeliveries(ctx, "unknown"); !errors.Is(err, utils.ErrWebhookNotFound) {
+			t.Errorf("ReplayDeadDeliveries() error = %v, want %v", err, utils.ErrWebhookNotFound)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MergePatch applies an RFC 7396 JSON merge patch to the JSON object target: members of the patch replace the
+// members of the target, a null removes the member, and nested objects are merged recursively.
+func MergePatch(target, patch []byte) ([]byte, error) {
+	var patchValue any
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if _, ok := patchValue.(map[string]any); !ok {
+		return nil, ErrInvalidPatch
+	}
+
+	var targetValue any
+	if err := json.Unmarshal(target, &targetValue); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(targetValue, patchValue))
+}
+
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
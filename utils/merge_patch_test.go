@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Examples from RFC 7396, Appendix A, where the patch is an object.
+	testsList := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{target: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{target: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{target: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{target: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{target: `{"a":["b"]}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{target: `{"a":"c"}`, patch: `{"a":["b"]}`, want: `{"a":["b"]}`},
+		{target: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{target: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, want: `{"a":[1]}`},
+		{target: `{"e":null}`, patch: `{"a":1}`, want: `{"a":1,"e":null}`},
+		{target: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range testsList {
+		got, err := MergePatch([]byte(tt.target), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("MergePatch(%s, %s) error = %v", tt.target, tt.patch, err)
+			continue
+		}
+
+		var gotValue, wantValue any
+		_ = json.Unmarshal(got, &gotValue)
+		_ = json.Unmarshal([]byte(tt.want), &wantValue)
+		if !reflect.DeepEqual(gotValue, wantValue) {
+			t.Errorf("MergePatch(%s, %s) got = %s, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatchInvalid(t *testing.T) {
+	for _, patch := range []string{`["a"]`, `"a"`, `null`, `{"a":`} {
+		if _, err := MergePatch([]byte(`{"a":"b"}`), []byte(patch)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("MergePatch(%s) error = %v, want %v", patch, err, ErrInvalidPatch)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"context"
+	"regexp"
+)
+
+// DefaultTenant owns what is stored without a tenant in the context: the calls made outside of a request, and the
+// records written before there were tenants.
+const DefaultTenant = "default"
+
+// TenantPattern keeps tenants free of the '#' and '/' that the repositories use to build their keys.
+const TenantPattern = `^[a-z0-9][a-z0-9-]{0,62}$`
+
+var tenantRegex = regexp.MustCompile(TenantPattern)
+
+type tenantContextKey struct{}
+
+// WithTenant scopes every repository call made with the returned context to tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of ctx, DefaultTenant when it has none.
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// ValidateTenant returns ErrInvalidTenant unless tenant is fit to key the records of the repositories.
+func ValidateTenant(tenant string) error {
+	if !tenantRegex.MatchString(tenant) {
+		return ErrInvalidTenant
+	}
+	return nil
+}
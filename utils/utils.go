@@ -15,10 +15,50 @@ import (
 )
 
 var (
-	ErrDeviceNotFound  = errors.New("device not found")
-	ErrDeviceDuplicate = errors.New("device is duplicated")
+	ErrDeviceNotFound   = errors.New("device not found")
+	ErrDeviceDuplicate  = errors.New("device is duplicated")
+	ErrDeviceNotDeleted = errors.New("device is not in the trash")
+	ErrInvalidCursor    = errors.New("invalid pagination cursor")
+	ErrInvalidFilter    = errors.New("invalid filter")
+	ErrInvalidSort      = errors.New("invalid sort field")
+	ErrInvalidDate      = errors.New("invalid date, It must be in RFC3339 format")
+	ErrVersionMismatch  = errors.New("device was changed by another request, reload it and try again")
+	ErrInvalidPatch     = errors.New("invalid merge patch, It must be a JSON object")
+
+	ErrInvalidBatch     = errors.New("invalid batch")
+	ErrBatchAborted     = errors.New("not applied, another operation of the atomic batch failed")
+	ErrBatchUnprocessed = errors.New("not applied, the table is throttled, retry later")
+
+	ErrDeviceModelNotFound  = errors.New("device model not found")
+	ErrDeviceModelDuplicate = errors.New("device model is duplicated")
+	ErrDeviceModelInUse     = errors.New("device model is still used by devices")
+	ErrUnknownDeviceModel   = errors.New("unknown device model")
+
+	ErrUnknownState       = errors.New("unknown state")
+	ErrIllegalTransition  = errors.New("illegal state transition")
+	ErrTransitionRequires = errors.New("missing field required by the state transition")
+	ErrStateChanged       = errors.New("device state was changed by another request, reload it and try again")
+	ErrLogBeforeLatest    = errors.New("invalid date, It must not be before the latest log of the device")
+
+	ErrTenantRequired = errors.New("tenant is required, send a tenant token or the X-Tenant-ID header")
+	ErrInvalidTenant  = errors.New("invalid tenant, It must be lowercase alphanumeric with dashes, up to 63 characters")
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrTenantMismatch = errors.New("X-Tenant-ID does not match the tenant of the token")
+	ErrTenantHeader   = errors.New("X-Tenant-ID can only name the default tenant, tenants are not taken from the header")
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrAdminRequired  = errors.New("admin token is required")
+
+	ErrUnknownEventType = errors.New("unknown event type")
+
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrWebhookAddress   = errors.New("webhook address is not public")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrDeliveryNotDead  = errors.New("only a dead webhook delivery can be replayed")
 )
 
+// MaxBodySize bounds the body of a request, which is enough for a batch of the most operations.
+const MaxBodySize = 1 << 20
+
 type ErrorJSON struct {
 	Message string `json:"message"`
 	Status  int    `json:"status,omitempty"`
@@ -31,6 +71,14 @@ func ErrorJSONFormat(w http.ResponseWriter, err string, code int) {
 	_ = json.NewEncoder(w).Encode(ErrorJSON{Message: err, Status: code})
 }
 
+func JSONFormat(w http.ResponseWriter, body any, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		ErrorJSONFormat(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func SanitizeInput(input string) string {
 	// Remove leading and trailing spaces
 	input = strings.TrimSpace(input)